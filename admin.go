@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/auth"
+	"google.golang.org/api/option"
+)
+
+// adminTimeout bounds a whole admin command, orphan cleanups and integrity checks scan every routine and every user
+const adminTimeout = 5 * time.Minute
+
+// userDirectory is satisfied by *auth.Client, and lets tests look users up without Firebase
+type userDirectory interface {
+	GetUserByEmail(ctx context.Context, email string) (*auth.UserRecord, error)
+}
+
+// admin runs the operational commands of `repetiswole admin` against the configured storage
+type admin struct {
+	store storage
+	users userDirectory
+}
+
+// adminCommand is a subcommand of `repetiswole admin`. Its result is written to stdout as JSON
+type adminCommand struct {
+	name  string
+	usage string
+	run   func(a *admin, ctx context.Context, args []string) (interface{}, error)
+}
+
+var adminCommands = []adminCommand{
+	{"lookup-user", "--email <email>  find a user's uid and profile by their sign-in email", (*admin).lookupUser},
+	{"set-tier", "--uid <uid> --tier Free|Premium [--expires-at <RFC3339>] [--dry-run]  change a user's SubscriptionTier", (*admin).setTier},
+	{"list-routines", "--uid <uid>  list a user's routines", (*admin).listRoutines},
+	{"delete-orphaned-routines", "[--dry-run]  delete routines whose UID has no users document", (*admin).deleteOrphanedRoutines},
+	{"check-integrity", "  report user and routine documents that do not match the Go schema", (*admin).checkIntegrityCommand},
+	{"repair-integrity", "[--dry-run]  apply the safe repairs of check-integrity, including schema migrations", (*admin).repairIntegrityCommand},
+	{"migrate-documents", "[--dry-run]  write user and routine documents back at their current SchemaVersion", (*admin).migrateDocumentsCommand},
+}
+
+// adminUsageError is a mistake in the command line, which exits with 2 like the server's flag errors
+type adminUsageError struct {
+	message string
+}
+
+func (e *adminUsageError) Error() string {
+	return e.message
+}
+
+// runAdmin runs `repetiswole admin [--config <file>] <command> [flags]`, returning the exit code. The settings are
+// resolved like the server's, from the config file and the environment
+func runAdmin(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("repetiswole admin", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", "", "path to a YAML config file")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		writeAdminUsage(stderr)
+		return 2
+	}
+	if fs.Arg(0) == "help" {
+		writeAdminUsage(stdout)
+		return 0
+	}
+
+	env, err := environment()
+	if err != nil {
+		return writeAdminError(stderr, err)
+	}
+	var settingsArgs []string
+	if *configFile != "" {
+		settingsArgs = []string{"--config", *configFile}
+	}
+	settings, _, err := loadSettings(settingsArgs, env)
+	if err != nil {
+		return writeAdminError(stderr, fmt.Errorf("error loading settings: %w", err))
+	}
+	if err := settings.validate(); err != nil {
+		return writeAdminError(stderr, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, adminTimeout)
+	defer cancel()
+
+	firebaseApp, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(settings.GoogleApplicationCredentials))
+	if err != nil {
+		return writeAdminError(stderr, fmt.Errorf("error initializing firebase app: %w", err))
+	}
+	cfg := &config{ctx: ctx, firebaseApp: firebaseApp}
+	defer func() {
+		_ = cfg.close()
+	}()
+	users, err := cfg.authClient()
+	if err != nil {
+		return writeAdminError(stderr, fmt.Errorf("error initializing firebase auth client: %w", err))
+	}
+
+	// commands read documents at the current schema version like the server does, the integrity and migration
+	// commands unwrap the store to see them as stored
+	a := &admin{store: migrateStorage(newFirestoreStorage(cfg)), users: users}
+	return a.execute(ctx, fs.Args(), stdout, stderr)
+}
+
+// execute runs the named command, writing its result to stdout and any error to stderr as JSON
+func (a *admin) execute(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		writeAdminUsage(stderr)
+		return 2
+	}
+	if args[0] == "help" {
+		writeAdminUsage(stdout)
+		return 0
+	}
+
+	for _, command := range adminCommands {
+		if command.name != args[0] {
+			continue
+		}
+
+		result, err := command.run(a, ctx, args[1:])
+		if err != nil {
+			return writeAdminError(stderr, err)
+		}
+
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return writeAdminError(stderr, fmt.Errorf("error while writing result: %w", err))
+		}
+		return 0
+	}
+
+	return writeAdminError(stderr, &adminUsageError{message: fmt.Sprintf("unknown admin command %q, see repetiswole admin help", args[0])})
+}
+
+func writeAdminUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: repetiswole admin [--config <file>] <command> [flags]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, command := range adminCommands {
+		flags, description, _ := strings.Cut(command.usage, "  ")
+		fmt.Fprintf(tw, "  %s %s\t%s\n", command.name, flags, description)
+	}
+	_ = tw.Flush()
+}
+
+// writeAdminError writes err as {"error": "..."} and returns the exit code for it
+func writeAdminError(w io.Writer, err error) int {
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+
+	var usageErr *adminUsageError
+	if errors.As(err, &usageErr) {
+		return 2
+	}
+	return 1
+}
+
+// parseAdminFlags parses the flags of a command, requiring the named ones to be set
+func parseAdminFlags(fs *flag.FlagSet, args []string, required ...string) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return &adminUsageError{message: fmt.Sprintf("%s: %v", fs.Name(), err)}
+	}
+	if fs.NArg() > 0 {
+		return &adminUsageError{message: fmt.Sprintf("%s: unexpected argument %q", fs.Name(), fs.Arg(0))}
+	}
+	for _, name := range required {
+		if fs.Lookup(name).Value.String() == "" {
+			return &adminUsageError{message: fmt.Sprintf("%s: --%s is required", fs.Name(), name)}
+		}
+	}
+	return nil
+}
+
+type adminUser struct {
+	UID         string     `json:"uid"`
+	Email       string     `json:"email"`
+	DisplayName string     `json:"displayName"`
+	Disabled    bool       `json:"disabled"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	LastLoginAt *time.Time `json:"lastLoginAt,omitempty"`
+	// Profile is the user's document within the users collection, null when registration never created it
+	Profile *UserProfileResponse `json:"profile"`
+}
+
+func (a *admin) lookupUser(ctx context.Context, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("lookup-user", flag.ContinueOnError)
+	email := fs.String("email", "", "sign-in email of the user")
+	if err := parseAdminFlags(fs, args, "email"); err != nil {
+		return nil, err
+	}
+
+	record, err := a.users.GetUserByEmail(ctx, *email)
+	if auth.IsUserNotFound(err) {
+		return nil, fmt.Errorf("no user signs in with %s: %w", *email, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to look up user by email: %w", err)
+	}
+
+	user := &adminUser{UID: record.UID, Email: record.Email, DisplayName: record.DisplayName, Disabled: record.Disabled}
+	if metadata := record.UserMetadata; metadata != nil {
+		user.CreatedAt = millisecondsToTime(metadata.CreationTimestamp)
+		user.LastLoginAt = millisecondsToTime(metadata.LastLogInTimestamp)
+	}
+
+	userDocument, err := a.store.GetUserDocument(ctx, record.UID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("error while trying to fetch user profile: %w", err)
+	default:
+		if user.Profile, err = userProfileFromDocument(userDocument); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func millisecondsToTime(milliseconds int64) *time.Time {
+	if milliseconds == 0 {
+		return nil
+	}
+	t := time.UnixMilli(milliseconds).UTC()
+	return &t
+}
+
+type adminTier struct {
+	Tier      string     `json:"tier"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type adminTierChange struct {
+	UID    string    `json:"uid"`
+	Before adminTier `json:"before"`
+	After  adminTier `json:"after"`
+	DryRun bool      `json:"dryRun"`
+}
+
+// setTier changes the user's subscription tier. Without --expires-at the tier does not expire, and Free clears the expiry
+func (a *admin) setTier(ctx context.Context, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("set-tier", flag.ContinueOnError)
+	uid := fs.String("uid", "", "uid of the user")
+	tier := fs.String("tier", "", "Free or Premium")
+	expiresAt := fs.String("expires-at", "", "end of the paid period, e.g. 2025-01-31T00:00:00Z")
+	dryRun := fs.Bool("dry-run", false, "print the change without applying it")
+	if err := parseAdminFlags(fs, args, "uid", "tier"); err != nil {
+		return nil, err
+	}
+	if *tier != freeSubscriptionTier && *tier != premiumSubscriptionTier {
+		return nil, &adminUsageError{message: fmt.Sprintf("set-tier: --tier must be %s or %s", freeSubscriptionTier, premiumSubscriptionTier)}
+	}
+
+	expires := time.Time{}
+	if *expiresAt != "" {
+		parsed, err := time.Parse(time.RFC3339, *expiresAt)
+		if err != nil || *tier == freeSubscriptionTier {
+			return nil, &adminUsageError{message: "set-tier: --expires-at must be an RFC3339 time, and only applies to paid tiers"}
+		}
+		expires = parsed.UTC()
+	}
+
+	userDocument, err := a.store.GetUserDocument(ctx, *uid)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch user profile: %w", err)
+	}
+	profile, err := userProfileFromDocument(userDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &adminTierChange{
+		UID:    *uid,
+		Before: adminTier{Tier: profile.Settings.SubscriptionTier, ExpiresAt: profile.Settings.SubscriptionExpiresAt},
+		After:  adminTier{Tier: *tier},
+		DryRun: *dryRun,
+	}
+	if !expires.IsZero() {
+		change.After.ExpiresAt = &expires
+	}
+	if *dryRun {
+		return change, nil
+	}
+
+	err = a.store.UpdateUserDocument(ctx, *uid, map[string]interface{}{
+		"Settings.SubscriptionTier":      *tier,
+		"Settings.SubscriptionExpiresAt": expires,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to update subscription tier: %w", err)
+	}
+
+	return change, nil
+}
+
+func (a *admin) listRoutines(ctx context.Context, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("list-routines", flag.ContinueOnError)
+	uid := fs.String("uid", "", "uid of the user")
+	if err := parseAdminFlags(fs, args, "uid"); err != nil {
+		return nil, err
+	}
+
+	return userRoutines(ctx, a.store, *uid)
+}
+
+type adminOrphanedRoutine struct {
+	RefId       string `json:"refId"`
+	UID         string `json:"uid"`
+	RoutineName string `json:"routineName"`
+}
+
+type adminOrphanReport struct {
+	DryRun  bool                   `json:"dryRun"`
+	Orphans []adminOrphanedRoutine `json:"orphans"`
+	Deleted int                    `json:"deleted"`
+}
+
+// deleteOrphanedRoutines deletes the routines whose UID has no users document, e.g. left behind by failed registrations
+func (a *admin) deleteOrphanedRoutines(ctx context.Context, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("delete-orphaned-routines", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "list the orphaned routines without deleting them")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return nil, err
+	}
+
+	routines, err := a.store.GetAllRoutines(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch every routine: %w", err)
+	}
+
+	report := &adminOrphanReport{DryRun: *dryRun, Orphans: []adminOrphanedRoutine{}}
+	hasUser := map[string]bool{}
+	for _, routine := range routines {
+		uid, _ := routine["UID"].(string)
+		exists, checked := hasUser[uid]
+		if !checked {
+			_, err := a.store.GetUserDocument(ctx, uid)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return nil, fmt.Errorf("error while trying to fetch user profile: %w", err)
+			}
+			exists = err == nil
+			hasUser[uid] = exists
+		}
+		if exists {
+			continue
+		}
+
+		refId, _ := routine["RefId"].(string)
+		routineName, _ := routine["RoutineName"].(string)
+		report.Orphans = append(report.Orphans, adminOrphanedRoutine{RefId: refId, UID: uid, RoutineName: routineName})
+	}
+
+	if *dryRun {
+		return report, nil
+	}
+	for _, orphan := range report.Orphans {
+		if err := a.store.DeleteRoutineDocument(ctx, orphan.RefId); err != nil {
+			return nil, fmt.Errorf("error after deleting %d orphaned routines: %w", report.Deleted, err)
+		}
+		report.Deleted++
+	}
+
+	return report, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// fakeDirectory looks users up from a map of email to uid
+type fakeDirectory map[string]string
+
+func (d fakeDirectory) GetUserByEmail(_ context.Context, email string) (*auth.UserRecord, error) {
+	uid, ok := d[email]
+	if !ok {
+		// auth.IsUserNotFound only recognizes the errors of the Firebase client, the admin reports any failure alike
+		return nil, ErrNotFound
+	}
+	return &auth.UserRecord{
+		UserInfo:     &auth.UserInfo{UID: uid, Email: email, DisplayName: "Lifter"},
+		UserMetadata: &auth.UserMetadata{CreationTimestamp: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC).UnixMilli()},
+	}, nil
+}
+
+func runAdminCommand(t *testing.T, store storage, args ...string) (int, string, string) {
+	t.Helper()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	// the store is wrapped the way runAdmin wraps Firestore
+	a := &admin{store: migrateStorage(store), users: fakeDirectory{"lifter@example.com": "uid-1"}}
+	code := a.execute(context.Background(), args, stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestAdmin_LookupUser(t *testing.T) {
+	store := newMemoryStorage()
+	if err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1", CurrentGoal: "Bench 140"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	code, stdout, stderr := runAdminCommand(t, store, "lookup-user", "--email", "lifter@example.com")
+	if code != 0 {
+		t.Fatalf("expected exit code 0 but got %d: %s", code, stderr)
+	}
+
+	user := adminUser{}
+	if err := json.Unmarshal([]byte(stdout), &user); err != nil {
+		t.Fatalf("expected JSON output, got %q: %v", stdout, err)
+	}
+	if user.UID != "uid-1" || user.CreatedAt == nil || user.Profile == nil || user.Profile.CurrentGoal != "Bench 140" {
+		t.Errorf("unexpected user: %+v", user)
+	}
+
+	code, _, stderr = runAdminCommand(t, store, "lookup-user", "--email", "nobody@example.com")
+	if code != 1 || !strings.Contains(stderr, `"error"`) {
+		t.Errorf("expected a JSON error for an unknown email, got %d %q", code, stderr)
+	}
+}
+
+func TestAdmin_LookupUser_MigratesProfile(t *testing.T) {
+	store := newMemoryStorage()
+	// a profile written before schema versions, without a subscription tier
+	store.collections["users"]["user-1"] = map[string]interface{}{
+		"UID":         "uid-1",
+		"CurrentGoal": "Bench 140",
+		"Metrics":     map[string]interface{}{"Height": int64(180), "JoinDate": time.Now(), "Weight": int64(80)},
+		"Settings":    map[string]interface{}{"UnitsPreference": "Metric", "SubscriptionExpiresAt": time.Time{}},
+	}
+
+	code, stdout, stderr := runAdminCommand(t, store, "lookup-user", "--email", "lifter@example.com")
+	if code != 0 {
+		t.Fatalf("expected exit code 0 but got %d: %s", code, stderr)
+	}
+	user := adminUser{}
+	if err := json.Unmarshal([]byte(stdout), &user); err != nil {
+		t.Fatalf("expected JSON output, got %q: %v", stdout, err)
+	}
+	if user.Profile == nil || user.Profile.Settings.SubscriptionTier != freeSubscriptionTier {
+		t.Errorf("expected the profile at the current schema version, got %+v", user.Profile)
+	}
+}
+
+func TestAdmin_SetTier(t *testing.T) {
+	store := newMemoryStorage()
+	err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1", Settings: UserDocumentSettings{SubscriptionTier: freeSubscriptionTier}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tier := func() string {
+		doc, err := store.GetUserDocument(context.Background(), "uid-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return doc["Settings"].(map[string]interface{})["SubscriptionTier"].(string)
+	}
+
+	code, stdout, stderr := runAdminCommand(t, store, "set-tier", "--uid", "uid-1", "--tier", "Premium", "--expires-at", "2030-01-31T00:00:00Z", "--dry-run")
+	if code != 0 {
+		t.Fatalf("expected exit code 0 but got %d: %s", code, stderr)
+	}
+	change := adminTierChange{}
+	if err := json.Unmarshal([]byte(stdout), &change); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !change.DryRun || change.Before.Tier != freeSubscriptionTier || change.After.Tier != premiumSubscriptionTier || change.After.ExpiresAt == nil {
+		t.Errorf("unexpected change: %+v", change)
+	}
+	if got := tier(); got != freeSubscriptionTier {
+		t.Errorf("expected a dry run to leave the tier alone, got %s", got)
+	}
+
+	if code, _, stderr := runAdminCommand(t, store, "set-tier", "--uid", "uid-1", "--tier", "Premium"); code != 0 {
+		t.Fatalf("expected exit code 0 but got %d: %s", code, stderr)
+	}
+	if got := tier(); got != premiumSubscriptionTier {
+		t.Errorf("expected the tier to be Premium, got %s", got)
+	}
+}
+
+func TestAdmin_DeleteOrphanedRoutines(t *testing.T) {
+	store := newMemoryStorage()
+	if err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kept := seedRoutine(t, store, "uid-1", "Push Day", time.Now(), nil)
+	orphan := seedRoutine(t, store, "uid-gone", "Leg Day", time.Now(), nil)
+
+	code, stdout, stderr := runAdminCommand(t, store, "delete-orphaned-routines", "--dry-run")
+	if code != 0 {
+		t.Fatalf("expected exit code 0 but got %d: %s", code, stderr)
+	}
+	report := adminOrphanReport{}
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].RefId != orphan || report.Deleted != 0 {
+		t.Errorf("expected the dry run to find only the orphan, got %+v", report)
+	}
+	if routines, _ := store.GetAllRoutines(context.Background()); len(routines) != 2 {
+		t.Fatalf("expected a dry run to delete nothing, got %d routines", len(routines))
+	}
+
+	code, stdout, _ = runAdminCommand(t, store, "delete-orphaned-routines")
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil || code != 0 || report.Deleted != 1 {
+		t.Fatalf("expected the orphan to be deleted, got %d %+v %v", code, report, err)
+	}
+	routines, _ := store.GetAllRoutines(context.Background())
+	if len(routines) != 1 || routines[0]["RefId"] != kept {
+		t.Errorf("expected only the routine of uid-1 to be left, got %v", routines)
+	}
+}
+
+func TestAdmin_Usage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no command", nil},
+		{"unknown command", []string{"drop-database"}},
+		{"missing flag", []string{"list-routines"}},
+		{"unknown tier", []string{"set-tier", "--uid", "uid-1", "--tier", "Gold"}},
+		{"expiring free tier", []string{"set-tier", "--uid", "uid-1", "--tier", "Free", "--expires-at", "2030-01-31T00:00:00Z"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _, _ := runAdminCommand(t, newMemoryStorage(), tt.args...); code != 2 {
+				t.Errorf("expected exit code 2 but got %d", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// accountArchiveFormat and accountArchiveVersion identify the archive, the version is bumped whenever a field
+	// changes meaning or is removed, so that restoring an archive never guesses
+	accountArchiveFormat  = "repetiswole.account"
+	accountArchiveVersion = 1
+	// maxArchiveBodyBytes bounds a restored archive, which holds every routine and every logged set of a user
+	maxArchiveBodyBytes = 20 << 20
+
+	conflictKeep    = "keep"
+	conflictReplace = "replace"
+)
+
+// AccountArchive is a complete copy of a user's data. Nested documents mirror the Firestore documents, see
+// docs/FIRESTORE_DATABASE.md, with the weights of workout logs in kilograms
+type AccountArchive struct {
+	Format      string              `json:"format" validate:"required"`
+	Version     int                 `json:"version" validate:"required"`
+	ExportedAt  time.Time           `json:"exportedAt"`
+	UID         string              `json:"uid"`
+	Profile     ArchiveProfile      `json:"profile"`
+	Routines    []ArchiveRoutine    `json:"routines" validate:"max=1000"`
+	WorkoutLogs []ArchiveWorkoutLog `json:"workoutLogs" validate:"max=50000"`
+}
+
+// ArchiveProfile is the user document. The subscription is exported for completeness but never restored, it stays
+// under the billing webhook's control
+type ArchiveProfile struct {
+	CurrentGoal string          `json:"CurrentGoal" validate:"max=200"`
+	Metrics     ArchiveMetrics  `json:"Metrics"`
+	Settings    ArchiveSettings `json:"Settings"`
+}
+
+type ArchiveMetrics struct {
+	Height   float64   `json:"Height" validate:"min=0,max=300"`
+	Weight   float64   `json:"Weight" validate:"min=0,max=1000"`
+	JoinDate time.Time `json:"JoinDate"`
+}
+
+type ArchiveSettings struct {
+	UnitsPreference       string     `json:"UnitsPreference" validate:"oneof=Metric Imperial"`
+	SubscriptionTier      string     `json:"SubscriptionTier"`
+	SubscriptionExpiresAt *time.Time `json:"SubscriptionExpiresAt,omitempty"`
+}
+
+type ArchiveRoutine struct {
+	RefId       string                 `json:"RefId"`
+	RoutineName string                 `json:"RoutineName" validate:"required,max=100"`
+	CreatedAt   time.Time              `json:"CreatedAt"`
+	Workouts    []WorkoutUpdateRequest `json:"Workouts" validate:"max=50"`
+}
+
+type ArchiveWorkoutLog struct {
+	RefId       string            `json:"RefId"`
+	WorkoutName string            `json:"WorkoutName" validate:"max=100"`
+	PerformedAt time.Time         `json:"PerformedAt" validate:"required"`
+	Source      string            `json:"Source" validate:"max=20"`
+	Exercises   []ArchiveExercise `json:"Exercises" validate:"max=100"`
+}
+
+// ArchiveExercise is an exercise of a workout log, whose MuscleGroup is -1 when an import could not map it
+type ArchiveExercise struct {
+	MuscleGroup  int                `json:"MuscleGroup" validate:"min=-1,max=11"`
+	ExerciseName string             `json:"ExerciseName" validate:"required,max=100"`
+	Sets         []SetUpdateRequest `json:"Sets" validate:"max=1000"`
+}
+
+// ArchiveRestoreResponse reports what restoring an archive did with the profile, every routine and every workout log
+type ArchiveRestoreResponse struct {
+	// Profile is "created" when the user had no profile, otherwise "replaced" or "kept" depending on onConflict
+	Profile     string               `json:"profile"`
+	Routines    ArchiveRestoreCounts `json:"routines"`
+	WorkoutLogs ArchiveRestoreCounts `json:"workoutLogs"`
+	Conflicts   []ArchiveConflict    `json:"conflicts"`
+	// Incomplete is set when the deadline passed partway. Restoring the archive again finishes it, as whatever was
+	// restored already matches
+	Incomplete bool `json:"incomplete"`
+}
+
+type ArchiveRestoreCounts struct {
+	Created  int `json:"created"`
+	Replaced int `json:"replaced"`
+	Kept     int `json:"kept"`
+}
+
+// ArchiveConflict is a document of the archive that matched data the user already has, and how it was resolved
+type ArchiveConflict struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Resolution string `json:"resolution"`
+}
+
+// ExportArchive downloads the AccountArchive of the user, which RestoreArchive accepts as-is
+func (rtr *router) ExportArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	uid := r.PathValue("uid")
+	idToken := r.PathValue("idToken")
+
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "export archive", err)
+		return
+	}
+
+	archive, err := rtr.accountArchive(r, uid)
+	if err != nil {
+		rtr.StatusError(w, r, "export archive", err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="repetiswole-archive-%s.json"`, archive.ExportedAt.Format(time.DateOnly)))
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(archive); err != nil {
+		loggerFrom(r.Context()).Error("error while writing account archive", "error", err.Error())
+	}
+}
+
+func (rtr *router) accountArchive(r *http.Request, uid string) (*AccountArchive, error) {
+	var userDocument map[string]interface{}
+	err := rtr.withProfile(r.Context(), uid, func() (err error) {
+		userDocument, err = rtr.config.store.GetUserDocument(r.Context(), uid)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch user profile: %w", err)
+	}
+	profile := ArchiveProfile{}
+	if err := decodeDocument(userDocument, &profile); err != nil {
+		return nil, err
+	}
+	if expiresAt := profile.Settings.SubscriptionExpiresAt; expiresAt != nil && expiresAt.IsZero() {
+		profile.Settings.SubscriptionExpiresAt = nil
+	}
+
+	routines, err := userRoutines(r.Context(), rtr.config.store, uid)
+	if err != nil {
+		return nil, err
+	}
+	archiveRoutines := make([]ArchiveRoutine, 0, len(routines))
+	for _, routine := range routines {
+		archiveRoutine := ArchiveRoutine{RefId: routine.RefId, RoutineName: routine.RoutineName, CreatedAt: routine.CreatedAt}
+		if err := convertDocument(routine.Workouts, &archiveRoutine.Workouts); err != nil {
+			return nil, err
+		}
+		archiveRoutines = append(archiveRoutines, archiveRoutine)
+	}
+
+	workoutLogs, err := userWorkoutLogs(r.Context(), rtr.config.store, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccountArchive{
+		Format:      accountArchiveFormat,
+		Version:     accountArchiveVersion,
+		ExportedAt:  time.Now().UTC(),
+		UID:         uid,
+		Profile:     profile,
+		Routines:    archiveRoutines,
+		WorkoutLogs: workoutLogs,
+	}, nil
+}
+
+// convertDocument converts between two types of the same JSON shape, e.g. the response and request types of a routine
+func convertDocument(src, dst interface{}) error {
+	raw, err := json.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("error while trying to encode %T: %w", src, err)
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return fmt.Errorf("error while trying to decode %T into %T: %w", src, dst, err)
+	}
+	return nil
+}
+
+// RestoreArchive restores an AccountArchive into the user's data, possibly in another deployment under another uid.
+// Routines match existing ones by RefId or name, and workout logs by the ID they would be imported under. Matches are
+// kept, or overwritten with onConflict=replace. Workout logs are history and are never overwritten
+func (rtr *router) RestoreArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	uid := r.PathValue("uid")
+	idToken := r.PathValue("idToken")
+
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "restore archive", err)
+		return
+	}
+
+	onConflict := r.URL.Query().Get("onConflict")
+	if onConflict == "" {
+		onConflict = conflictKeep
+	}
+	if onConflict != conflictKeep && onConflict != conflictReplace {
+		rtr.StatusError(w, r, "restore archive", validationError(fieldError{Field: "onConflict", Message: "must be one of: keep, replace"}))
+		return
+	}
+
+	archive := &AccountArchive{}
+	if err := decodeJSONBody(w, r, archive, maxArchiveBodyBytes); err != nil {
+		rtr.StatusError(w, r, "restore archive", err)
+		return
+	}
+	if archive.Format != accountArchiveFormat {
+		rtr.StatusError(w, r, "restore archive", validationError(fieldError{Field: "format", Message: fmt.Sprintf("must be %s", accountArchiveFormat)}))
+		return
+	}
+	if archive.Version != accountArchiveVersion {
+		rtr.StatusError(w, r, "restore archive", validationError(fieldError{Field: "version", Message: fmt.Sprintf("archive version %d is not supported, this server reads version %d", archive.Version, accountArchiveVersion)}))
+		return
+	}
+
+	report := &ArchiveRestoreResponse{Conflicts: []ArchiveConflict{}}
+	err := rtr.restoreProfile(r, uid, &archive.Profile, onConflict, report)
+	if err == nil {
+		err = rtr.restoreRoutines(r, uid, archive.Routines, onConflict, report)
+	}
+	if err == nil {
+		err = rtr.restoreWorkoutLogs(r, uid, archive.WorkoutLogs, report)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		loggerFrom(r.Context()).Warn("archive restore ran out of time", "uid", uid, "error", err.Error())
+		report.Incomplete = true
+		rtr.StatusOK(w, r, http.StatusOK, "restored part of the account archive before the deadline, restore it again to finish", report)
+		return
+	}
+	if err != nil {
+		rtr.StatusError(w, r, "restore archive", err)
+		return
+	}
+
+	rtr.StatusOK(w, r, http.StatusOK, "successfully restored account archive", report)
+}
+
+// restoreProfile creates the user's profile when it is missing, or overwrites the fields a client may change
+func (rtr *router) restoreProfile(r *http.Request, uid string, profile *ArchiveProfile, onConflict string, report *ArchiveRestoreResponse) error {
+	_, err := rtr.config.store.GetUserDocument(r.Context(), uid)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		joinDate := profile.Metrics.JoinDate
+		if joinDate.IsZero() {
+			joinDate = time.Now()
+		}
+		// the providers come from the user's account in this deployment, not from the archive
+		providers, err := rtr.signInProviders(r.Context(), uid)
+		if err != nil {
+			return fmt.Errorf("error while trying to restore user document: %w", err)
+		}
+		err = rtr.config.store.CreateUserDocument(r.Context(), &UserDocument{
+			SchemaVersion: userSchemaVersion,
+			UID:           uid,
+			Providers:     providers,
+			Metrics:       UserDocumentMetrics{JoinDate: joinDate},
+			Settings:      UserDocumentSettings{SubscriptionTier: freeSubscriptionTier},
+		})
+		if err != nil {
+			return fmt.Errorf("error while trying to create restored user document: %w", err)
+		}
+		report.Profile = "created"
+	case err != nil:
+		return fmt.Errorf("error while trying to fetch user profile: %w", err)
+	case onConflict == conflictKeep:
+		report.Profile = "kept"
+		report.Conflicts = append(report.Conflicts, ArchiveConflict{Kind: "profile", Name: uid, Resolution: "kept"})
+		return nil
+	default:
+		report.Profile = "replaced"
+		report.Conflicts = append(report.Conflicts, ArchiveConflict{Kind: "profile", Name: uid, Resolution: "replaced"})
+	}
+
+	update := &ProfileUpdateRequest{
+		CurrentGoal:     &profile.CurrentGoal,
+		Height:          &profile.Metrics.Height,
+		Weight:          &profile.Metrics.Weight,
+		UnitsPreference: &profile.Settings.UnitsPreference,
+	}
+	if err := rtr.config.store.UpdateUserDocument(r.Context(), uid, update.Updates()); err != nil {
+		return fmt.Errorf("error while trying to restore user document: %w", err)
+	}
+	return nil
+}
+
+// restoreRoutines creates the archive's routines, within the user's quota, matching existing routines by RefId and
+// then by name. Routines are created and replaced in bulk, so that archives of every routine fit the deadline
+func (rtr *router) restoreRoutines(r *http.Request, uid string, routines []ArchiveRoutine, onConflict string, report *ArchiveRestoreResponse) error {
+	existing, err := userRoutines(r.Context(), rtr.config.store, uid)
+	if err != nil {
+		return err
+	}
+	byRefId := make(map[string]string, len(existing))
+	byName := make(map[string]string, len(existing))
+	for _, routine := range existing {
+		byRefId[routine.RefId] = routine.RefId
+		byName[routine.RoutineName] = routine.RefId
+	}
+
+	// routines the archive matches twice, e.g. by name, are written once, with the last match
+	replaces, creates := &routineWrites{}, &routineWrites{}
+	for _, routine := range routines {
+		document := (&RoutineUpdateRequest{RoutineName: routine.RoutineName, Workouts: routine.Workouts}).toDocument(uid, routine.CreatedAt)
+
+		refId, found := byRefId[routine.RefId]
+		if !found {
+			refId, found = byName[routine.RoutineName]
+		}
+		switch {
+		case found && onConflict == conflictReplace:
+			replaces.add(refId, routine.RoutineName, &routineWrite{RefId: refId, Document: document})
+		case found, creates.has(routine.RoutineName) && onConflict == conflictKeep:
+			report.Routines.Kept++
+			report.Conflicts = append(report.Conflicts, ArchiveConflict{Kind: "routine", Name: routine.RoutineName, Resolution: "kept"})
+		default:
+			creates.add(routine.RoutineName, routine.RoutineName, &routineWrite{Document: document})
+		}
+	}
+
+	err = rtr.config.store.ReplaceRoutineDocuments(r.Context(), replaces.writes)
+	for i, write := range replaces.writes {
+		if !write.Written {
+			continue
+		}
+		for _, name := range replaces.names[i] {
+			report.Routines.Replaced++
+			report.Conflicts = append(report.Conflicts, ArchiveConflict{Kind: "routine", Name: name, Resolution: "replaced"})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error while trying to replace routines: %w", err)
+	}
+
+	err = createRoutinesWithinQuota(r.Context(), rtr.config.store, uid, creates.writes)
+	for i, write := range creates.writes {
+		for j, name := range creates.names[i] {
+			switch {
+			case write.Written && j == 0:
+				report.Routines.Created++
+			case write.Written:
+				report.Routines.Replaced++
+				report.Conflicts = append(report.Conflicts, ArchiveConflict{Kind: "routine", Name: name, Resolution: "replaced"})
+			case err == nil:
+				report.Conflicts = append(report.Conflicts, ArchiveConflict{Kind: "routine", Name: name, Resolution: string(codeQuotaExceeded)})
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error while trying to create restored routines: %w", err)
+	}
+
+	return nil
+}
+
+// routineWrites collects the routine writes of a restore by key, with the names of the archive's routines each one
+// writes
+type routineWrites struct {
+	writes []*routineWrite
+	names  [][]string
+	byKey  map[string]int
+}
+
+func (rw *routineWrites) has(key string) bool {
+	_, ok := rw.byKey[key]
+	return ok
+}
+
+// add queues write under key, or only its document should a write be queued under key already
+func (rw *routineWrites) add(key, name string, write *routineWrite) {
+	if i, ok := rw.byKey[key]; ok {
+		rw.writes[i].Document = write.Document
+		rw.names[i] = append(rw.names[i], name)
+		return
+	}
+	if rw.byKey == nil {
+		rw.byKey = map[string]int{}
+	}
+	rw.byKey[key] = len(rw.writes)
+	rw.writes = append(rw.writes, write)
+	rw.names = append(rw.names, []string{name})
+}
+
+// restoreWorkoutLogs stores the archive's workout logs under the ID an import would give them within this deployment,
+// so that neither restoring twice nor importing the original export afterwards duplicates them
+func (rtr *router) restoreWorkoutLogs(r *http.Request, uid string, workoutLogs []ArchiveWorkoutLog, report *ArchiveRestoreResponse) error {
+	writes := make([]*workoutLogWrite, 0, len(workoutLogs))
+	for _, archived := range workoutLogs {
+		workoutLog := &WorkoutLogDocument{
+			UID:         uid,
+			WorkoutName: archived.WorkoutName,
+			PerformedAt: archived.PerformedAt.UTC(),
+			Source:      archived.Source,
+			Exercises:   make([]ExerciseDoc, 0, len(archived.Exercises)),
+		}
+		for _, exercise := range archived.Exercises {
+			sets := make([]SetDoc, 0, len(exercise.Sets))
+			for _, set := range exercise.Sets {
+				sets = append(sets, SetDoc{Reps: set.Reps, Weight: set.Weight, IsDropSet: set.IsDropSet, IsWarmUp: set.IsWarmUp})
+			}
+			workoutLog.Exercises = append(workoutLog.Exercises, ExerciseDoc{MuscleGroup: exercise.MuscleGroup, ExerciseName: exercise.ExerciseName, Sets: sets})
+		}
+		writes = append(writes, &workoutLogWrite{ID: workoutLogID(workoutLog), Log: workoutLog})
+	}
+
+	err := rtr.config.store.CreateWorkoutLogDocuments(r.Context(), writes)
+	for _, write := range writes {
+		if write.Created {
+			report.WorkoutLogs.Created++
+		} else if write.Duplicate {
+			report.WorkoutLogs.Kept++
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error while trying to restore workout logs: %w", err)
+	}
+
+	return nil
+}
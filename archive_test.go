@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// seedAccount stores a premium user with two routines and a workout log, the data an archive should carry
+func seedAccount(t *testing.T, store *memoryStorage, uid string) {
+	t.Helper()
+
+	err := store.CreateUserDocument(context.Background(), &UserDocument{
+		UID:         uid,
+		CurrentGoal: "Bench 140",
+		Metrics:     UserDocumentMetrics{Height: 180, Weight: 90, JoinDate: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+		Settings:    UserDocumentSettings{UnitsPreference: imperialUnits, SubscriptionTier: "Premium", SubscriptionExpiresAt: time.Now().Add(24 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	createdAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range []string{"Push Day", "Leg Day"} {
+		seedRoutine(t, store, uid, name, createdAt.Add(time.Duration(i)*time.Hour), []map[string]interface{}{{
+			"WorkoutName": "Monday",
+			"Exercises": []map[string]interface{}{{
+				"MuscleGroup":  8,
+				"ExerciseName": "Squat",
+				"Sets":         []map[string]interface{}{{"Reps": 5, "Weight": 142.5, "IsWarmUp": false, "IsDropSet": false}},
+			}},
+		}})
+	}
+
+	err = store.CreateWorkoutLogDocuments(context.Background(), []*workoutLogWrite{{ID: "log-1", Log: &WorkoutLogDocument{
+		UID:         uid,
+		WorkoutName: "Leg Day",
+		PerformedAt: time.Date(2024, 3, 6, 7, 30, 0, 0, time.UTC),
+		Source:      importFormatStrong,
+		Exercises:   []ExerciseDoc{{MuscleGroup: -1, ExerciseName: "Zottman Thing", Sets: []SetDoc{{Reps: 10, Weight: 12.5}}}},
+	}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func exportArchive(t *testing.T, rtr *router, uid string) []byte {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/user/export/archive/"+uid+"/"+uid, nil))
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return body
+}
+
+func restoreArchive(t *testing.T, rtr *router, uid, query string, archive []byte) (int, *ArchiveRestoreResponse) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/user/import/archive/"+uid+"/"+uid+query, bytes.NewReader(archive)))
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	envelope := struct {
+		Data *ArchiveRestoreResponse `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		t.Fatalf("unexpected error decoding the response: %v", err)
+	}
+	return resp.StatusCode, envelope.Data
+}
+
+func TestExportArchive(t *testing.T) {
+	store := newMemoryStorage()
+	seedAccount(t, store, "uid-1")
+	seedAccount(t, store, "uid-2")
+
+	archive := AccountArchive{}
+	if err := json.Unmarshal(exportArchive(t, getMemoryTestRouter(store), "uid-1"), &archive); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if archive.Format != accountArchiveFormat || archive.Version != accountArchiveVersion || archive.UID != "uid-1" {
+		t.Errorf("unexpected archive header: %s %d %s", archive.Format, archive.Version, archive.UID)
+	}
+	if archive.Profile.CurrentGoal != "Bench 140" || archive.Profile.Settings.SubscriptionTier != "Premium" {
+		t.Errorf("expected the whole profile, got %+v", archive.Profile)
+	}
+	if len(archive.Routines) != 2 || archive.Routines[0].RoutineName != "Push Day" || archive.Routines[1].Workouts[0].Exercises[0].Sets[0].Weight != 142.5 {
+		t.Errorf("expected both routines of the user, oldest first, got %+v", archive.Routines)
+	}
+	if len(archive.WorkoutLogs) != 1 || archive.WorkoutLogs[0].Exercises[0].MuscleGroup != -1 {
+		t.Errorf("expected the workout log of the user, got %+v", archive.WorkoutLogs)
+	}
+}
+
+func TestRestoreArchive_NewDeployment(t *testing.T) {
+	source := newMemoryStorage()
+	seedAccount(t, source, "uid-1")
+	archive := exportArchive(t, getMemoryTestRouter(source), "uid-1")
+
+	// a new deployment, where the user signed up again under another uid but has no profile yet
+	target := newMemoryStorage()
+	rtr := getMemoryTestRouter(target)
+	status, report := restoreArchive(t, rtr, "uid-9", "", archive)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", status)
+	}
+	if report.Profile != "created" || report.Routines.Created != 2 || report.WorkoutLogs.Created != 1 || len(report.Conflicts) != 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	restored := AccountArchive{}
+	if err := json.Unmarshal(exportArchive(t, rtr, "uid-9"), &restored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if restored.Profile.CurrentGoal != "Bench 140" || restored.Profile.Settings.UnitsPreference != imperialUnits {
+		t.Errorf("expected the profile to be restored, got %+v", restored.Profile)
+	}
+	if restored.Profile.Settings.SubscriptionTier != freeSubscriptionTier {
+		t.Errorf("expected the subscription to never be restored, got %s", restored.Profile.Settings.SubscriptionTier)
+	}
+	if len(restored.Routines) != 2 || !restored.Routines[0].CreatedAt.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the routines with their creation times, got %+v", restored.Routines)
+	}
+
+	// restoring twice finds everything it wrote the first time
+	status, report = restoreArchive(t, rtr, "uid-9", "", archive)
+	if status != http.StatusOK || report.Profile != "kept" || report.Routines.Kept != 2 || report.Routines.Created != 0 || report.WorkoutLogs.Kept != 1 {
+		t.Errorf("expected the second restore to keep everything, got %d %+v", status, report)
+	}
+}
+
+func TestRestoreArchive_Deadline(t *testing.T) {
+	source := newMemoryStorage()
+	seedAccount(t, source, "uid-1")
+	archive := exportArchive(t, getMemoryTestRouter(source), "uid-1")
+
+	target := newMemoryStorage()
+	status, report := restoreArchive(t, getMemoryTestRouter(&deadlineStorage{memoryStorage: target, limit: 0}), "uid-9", "", archive)
+	if status != http.StatusOK {
+		t.Fatalf("expected the partial report with status 200 but got %d", status)
+	}
+	if !report.Incomplete || report.Routines.Created != 2 || report.WorkoutLogs.Created != 0 {
+		t.Errorf("expected an incomplete restore of the routines alone, got %+v", report)
+	}
+
+	// restoring again finishes the restore
+	status, report = restoreArchive(t, getMemoryTestRouter(target), "uid-9", "", archive)
+	if status != http.StatusOK || report.Incomplete || report.Routines.Kept != 2 || report.WorkoutLogs.Created != 1 {
+		t.Errorf("expected the second restore to write the workout log, got %d %+v", status, report)
+	}
+}
+
+func TestRestoreArchive_Conflicts(t *testing.T) {
+	store := newMemoryStorage()
+	seedAccount(t, store, "uid-1")
+	rtr := getMemoryTestRouter(store)
+
+	archive := AccountArchive{}
+	if err := json.Unmarshal(exportArchive(t, rtr, "uid-1"), &archive); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	archive.Profile.CurrentGoal = "Squat 200"
+	archive.Routines[0].Workouts[0].WorkoutName = "Tuesday"
+	changed, _ := json.Marshal(archive)
+
+	status, report := restoreArchive(t, rtr, "uid-1", "?onConflict=keep", changed)
+	if status != http.StatusOK || report.Profile != "kept" || report.Routines.Kept != 2 || len(report.Conflicts) != 3 {
+		t.Errorf("expected every conflict to be kept, got %d %+v", status, report)
+	}
+
+	status, report = restoreArchive(t, rtr, "uid-1", "?onConflict=replace", changed)
+	if status != http.StatusOK || report.Profile != "replaced" || report.Routines.Replaced != 2 {
+		t.Errorf("expected every conflict to be replaced, got %d %+v", status, report)
+	}
+
+	restored := AccountArchive{}
+	if err := json.Unmarshal(exportArchive(t, rtr, "uid-1"), &restored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if restored.Profile.CurrentGoal != "Squat 200" || restored.Routines[0].Workouts[0].WorkoutName != "Tuesday" || len(restored.Routines) != 2 {
+		t.Errorf("expected the archive to replace the profile and routine, got %+v", restored)
+	}
+	if restored.Profile.Settings.SubscriptionTier != "Premium" {
+		t.Errorf("expected the subscription to be left alone, got %s", restored.Profile.Settings.SubscriptionTier)
+	}
+}
+
+func TestRestoreArchive_Quota(t *testing.T) {
+	archive := AccountArchive{Format: accountArchiveFormat, Version: accountArchiveVersion, Profile: ArchiveProfile{Settings: ArchiveSettings{UnitsPreference: "Metric"}}}
+	for _, name := range []string{"A", "B", "C", "D"} {
+		archive.Routines = append(archive.Routines, ArchiveRoutine{RoutineName: name, CreatedAt: time.Now()})
+	}
+	body, _ := json.Marshal(archive)
+
+	status, report := restoreArchive(t, getMemoryTestRouter(newMemoryStorage()), "uid-1", "", body)
+	if status != http.StatusOK || report.Routines.Created != 3 || len(report.Conflicts) != 1 || report.Conflicts[0].Resolution != string(codeQuotaExceeded) {
+		t.Errorf("expected a free tier user to get 3 routines and a quota conflict, got %d %+v", status, report)
+	}
+}
+
+func TestRestoreArchive_Rejected(t *testing.T) {
+	valid := AccountArchive{Format: accountArchiveFormat, Version: accountArchiveVersion, Profile: ArchiveProfile{Settings: ArchiveSettings{UnitsPreference: "Metric"}}}
+	newer, wrongFormat, invalid := valid, valid, valid
+	newer.Version = accountArchiveVersion + 1
+	wrongFormat.Format = "strong"
+	invalid.Routines = []ArchiveRoutine{{RoutineName: ""}}
+
+	tests := []struct {
+		name    string
+		query   string
+		archive AccountArchive
+	}{
+		{"newer version", "", newer},
+		{"wrong format", "", wrongFormat},
+		{"invalid routine", "", invalid},
+		{"unknown conflict mode", "?onConflict=merge", valid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStorage()
+			body, _ := json.Marshal(tt.archive)
+			status, _ := restoreArchive(t, getMemoryTestRouter(store), "uid-1", tt.query, body)
+			if status != http.StatusUnprocessableEntity {
+				t.Errorf("expected status 422 but got %d", status)
+			}
+			if _, err := store.GetUserDocument(context.Background(), "uid-1"); err == nil {
+				t.Errorf("expected a rejected archive to write nothing")
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	freeSubscriptionTier    = "Free"
+	premiumSubscriptionTier = "Premium"
+
+	// the most we will read from a webhook body, Stripe events are a few KB at most
+	maxBillingWebhookBodyBytes = 64 * 1024
+	// how old a signed webhook can be before we treat it as a replay
+	billingSignatureTolerance = 5 * time.Minute
+)
+
+// billingEvent is the envelope of a Stripe-compatible webhook event. Only the fields we act on are decoded
+type billingEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type billingCheckoutSession struct {
+	ClientReferenceID string            `json:"client_reference_id"`
+	Customer          string            `json:"customer"`
+	Subscription      string            `json:"subscription"`
+	Mode              string            `json:"mode"`
+	PaymentStatus     string            `json:"payment_status"`
+	Metadata          map[string]string `json:"metadata"`
+}
+
+type billingSubscription struct {
+	ID               string            `json:"id"`
+	Customer         string            `json:"customer"`
+	Status           string            `json:"status"`
+	CurrentPeriodEnd int64             `json:"current_period_end"`
+	EndedAt          int64             `json:"ended_at"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// subscriptionChange is what a billing event means for a single user's Settings
+type subscriptionChange struct {
+	UID       string
+	Tier      string
+	ExpiresAt time.Time
+	// EventCreated is when the provider created the event, which orders changes delivered out of order
+	EventCreated time.Time
+}
+
+// billingStore is the storage the webhook needs, implemented by storageBillingStore in production
+type billingStore interface {
+	// RecordEvent returns false if the event was already recorded, which makes redelivered events a no-op
+	RecordEvent(ctx context.Context, eventID, eventType string) (bool, error)
+	ForgetEvent(ctx context.Context, eventID string) error
+	// UpdateSubscription returns false if the subscription was last changed by a newer event, and ErrNotFound if
+	// the user does not exist
+	UpdateSubscription(ctx context.Context, change *subscriptionChange) (bool, error)
+}
+
+func (rtr *router) BillingWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	secret := rtr.config.billingWebhookSecret
+	if secret == "" {
+		rtr.StatusError(w, r, "billing webhook", newAPIError(http.StatusServiceUnavailable, codeUnavailable, "billing webhook secret is not configured"))
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxBillingWebhookBodyBytes+1))
+	if err != nil {
+		rtr.StatusError(w, r, "billing webhook", newAPIError(http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("error reading webhook body: %v", err)))
+		return
+	}
+	if len(payload) > maxBillingWebhookBodyBytes {
+		rtr.StatusError(w, r, "billing webhook", newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("webhook body is larger than %d bytes", maxBillingWebhookBodyBytes)))
+		return
+	}
+
+	if err := verifyBillingSignature(payload, r.Header.Get("Stripe-Signature"), secret, time.Now()); err != nil {
+		rtr.StatusError(w, r, "billing webhook", newAPIError(http.StatusBadRequest, codeInvalidSignature, err.Error()))
+		return
+	}
+
+	event := &billingEvent{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		rtr.StatusError(w, r, "billing webhook", invalidJSONError(err))
+		return
+	}
+
+	applied, err := processBillingEvent(r.Context(), &storageBillingStore{store: rtr.config.store}, event)
+	if err != nil {
+		// a non 2xx response makes the provider redeliver the event later
+		rtr.StatusError(w, r, "billing webhook", err)
+		return
+	}
+
+	message := "billing event processed"
+	if !applied {
+		message = "billing event ignored"
+	}
+	rtr.StatusOK(w, r, http.StatusOK, message, BillingWebhookResponse{EventID: event.ID})
+}
+
+// verifyBillingSignature checks a Stripe-Signature header of the form "t=<unix>,v1=<hex hmac>[,v1=...]",
+// where the HMAC-SHA256 is computed over "<t>.<payload>" with the webhook signing secret
+func verifyBillingSignature(payload []byte, header, secret string, now time.Time) error {
+	if header == "" {
+		return fmt.Errorf("missing Stripe-Signature header")
+	}
+
+	var timestamp string
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("malformed Stripe-Signature header")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed Stripe-Signature timestamp: %w", err)
+	}
+
+	signedAt := time.Unix(unix, 0)
+	if now.Sub(signedAt) > billingSignatureTolerance || signedAt.Sub(now) > billingSignatureTolerance {
+		return fmt.Errorf("webhook signature timestamp is outside of the %s tolerance", billingSignatureTolerance)
+	}
+
+	expected := computeBillingSignature(payload, timestamp, secret)
+	for _, signature := range signatures {
+		decoded, err := hex.DecodeString(signature)
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no webhook signature matched the expected signature")
+}
+
+func computeBillingSignature(payload []byte, timestamp, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// processBillingEvent applies an event exactly once. It returns false when the event was a duplicate, is of a type
+// we do not act on, is older than the last change to the subscription, or is for a user who does not exist. The
+// latter are acknowledged rather than failed, as the provider would redeliver them for days to no effect
+func processBillingEvent(ctx context.Context, store billingStore, event *billingEvent) (bool, error) {
+	if event.ID == "" {
+		return false, fmt.Errorf("billing event is missing its id")
+	}
+
+	change, err := subscriptionChangeFromEvent(event)
+	if err != nil {
+		return false, err
+	}
+	if change == nil {
+		return false, nil
+	}
+
+	recorded, err := store.RecordEvent(ctx, event.ID, event.Type)
+	if err != nil {
+		return false, fmt.Errorf("error while trying to record billing event (%s): %w", event.ID, err)
+	}
+	if !recorded {
+		return false, nil
+	}
+
+	updated, err := store.UpdateSubscription(ctx, change)
+	if errors.Is(err, ErrNotFound) {
+		loggerFrom(ctx).Warn("ignoring billing event for unknown user", "event_id", event.ID, "event_type", event.Type, "uid", change.UID)
+		return false, nil
+	}
+	if err != nil {
+		// forget the event so that the provider's retry is not mistaken for a duplicate
+		if forgetErr := store.ForgetEvent(ctx, event.ID); forgetErr != nil {
+			return false, fmt.Errorf("error while updating subscription (%v) and while forgetting billing event (%s): %w", err, event.ID, forgetErr)
+		}
+		return false, fmt.Errorf("error while trying to update subscription for user (uid: %s): %w", change.UID, err)
+	}
+	if !updated {
+		loggerFrom(ctx).Info("ignoring billing event older than the last subscription change", "event_id", event.ID, "event_type", event.Type, "uid", change.UID)
+	}
+
+	return updated, nil
+}
+
+// subscriptionChangeFromEvent maps an event onto the user's new tier and expiry. A nil change means the event is ignored
+func subscriptionChangeFromEvent(event *billingEvent) (*subscriptionChange, error) {
+	switch event.Type {
+	case "checkout.session.completed":
+		session := &billingCheckoutSession{}
+		if err := json.Unmarshal(event.Data.Object, session); err != nil {
+			return nil, fmt.Errorf("error decoding checkout session of event (%s): %w", event.ID, err)
+		}
+		if session.Mode != "subscription" || session.PaymentStatus != "paid" {
+			return nil, nil
+		}
+		if session.ClientReferenceID == "" {
+			return nil, fmt.Errorf("checkout session of event (%s) has no client_reference_id", event.ID)
+		}
+
+		tier, err := tierFromMetadata(session.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("checkout session of event (%s): %w", event.ID, err)
+		}
+
+		// a checkout session does not carry the expiry, which the customer.subscription.created event of the same
+		// subscription does. Until then an expiry that passed before the checkout is cleared, see subscriptionUpdates
+		return &subscriptionChange{
+			UID:          session.ClientReferenceID,
+			Tier:         tier,
+			EventCreated: time.Unix(event.Created, 0).UTC(),
+		}, nil
+
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		sub := &billingSubscription{}
+		if err := json.Unmarshal(event.Data.Object, sub); err != nil {
+			return nil, fmt.Errorf("error decoding subscription of event (%s): %w", event.ID, err)
+		}
+		uid := sub.Metadata["uid"]
+		if uid == "" {
+			return nil, fmt.Errorf("subscription (%s) of event (%s) has no uid within its metadata", sub.ID, event.ID)
+		}
+
+		if event.Type != "customer.subscription.deleted" && (sub.Status == "active" || sub.Status == "trialing" || sub.Status == "past_due") {
+			tier, err := tierFromMetadata(sub.Metadata)
+			if err != nil {
+				return nil, fmt.Errorf("subscription (%s) of event (%s): %w", sub.ID, event.ID, err)
+			}
+			return &subscriptionChange{
+				UID:          uid,
+				Tier:         tier,
+				ExpiresAt:    time.Unix(sub.CurrentPeriodEnd, 0).UTC(),
+				EventCreated: time.Unix(event.Created, 0).UTC(),
+			}, nil
+		}
+
+		// cancelled, unpaid or deleted subscriptions drop the user back onto the free tier
+		endedAt := time.Unix(event.Created, 0).UTC()
+		if sub.EndedAt != 0 {
+			endedAt = time.Unix(sub.EndedAt, 0).UTC()
+		}
+		return &subscriptionChange{
+			UID:          uid,
+			Tier:         freeSubscriptionTier,
+			ExpiresAt:    endedAt,
+			EventCreated: time.Unix(event.Created, 0).UTC(),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// tierFromMetadata returns the paid tier named by the "tier" metadata, Premium when it is missing. Any other tier is
+// rejected rather than stored, as nothing else in the service would know what it allows
+func tierFromMetadata(metadata map[string]string) (string, error) {
+	switch tier := metadata["tier"]; tier {
+	case "":
+		return premiumSubscriptionTier, nil
+	case premiumSubscriptionTier:
+		return tier, nil
+	default:
+		return "", fmt.Errorf("unknown subscription tier %q within metadata", tier)
+	}
+}
+
+// effectiveSubscriptionTier treats a paid tier whose expiry has passed as the free tier, in case a cancellation webhook never arrived
+func effectiveSubscriptionTier(settings map[string]interface{}, now time.Time) interface{} {
+	tier := settings["SubscriptionTier"]
+	if tier == freeSubscriptionTier {
+		return tier
+	}
+
+	if expiresAt, ok := settings["SubscriptionExpiresAt"].(time.Time); ok && !expiresAt.IsZero() && now.After(expiresAt) {
+		return freeSubscriptionTier
+	}
+
+	return tier
+}
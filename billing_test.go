@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "whsec_test_secret"
+
+// fakeBillingStore keeps billing state in memory so idempotency can be checked without Firestore
+type fakeBillingStore struct {
+	events    map[string]string
+	changes   []*subscriptionChange
+	updateErr error
+}
+
+func newFakeBillingStore() *fakeBillingStore {
+	return &fakeBillingStore{events: map[string]string{}}
+}
+
+func (s *fakeBillingStore) RecordEvent(_ context.Context, eventID, eventType string) (bool, error) {
+	if _, ok := s.events[eventID]; ok {
+		return false, nil
+	}
+	s.events[eventID] = eventType
+	return true, nil
+}
+
+func (s *fakeBillingStore) ForgetEvent(_ context.Context, eventID string) error {
+	delete(s.events, eventID)
+	return nil
+}
+
+func (s *fakeBillingStore) UpdateSubscription(_ context.Context, change *subscriptionChange) (bool, error) {
+	if s.updateErr != nil {
+		return false, s.updateErr
+	}
+	s.changes = append(s.changes, change)
+	return true, nil
+}
+
+func loadBillingFixture(t *testing.T, name string) (*billingEvent, []byte) {
+	t.Helper()
+
+	payload, err := os.ReadFile("testdata/billing/" + name)
+	if err != nil {
+		t.Fatalf("failed to read fixture %s: %v", name, err)
+	}
+
+	event := &billingEvent{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		t.Fatalf("failed to decode fixture %s: %v", name, err)
+	}
+
+	return event, payload
+}
+
+func signBillingPayload(payload []byte, secret string, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(computeBillingSignature(payload, timestamp, secret)))
+}
+
+func TestVerifyBillingSignature(t *testing.T) {
+	_, payload := loadBillingFixture(t, "checkout_session_completed.json")
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		payload []byte
+		header  string
+		wantErr bool
+	}{
+		{"valid signature", payload, signBillingPayload(payload, testWebhookSecret, now), false},
+		{"valid signature among rotated secrets", payload, signBillingPayload(payload, "whsec_old", now) + ",v1=" + hex.EncodeToString(computeBillingSignature(payload, strconv.FormatInt(now.Unix(), 10), testWebhookSecret)), false},
+		{"wrong secret", payload, signBillingPayload(payload, "whsec_wrong", now), true},
+		{"tampered payload", append(bytes.Clone(payload), ' '), signBillingPayload(payload, testWebhookSecret, now), true},
+		{"replayed signature", payload, signBillingPayload(payload, testWebhookSecret, now.Add(-time.Hour)), true},
+		{"missing header", payload, "", true},
+		{"malformed header", payload, "v1=deadbeef", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyBillingSignature(tt.payload, tt.header, testWebhookSecret, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyBillingSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubscriptionChangeFromEvent(t *testing.T) {
+	uid := "D4YNgGufhgfnlTJI1Zg1lL9nhS42"
+
+	tests := []struct {
+		fixture string
+		want    *subscriptionChange
+	}{
+		{"checkout_session_completed.json", &subscriptionChange{UID: uid, Tier: premiumSubscriptionTier}},
+		{"customer_subscription_created.json", &subscriptionChange{UID: uid, Tier: premiumSubscriptionTier, ExpiresAt: time.Unix(1746057600, 0).UTC()}},
+		{"customer_subscription_updated.json", &subscriptionChange{UID: uid, Tier: premiumSubscriptionTier, ExpiresAt: time.Unix(1738368000, 0).UTC()}},
+		{"customer_subscription_updated_unpaid.json", &subscriptionChange{UID: uid, Tier: freeSubscriptionTier, ExpiresAt: time.Unix(1738972800, 0).UTC()}},
+		{"customer_subscription_deleted.json", &subscriptionChange{UID: uid, Tier: freeSubscriptionTier, ExpiresAt: time.Unix(1740787200, 0).UTC()}},
+		{"invoice_paid.json", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			event, _ := loadBillingFixture(t, tt.fixture)
+
+			got, err := subscriptionChangeFromEvent(event)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("expected event to be ignored, got %+v", got)
+				}
+				return
+			}
+
+			if got == nil || got.UID != tt.want.UID || got.Tier != tt.want.Tier || !got.ExpiresAt.Equal(tt.want.ExpiresAt) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSubscriptionChangeFromEvent_UnknownTier(t *testing.T) {
+	for _, fixture := range []string{"checkout_session_completed.json", "customer_subscription_updated.json"} {
+		t.Run(fixture, func(t *testing.T) {
+			event, _ := loadBillingFixture(t, fixture)
+			event.Data.Object = bytes.Replace(event.Data.Object, []byte(`"tier": "Premium"`), []byte(`"tier": "Platinum"`), 1)
+
+			if _, err := subscriptionChangeFromEvent(event); err == nil {
+				t.Errorf("expected an error for a tier the service does not know")
+			}
+		})
+	}
+}
+
+func TestProcessBillingEvent_Idempotent(t *testing.T) {
+	store := newFakeBillingStore()
+	event, _ := loadBillingFixture(t, "customer_subscription_updated.json")
+
+	applied, err := processBillingEvent(context.Background(), store, event)
+	if err != nil || !applied {
+		t.Fatalf("expected first delivery to be applied, got applied=%v err=%v", applied, err)
+	}
+
+	applied, err = processBillingEvent(context.Background(), store, event)
+	if err != nil || applied {
+		t.Fatalf("expected redelivery to be ignored, got applied=%v err=%v", applied, err)
+	}
+
+	if len(store.changes) != 1 {
+		t.Errorf("expected exactly one subscription update, got %d", len(store.changes))
+	}
+}
+
+func TestProcessBillingEvent_FailedUpdateCanBeRetried(t *testing.T) {
+	store := newFakeBillingStore()
+	store.updateErr = fmt.Errorf("firestore unavailable")
+	event, _ := loadBillingFixture(t, "customer_subscription_deleted.json")
+
+	if _, err := processBillingEvent(context.Background(), store, event); err == nil {
+		t.Fatalf("expected an error when the subscription update fails")
+	}
+
+	if _, ok := store.events[event.ID]; ok {
+		t.Fatalf("expected failed event to be forgotten so that it can be retried")
+	}
+
+	store.updateErr = nil
+	applied, err := processBillingEvent(context.Background(), store, event)
+	if err != nil || !applied {
+		t.Errorf("expected retried event to be applied, got applied=%v err=%v", applied, err)
+	}
+}
+
+func TestProcessBillingEvent_UnknownUserIsAcknowledged(t *testing.T) {
+	store := &storageBillingStore{store: newMemoryStorage()}
+	event, _ := loadBillingFixture(t, "checkout_session_completed.json")
+
+	applied, err := processBillingEvent(context.Background(), store, event)
+	if err != nil || applied {
+		t.Fatalf("expected the event of an unknown user to be acknowledged without applying it, got applied=%v err=%v", applied, err)
+	}
+	if recorded, _ := store.RecordEvent(context.Background(), event.ID, event.Type); recorded {
+		t.Errorf("expected the event to stay recorded, so that its redeliveries are duplicates")
+	}
+}
+
+func TestProcessBillingEvent_IgnoresOlderEvents(t *testing.T) {
+	memory := newMemoryStorage()
+	store := &storageBillingStore{store: memory}
+	uid := "D4YNgGufhgfnlTJI1Zg1lL9nhS42"
+	if err := memory.CreateUserDocument(context.Background(), newUserDocument(uid, []string{passwordProvider})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the cancellation arrives before the checkout that started the subscription it cancels
+	deleted, _ := loadBillingFixture(t, "customer_subscription_deleted.json")
+	checkout, _ := loadBillingFixture(t, "checkout_session_completed.json")
+	if applied, err := processBillingEvent(context.Background(), store, deleted); err != nil || !applied {
+		t.Fatalf("expected the cancellation to be applied, got applied=%v err=%v", applied, err)
+	}
+	if applied, err := processBillingEvent(context.Background(), store, checkout); err != nil || applied {
+		t.Fatalf("expected the older checkout to be ignored, got applied=%v err=%v", applied, err)
+	}
+
+	user, err := memory.GetUserDocument(context.Background(), uid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	settings := user["Settings"].(map[string]interface{})
+	if settings["SubscriptionTier"] != freeSubscriptionTier || !settings["SubscriptionUpdatedAt"].(time.Time).Equal(time.Unix(deleted.Created, 0)) {
+		t.Errorf("expected the cancelled user to stay on the free tier, got %v", settings)
+	}
+}
+
+func TestProcessBillingEvent_Resubscribe(t *testing.T) {
+	memory := newMemoryStorage()
+	store := &storageBillingStore{store: memory}
+	uid := "D4YNgGufhgfnlTJI1Zg1lL9nhS42"
+	if err := memory.CreateUserDocument(context.Background(), newUserDocument(uid, []string{passwordProvider})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	settings := func() map[string]interface{} {
+		user, err := memory.GetUserDocument(context.Background(), uid)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return user["Settings"].(map[string]interface{})
+	}
+
+	deleted, _ := loadBillingFixture(t, "customer_subscription_deleted.json")
+	checkout, _ := loadBillingFixture(t, "checkout_session_completed_resubscribe.json")
+	created, _ := loadBillingFixture(t, "customer_subscription_created.json")
+
+	if applied, err := processBillingEvent(context.Background(), store, deleted); err != nil || !applied {
+		t.Fatalf("expected the cancellation to be applied, got applied=%v err=%v", applied, err)
+	}
+	if applied, err := processBillingEvent(context.Background(), store, checkout); err != nil || !applied {
+		t.Fatalf("expected the checkout to be applied, got applied=%v err=%v", applied, err)
+	}
+
+	// the expiry of the cancelled subscription must not outlive the checkout of the new one
+	resubscribedAt := time.Unix(checkout.Created, 0).Add(time.Second)
+	if tier := effectiveSubscriptionTier(settings(), resubscribedAt); tier != premiumSubscriptionTier {
+		t.Errorf("expected the re-subscribed user to be on the premium tier, got %v (settings: %v)", tier, settings())
+	}
+
+	if applied, err := processBillingEvent(context.Background(), store, created); err != nil || !applied {
+		t.Fatalf("expected the new subscription to be applied, got applied=%v err=%v", applied, err)
+	}
+	if expiresAt := settings()["SubscriptionExpiresAt"].(time.Time); !expiresAt.Equal(time.Unix(1746057600, 0)) {
+		t.Errorf("expected the expiry of the new subscription, got %v", expiresAt)
+	}
+	if tier := effectiveSubscriptionTier(settings(), resubscribedAt); tier != premiumSubscriptionTier {
+		t.Errorf("expected the re-subscribed user to be on the premium tier, got %v", tier)
+	}
+}
+
+func TestEffectiveSubscriptionTier(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		want     interface{}
+	}{
+		{"free tier", map[string]interface{}{"SubscriptionTier": freeSubscriptionTier}, freeSubscriptionTier},
+		{"paid tier without expiry", map[string]interface{}{"SubscriptionTier": premiumSubscriptionTier}, premiumSubscriptionTier},
+		{"paid tier before expiry", map[string]interface{}{"SubscriptionTier": premiumSubscriptionTier, "SubscriptionExpiresAt": now.Add(time.Hour)}, premiumSubscriptionTier},
+		{"paid tier after expiry", map[string]interface{}{"SubscriptionTier": premiumSubscriptionTier, "SubscriptionExpiresAt": now.Add(-time.Hour)}, freeSubscriptionTier},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := effectiveSubscriptionTier(tt.settings, now); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBillingWebhookEndpoint(t *testing.T) {
+	_, payload := loadBillingFixture(t, "checkout_session_completed.json")
+
+	tests := []struct {
+		name       string
+		secret     string
+		signature  string
+		wantStatus int
+	}{
+		{"not configured", "", signBillingPayload(payload, testWebhookSecret, time.Now()), http.StatusServiceUnavailable},
+		{"bad signature", testWebhookSecret, signBillingPayload(payload, "whsec_wrong", time.Now()), http.StatusBadRequest},
+		{"valid signature, firebase nil", testWebhookSecret, signBillingPayload(payload, testWebhookSecret, time.Now()), http.StatusInternalServerError},
+		{"valid signature, unknown user", testWebhookSecret, signBillingPayload(payload, testWebhookSecret, time.Now()), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := getTestRouter()
+			if tt.wantStatus == http.StatusOK {
+				r = getMemoryTestRouter(newMemoryStorage())
+			}
+			r.config.billingWebhookSecret = tt.secret
+
+			req := httptest.NewRequest("POST", "/api/v1/billing/webhook", bytes.NewReader(payload))
+			req.Header.Set("Stripe-Signature", tt.signature)
+			w := httptest.NewRecorder()
+
+			r.BillingWebhook(w, req)
+
+			resp := w.Result()
+			defer func() {
+				err := resp.Body.Close()
+				if err != nil {
+					log.Fatal(err)
+				}
+			}()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
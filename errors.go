@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCode is a stable, machine-readable identifier for a failure. Clients should branch on these rather than on messages
+type errorCode string
+
+const (
+	codeInvalidJSON      errorCode = "invalid_json"
+	codeInvalidSignature errorCode = "invalid_signature"
+	codeBodyTooLarge     errorCode = "body_too_large"
+	codeInvalidToken     errorCode = "invalid_token"
+	codeTokenExpired     errorCode = "token_expired"
+	codeForbidden        errorCode = "forbidden"
+	codeCSRFFailed       errorCode = "csrf_failed"
+	codeNotFound         errorCode = "not_found"
+	codeAlreadyExists    errorCode = "already_exists"
+	codeQuotaExceeded    errorCode = "quota_exceeded"
+	codeValidationFailed errorCode = "validation_failed"
+	codeUnavailable      errorCode = "unavailable"
+	codeTimeout          errorCode = "timeout"
+	codeRateLimited      errorCode = "rate_limited"
+	codeInternal         errorCode = "internal"
+)
+
+// sentinel errors returned by the storage and auth helpers, which handlers map onto an apiError with toAPIError
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrForbidden     = errors.New("forbidden")
+	ErrInvalidToken  = errors.New("invalid id token")
+	ErrTokenExpired  = errors.New("id token has expired")
+	ErrRateLimited   = errors.New("rate limit exceeded")
+	// ErrUnavailable is a failure of a service the server relies on, e.g. the Identity Toolkit
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// fieldError describes why a single field of a request was rejected
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// apiError is the body of every failed response. Message is serialized as "error" so that older clients,
+// which only ever read a string from that key, keep working
+type apiError struct {
+	Status  int          `json:"-"`
+	Code    errorCode    `json:"code"`
+	Message string       `json:"error"`
+	Details []fieldError `json:"details,omitempty"`
+	// RequestID is set on server errors, whose cause is only logged, so that a report can be matched to the logs
+	RequestID string `json:"requestId,omitempty"`
+	cause     error
+}
+
+func (e *apiError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.cause)
+	}
+	return e.Message
+}
+
+func (e *apiError) Unwrap() error {
+	return e.cause
+}
+
+func newAPIError(status int, code errorCode, message string) *apiError {
+	return &apiError{Status: status, Code: code, Message: message}
+}
+
+func invalidJSONError(err error) *apiError {
+	return &apiError{
+		Status:  http.StatusBadRequest,
+		Code:    codeInvalidJSON,
+		Message: fmt.Sprintf("request body is not valid JSON: %v", err),
+		cause:   err,
+	}
+}
+
+func validationError(details ...fieldError) *apiError {
+	return &apiError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    codeValidationFailed,
+		Message: "request failed validation",
+		Details: details,
+	}
+}
+
+// toAPIError maps any error returned by a handler's dependencies onto the status, code and message the client sees.
+// The message is fixed per code, as the wrapped chain may name Firestore paths, uids or the text of Firebase errors.
+// The chain stays the cause of the apiError, which is only ever logged
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	mapped := &apiError{cause: err}
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		mapped.Status, mapped.Code = http.StatusUnauthorized, codeTokenExpired
+		mapped.Message = "the idToken has expired, refresh it and retry"
+	case errors.Is(err, ErrInvalidToken):
+		mapped.Status, mapped.Code = http.StatusUnauthorized, codeInvalidToken
+		mapped.Message = "the idToken is not valid"
+	case errors.Is(err, ErrForbidden):
+		mapped.Status, mapped.Code = http.StatusForbidden, codeForbidden
+		mapped.Message = "not allowed to access the requested resource"
+	case errors.Is(err, ErrQuotaExceeded):
+		mapped.Status, mapped.Code = http.StatusForbidden, codeQuotaExceeded
+		mapped.Message = "the subscription tier of the user does not allow this request"
+	case errors.Is(err, ErrNotFound):
+		mapped.Status, mapped.Code = http.StatusNotFound, codeNotFound
+		mapped.Message = "the requested resource was not found"
+	case errors.Is(err, ErrAlreadyExists):
+		mapped.Status, mapped.Code = http.StatusConflict, codeAlreadyExists
+		mapped.Message = "the resource already exists"
+	case errors.Is(err, ErrRateLimited):
+		mapped.Status, mapped.Code = http.StatusTooManyRequests, codeRateLimited
+		mapped.Message = "too many requests, retry after the seconds of the Retry-After header"
+	case errors.Is(err, context.DeadlineExceeded), status.Code(err) == codes.DeadlineExceeded:
+		// the route's deadline passed before storage answered
+		mapped.Status, mapped.Code = http.StatusGatewayTimeout, codeTimeout
+		mapped.Message = "the request's deadline passed before the database answered"
+	case errors.Is(err, ErrUnavailable):
+		mapped.Status, mapped.Code = http.StatusServiceUnavailable, codeUnavailable
+		mapped.Message = "a service this request relies on is unavailable, try again later"
+	default:
+		mapped.Status, mapped.Code = http.StatusInternalServerError, codeInternal
+		mapped.Message = "internal server error"
+	}
+
+	return mapped
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToAPIError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   errorCode
+	}{
+		{"expired token", fmt.Errorf("minting: %w", ErrTokenExpired), http.StatusUnauthorized, codeTokenExpired},
+		{"invalid token", fmt.Errorf("minting: %w", ErrInvalidToken), http.StatusUnauthorized, codeInvalidToken},
+		{"forbidden", fmt.Errorf("routine is someone else's: %w", ErrForbidden), http.StatusForbidden, codeForbidden},
+		{"quota exceeded", fmt.Errorf("free tier: %w", ErrQuotaExceeded), http.StatusForbidden, codeQuotaExceeded},
+		{"not found", fmt.Errorf("wrapped twice: %w", fmt.Errorf("no user: %w", ErrNotFound)), http.StatusNotFound, codeNotFound},
+		{"already exists", fmt.Errorf("email taken: %w", ErrAlreadyExists), http.StatusConflict, codeAlreadyExists},
+		{"invalid json", invalidJSONError(fmt.Errorf("unexpected EOF")), http.StatusBadRequest, codeInvalidJSON},
+		{"validation", validationError(fieldError{Field: "email", Message: "required"}), http.StatusUnprocessableEntity, codeValidationFailed},
+		{"wrapped api error", fmt.Errorf("context: %w", invalidJSONError(fmt.Errorf("bad"))), http.StatusBadRequest, codeInvalidJSON},
+		{"unknown error", fmt.Errorf("firestore unavailable"), http.StatusInternalServerError, codeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toAPIError(tt.err)
+			if got.Status != tt.wantStatus || got.Code != tt.wantCode {
+				t.Errorf("expected %d %s, got %d %s", tt.wantStatus, tt.wantCode, got.Status, got.Code)
+			}
+		})
+	}
+}
+
+func TestToAPIError_KeepsChainOutOfMessage(t *testing.T) {
+	for _, sentinel := range []error{ErrTokenExpired, ErrInvalidToken, ErrForbidden, ErrQuotaExceeded, ErrNotFound, ErrAlreadyExists, ErrRateLimited, ErrUnavailable} {
+		t.Run(sentinel.Error(), func(t *testing.T) {
+			err := fmt.Errorf("error while reading users/abc123 of uid-1: %w", fmt.Errorf("firebase: EMAIL_EXISTS: %w", sentinel))
+
+			got := toAPIError(err)
+			if strings.Contains(got.Message, "uid-1") || strings.Contains(got.Message, "users/abc123") || strings.Contains(got.Message, "EMAIL_EXISTS") {
+				t.Errorf("expected a fixed message, got %q", got.Message)
+			}
+			if got.Message != toAPIError(sentinel).Message {
+				t.Errorf("expected the message of the code whatever wraps it, got %q and %q", got.Message, toAPIError(sentinel).Message)
+			}
+			if !errors.Is(got, sentinel) {
+				t.Errorf("expected the chain to stay the cause of the error")
+			}
+		})
+	}
+}
+
+func TestStatusError_WritesCodeAndDetails(t *testing.T) {
+	r := getTestRouter()
+	w := httptest.NewRecorder()
+
+	r.StatusError(w, httptest.NewRequest("GET", "/test", nil), "test endpoint", validationError(fieldError{Field: "routineName", Message: "must not be empty"}))
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422, got %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Error   string       `json:"error"`
+		Code    errorCode    `json:"code"`
+		Details []fieldError `json:"details"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+
+	if result.Error == "" {
+		t.Errorf("expected a human readable error message")
+	}
+	if result.Code != codeValidationFailed {
+		t.Errorf("expected code %s, got %s", codeValidationFailed, result.Code)
+	}
+	if len(result.Details) != 1 || result.Details[0].Field != "routineName" {
+		t.Errorf("unexpected details: %+v", result.Details)
+	}
+}
+
+func TestStatusError_HidesInternalErrors(t *testing.T) {
+	r := getTestRouter()
+	w := httptest.NewRecorder()
+	w.Header().Set(requestIDHeader, "req-1")
+
+	cause := fmt.Errorf("error while iterating through users/abc123 of uid-1: %w", fmt.Errorf("rpc error: code = Internal"))
+	r.StatusError(w, httptest.NewRequest("GET", "/test", nil), "test endpoint", cause)
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d", resp.StatusCode)
+	}
+	result := apiError{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if result.Message != "internal server error" || result.RequestID != "req-1" {
+		t.Errorf("expected a generic message with the request ID, got %+v", result)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// muscleGroupNames names the MuscleGroup values of ExerciseDoc
+var muscleGroupNames = []string{
+	"chest", "back", "biceps", "triceps", "front delts", "side delts", "rear delts",
+	"abs", "quads", "hamstrings", "calves", "forearms",
+}
+
+const (
+	imperialUnits = "Imperial"
+	// poundsPerKilogram converts the weights of workout logs, which are stored in kilograms, for users preferring
+	// imperial units
+	poundsPerKilogram = 2.2046226218
+)
+
+// csvExportHeader are the columns of the CSV export, which has one row per set. Rows of routines leave performed_at
+// empty, rows of logged workouts leave the routine columns empty
+var csvExportHeader = []string{
+	"routine_name", "routine_created_at", "workout_name", "exercise_name", "muscle_group",
+	"set_number", "reps", "weight", "unit", "is_warm_up", "is_drop_set", "performed_at",
+}
+
+func muscleGroupName(muscleGroup int) string {
+	if muscleGroup < 0 || muscleGroup >= len(muscleGroupNames) {
+		return "unknown"
+	}
+	return muscleGroupNames[muscleGroup]
+}
+
+// weightUnit returns the unit weights are exported in for the user's units preference, and the factor converting
+// the kilograms of a workout log into it. Routines hold weights in that unit already, as the user typed them
+func weightUnit(unitsPreference string) (string, float64) {
+	if unitsPreference == imperialUnits {
+		return "lb", poundsPerKilogram
+	}
+	return "kg", 1
+}
+
+// csvSafe stops spreadsheet applications from evaluating a user-entered name as a formula
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// ExportCSV streams every set of every routine and every logged workout of the user as CSV, with weights in the user's
+// units preference
+func (rtr *router) ExportCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	uid := r.PathValue("uid")
+	idToken := r.PathValue("idToken")
+
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "export csv", err)
+		return
+	}
+
+	var userDocument map[string]interface{}
+	err := rtr.withProfile(r.Context(), uid, func() (err error) {
+		userDocument, err = rtr.config.store.GetUserDocument(r.Context(), uid)
+		return err
+	})
+	if err != nil {
+		rtr.StatusError(w, r, "export csv", fmt.Errorf("error while trying to fetch user profile: %w", err))
+		return
+	}
+	profile, err := userProfileFromDocument(userDocument)
+	if err != nil {
+		rtr.StatusError(w, r, "export csv", err)
+		return
+	}
+
+	routines, err := userRoutines(r.Context(), rtr.config.store, uid)
+	if err != nil {
+		rtr.StatusError(w, r, "export csv", err)
+		return
+	}
+	workoutLogs, err := userWorkoutLogs(r.Context(), rtr.config.store, uid)
+	if err != nil {
+		rtr.StatusError(w, r, "export csv", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="repetiswole-export-%s.csv"`, time.Now().UTC().Format(time.DateOnly)))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := writeCSVExport(w, routines, workoutLogs, profile.Settings.UnitsPreference); err != nil {
+		// the status has been written, all that is left is to stop and log
+		loggerFrom(r.Context()).Error("error while writing csv export", "error", err.Error())
+	}
+}
+
+// userRoutines fetches and decodes every routine of the user, oldest first
+func userRoutines(ctx context.Context, store storage, uid string) ([]*RoutineResponse, error) {
+	routineDocuments, err := store.GetUserRoutines(ctx, uid)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch user routines: %w", err)
+	}
+
+	routines := make([]*RoutineResponse, 0, len(routineDocuments))
+	for _, routineDocument := range routineDocuments {
+		refId, _ := routineDocument["RefId"].(string)
+		routine, err := routineFromDocument(refId, routineDocument)
+		if err != nil {
+			return nil, err
+		}
+		routines = append(routines, routine)
+	}
+
+	sort.SliceStable(routines, func(i, j int) bool {
+		if !routines[i].CreatedAt.Equal(routines[j].CreatedAt) {
+			return routines[i].CreatedAt.Before(routines[j].CreatedAt)
+		}
+		return routines[i].RoutineName < routines[j].RoutineName
+	})
+	return routines, nil
+}
+
+// userWorkoutLogs fetches and decodes every workout log of the user, oldest first
+func userWorkoutLogs(ctx context.Context, store storage, uid string) ([]ArchiveWorkoutLog, error) {
+	logDocuments, err := store.GetWorkoutLogs(ctx, uid)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch workout logs: %w", err)
+	}
+
+	workoutLogs := make([]ArchiveWorkoutLog, 0, len(logDocuments))
+	for _, logDocument := range logDocuments {
+		workoutLog := ArchiveWorkoutLog{}
+		if err := decodeDocument(logDocument, &workoutLog); err != nil {
+			return nil, err
+		}
+		workoutLogs = append(workoutLogs, workoutLog)
+	}
+
+	sort.SliceStable(workoutLogs, func(i, j int) bool {
+		return workoutLogs[i].PerformedAt.Before(workoutLogs[j].PerformedAt)
+	})
+	return workoutLogs, nil
+}
+
+// writeCSVExport writes one row per set, routines first and then workout logs, flushing after every routine and every
+// log so that large exports stream to the client. Only the weights of workout logs are converted, see weightUnit
+func writeCSVExport(w http.ResponseWriter, routines []*RoutineResponse, workoutLogs []ArchiveWorkoutLog, unitsPreference string) error {
+	unit, factor := weightUnit(unitsPreference)
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(csvExportHeader); err != nil {
+		return fmt.Errorf("error while writing csv header: %w", err)
+	}
+
+	for _, routine := range routines {
+		for _, workout := range routine.Workouts {
+			for _, exercise := range workout.Exercises {
+				for i, set := range exercise.Sets {
+					err := cw.Write([]string{
+						csvSafe(routine.RoutineName),
+						routine.CreatedAt.UTC().Format(time.RFC3339),
+						csvSafe(workout.WorkoutName),
+						csvSafe(exercise.ExerciseName),
+						muscleGroupName(exercise.MuscleGroup),
+						strconv.Itoa(i + 1),
+						strconv.Itoa(set.Reps),
+						strconv.FormatFloat(set.Weight, 'f', -1, 64),
+						unit,
+						strconv.FormatBool(set.IsWarmUp),
+						strconv.FormatBool(set.IsDropSet),
+						"",
+					})
+					if err != nil {
+						return fmt.Errorf("error while writing csv row of routine (%s): %w", routine.RefId, err)
+					}
+				}
+			}
+		}
+
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("error while flushing csv rows of routine (%s): %w", routine.RefId, err)
+		}
+		// middlewares wrap the ResponseWriter, the ResponseController unwraps them to reach the connection
+		_ = http.NewResponseController(w).Flush()
+	}
+
+	for _, workoutLog := range workoutLogs {
+		for _, exercise := range workoutLog.Exercises {
+			for i, set := range exercise.Sets {
+				err := cw.Write([]string{
+					"",
+					"",
+					csvSafe(workoutLog.WorkoutName),
+					csvSafe(exercise.ExerciseName),
+					muscleGroupName(exercise.MuscleGroup),
+					strconv.Itoa(i + 1),
+					strconv.Itoa(set.Reps),
+					strconv.FormatFloat(roundWeight(set.Weight*factor), 'f', -1, 64),
+					unit,
+					strconv.FormatBool(set.IsWarmUp),
+					strconv.FormatBool(set.IsDropSet),
+					workoutLog.PerformedAt.UTC().Format(time.RFC3339),
+				})
+				if err != nil {
+					return fmt.Errorf("error while writing csv row of workout log (%s): %w", workoutLog.RefId, err)
+				}
+			}
+		}
+
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("error while flushing csv rows of workout log (%s): %w", workoutLog.RefId, err)
+		}
+		_ = http.NewResponseController(w).Flush()
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// roundWeight rounds a converted weight to two decimals, e.g. 100 kg to 220.46 lb
+func roundWeight(weight float64) float64 {
+	return math.Round(weight*100) / 100
+}
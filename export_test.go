@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// seedRoutine stores a routine of uid holding the given workouts, returning its ID
+func seedRoutine(t *testing.T, store *memoryStorage, uid, name string, createdAt time.Time, workouts []map[string]interface{}) string {
+	t.Helper()
+
+	id, err := store.CreateRoutineDocument(context.Background(), uid, name, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = store.UpdateOneUserRoutine(context.Background(), id, map[string]interface{}{
+		"RoutineName": name,
+		"UID":         uid,
+		"CreatedAt":   createdAt,
+		"Workouts":    workouts,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return id
+}
+
+func TestExportCSV(t *testing.T) {
+	store := newMemoryStorage()
+	err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1", Settings: UserDocumentSettings{UnitsPreference: imperialUnits}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	createdAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	seedRoutine(t, store, "uid-1", "Push Day", createdAt, []map[string]interface{}{{
+		"WorkoutName": "Monday",
+		"Exercises": []map[string]interface{}{{
+			"MuscleGroup":  0,
+			"ExerciseName": "Bench Press",
+			"Sets": []map[string]interface{}{
+				{"Reps": 10, "Weight": 60, "IsWarmUp": true, "IsDropSet": false},
+				{"Reps": 5, "Weight": 100.5, "IsWarmUp": false, "IsDropSet": false},
+			},
+		}},
+	}})
+	seedRoutine(t, store, "uid-1", "=HYPERLINK()", createdAt.Add(time.Hour), []map[string]interface{}{{
+		"WorkoutName": "Tuesday",
+		"Exercises": []map[string]interface{}{{
+			"MuscleGroup":  8,
+			"ExerciseName": "Squat",
+			"Sets":         []map[string]interface{}{{"Reps": 8, "Weight": 80, "IsWarmUp": false, "IsDropSet": true}},
+		}},
+	}})
+	seedRoutine(t, store, "uid-2", "Someone else's", createdAt, nil)
+	err = store.CreateWorkoutLogDocuments(context.Background(), []*workoutLogWrite{{ID: "log-1", Log: &WorkoutLogDocument{
+		UID:         "uid-1",
+		WorkoutName: "Leg Day",
+		PerformedAt: time.Date(2024, 3, 6, 7, 30, 0, 0, time.UTC),
+		Source:      importFormatStrong,
+		Exercises:   []ExerciseDoc{{MuscleGroup: -1, ExerciseName: "Zottman Thing", Sets: []SetDoc{{Reps: 10, Weight: 12.5}}}},
+	}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rtr := getMemoryTestRouter(store)
+	w := httptest.NewRecorder()
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/user/export/csv/uid-1/uid-1", nil))
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("expected a csv content type, got %q", got)
+	}
+
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("error reading csv: %v", err)
+	}
+	want := [][]string{
+		csvExportHeader,
+		{"Push Day", "2024-03-01T12:00:00Z", "Monday", "Bench Press", "chest", "1", "10", "60", "lb", "true", "false", ""},
+		{"Push Day", "2024-03-01T12:00:00Z", "Monday", "Bench Press", "chest", "2", "5", "100.5", "lb", "false", "false", ""},
+		{"'=HYPERLINK()", "2024-03-01T13:00:00Z", "Tuesday", "Squat", "quads", "1", "8", "80", "lb", "false", "true", ""},
+		{"", "", "Leg Day", "Zottman Thing", "unknown", "1", "10", "27.56", "lb", "false", "false", "2024-03-06T07:30:00Z"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("expected rows %v, got %v", want, rows)
+	}
+}
+
+func TestExportCSV_Forbidden(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	w := httptest.NewRecorder()
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/user/export/csv/uid-1/uid-2", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 but got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected a json error, got %q", got)
+	}
+}
+
+func TestWeightUnit(t *testing.T) {
+	if unit, factor := weightUnit("Metric"); unit != "kg" || factor != 1 {
+		t.Errorf("expected kg, got %s (%v)", unit, factor)
+	}
+	if unit, _ := weightUnit(""); unit != "kg" {
+		t.Errorf("expected kg without a preference, got %s", unit)
+	}
+	if unit, factor := weightUnit(imperialUnits); unit != "lb" || roundWeight(100*factor) != 220.46 {
+		t.Errorf("expected lb, got %s (%v)", unit, factor)
+	}
+}
@@ -1,41 +1,56 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/auth"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type UserDocument struct {
-	UID         string
+	// SchemaVersion is the version of this struct the document was written with, see migrations.go
+	SchemaVersion int
+	UID           string
+	// Providers are the sign-in providers of the user's Firebase account, e.g. "password" or "google.com"
+	Providers   []string
 	CurrentGoal string
 	Metrics     UserDocumentMetrics
 	Settings    UserDocumentSettings
 }
 
+// UserDocumentMetrics are numbers, as profile updates accept fractions, e.g. a weight of 72.5
 type UserDocumentMetrics struct {
-	Height   int
+	Height   float64
 	JoinDate time.Time
-	Weight   int
+	Weight   float64
 }
 
 type UserDocumentSettings struct {
-	UnitsPreference  string
-	SubscriptionTier string
+	UnitsPreference       string
+	SubscriptionTier      string
+	SubscriptionExpiresAt time.Time
+	// SubscriptionUpdatedAt is when the billing event that last changed the subscription was created
+	SubscriptionUpdatedAt time.Time
 }
 
 type RoutineDocument struct {
-	RoutineName string
-	UID         string
-	CreatedAt   time.Time
-	Workouts    []WorkoutDoc
+	// SchemaVersion is the version of this struct the document was written with, see migrations.go
+	SchemaVersion int
+	RoutineName   string
+	UID           string
+	CreatedAt     time.Time
+	Workouts      []WorkoutDoc
 }
 
 type WorkoutDoc struct {
 	WorkoutName string
-	Excersices  []ExerciseDoc
+	Exercises   []ExerciseDoc
 }
 
 type ExerciseDoc struct {
@@ -45,45 +60,77 @@ type ExerciseDoc struct {
 }
 
 type SetDoc struct {
-	Reps      int
-	Weight    int
+	Reps int
+	// Weight of a workout log is in kilograms, whatever the user's units preference. Routines keep the weight as the
+	// user typed it, in their units preference
+	Weight    float64
 	IsDropSet bool
 	IsWarmUp  bool
 }
 
-func MintIdToken(rtr *router, idToken string) error {
-	if rtr.config.firebaseApp == nil {
-		return fmt.Errorf("error, firebase app is not initialized")
+// RoutineCounterDocument counts the routines of a user, within the routineCounters collection under their UID
+type RoutineCounterDocument struct {
+	UID   string
+	Count int
+}
+
+// WorkoutLogDocument is a workout the user performed, e.g. one imported from another app, within the workoutLogs collection
+type WorkoutLogDocument struct {
+	UID         string
+	WorkoutName string
+	PerformedAt time.Time
+	// Source is where the log came from, e.g. "strong" or "hevy"
+	Source    string
+	Exercises []ExerciseDoc
+}
+
+// MintIdToken verifies the idToken, or the session cookie should the idToken be "session", returning ErrTokenExpired
+// or ErrInvalidToken when the client should sign in again
+func MintIdToken(ctx context.Context, rtr *router, idToken string) (_ *auth.Token, err error) {
+	if idToken == sessionIdToken {
+		return verifySessionCookie(ctx, rtr)
 	}
 
-	client, err := rtr.config.firebaseApp.Auth(rtr.config.ctx)
+	ctx, span := startSpan(ctx, rtr.config.tracer(), "auth.VerifyIDToken")
+	defer func() { finishSpan(span, err) }()
+
+	client, err := rtr.config.idTokenVerifier()
 	if err != nil {
-		return fmt.Errorf("error initializing firebase auth client: %v", err)
+		return nil, fmt.Errorf("error initializing firebase auth client: %v", err)
 	}
 
 	// mint user id token to check if they have authoritative access to get the information
-	_, err = client.VerifyIDToken(rtr.config.ctx, idToken)
+	token, err := client.VerifyIDToken(ctx, idToken)
+	if auth.IsIDTokenExpired(err) {
+		return nil, fmt.Errorf("error minting user supplied idToken: %w", ErrTokenExpired)
+	}
+	if auth.IsIDTokenInvalid(err) {
+		return nil, fmt.Errorf("error minting user supplied idToken (%v): %w", err, ErrInvalidToken)
+	}
 	if err != nil {
-		return fmt.Errorf("error minting user supplied idToken: %v", err)
+		return nil, fmt.Errorf("error minting user supplied idToken: %w", err)
 	}
 
-	return nil
+	setRequestUID(ctx, token.UID)
+	return token, nil
+}
+
+// firestoreStorage implements storage on top of the Firestore client of the config
+type firestoreStorage struct {
+	config *config
 }
 
-func CreateUserDocument(rtr *router, userDoc *UserDocument) error {
-	client, err := rtr.config.firebaseApp.Firestore(rtr.config.ctx)
+func newFirestoreStorage(cfg *config) *firestoreStorage {
+	return &firestoreStorage{config: cfg}
+}
+
+func (s *firestoreStorage) CreateUserDocument(ctx context.Context, userDoc *UserDocument) error {
+	client, err := s.config.firestoreClient()
 	if err != nil {
 		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	defer func() {
-		err := client.Close()
-		if err != nil {
-			rtr.logger.Error("could not close firebase client")
-		}
-	}()
-
-	_, _, err = client.Collection("users").Add(rtr.config.ctx, userDoc)
+	_, _, err = client.Collection("users").Add(ctx, userDoc)
 
 	if err != nil {
 		return fmt.Errorf("error while trying to create new user document: %w", err)
@@ -92,20 +139,42 @@ func CreateUserDocument(rtr *router, userDoc *UserDocument) error {
 	return nil
 }
 
-func GetUserDocument(rtr *router, uid string) (map[string]interface{}, error) {
-	client, err := rtr.config.firebaseApp.Firestore(rtr.config.ctx)
+// CreateUserDocumentIfMissing looks the user up and creates their document within one transaction, so that concurrent
+// first requests create one document between them
+func (s *firestoreStorage) CreateUserDocumentIfMissing(ctx context.Context, userDoc *UserDocument) (bool, error) {
+	client, err := s.config.firestoreClient()
 	if err != nil {
-		return nil, fmt.Errorf("error while trying to initialize firestore client: %w", err)
+		return false, fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	defer func() {
-		err := client.Close()
-		if err != nil {
-			rtr.logger.Error("could not close firebase client")
+	created := false
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		created = false
+		existing, err := tx.Documents(client.Collection("users").Where("UID", "==", userDoc.UID).Limit(1)).GetAll()
+		if err != nil || len(existing) > 0 {
+			return err
 		}
-	}()
 
-	iter := client.Collection("users").Documents(rtr.config.ctx)
+		created = true
+		return tx.Create(client.Collection("users").NewDoc(), userDoc)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error while trying to create missing user document (uid: %s): %w", userDoc.UID, err)
+	}
+
+	return created, nil
+}
+
+func (s *firestoreStorage) GetUserDocument(ctx context.Context, uid string) (map[string]interface{}, error) {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	iter := client.Collection("users").Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "users", &scanned, time.Now())
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
@@ -115,28 +184,25 @@ func GetUserDocument(rtr *router, uid string) (map[string]interface{}, error) {
 			return nil, fmt.Errorf("error while iterating through the firestore user documents to retrieve documents: %w", err)
 		}
 
+		scanned++
 		if doc.Data()["UID"] == uid {
 			return doc.Data(), nil
 		}
 	}
 
-	return nil, fmt.Errorf("error, did not find associated user document for UID of %s within users collection", uid)
+	return nil, fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", uid, ErrNotFound)
 }
 
-func UpdateUserDocument(rtr *router, uid string, requestedUpdates map[string]interface{}) error {
-	client, err := rtr.config.firebaseApp.Firestore(rtr.config.ctx)
+func (s *firestoreStorage) UpdateUserDocument(ctx context.Context, uid string, requestedUpdates map[string]interface{}) error {
+	client, err := s.config.firestoreClient()
 	if err != nil {
 		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	defer func() {
-		err := client.Close()
-		if err != nil {
-			rtr.logger.Error("could not close firebase client")
-		}
-	}()
-
-	iter := client.Collection("users").Documents(rtr.config.ctx)
+	iter := client.Collection("users").Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "users", &scanned, time.Now())
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
@@ -146,6 +212,7 @@ func UpdateUserDocument(rtr *router, uid string, requestedUpdates map[string]int
 			return fmt.Errorf("error while iterating through the firestore user documents to retrieve documents: %w", err)
 		}
 
+		scanned++
 		if doc.Data()["UID"] == uid {
 			docRef := client.Collection("users").Doc(doc.Ref.ID)
 			formattedUpdates := []firestore.Update{}
@@ -153,80 +220,196 @@ func UpdateUserDocument(rtr *router, uid string, requestedUpdates map[string]int
 				formattedUpdates = append(formattedUpdates, firestore.Update{Path: key, Value: val})
 			}
 
-			if _, err = docRef.Update(rtr.config.ctx, formattedUpdates); err != nil {
-				return fmt.Errorf("error while triyng to insert updates for user with UID (%s): %v", uid, err)
+			if _, err = docRef.Update(ctx, formattedUpdates); err != nil {
+				return fmt.Errorf("error while triyng to insert updates for user with UID (%s): %w", uid, err)
 			}
 
 			return nil
 		}
 	}
 
-	return fmt.Errorf("error, did not find associated user document for UID of %s within users collection", uid)
+	return fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", uid, ErrNotFound)
 }
 
-func CreateRoutineDocument(rtr *router, uid, routineName string) error {
-	client, err := rtr.config.firebaseApp.Firestore(rtr.config.ctx)
+func (s *firestoreStorage) GetAllUsers(ctx context.Context) ([]map[string]interface{}, error) {
+	users := make([]map[string]interface{}, 0)
+	client, err := s.config.firestoreClient()
 	if err != nil {
-		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
+		return nil, fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	defer func() {
-		err := client.Close()
+	iter := client.Collection("users").Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "users", &scanned, time.Now())
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
 		if err != nil {
-			rtr.logger.Error("could not close firebase client")
+			return nil, fmt.Errorf("error while iterating through the user documents: %w", err)
 		}
-	}()
 
-	userDoc, err := GetUserDocument(rtr, uid)
+		scanned++
+		data := doc.Data()
+		data["RefId"] = doc.Ref.ID
+		users = append(users, data)
+	}
+
+	return users, nil
+}
+
+// CreateRoutineDocument creates an empty routine for the user, returning the new routine's document ID. The user
+// document, the routine count and the new routine are read and written within one transaction, so concurrent
+// creations cannot both pass the quota
+func (s *firestoreStorage) CreateRoutineDocument(ctx context.Context, uid, routineName string, quota routineQuota) (string, error) {
+	client, err := s.config.firestoreClient()
 	if err != nil {
-		return fmt.Errorf("error while trying to get users document to check subscription tier while creatine routine: %w", err)
+		return "", fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	settings, ok := userDoc["Settings"].(map[string]interface{})
-	if ok {
-		// check the tier of the user to see if they are able to make more than one routine
-		// if the user is not on a paid plan, they should not be able to make more than one routine
-		routines, err := GetUserRoutines(rtr, uid)
+	newRoutineDoc := RoutineDocument{
+		SchemaVersion: routineSchemaVersion,
+		RoutineName:   routineName,
+		UID:           uid,
+		CreatedAt:     time.Now(),
+		Workouts:      []WorkoutDoc{},
+	}
+	routineRef := client.Collection("routines").NewDoc()
+	counterRef := client.Collection("routineCounters").Doc(uid)
+
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// a transaction does every read before its first write
+		count, err := routineCount(tx, client, uid)
 		if err != nil {
-			return fmt.Errorf("error while trying to create new user document: %w", err)
+			return err
+		}
+		if quota != nil {
+			userDocs, err := tx.Documents(client.Collection("users").Where("UID", "==", uid).Limit(1)).GetAll()
+			if err != nil {
+				return fmt.Errorf("error while trying to get users document to check subscription tier while creatine routine: %w", err)
+			}
+			if len(userDocs) == 0 {
+				return fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", uid, ErrNotFound)
+			}
+			if err := routineQuotaError(quota, userDocs[0].Data(), uid, count); err != nil {
+				return err
+			}
 		}
 
-		if settings["SubscriptionTier"] == "Free" && len(routines) > 2 {
-			return fmt.Errorf("error trying to make routine: Free tier user cannot make more than 3 routines")
+		if err := tx.Create(routineRef, newRoutineDoc); err != nil {
+			return err
 		}
+		return tx.Set(counterRef, RoutineCounterDocument{UID: uid, Count: count + 1})
+	})
+	if err != nil {
+		return "", fmt.Errorf("error while trying to create new routine document for user (uid: %s): %w", uid, err)
+	}
+
+	return routineRef.ID, nil
+}
 
-		newRoutineDoc := RoutineDocument{
-			RoutineName: routineName,
-			UID:         uid,
-			CreatedAt:   time.Now(),
-			Workouts:    []WorkoutDoc{},
+// maxRoutinesPerTransaction keeps a transaction of CreateRoutineDocuments, which also writes the routine counter,
+// below Firestore's 500 writes
+const maxRoutinesPerTransaction = 400
+
+func (s *firestoreStorage) CreateRoutineDocuments(ctx context.Context, uid string, writes []*routineWrite, quota routineQuota) error {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+	counterRef := client.Collection("routineCounters").Doc(uid)
+
+	for start := 0; start < len(writes); start += maxRoutinesPerTransaction {
+		batch := writes[start:min(start+maxRoutinesPerTransaction, len(writes))]
+		refs := make([]*firestore.DocumentRef, 0, len(batch))
+
+		err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			// Firestore may run the function again, starting over
+			refs = refs[:0]
+			count, err := routineCount(tx, client, uid)
+			if err != nil {
+				return err
+			}
+			var userDoc map[string]interface{}
+			if quota != nil {
+				userDocs, err := tx.Documents(client.Collection("users").Where("UID", "==", uid).Limit(1)).GetAll()
+				if err != nil {
+					return fmt.Errorf("error while trying to get users document to check subscription tier while creating routines: %w", err)
+				}
+				if len(userDocs) == 0 {
+					return fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", uid, ErrNotFound)
+				}
+				userDoc = userDocs[0].Data()
+			}
+
+			for _, write := range batch {
+				if quota != nil {
+					err := routineQuotaError(quota, userDoc, uid, count+len(refs))
+					if errors.Is(err, ErrQuotaExceeded) {
+						break
+					}
+					if err != nil {
+						return err
+					}
+				}
+				ref := client.Collection("routines").NewDoc()
+				if err := tx.Create(ref, write.Document); err != nil {
+					return err
+				}
+				refs = append(refs, ref)
+			}
+			if len(refs) == 0 {
+				return nil
+			}
+			return tx.Set(counterRef, RoutineCounterDocument{UID: uid, Count: count + len(refs)})
+		})
+		if err != nil {
+			return fmt.Errorf("error while trying to create routine documents for user (uid: %s): %w", uid, err)
 		}
 
-		if _, _, err = client.Collection("routines").Add(rtr.config.ctx, newRoutineDoc); err != nil {
-			return fmt.Errorf("error while trying to create new routine document for user (uid: %s): %w", uid, err)
+		for i, ref := range refs {
+			batch[i].RefId, batch[i].Written = ref.ID, true
 		}
+		if len(refs) < len(batch) {
+			return nil
+		}
+	}
 
-		return nil
+	return nil
+}
+
+// routineCount reads the user's routine count within the transaction. Users whose routines were created before the
+// counters existed have none, and their routines are counted instead
+func routineCount(tx *firestore.Transaction, client *firestore.Client, uid string) (int, error) {
+	counter, err := tx.Get(client.Collection("routineCounters").Doc(uid))
+	if status.Code(err) == codes.NotFound {
+		routines, err := tx.Documents(client.Collection("routines").Where("UID", "==", uid)).GetAll()
+		if err != nil {
+			return 0, fmt.Errorf("error while trying to count the routines of user (uid: %s): %w", uid, err)
+		}
+		return len(routines), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error while trying to get the routine counter of user (uid: %s): %w", uid, err)
 	}
 
-	return fmt.Errorf("error trying to get users subscription settings while trying to create user workout routine")
+	count, _ := counter.Data()["Count"].(int64)
+	return int(count), nil
 }
 
-func GetUserRoutines(rtr *router, uid string) ([]map[string]interface{}, error) {
+func (s *firestoreStorage) GetUserRoutines(ctx context.Context, uid string) ([]map[string]interface{}, error) {
 	rd := make([]map[string]interface{}, 0)
-	client, err := rtr.config.firebaseApp.Firestore(rtr.config.ctx)
+	client, err := s.config.firestoreClient()
 	if err != nil {
 		return nil, fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	defer func() {
-		err := client.Close()
-		if err != nil {
-			rtr.logger.Error("could not close firebase client")
-		}
-	}()
-
-	iter := client.Collection("routines").Documents(rtr.config.ctx)
+	iter := client.Collection("routines").Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "routines", &scanned, time.Now())
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
@@ -237,6 +420,7 @@ func GetUserRoutines(rtr *router, uid string) ([]map[string]interface{}, error)
 			return nil, fmt.Errorf("error while iterating through the firestore user documents to retrieve documents: %w", err)
 		}
 
+		scanned++
 		if doc.Data()["UID"] == uid {
 			docDataAndRef := doc.Data()
 			docDataAndRef["RefId"] = doc.Ref.ID
@@ -247,20 +431,16 @@ func GetUserRoutines(rtr *router, uid string) ([]map[string]interface{}, error)
 	return rd, nil
 }
 
-func GetOneUserRoutine(rtr *router, routineRefId string) (map[string]interface{}, error) {
-	client, err := rtr.config.firebaseApp.Firestore(rtr.config.ctx)
+func (s *firestoreStorage) GetOneUserRoutine(ctx context.Context, routineRefId string) (map[string]interface{}, error) {
+	client, err := s.config.firestoreClient()
 	if err != nil {
 		return nil, fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	defer func() {
-		err := client.Close()
-		if err != nil {
-			rtr.logger.Error("could not close firebase client")
-		}
-	}()
-
-	iter := client.Collection("routines").Documents(rtr.config.ctx)
+	iter := client.Collection("routines").Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "routines", &scanned, time.Now())
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
@@ -271,45 +451,317 @@ func GetOneUserRoutine(rtr *router, routineRefId string) (map[string]interface{}
 			return nil, fmt.Errorf("error while iterating through the firestore user documents to retrieve documents: %w", err)
 		}
 
+		scanned++
 		if doc.Ref.ID == routineRefId {
 			return doc.Data(), nil
 		}
 	}
 
-	return nil, fmt.Errorf("error while trying to find routine associated with routine ref, found nothing")
+	return nil, fmt.Errorf("error while trying to find routine associated with routine ref (%s): %w", routineRefId, ErrNotFound)
+}
+
+func (s *firestoreStorage) UpdateOneUserRoutine(ctx context.Context, routineRefId string, routineUpdates map[string]interface{}) error {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	iter := client.Collection("routines").Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "routines", &scanned, time.Now())
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error while iterating through the firestore routine documents to retrieve routine: %w", err)
+		}
+
+		scanned++
+		if doc.Ref.ID == routineRefId {
+			if _, err = doc.Ref.Set(ctx, routineUpdates); err != nil {
+				return fmt.Errorf("error while trying to insert updates for user's routine with routine ID (%s): %w", routineRefId, err)
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("error, did not find associated user's routine document for routine of %s within routines collection: %w", routineRefId, ErrNotFound)
 }
 
-func UpdateOneUserRoutine(rtr *router, routineRefId string, routineUpdates map[string]interface{}) error {
-	client, err := rtr.config.firebaseApp.Firestore(rtr.config.ctx)
+func (s *firestoreStorage) ReplaceRoutineDocuments(ctx context.Context, writes []*routineWrite) error {
+	client, err := s.config.firestoreClient()
 	if err != nil {
 		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
 	}
 
-	defer func() {
-		err := client.Close()
+	bulk := client.BulkWriter(ctx)
+	jobs := make([]*firestore.BulkWriterJob, len(writes))
+	for i, write := range writes {
+		jobs[i], err = bulk.Set(client.Collection("routines").Doc(write.RefId), write.Document)
 		if err != nil {
-			rtr.logger.Error("could not close firebase client")
+			bulk.End()
+			return fmt.Errorf("error while trying to queue routine document (%s): %w", write.RefId, err)
 		}
-	}()
+	}
+	bulk.End()
+
+	var failed error
+	for i, write := range writes {
+		if _, err := jobs[i].Results(); err != nil {
+			if failed == nil {
+				failed = fmt.Errorf("error while trying to replace routine document (%s): %w", write.RefId, err)
+			}
+			continue
+		}
+		write.Written = true
+	}
 
-	iter := client.Collection("routines").Documents(rtr.config.ctx)
+	return failed
+}
+
+func (s *firestoreStorage) GetAllRoutines(ctx context.Context) ([]map[string]interface{}, error) {
+	rd := make([]map[string]interface{}, 0)
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	iter := client.Collection("routines").Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "routines", &scanned, time.Now())
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error while iterating through the firestore routine documents to retrieve routine: %w", err)
+			return nil, fmt.Errorf("error while iterating through the routine documents: %w", err)
 		}
 
-		if doc.Ref.ID == routineRefId {
-			if _, err = doc.Ref.Set(rtr.config.ctx, routineUpdates); err != nil {
-				return fmt.Errorf("error while trying to insert updates for user's routine with routine ID (%s): %v", routineRefId, err)
+		scanned++
+		docDataAndRef := doc.Data()
+		docDataAndRef["RefId"] = doc.Ref.ID
+		rd = append(rd, docDataAndRef)
+	}
+
+	return rd, nil
+}
+
+func (s *firestoreStorage) DeleteRoutineDocument(ctx context.Context, routineRefId string) error {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	routineRef := client.Collection("routines").Doc(routineRefId)
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		routine, err := tx.Get(routineRef)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		uid, _ := routine.Data()["UID"].(string)
+		if uid == "" {
+			return tx.Delete(routineRef)
+		}
+
+		// counters are created by the first routine created after they existed, until then there is nothing to take off
+		counterRef := client.Collection("routineCounters").Doc(uid)
+		counter, err := tx.Get(counterRef)
+		if status.Code(err) == codes.NotFound {
+			return tx.Delete(routineRef)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Delete(routineRef); err != nil {
+			return err
+		}
+		count, _ := counter.Data()["Count"].(int64)
+		if count <= 0 {
+			return nil
+		}
+		return tx.Update(counterRef, []firestore.Update{{Path: "Count", Value: count - 1}})
+	})
+	if err != nil {
+		return fmt.Errorf("error while trying to delete routine document (%s): %w", routineRefId, err)
+	}
+
+	return nil
+}
+
+// logScan logs how many documents a collection scan read before it returned, with the request's logger
+func logScan(ctx context.Context, collection string, scanned *int, start time.Time) {
+	loggerFrom(ctx).Debug("scanned firestore collection", "collection", collection, "documents", *scanned, "duration", time.Since(start))
+}
+
+func (s *firestoreStorage) CreateWorkoutLogDocuments(ctx context.Context, writes []*workoutLogWrite) error {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	// the BulkWriter sends the creates in parallel batches, and refuses to write the same document twice
+	bulk := client.BulkWriter(ctx)
+	jobs := make([]*firestore.BulkWriterJob, len(writes))
+	seen := make(map[string]bool, len(writes))
+	for i, write := range writes {
+		if seen[write.ID] {
+			continue
+		}
+		seen[write.ID] = true
+
+		jobs[i], err = bulk.Create(client.Collection("workoutLogs").Doc(write.ID), write.Log)
+		if err != nil {
+			bulk.End()
+			return fmt.Errorf("error while trying to queue workout log document (%s): %w", write.ID, err)
+		}
+	}
+	bulk.End()
+
+	var failed error
+	for i, write := range writes {
+		if jobs[i] == nil {
+			write.Duplicate = true
+			continue
+		}
+		_, err := jobs[i].Results()
+		switch {
+		case status.Code(err) == codes.AlreadyExists:
+			write.Duplicate = true
+		case err != nil:
+			if failed == nil {
+				failed = fmt.Errorf("error while trying to create workout log document (%s): %w", write.ID, err)
 			}
+		default:
+			write.Created = true
+		}
+	}
+
+	return failed
+}
 
+func (s *firestoreStorage) GetWorkoutLogs(ctx context.Context, uid string) ([]map[string]interface{}, error) {
+	logs := make([]map[string]interface{}, 0)
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	iter := client.Collection("workoutLogs").Where("UID", "==", uid).Documents(ctx)
+	defer iter.Stop()
+	scanned := 0
+	defer logScan(ctx, "workoutLogs", &scanned, time.Now())
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while iterating through the workout log documents: %w", err)
+		}
+
+		scanned++
+		data := doc.Data()
+		data["RefId"] = doc.Ref.ID
+		logs = append(logs, data)
+	}
+
+	return logs, nil
+}
+
+// CreateBillingEventDocument records a processed billing webhook event under its event ID.
+// It returns false without an error if the event has already been recorded
+func (s *firestoreStorage) CreateBillingEventDocument(ctx context.Context, eventID, eventType string) (bool, error) {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return false, fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	_, err = client.Collection("billingEvents").Doc(eventID).Create(ctx, map[string]interface{}{
+		"Type":        eventType,
+		"ProcessedAt": time.Now(),
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error while trying to create billing event document (%s): %w", eventID, err)
+	}
+
+	return true, nil
+}
+
+func (s *firestoreStorage) DeleteBillingEventDocument(ctx context.Context, eventID string) error {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	if _, err = client.Collection("billingEvents").Doc(eventID).Delete(ctx); err != nil {
+		return fmt.Errorf("error while trying to delete billing event document (%s): %w", eventID, err)
+	}
+
+	return nil
+}
+
+func (s *firestoreStorage) UpdateUserSubscription(ctx context.Context, change *subscriptionChange) (bool, error) {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return false, fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	updated := false
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		updated = false
+		userDocs, err := tx.Documents(client.Collection("users").Where("UID", "==", change.UID).Limit(1)).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(userDocs) == 0 {
+			return fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", change.UID, ErrNotFound)
+		}
+
+		updates := subscriptionUpdates(userDocs[0].Data(), change)
+		if updates == nil {
 			return nil
 		}
+		formattedUpdates := []firestore.Update{}
+		for key, val := range updates {
+			formattedUpdates = append(formattedUpdates, firestore.Update{Path: key, Value: val})
+		}
+
+		updated = true
+		return tx.Update(userDocs[0].Ref, formattedUpdates)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error while trying to update subscription of user (uid: %s): %w", change.UID, err)
 	}
 
-	return fmt.Errorf("error, did not find associated user's routine document for routine of %s within routines collection", routineRefId)
+	return updated, nil
+}
+
+// Ping reads at most one user document, which fails when Firestore cannot be reached or the credentials are rejected
+func (s *firestoreStorage) Ping(ctx context.Context) error {
+	client, err := s.config.firestoreClient()
+	if err != nil {
+		return fmt.Errorf("error while trying to initialize firestore client: %w", err)
+	}
+
+	iter := client.Collection("users").Limit(1).Documents(ctx)
+	defer iter.Stop()
+	if _, err := iter.Next(); err != nil && err != iterator.Done {
+		return fmt.Errorf("error while trying to reach firestore: %w", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hashedAssetsCacheControl is sent for Vite's assets directory, whose file names carry a hash of their contents
+	hashedAssetsCacheControl = "public, max-age=31536000, immutable"
+	// indexCacheControl makes browsers revalidate index.html, so a deploy is picked up on the next load
+	indexCacheControl = "no-cache"
+	// publicFilesCacheControl is sent for the unhashed files copied from frontend/public, e.g. logo.svg
+	publicFilesCacheControl = "public, max-age=3600"
+)
+
+// precompressedEncodings are the encodings a build may ship next to a file, e.g. assets/index-a1b2.js.br, in order of preference
+var precompressedEncodings = []struct {
+	name      string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// frontendSource returns the files of the frontend build and where they come from: the build embedded into the
+// binary ("embed"), or the build at buildPath ("disk"). "auto" picks the embedded build when the binary has one
+func frontendSource(source, buildPath string) (fs.FS, string, error) {
+	embedded, ok := embeddedFrontendFiles()
+	switch source {
+	case "embed":
+		if !ok {
+			return nil, "", fmt.Errorf("frontend source is embed but the binary was built without the embedfrontend tag")
+		}
+		return embedded, "embed", nil
+	case "auto":
+		if ok {
+			return embedded, "embed", nil
+		}
+		return os.DirFS(buildPath), "disk", nil
+	case "disk":
+		return os.DirFS(buildPath), "disk", nil
+	}
+
+	return nil, "", fmt.Errorf("unknown frontend source %q", source)
+}
+
+// frontendServer serves the files of a frontend build, remembering the ETag of every file it has served until the
+// file changes on disk
+type frontendServer struct {
+	files fs.FS
+
+	mu    sync.Mutex
+	etags map[string]frontendETag
+}
+
+type frontendETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func newFrontendServer(files fs.FS) *frontendServer {
+	return &frontendServer{files: files, etags: map[string]frontendETag{}}
+}
+
+func (rtr *router) frontend() *frontendServer {
+	rtr.frontendOnce.Do(func() {
+		rtr.frontendServer = newFrontendServer(rtr.config.frontendFiles())
+	})
+	return rtr.frontendServer
+}
+
+// ServeFrontend serves the file of the frontend build the path names, or index.html for any path that names no file so
+// that React Router can route it. fs.FS names are rooted and cleaned, so no path can reach outside of the build
+func (rtr *router) ServeFrontend(w http.ResponseWriter, r *http.Request) {
+	name, err := rtr.frontend().resolve(r.URL.Path)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		rtr.StatusError(w, r, "serve frontend", err)
+		return
+	}
+
+	if err := rtr.frontend().serve(w, r, name); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		rtr.StatusError(w, r, "serve frontend", err)
+	}
+}
+
+// resolve returns the name of the file the URL path names, or index.html when it names none
+func (s *frontendServer) resolve(urlPath string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return "index.html", nil
+	}
+
+	info, err := fs.Stat(s.files, name)
+	switch {
+	case err == nil && info.IsDir(), errors.Is(err, fs.ErrNotExist):
+		return "index.html", nil
+	case err != nil:
+		return "", fmt.Errorf("error while trying to stat frontend file %q: %w", name, err)
+	}
+
+	return name, nil
+}
+
+// serve writes the named file, or its precompressed variant when the client accepts its encoding, with the cache
+// headers of its kind and an ETag. http.ServeContent answers conditional and range requests
+func (s *frontendServer) serve(w http.ResponseWriter, r *http.Request, name string) error {
+	switch {
+	case name == "index.html":
+		w.Header().Set("Cache-Control", indexCacheControl)
+	case strings.HasPrefix(name, "assets/"):
+		w.Header().Set("Cache-Control", hashedAssetsCacheControl)
+	default:
+		w.Header().Set("Cache-Control", publicFilesCacheControl)
+	}
+
+	file, encoding, err := s.open(name, r.Header.Get("Accept-Encoding"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error while trying to stat frontend file %q: %w", name, err)
+	}
+
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return fmt.Errorf("error while trying to read frontend file %q: %w", name, err)
+		}
+		content = bytes.NewReader(data)
+	}
+
+	etag, err := s.etag(name, encoding, info, content)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", etag)
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	// the content type comes from the extension of the name, not of its precompressed variant
+	http.ServeContent(w, r, name, info.ModTime(), content)
+	return nil
+}
+
+// open opens the best precompressed variant of the named file the client accepts, or the file itself
+func (s *frontendServer) open(name, acceptEncoding string) (fs.File, string, error) {
+	for _, encoding := range precompressedEncodings {
+		if !acceptsEncoding(acceptEncoding, encoding.name) {
+			continue
+		}
+		file, err := s.files.Open(name + encoding.extension)
+		if err == nil {
+			return file, encoding.name, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, "", fmt.Errorf("error while trying to open frontend file %q: %w", name+encoding.extension, err)
+		}
+	}
+
+	file, err := s.files.Open(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("error while trying to open frontend file %q: %w", name, err)
+	}
+	return file, "", nil
+}
+
+// etag returns the strong ETag of the content, a hash of it, hashing it again only when the file has changed
+func (s *frontendServer) etag(name, encoding string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	key := name + ";" + encoding
+
+	s.mu.Lock()
+	cached, ok := s.etags[key]
+	s.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", fmt.Errorf("error while trying to hash frontend file %q: %w", name, err)
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("error while trying to rewind frontend file %q: %w", name, err)
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	s.mu.Lock()
+	s.etags[key] = frontendETag{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	s.mu.Unlock()
+
+	return etag, nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header accepts encoding, i.e. lists it without q=0
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
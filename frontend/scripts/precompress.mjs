@@ -0,0 +1,32 @@
+// Writes a .br and a .gz file next to every compressible file of the build, which the Go server serves to clients
+// that accept those encodings instead of compressing on every request
+import { readdirSync, readFileSync, writeFileSync, statSync } from "node:fs";
+import { join, extname } from "node:path";
+import { brotliCompressSync, gzipSync, constants } from "node:zlib";
+
+const dist = new URL("../dist/", import.meta.url).pathname;
+const compressible = new Set([".html", ".js", ".css", ".svg", ".json", ".txt", ".map"]);
+// compressing tiny files saves nothing once headers are counted
+const minBytes = 1024;
+
+function walk(dir) {
+  for (const entry of readdirSync(dir)) {
+    const path = join(dir, entry);
+    if (statSync(path).isDirectory()) {
+      walk(path);
+      continue;
+    }
+    if (!compressible.has(extname(path))) {
+      continue;
+    }
+
+    const data = readFileSync(path);
+    if (data.length < minBytes) {
+      continue;
+    }
+    writeFileSync(path + ".br", brotliCompressSync(data, { params: { [constants.BROTLI_PARAM_QUALITY]: 11 } }));
+    writeFileSync(path + ".gz", gzipSync(data, { level: 9 }));
+  }
+}
+
+walk(dist);
@@ -0,0 +1,10 @@
+//go:build !embedfrontend
+
+package main
+
+import "io/fs"
+
+// embeddedFrontendFiles reports that no frontend build was embedded, the build is served from disk
+func embeddedFrontendFiles() (fs.FS, bool) {
+	return nil, false
+}
@@ -0,0 +1,22 @@
+//go:build embedfrontend
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// embeddedFrontend is the frontend build, embedded when the binary is built with -tags embedfrontend after
+// `npm run build` has written frontend/dist
+//
+//go:embed all:frontend/dist
+var embeddedFrontend embed.FS
+
+func embeddedFrontendFiles() (fs.FS, bool) {
+	files, err := fs.Sub(embeddedFrontend, "frontend/dist")
+	if err != nil {
+		return nil, false
+	}
+	return files, true
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func serveFrontendRequest(rtr *router, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	rtr.ServeFrontend(w, req)
+	return w
+}
+
+func TestServeFrontend_CacheHeaders(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.frontend = fstest.MapFS{
+		"index.html":              {Data: []byte("<html>index</html>")},
+		"assets/index-a1b2c3d.js": {Data: []byte("console.log('app')")},
+		"logo.svg":                {Data: []byte("<svg></svg>")},
+	}
+
+	tests := []struct {
+		path             string
+		wantCacheControl string
+		wantContentType  string
+	}{
+		{"/", indexCacheControl, "text/html; charset=utf-8"},
+		{"/home/routines", indexCacheControl, "text/html; charset=utf-8"},
+		{"/assets/index-a1b2c3d.js", hashedAssetsCacheControl, "text/javascript; charset=utf-8"},
+		{"/logo.svg", publicFilesCacheControl, "image/svg+xml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := serveFrontendRequest(rtr, tt.path, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200 but got %d", w.Code)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tt.wantCacheControl {
+				t.Errorf("expected Cache-Control %q, got %q", tt.wantCacheControl, got)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("expected Content-Type %q, got %q", tt.wantContentType, got)
+			}
+			if w.Header().Get("ETag") == "" {
+				t.Errorf("expected an ETag")
+			}
+		})
+	}
+}
+
+func TestServeFrontend_Precompressed(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.frontend = fstest.MapFS{
+		"index.html":          {Data: []byte("<html>index</html>")},
+		"assets/app.js":       {Data: []byte("plain")},
+		"assets/app.js.br":    {Data: []byte("brotli")},
+		"assets/app.js.gz":    {Data: []byte("gzip")},
+		"assets/style.css":    {Data: []byte("plain css")},
+		"assets/style.css.gz": {Data: []byte("gzip css")},
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+		wantBody       string
+	}{
+		{"brotli preferred", "/assets/app.js", "gzip, deflate, br", "br", "brotli"},
+		{"gzip only", "/assets/app.js", "gzip", "gzip", "gzip"},
+		{"brotli refused", "/assets/app.js", "br;q=0, gzip;q=0.8", "gzip", "gzip"},
+		{"no encoding", "/assets/app.js", "", "", "plain"},
+		{"missing variant", "/assets/style.css", "br", "", "plain css"},
+		{"gzip variant", "/assets/style.css", "br, gzip", "gzip", "gzip css"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveFrontendRequest(rtr, tt.path, map[string]string{"Accept-Encoding": tt.acceptEncoding})
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("expected Content-Encoding %q, got %q", tt.wantEncoding, got)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("expected body %q, got %q", tt.wantBody, w.Body.String())
+			}
+			if w.Header().Get("Content-Type") == "" || w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("expected the content type of the uncompressed file and Vary: Accept-Encoding, got %v", w.Header())
+			}
+		})
+	}
+
+	plain := serveFrontendRequest(rtr, "/assets/app.js", nil).Header().Get("ETag")
+	brotli := serveFrontendRequest(rtr, "/assets/app.js", map[string]string{"Accept-Encoding": "br"}).Header().Get("ETag")
+	if plain == brotli {
+		t.Errorf("expected every encoding to have its own ETag, got %s for both", plain)
+	}
+}
+
+func TestServeFrontend_ETag(t *testing.T) {
+	buildPath := t.TempDir()
+	index := filepath.Join(buildPath, "index.html")
+	if err := os.WriteFile(index, []byte("<html>v1</html>"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.frontendBuildPath = buildPath
+
+	first := serveFrontendRequest(rtr, "/", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected a 200 with an ETag, got %d %q", first.Code, etag)
+	}
+
+	revalidated := serveFrontendRequest(rtr, "/", map[string]string{"If-None-Match": etag})
+	if revalidated.Code != http.StatusNotModified || revalidated.Body.Len() != 0 {
+		t.Errorf("expected a 304 without a body, got %d %q", revalidated.Code, revalidated.Body.String())
+	}
+
+	// a rebuild on disk changes the ETag, even though the frontend server has cached the old one
+	if err := os.WriteFile(index, []byte("<html>version 2</html>"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chtimes(index, time.Now().Add(time.Minute), time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rebuilt := serveFrontendRequest(rtr, "/", map[string]string{"If-None-Match": etag})
+	if rebuilt.Code != http.StatusOK || rebuilt.Body.String() != "<html>version 2</html>" {
+		t.Errorf("expected the rebuilt index.html, got %d %q", rebuilt.Code, rebuilt.Body.String())
+	}
+	if rebuilt.Header().Get("ETag") == etag {
+		t.Errorf("expected a new ETag once the file changed")
+	}
+}
+
+func TestFrontendSource(t *testing.T) {
+	buildPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(buildPath, "index.html"), []byte("<html></html>"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, embedded := embeddedFrontendFiles()
+
+	for _, source := range []string{"disk", "auto"} {
+		files, from, err := frontendSource(source, buildPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if source == "disk" || !embedded {
+			if from != "disk" {
+				t.Errorf("expected %s to serve from disk, got %s", source, from)
+			}
+			if _, err := files.Open("index.html"); err != nil {
+				t.Errorf("expected index.html to be served from the build path: %v", err)
+			}
+		}
+	}
+
+	if _, _, err := frontendSource("embed", buildPath); (err == nil) != embedded {
+		t.Errorf("expected embed to fail only without an embedded build, got %v", err)
+	}
+	if _, _, err := frontendSource("s3", buildPath); err == nil {
+		t.Errorf("expected an unknown source to fail")
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		want     bool
+	}{
+		{"gzip, deflate, br", "br", true},
+		{"gzip, deflate", "br", false},
+		{"br;q=0", "br", false},
+		{"br; q=0.0", "br", false},
+		{"BR;q=0.5", "br", true},
+		{"", "gzip", false},
+		{"*", "gzip", false},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, tt.encoding); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, want %v", tt.header, tt.encoding, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessCacheTTL is how long check results are reused, so that frequent probes do not each reach Firestore
+	readinessCacheTTL = 10 * time.Second
+	// readinessCheckTimeout bounds every check, a probe should never hang on an unreachable dependency
+	readinessCheckTimeout = 3 * time.Second
+)
+
+const (
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+)
+
+type HealthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+type HealthCheckResult struct {
+	Status string `json:"status"`
+	// Error is only answered to requests bearing the metrics token, it may name hosts, projects or credentials
+	Error      string    `json:"error,omitempty"`
+	DurationMs float64   `json:"durationMs"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+// readinessCheck returns nil when the dependency it checks can serve requests
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecker runs its checks at most once per readinessCacheTTL. Probes arriving while the checks run wait for
+// their results instead of starting another run
+type readinessChecker struct {
+	checks []readinessCheck
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	results map[string]HealthCheckResult
+	expires time.Time
+}
+
+func newReadinessChecker(cfg *config) *readinessChecker {
+	return &readinessChecker{
+		ttl: readinessCacheTTL,
+		now: time.Now,
+		checks: []readinessCheck{
+			{name: "storage", check: func(ctx context.Context) error {
+				if cfg.store == nil {
+					return fmt.Errorf("storage is not configured")
+				}
+				return cfg.store.Ping(ctx)
+			}},
+			// the client is built from the service account credentials without reaching Firebase, so this catches missing
+			// or malformed credentials rather than an outage of Firebase Auth
+			{name: "authClient", check: func(context.Context) error {
+				_, err := cfg.idTokenVerifier()
+				return err
+			}},
+			{name: "frontend", check: func(context.Context) error {
+				if _, err := fs.Stat(cfg.frontendFiles(), "index.html"); err != nil {
+					return fmt.Errorf("frontend build is missing: %w", err)
+				}
+				return nil
+			}},
+		},
+	}
+}
+
+// check returns the result of every check, running them again once the cached results have expired
+func (c *readinessChecker) check(ctx context.Context) map[string]HealthCheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results != nil && c.now().Before(c.expires) {
+		return c.results
+	}
+
+	results := make(map[string]HealthCheckResult, len(c.checks))
+	resultsMu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// the results are shared with other probes, so a probe that gives up must not cancel the checks
+			checkCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessCheckTimeout)
+			defer cancel()
+
+			checkedAt, start := c.now(), time.Now()
+			err := check.check(checkCtx)
+			result := HealthCheckResult{
+				Status:     healthStatusOK,
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+				CheckedAt:  checkedAt,
+			}
+			if err != nil {
+				result.Status, result.Error = healthStatusUnavailable, err.Error()
+			}
+
+			resultsMu.Lock()
+			results[check.name] = result
+			resultsMu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	c.results, c.expires = results, c.now().Add(c.ttl)
+	return results
+}
+
+func (rtr *router) readiness() *readinessChecker {
+	rtr.readinessOnce.Do(func() {
+		rtr.readinessChecker = newReadinessChecker(rtr.config)
+	})
+	return rtr.readinessChecker
+}
+
+// Healthz reports that the process is alive and serving requests, it checks no dependencies
+func (rtr *router) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	writeHealth(w, r, http.StatusOK, HealthResponse{Status: healthStatusOK})
+}
+
+// Readyz reports whether every dependency needed to serve the API is available, answering 503 when one is not. The
+// errors of failed checks are logged, and only answered to requests bearing the metrics token
+func (rtr *router) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	token := rtr.config.metricsToken
+	detailed := token != "" && bearerTokenMatches(r, token)
+
+	response := HealthResponse{Status: healthStatusOK, Checks: map[string]HealthCheckResult{}}
+	status := http.StatusOK
+	// the results are cached and shared with other probes, so they are copied rather than stripped of their errors
+	for name, result := range rtr.readiness().check(r.Context()) {
+		if result.Status != healthStatusOK {
+			response.Status, status = healthStatusUnavailable, http.StatusServiceUnavailable
+			loggerFrom(r.Context()).Warn("readiness check failed", "check", name, "error", result.Error)
+		}
+		if !detailed {
+			result.Error = ""
+		}
+		response.Checks[name] = result
+	}
+
+	writeHealth(w, r, status, response)
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, status int, response HealthResponse) {
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		loggerFrom(r.Context()).Error("error writing health response", "error", err.Error())
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func decodeHealth(t *testing.T, w *httptest.ResponseRecorder) HealthResponse {
+	t.Helper()
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	health := HealthResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	return health
+}
+
+func TestHealthz(t *testing.T) {
+	r := getTestRouter()
+	w := httptest.NewRecorder()
+
+	r.Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", w.Code)
+	}
+	if health := decodeHealth(t, w); health.Status != healthStatusOK {
+		t.Errorf("unexpected health: %+v", health)
+	}
+}
+
+func TestReadyz_Ready(t *testing.T) {
+	buildPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(buildPath, "index.html"), []byte("<html></html>"), 0o600); err != nil {
+		t.Fatalf("failed to write index.html: %v", err)
+	}
+
+	r := getMemoryTestRouter(newMemoryStorage())
+	r.config.frontendBuildPath = buildPath
+	w := httptest.NewRecorder()
+
+	r.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", w.Code)
+	}
+	health := decodeHealth(t, w)
+	for _, name := range []string{"storage", "authClient", "frontend"} {
+		if result, ok := health.Checks[name]; !ok || result.Status != healthStatusOK || result.CheckedAt.IsZero() {
+			t.Errorf("expected check %s to pass, got %+v", name, result)
+		}
+	}
+}
+
+func TestReadyz_FirebaseNil(t *testing.T) {
+	r := getTestRouter()
+	w := httptest.NewRecorder()
+
+	r.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 but got %d", w.Code)
+	}
+	health := decodeHealth(t, w)
+	if health.Status != healthStatusUnavailable {
+		t.Errorf("unexpected status: %s", health.Status)
+	}
+	for _, name := range []string{"storage", "authClient", "frontend"} {
+		if result := health.Checks[name]; result.Status != healthStatusUnavailable || result.Error != "" {
+			t.Errorf("expected check %s to fail without its error, got %+v", name, result)
+		}
+	}
+}
+
+func TestReadyz_ErrorsBehindMetricsToken(t *testing.T) {
+	r := getTestRouter()
+	r.config.metricsToken = "scrape-secret"
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantErrors    bool
+	}{
+		{"missing token", "", false},
+		{"wrong token", "Bearer nope", false},
+		{"right token", "Bearer scrape-secret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/readyz", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			r.Readyz(w, req)
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected status 503 but got %d", w.Code)
+			}
+			for name, result := range decodeHealth(t, w).Checks {
+				if (result.Error != "") != tt.wantErrors {
+					t.Errorf("expected errors to be answered: %v, got check %s %+v", tt.wantErrors, name, result)
+				}
+			}
+		})
+	}
+}
+
+func TestReadinessChecker_CachesResults(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	runs := 0
+	checker := &readinessChecker{
+		ttl: 10 * time.Second,
+		now: func() time.Time { return now },
+		checks: []readinessCheck{{name: "storage", check: func(context.Context) error {
+			runs++
+			return errors.New("unreachable")
+		}}},
+	}
+
+	checker.check(context.Background())
+	now = now.Add(5 * time.Second)
+	results := checker.check(context.Background())
+
+	if runs != 1 {
+		t.Errorf("expected probes within the TTL to reuse the results, ran %d times", runs)
+	}
+	if results["storage"].Error != "unreachable" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	now = now.Add(5 * time.Second)
+	checker.check(context.Background())
+	if runs != 2 {
+		t.Errorf("expected the checks to run again once the TTL passed, ran %d times", runs)
+	}
+}
+
+func TestReadinessChecker_ProbeCancellationDoesNotFailChecks(t *testing.T) {
+	checker := &readinessChecker{
+		ttl: time.Minute,
+		now: time.Now,
+		checks: []readinessCheck{{name: "storage", check: func(ctx context.Context) error {
+			return ctx.Err()
+		}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if result := checker.check(ctx)["storage"]; result.Status != healthStatusOK {
+		t.Errorf("expected a cancelled probe not to cancel the cached check, got %+v", result)
+	}
+}
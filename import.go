@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxImportBodyBytes bounds an uploaded export, years of history from Strong or Hevy are a few megabytes
+	maxImportBodyBytes = 10 << 20
+	// maxImportRowErrors bounds the unparsable rows reported back, the rest are only counted within SkippedRows
+	maxImportRowErrors = 50
+
+	importFormatStrong = "strong"
+	importFormatHevy   = "hevy"
+)
+
+// strongDateLayouts and hevyDateLayouts are the timestamp layouts the apps have exported over the years, in local time
+var (
+	strongDateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04"}
+	hevyDateLayouts   = []string{"2 Jan 2006, 15:04", "Jan 2, 2006, 3:04 PM", "2006-01-02 15:04:05", "2006-01-02T15:04:05Z07:00"}
+)
+
+// exerciseCatalog maps keywords of exercise names onto muscle groups for exercises the user has never logged before.
+// Names are matched against the first keyword they contain, so more specific keywords come first
+var exerciseCatalog = []struct {
+	keyword     string
+	muscleGroup int
+}{
+	{"wrist curl", 11}, {"reverse curl", 11}, {"farmer", 11}, {"forearm", 11},
+	{"leg curl", 9}, {"romanian deadlift", 9}, {"stiff leg", 9}, {"good morning", 9}, {"hip thrust", 9}, {"glute", 9}, {"hamstring", 9},
+	{"calf", 10}, {"calves", 10},
+	{"leg press", 8}, {"leg extension", 8}, {"squat", 8}, {"lunge", 8}, {"step up", 8}, {"hack", 8},
+	{"rear delt", 6}, {"reverse fly", 6}, {"face pull", 6},
+	{"lateral raise", 5}, {"upright row", 5},
+	{"overhead press", 4}, {"shoulder press", 4}, {"military press", 4}, {"arnold press", 4}, {"front raise", 4},
+	{"skullcrusher", 3}, {"skull crusher", 3}, {"tricep", 3}, {"pushdown", 3}, {"dip", 3}, {"close grip bench", 3},
+	{"curl", 2}, {"bicep", 2},
+	{"bench press", 0}, {"chest", 0}, {"fly", 0}, {"push up", 0}, {"pec deck", 0},
+	{"deadlift", 1}, {"row", 1}, {"pull up", 1}, {"pulldown", 1}, {"chin up", 1}, {"pullover", 1}, {"shrug", 1}, {"back extension", 1},
+	{"crunch", 7}, {"plank", 7}, {"sit up", 7}, {"leg raise", 7}, {"ab wheel", 7}, {"russian twist", 7}, {"abs", 7},
+}
+
+// ImportResponse reports what an import wrote and which rows of the export it could not use
+type ImportResponse struct {
+	Format string `json:"format"`
+	// Workouts is the number of workouts written, Duplicates the number already imported by an earlier upload
+	Workouts   int `json:"workouts"`
+	Duplicates int `json:"duplicates"`
+	Sets       int `json:"sets"`
+	// SkippedRows counts rows without a lifting set, e.g. rest timers and cardio, and rows that could not be parsed
+	SkippedRows int `json:"skippedRows"`
+	// UnmappedExercises are the exercise names that matched none of the user's exercises nor a known muscle group
+	UnmappedExercises []string         `json:"unmappedExercises"`
+	Errors            []ImportRowError `json:"errors"`
+	// Incomplete is set when the deadline passed before every workout was written. Uploading the export again
+	// writes the rest, as the workouts already written count as duplicates
+	Incomplete bool `json:"incomplete"`
+}
+
+// ImportRowError is a row of the export that could not be parsed, by its line number within the file
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// importedSet is one set parsed out of a row of an export, with its weight already in kilograms
+type importedSet struct {
+	workoutName  string
+	performedAt  time.Time
+	exerciseName string
+	set          SetDoc
+}
+
+// errSkipRow marks rows that hold no lifting set, which are skipped without being reported
+var errSkipRow = errors.New("row holds no lifting set")
+
+// ImportHistory imports the workout history of a Strong or Hevy CSV export, sent as the request body, into the user's
+// workout logs. Workouts that were imported before are left as they are, so the same export can be uploaded again
+func (rtr *router) ImportHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	uid := r.PathValue("uid")
+	idToken := r.PathValue("idToken")
+
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "import history", err)
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format != "" && format != importFormatStrong && format != importFormatHevy {
+		rtr.StatusError(w, r, "import history", validationError(fieldError{Field: "format", Message: "must be one of strong hevy"}))
+		return
+	}
+	units := strings.ToLower(r.URL.Query().Get("units"))
+	if units == "" {
+		var userDocument map[string]interface{}
+		err := rtr.withProfile(r.Context(), uid, func() (err error) {
+			userDocument, err = rtr.config.store.GetUserDocument(r.Context(), uid)
+			return err
+		})
+		if err != nil {
+			rtr.StatusError(w, r, "import history", fmt.Errorf("error while trying to fetch user profile: %w", err))
+			return
+		}
+		profile, err := userProfileFromDocument(userDocument)
+		if err != nil {
+			rtr.StatusError(w, r, "import history", err)
+			return
+		}
+		units, _ = weightUnit(profile.Settings.UnitsPreference)
+	}
+	if units != "kg" && units != "lb" {
+		rtr.StatusError(w, r, "import history", validationError(fieldError{Field: "units", Message: "must be one of kg lb"}))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBodyBytes))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		rtr.StatusError(w, r, "import history", decodeError(err))
+		return
+	}
+	if err != nil {
+		rtr.StatusError(w, r, "import history", fmt.Errorf("error while reading the uploaded export: %w", err))
+		return
+	}
+
+	report := &ImportResponse{UnmappedExercises: []string{}, Errors: []ImportRowError{}}
+	sets, err := parseImport(body, format, units, report)
+	if err != nil {
+		rtr.StatusError(w, r, "import history", err)
+		return
+	}
+
+	routines, err := userRoutines(r.Context(), rtr.config.store, uid)
+	if err != nil {
+		rtr.StatusError(w, r, "import history", err)
+		return
+	}
+
+	logs := groupWorkoutLogs(uid, report.Format, sets, newExerciseMapper(routines), report)
+	writes := make([]*workoutLogWrite, 0, len(logs))
+	for _, workoutLog := range logs {
+		writes = append(writes, &workoutLogWrite{ID: workoutLogID(workoutLog), Log: workoutLog})
+	}
+	err = rtr.config.store.CreateWorkoutLogDocuments(r.Context(), writes)
+	for _, write := range writes {
+		if write.Duplicate {
+			report.Duplicates++
+		}
+		if !write.Created {
+			continue
+		}
+
+		report.Workouts++
+		for _, exercise := range write.Log.Exercises {
+			report.Sets += len(exercise.Sets)
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		loggerFrom(r.Context()).Warn("import ran out of time", "uid", uid, "workouts", report.Workouts, "pending", len(writes)-report.Workouts-report.Duplicates)
+		report.Incomplete = true
+		rtr.StatusOK(w, r, http.StatusOK, "imported part of the workout history before the deadline, upload the export again to import the rest", report)
+		return
+	}
+	if err != nil {
+		rtr.StatusError(w, r, "import history", fmt.Errorf("error while trying to store imported workouts: %w", err))
+		return
+	}
+
+	rtr.StatusOK(w, r, http.StatusOK, "successfully imported workout history", report)
+}
+
+// parseImport parses every row of the export into sets, detecting its format from the header when none is given.
+// Rows that cannot be parsed are recorded within the report rather than failing the import
+func parseImport(body []byte, format, units string, report *ImportResponse) ([]importedSet, error) {
+	body = bytes.TrimPrefix(body, []byte("\ufeff"))
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.Comma = detectDelimiter(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, validationError(fieldError{Field: "body", Message: "must be a CSV export with a header row"})
+	}
+	if err != nil {
+		return nil, validationError(fieldError{Field: "body", Message: fmt.Sprintf("is not valid CSV: %v", err)})
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	if format == "" {
+		format = detectImportFormat(columns)
+	}
+	parseRow, err := importRowParser(format, columns, units)
+	if err != nil {
+		return nil, err
+	}
+	report.Format = format
+
+	sets := make([]importedSet, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		// the reader only knows the positions of fields it read, which a malformed row may have none of
+		line := 0
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			line = parseErr.Line
+		} else if len(record) > 0 {
+			line, _ = reader.FieldPos(0)
+		}
+		if err == nil {
+			var set importedSet
+			if set, err = parseRow(record); err == nil {
+				sets = append(sets, set)
+				continue
+			}
+		}
+
+		report.SkippedRows++
+		if errors.Is(err, errSkipRow) {
+			continue
+		}
+		if len(report.Errors) < maxImportRowErrors {
+			report.Errors = append(report.Errors, ImportRowError{Line: line, Error: err.Error()})
+		}
+	}
+
+	return sets, nil
+}
+
+// detectDelimiter picks the delimiter of the header row, Strong exports use semicolons in locales with decimal commas
+func detectDelimiter(body []byte) rune {
+	firstLine, _, _ := bufio.NewReader(bytes.NewReader(body)).ReadLine()
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		return ';'
+	}
+	return ','
+}
+
+func detectImportFormat(columns map[string]int) string {
+	if _, ok := columns["exercise_title"]; ok {
+		return importFormatHevy
+	}
+	if _, ok := columns["exercise name"]; ok {
+		return importFormatStrong
+	}
+	return ""
+}
+
+// importRowParser returns the parser of the rows of the format, checking that the header has every column it reads
+func importRowParser(format string, columns map[string]int, units string) (func(record []string) (importedSet, error), error) {
+	var required []string
+	switch format {
+	case importFormatStrong:
+		required = []string{"date", "workout name", "exercise name", "set order", "weight", "reps"}
+	case importFormatHevy:
+		required = []string{"title", "start_time", "exercise_title", "set_type", "reps"}
+		if _, ok := columns["weight_kg"]; !ok {
+			required = append(required, "weight_lbs")
+		}
+	default:
+		return nil, validationError(fieldError{Field: "format", Message: "could not be detected from the header, must be a Strong or Hevy CSV export"})
+	}
+
+	var missing []string
+	for _, column := range required {
+		if _, ok := columns[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, validationError(fieldError{Field: "body", Message: fmt.Sprintf("is missing the %s columns of a %s export", strings.Join(missing, ", "), format)})
+	}
+
+	field := func(record []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	if format == importFormatHevy {
+		return func(record []string) (importedSet, error) {
+			return parseHevyRow(record, field)
+		}, nil
+	}
+	return func(record []string) (importedSet, error) {
+		return parseStrongRow(record, field, units)
+	}, nil
+}
+
+// parseStrongRow parses a row of a Strong export. Set Order is the set number, or W, D and F for warm-up, drop and
+// failure sets, and newer exports add rest timer rows and a Weight Unit column
+func parseStrongRow(record []string, field func([]string, string) string, units string) (importedSet, error) {
+	setOrder := field(record, "set order")
+	if strings.EqualFold(setOrder, "rest timer") {
+		return importedSet{}, errSkipRow
+	}
+
+	performedAt, err := parseImportTime(field(record, "date"), strongDateLayouts)
+	if err != nil {
+		return importedSet{}, err
+	}
+
+	if unit := strings.ToLower(field(record, "weight unit")); unit != "" {
+		units = strings.TrimSuffix(unit, "s")
+	}
+	set, err := parseImportSet(field(record, "reps"), field(record, "weight"), units)
+	if err != nil {
+		return importedSet{}, err
+	}
+	set.IsWarmUp = strings.EqualFold(setOrder, "w")
+	set.IsDropSet = strings.EqualFold(setOrder, "d")
+
+	return importedSet{
+		workoutName:  field(record, "workout name"),
+		performedAt:  performedAt,
+		exerciseName: field(record, "exercise name"),
+		set:          set,
+	}, nil
+}
+
+// parseHevyRow parses a row of a Hevy export, whose weights are in kilograms or pounds depending on the column present
+func parseHevyRow(record []string, field func([]string, string) string) (importedSet, error) {
+	performedAt, err := parseImportTime(field(record, "start_time"), hevyDateLayouts)
+	if err != nil {
+		return importedSet{}, err
+	}
+
+	weight, units := field(record, "weight_kg"), "kg"
+	if weight == "" {
+		weight, units = field(record, "weight_lbs"), "lb"
+	}
+	set, err := parseImportSet(field(record, "reps"), weight, units)
+	if err != nil {
+		return importedSet{}, err
+	}
+	setType := strings.ToLower(field(record, "set_type"))
+	set.IsWarmUp = setType == "warmup"
+	set.IsDropSet = setType == "dropset"
+
+	return importedSet{
+		workoutName:  field(record, "title"),
+		performedAt:  performedAt,
+		exerciseName: field(record, "exercise_title"),
+		set:          set,
+	}, nil
+}
+
+func parseImportTime(value string, layouts []string) (time.Time, error) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date %q is not in a known format", value)
+}
+
+// parseImportSet parses the reps and weight of a set, converting the weight into kilograms. Sets without reps, e.g.
+// cardio and timed exercises, are skipped
+func parseImportSet(repsValue, weightValue, units string) (SetDoc, error) {
+	if repsValue == "" || repsValue == "0" {
+		return SetDoc{}, errSkipRow
+	}
+	reps, err := strconv.ParseFloat(repsValue, 64)
+	if err != nil || reps < 0 || reps != float64(int(reps)) {
+		return SetDoc{}, fmt.Errorf("reps %q is not a whole number", repsValue)
+	}
+
+	weight := 0.0
+	if weightValue != "" {
+		// semicolon separated exports write decimals with a comma
+		weight, err = strconv.ParseFloat(strings.Replace(weightValue, ",", ".", 1), 64)
+		if err != nil || weight < 0 {
+			return SetDoc{}, fmt.Errorf("weight %q is not a number", weightValue)
+		}
+	}
+
+	switch units {
+	case "kg":
+	case "lb":
+		weight = roundWeight(weight / poundsPerKilogram)
+	default:
+		return SetDoc{}, fmt.Errorf("weight unit %q is neither kg nor lbs", units)
+	}
+
+	return SetDoc{Reps: int(reps), Weight: weight}, nil
+}
+
+// exerciseMapper maps the exercise names of an export onto the user's exercises, falling back on exerciseCatalog
+type exerciseMapper struct {
+	known map[string]ExerciseDoc
+}
+
+func newExerciseMapper(routines []*RoutineResponse) *exerciseMapper {
+	mapper := &exerciseMapper{known: map[string]ExerciseDoc{}}
+	for _, routine := range routines {
+		for _, workout := range routine.Workouts {
+			for _, exercise := range workout.Exercises {
+				mapper.known[normalizeExerciseName(exercise.ExerciseName)] = ExerciseDoc{MuscleGroup: exercise.MuscleGroup, ExerciseName: exercise.ExerciseName}
+			}
+		}
+	}
+	return mapper
+}
+
+// mapExercise returns the exercise the name maps onto, and false when its muscle group is unknown
+func (m *exerciseMapper) mapExercise(name string) (ExerciseDoc, bool) {
+	normalized := normalizeExerciseName(name)
+	if exercise, ok := m.known[normalized]; ok {
+		return exercise, true
+	}
+
+	for _, entry := range exerciseCatalog {
+		if strings.Contains(" "+normalized+" ", " "+entry.keyword) {
+			return ExerciseDoc{MuscleGroup: entry.muscleGroup, ExerciseName: name}, true
+		}
+	}
+	return ExerciseDoc{MuscleGroup: -1, ExerciseName: name}, false
+}
+
+// normalizeExerciseName lowercases the name and turns punctuation into spaces, e.g. "Pull-Up (Weighted)" into
+// "pull up weighted"
+func normalizeExerciseName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// groupWorkoutLogs groups the sets into workouts, by start time and name, and their exercises in the order the export
+// lists them
+func groupWorkoutLogs(uid, source string, sets []importedSet, mapper *exerciseMapper, report *ImportResponse) []*WorkoutLogDocument {
+	logs := make([]*WorkoutLogDocument, 0)
+	byWorkout := map[string]*WorkoutLogDocument{}
+	unmapped := map[string]bool{}
+
+	for _, set := range sets {
+		key := set.performedAt.Format(time.RFC3339) + "|" + set.workoutName
+		workoutLog, ok := byWorkout[key]
+		if !ok {
+			workoutLog = &WorkoutLogDocument{UID: uid, WorkoutName: set.workoutName, PerformedAt: set.performedAt, Source: source}
+			byWorkout[key] = workoutLog
+			logs = append(logs, workoutLog)
+		}
+
+		exercise, mapped := mapper.mapExercise(set.exerciseName)
+		if !mapped && !unmapped[set.exerciseName] {
+			unmapped[set.exerciseName] = true
+			report.UnmappedExercises = append(report.UnmappedExercises, set.exerciseName)
+		}
+
+		i := len(workoutLog.Exercises) - 1
+		for ; i >= 0; i-- {
+			if workoutLog.Exercises[i].ExerciseName == exercise.ExerciseName {
+				break
+			}
+		}
+		if i < 0 {
+			workoutLog.Exercises = append(workoutLog.Exercises, exercise)
+			i = len(workoutLog.Exercises) - 1
+		}
+		workoutLog.Exercises[i].Sets = append(workoutLog.Exercises[i].Sets, set.set)
+	}
+
+	sort.Strings(report.UnmappedExercises)
+	return logs
+}
+
+// workoutLogID derives the document ID of an imported workout from what identifies it within the export, so that
+// importing the same export twice finds the workouts already stored
+func workoutLogID(workoutLog *WorkoutLogDocument) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		workoutLog.UID, workoutLog.Source, workoutLog.PerformedAt.Format(time.RFC3339), workoutLog.WorkoutName,
+	}, "|")))
+	return hex.EncodeToString(sum[:20])
+}
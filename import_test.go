@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const strongExport = `Date;Workout Name;Duration;Exercise Name;Set Order;Weight;Reps;Distance;Seconds;Notes;Workout Notes;RPE
+2024-03-04 18:02:11;Push Day;1h 2m;Bench Press (Barbell);W;40;10;0;0;;;
+2024-03-04 18:02:11;Push Day;1h 2m;Bench Press (Barbell);1;100,5;5;0;0;;;
+2024-03-04 18:02:11;Push Day;1h 2m;Bench Press (Barbell);Rest Timer;0;0;0;90;;;
+2024-03-04 18:02:11;Push Day;1h 2m;Triceps Pushdown (Cable);D;30;12;0;0;;;
+2024-03-04 18:02:11;Push Day;1h 2m;Treadmill;1;0;0;2;600;;;
+2024-03-06 07:30:00;Leg Day;50m;Squat (Barbell);1;140;3;0;0;;;
+2024-03-06 07:30:00;Leg Day;50m;Squat (Barbell);2;140;three;0;0;;;
+yesterday;Leg Day;50m;Squat (Barbell);3;140;3;0;0;;;
+`
+
+const hevyExport = `"title","start_time","end_time","description","exercise_title","superset_id","exercise_notes","set_index","set_type","weight_lbs","reps","distance_miles","duration_seconds","rpe"
+"Upper","12 Mar 2024, 17:09","12 Mar 2024, 18:10","","Lat Pulldown (Cable)","","","0","warmup","100","12","","",""
+"Upper","12 Mar 2024, 17:09","12 Mar 2024, 18:10","","Lat Pulldown (Cable)","","","1","normal","220.46","8","","",""
+"Upper","12 Mar 2024, 17:09","12 Mar 2024, 18:10","","Zottman Thing","","","0","dropset","25","10","","",""
+`
+
+func importRequest(t *testing.T, rtr *router, query, body string) (int, *ImportResponse, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/user/import/uid-1/uid-1"+query, strings.NewReader(body)))
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	envelope := struct {
+		Data *ImportResponse `json:"data"`
+		Code string          `json:"code"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		t.Fatalf("unexpected error decoding the response: %v", err)
+	}
+	return resp.StatusCode, envelope.Data, envelope.Code
+}
+
+func workoutLogs(t *testing.T, store *memoryStorage, uid string) []map[string]interface{} {
+	t.Helper()
+
+	logs, err := store.GetWorkoutLogs(context.Background(), uid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return logs
+}
+
+func TestImportHistory_Strong(t *testing.T) {
+	store := newMemoryStorage()
+	if err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1", Settings: UserDocumentSettings{UnitsPreference: "Metric"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rtr := getMemoryTestRouter(store)
+
+	status, report, _ := importRequest(t, rtr, "", strongExport)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", status)
+	}
+	if report.Format != importFormatStrong || report.Workouts != 2 || report.Sets != 4 || report.Duplicates != 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	// the rest timer and the treadmill are skipped silently, the bad reps and date are reported by line
+	if report.SkippedRows != 4 || len(report.Errors) != 2 || report.Errors[0].Line != 8 || report.Errors[1].Line != 9 {
+		t.Errorf("expected 4 skipped rows and errors on lines 8 and 9, got %d %+v", report.SkippedRows, report.Errors)
+	}
+
+	logs := workoutLogs(t, store, "uid-1")
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 workout logs, got %d", len(logs))
+	}
+	var push map[string]interface{}
+	for _, workoutLog := range logs {
+		if workoutLog["WorkoutName"] == "Push Day" {
+			push = workoutLog
+		}
+	}
+	if push == nil {
+		t.Fatalf("expected a Push Day log, got %v", logs)
+	}
+	if want := time.Date(2024, 3, 4, 18, 2, 11, 0, time.UTC); !push["PerformedAt"].(time.Time).Equal(want) || push["Source"] != importFormatStrong {
+		t.Errorf("unexpected log: %v", push)
+	}
+
+	exercises := push["Exercises"].([]interface{})
+	bench := exercises[0].(map[string]interface{})
+	pushdown := exercises[1].(map[string]interface{})
+	if bench["ExerciseName"] != "Bench Press (Barbell)" || bench["MuscleGroup"] != int64(0) || pushdown["MuscleGroup"] != int64(3) {
+		t.Errorf("unexpected exercises: %v", exercises)
+	}
+	sets := bench["Sets"].([]interface{})
+	warmUp, working := sets[0].(map[string]interface{}), sets[1].(map[string]interface{})
+	if warmUp["IsWarmUp"] != true || working["Weight"] != 100.5 || working["Reps"] != int64(5) {
+		t.Errorf("unexpected sets: %v", sets)
+	}
+	if dropSet := pushdown["Sets"].([]interface{})[0].(map[string]interface{}); dropSet["IsDropSet"] != true {
+		t.Errorf("expected the D set to be a drop set, got %v", dropSet)
+	}
+}
+
+func TestImportHistory_Duplicates(t *testing.T) {
+	store := newMemoryStorage()
+	rtr := getMemoryTestRouter(store)
+
+	if status, report, _ := importRequest(t, rtr, "?units=kg", strongExport); status != http.StatusOK || report.Workouts != 2 {
+		t.Fatalf("expected the first import to write 2 workouts, got %d %+v", status, report)
+	}
+
+	status, report, _ := importRequest(t, rtr, "?units=kg", strongExport)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", status)
+	}
+	if report.Workouts != 0 || report.Duplicates != 2 || report.Sets != 0 {
+		t.Errorf("expected the re-import to only find duplicates, got %+v", report)
+	}
+	if logs := workoutLogs(t, store, "uid-1"); len(logs) != 2 {
+		t.Errorf("expected the re-import to leave 2 workout logs, got %d", len(logs))
+	}
+}
+
+// deadlineStorage writes the first limit workout logs of a bulk write, then fails as if the deadline had passed
+type deadlineStorage struct {
+	*memoryStorage
+	limit int
+}
+
+func (s *deadlineStorage) CreateWorkoutLogDocuments(ctx context.Context, writes []*workoutLogWrite) error {
+	if len(writes) <= s.limit {
+		return s.memoryStorage.CreateWorkoutLogDocuments(ctx, writes)
+	}
+	if err := s.memoryStorage.CreateWorkoutLogDocuments(ctx, writes[:s.limit]); err != nil {
+		return err
+	}
+	return fmt.Errorf("error while trying to create workout log document (%s): %w", writes[s.limit].ID, context.DeadlineExceeded)
+}
+
+func TestImportHistory_Deadline(t *testing.T) {
+	store := newMemoryStorage()
+	rtr := getMemoryTestRouter(&deadlineStorage{memoryStorage: store, limit: 1})
+
+	status, report, _ := importRequest(t, rtr, "?units=kg", strongExport)
+	if status != http.StatusOK {
+		t.Fatalf("expected the partial report with status 200 but got %d", status)
+	}
+	if !report.Incomplete || report.Workouts != 1 || report.Duplicates != 0 {
+		t.Errorf("expected an incomplete import of 1 workout, got %+v", report)
+	}
+
+	// uploading the export again writes the rest
+	status, report, _ = importRequest(t, getMemoryTestRouter(store), "?units=kg", strongExport)
+	if status != http.StatusOK || report.Incomplete || report.Workouts != 1 || report.Duplicates != 1 {
+		t.Errorf("expected the second upload to write the remaining workout, got %d %+v", status, report)
+	}
+	if logs := workoutLogs(t, store, "uid-1"); len(logs) != 2 {
+		t.Errorf("expected 2 workout logs, got %d", len(logs))
+	}
+}
+
+func TestImportHistory_Hevy(t *testing.T) {
+	store := newMemoryStorage()
+	// exercises the user already has keep their name and muscle group
+	seedRoutine(t, store, "uid-1", "Pull", time.Now(), []map[string]interface{}{{
+		"WorkoutName": "Back",
+		"Exercises":   []map[string]interface{}{{"MuscleGroup": 1, "ExerciseName": "Lat pulldown - cable", "Sets": []map[string]interface{}{}}},
+	}})
+	rtr := getMemoryTestRouter(store)
+
+	status, report, _ := importRequest(t, rtr, "?units=kg", hevyExport)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", status)
+	}
+	if report.Format != importFormatHevy || report.Workouts != 1 || report.Sets != 3 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if !reflect.DeepEqual(report.UnmappedExercises, []string{"Zottman Thing"}) {
+		t.Errorf("expected Zottman Thing to be unmapped, got %v", report.UnmappedExercises)
+	}
+
+	logs := workoutLogs(t, store, "uid-1")
+	if len(logs) != 1 {
+		t.Fatalf("expected 1 workout log, got %d", len(logs))
+	}
+	exercises := logs[0]["Exercises"].([]interface{})
+	pulldown := exercises[0].(map[string]interface{})
+	if pulldown["ExerciseName"] != "Lat pulldown - cable" || pulldown["MuscleGroup"] != int64(1) {
+		t.Errorf("expected the user's exercise, got %v", pulldown)
+	}
+	// weight_lbs ignores the units query parameter, the column names the unit
+	if working := pulldown["Sets"].([]interface{})[1].(map[string]interface{}); working["Weight"] != 100.0 {
+		t.Errorf("expected 220.46 lb to be stored as 100 kg, got %v", working["Weight"])
+	}
+	if unmapped := exercises[1].(map[string]interface{}); unmapped["MuscleGroup"] != int64(-1) {
+		t.Errorf("expected an unmapped exercise to have no muscle group, got %v", unmapped)
+	}
+}
+
+func TestImportHistory_Rejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"empty body", "?units=kg", "", http.StatusUnprocessableEntity, string(codeValidationFailed)},
+		{"unknown header", "?units=kg", "a,b,c\n1,2,3\n", http.StatusUnprocessableEntity, string(codeValidationFailed)},
+		{"missing columns", "?format=strong&units=kg", "Date,Exercise Name\n", http.StatusUnprocessableEntity, string(codeValidationFailed)},
+		{"unknown format", "?format=fitbod&units=kg", strongExport, http.StatusUnprocessableEntity, string(codeValidationFailed)},
+		{"unknown units", "?units=stone", strongExport, http.StatusUnprocessableEntity, string(codeValidationFailed)},
+		{"too large", "?units=kg", strings.Repeat("a", maxImportBodyBytes+1), http.StatusRequestEntityTooLarge, string(codeBodyTooLarge)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rtr := getMemoryTestRouter(newMemoryStorage())
+			status, _, code := importRequest(t, rtr, tt.query, tt.body)
+			if status != tt.wantStatus || code != tt.wantCode {
+				t.Errorf("expected %d %s, got %d %s", tt.wantStatus, tt.wantCode, status, code)
+			}
+		})
+	}
+}
+
+func TestImportHistory_MalformedQuote(t *testing.T) {
+	header, rows, _ := strings.Cut(strongExport, "\n")
+	export := header + "\n" + `"2024-03-04 18:02:11"x;Push Day;1h 2m;Bench Press (Barbell);1;100;5;0;0;;;` + "\n" + rows
+
+	status, report, _ := importRequest(t, getMemoryTestRouter(newMemoryStorage()), "?units=kg", export)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", status)
+	}
+	if report.Workouts != 2 || len(report.Errors) == 0 || report.Errors[0].Line != 2 {
+		t.Errorf("expected the malformed row to be reported on line 2 and the rest imported, got %+v", report)
+	}
+}
+
+func TestExerciseMapper(t *testing.T) {
+	mapper := newExerciseMapper(nil)
+
+	tests := []struct {
+		name            string
+		wantMuscleGroup int
+	}{
+		{"Bench Press (Dumbbell)", 0},
+		{"Romanian Deadlift (Barbell)", 9},
+		{"Deadlift (Barbell)", 1},
+		{"Hammer Curl (Dumbbell)", 2},
+		{"Lying Leg Curl (Machine)", 9},
+		{"Seated Calf Raise", 10},
+		{"Face Pull (Cable)", 6},
+		{"Lateral Raise (Dumbbell)", 5},
+		{"Pull-Up", 1},
+		{"Squat (Smith Machine)", 8},
+		{"Crossbody Thing", -1},
+	}
+
+	for _, tt := range tests {
+		exercise, _ := mapper.mapExercise(tt.name)
+		if exercise.MuscleGroup != tt.wantMuscleGroup || exercise.ExerciseName != tt.name {
+			t.Errorf("mapExercise(%q) = %+v, want muscle group %d", tt.name, exercise, tt.wantMuscleGroup)
+		}
+	}
+}
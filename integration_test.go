@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emoral435/repetiswole/pkg/client"
+)
+
+// newTestServer serves routes() over HTTP so the API can be driven through pkg/client
+func newTestServer(t *testing.T) *client.Client {
+	t.Helper()
+
+	rtr := getTestRouter()
+	srv := httptest.NewServer(routes(rtr.config, rtr.logger))
+	t.Cleanup(srv.Close)
+
+	return client.New(srv.URL, client.WithHTTPClient(srv.Client()))
+}
+
+// newMemoryTestServer is newTestServer backed by store, where every idToken signs in as the uid it names
+func newMemoryTestServer(t *testing.T, store storage) *client.Client {
+	t.Helper()
+
+	rtr := getMemoryTestRouter(store)
+	srv := httptest.NewServer(routes(rtr.config, rtr.logger))
+	t.Cleanup(srv.Close)
+
+	return client.New(srv.URL, client.WithHTTPClient(srv.Client()))
+}
+
+func TestIntegration_Status(t *testing.T) {
+	c := newTestServer(t)
+
+	status, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Code != http.StatusOK || status.Message != "Server status:" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestIntegration_OpenAPI(t *testing.T) {
+	c := newTestServer(t)
+
+	doc, err := c.OpenAPI(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spec := struct {
+		Paths map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(doc, &spec); err != nil {
+		t.Fatalf("error decoding spec: %v", err)
+	}
+	if _, ok := spec.Paths["/api/v1/user/routine/single/{routineRefId}/{idToken}"]; !ok {
+		t.Errorf("expected the routine route within the spec")
+	}
+}
+
+func TestIntegration_ValidationErrorsReachTheClient(t *testing.T) {
+	c := newTestServer(t)
+
+	_, err := c.RegisterEmail(context.Background(), client.RegisterEmailRequest{
+		Email:       "not-an-email",
+		Password:    "123",
+		DisplayName: "Tester",
+	})
+
+	if !client.IsCode(err, client.CodeValidationFailed) {
+		t.Fatalf("expected a validation_failed error, got %v", err)
+	}
+	if details := err.(*client.Error).Details; len(details) != 2 {
+		t.Errorf("expected email and password field errors, got %+v", details)
+	}
+}
+
+func TestIntegration_FirebaseNil(t *testing.T) {
+	c := newTestServer(t)
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		"GetProfile": func() error {
+			_, err := c.GetProfile(ctx, "test-user-123", "fake-token")
+			return err
+		},
+		"ListRoutines": func() error {
+			_, err := c.ListRoutines(ctx, "test-user-123", "fake-token")
+			return err
+		},
+		"CreateRoutine": func() error {
+			_, err := c.CreateRoutine(ctx, "test-user-123", "fake-token", "Push Day")
+			return err
+		},
+		"GetRoutine": func() error {
+			_, err := c.GetRoutine(ctx, "fake-routine-id", "fake-token")
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			err := call()
+			if !client.IsCode(err, client.CodeInternal) {
+				t.Errorf("expected an internal error for nil Firebase client, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIntegration_ConcurrentRoutineCreationRespectsQuota(t *testing.T) {
+	store := newMemoryStorage()
+	err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1", Settings: UserDocumentSettings{SubscriptionTier: freeSubscriptionTier}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := newMemoryTestServer(t, store)
+
+	const requests = 20
+	errs := make(chan error, requests)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := c.CreateRoutine(context.Background(), "uid-1", "uid-1", "Push Day")
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !client.IsCode(err, client.CodeQuotaExceeded):
+			t.Errorf("expected a quota_exceeded error, got %v", err)
+		}
+	}
+	if created != freeRoutineLimit {
+		t.Errorf("expected %d of %d parallel creations to succeed, got %d", freeRoutineLimit, requests, created)
+	}
+
+	routines, err := store.GetUserRoutines(context.Background(), "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(routines) != freeRoutineLimit {
+		t.Errorf("expected the Free tier limit of %d routines to hold, stored %d", freeRoutineLimit, len(routines))
+	}
+}
+
+// newSessionTestServer is newMemoryTestServer with sessions, and an http.Client keeping the session cookie
+func newSessionTestServer(t *testing.T, rtr *router) *client.Client {
+	t.Helper()
+
+	rtr.config.sessions = &fakeSessions{}
+	srv := httptest.NewServer(routes(rtr.config, rtr.logger))
+	t.Cleanup(srv.Close)
+
+	httpClient := srv.Client()
+	httpClient.Jar, _ = cookiejar.New(nil)
+	return client.New(srv.URL, client.WithHTTPClient(httpClient))
+}
+
+func TestIntegration_Session(t *testing.T) {
+	store := newMemoryStorage()
+	c := newSessionTestServer(t, getMemoryTestRouter(store))
+
+	session, err := c.Login(context.Background(), "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.UID != "uid-1" {
+		t.Errorf("unexpected session: %+v", session)
+	}
+
+	// the server refuses a POST carrying the session cookie without its CSRF token, which the client sends by itself
+	if _, err := c.CreateRoutine(context.Background(), "uid-1", client.SessionIdToken, "Push Day"); err != nil {
+		t.Fatalf("expected the session to authenticate the routine creation, got %v", err)
+	}
+	if _, err := c.Session(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := c.RevokeSessions(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.Session(context.Background()); !client.IsCode(err, client.CodeInvalidToken) {
+		t.Errorf("expected no session once revoked, got %v", err)
+	}
+}
+
+// TestIntegration_ClientCoversOpenAPI drives every operation of the OpenAPI document through pkg/client, so that a
+// route added to apiOperations without a client method fails here. Whether a call succeeds does not matter, only
+// that it reached the operation's route, as counted by the metrics
+func TestIntegration_ClientCoversOpenAPI(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.metrics = newMetrics()
+	c := newSessionTestServer(t, rtr)
+	ctx := context.Background()
+
+	// the metrics are scraped by Prometheus rather than read through the client
+	notWrapped := map[string]bool{"GET /metrics": true}
+
+	calls := []func() error{
+		func() error { _, err := c.Status(ctx); return err },
+		func() error { _, err := c.Healthz(ctx); return err },
+		func() error { _, err := c.Readyz(ctx); return err },
+		func() error { _, err := c.OpenAPI(ctx); return err },
+		func() error { _, err := c.RegisterEmail(ctx, client.RegisterEmailRequest{}); return err },
+		func() error { _, err := c.Login(ctx, "uid-1"); return err },
+		func() error { _, err := c.Session(ctx); return err },
+		func() error {
+			_, err := c.LinkProvider(ctx, "uid-1", "uid-1", client.LinkProviderRequest{})
+			return err
+		},
+		func() error { _, err := c.GetProfile(ctx, "uid-1", "uid-1"); return err },
+		func() error { _, err := c.UpdateProfile(ctx, "uid-1", "uid-1", client.ProfileUpdate{}); return err },
+		func() error { _, err := c.CreateRoutine(ctx, "uid-1", "uid-1", "Push Day"); return err },
+		func() error { _, err := c.ListRoutines(ctx, "uid-1", "uid-1"); return err },
+		func() error { _, err := c.GetRoutine(ctx, "routine-1", "uid-1"); return err },
+		func() error { _, err := c.UpdateRoutine(ctx, "routine-1", "uid-1", client.Routine{}); return err },
+		func() error { return c.ExportCSV(ctx, "uid-1", "uid-1", io.Discard) },
+		func() error {
+			_, err := c.ImportHistory(ctx, "uid-1", "uid-1", "", "", strings.NewReader("Date\n"))
+			return err
+		},
+		func() error { return c.ExportArchive(ctx, "uid-1", "uid-1", io.Discard) },
+		func() error {
+			_, err := c.RestoreArchive(ctx, "uid-1", "uid-1", "", strings.NewReader("{}"))
+			return err
+		},
+		func() error { _, err := c.SendBillingEvent(ctx, []byte("{}"), ""); return err },
+		func() error { return c.Logout(ctx) },
+		func() error { return c.RevokeSessions(ctx) },
+	}
+	for _, call := range calls {
+		_ = call()
+	}
+
+	families, err := rtr.config.metrics.registry.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reached := map[string]bool{}
+	for _, family := range families {
+		if family.GetName() != "repetiswole_http_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			reached[labels["method"]+" "+labels["route"]] = true
+		}
+	}
+
+	for _, op := range apiOperations {
+		if !notWrapped[op.Pattern] && !reached[op.Pattern] {
+			t.Errorf("no pkg/client method reached %q, wrap it in the client", op.Pattern)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// integrityViolation is a field of a stored document that does not match the Go schema of its collection
+type integrityViolation struct {
+	Collection string `json:"collection"`
+	DocumentId string `json:"documentId"`
+	// Field is the path of the field within the document, e.g. Workouts[0].Exercises
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+	// Repair is the safe repair applied, or that would be applied, and empty when the violation needs a person
+	Repair string `json:"repair,omitempty"`
+}
+
+type integrityReport struct {
+	DryRun          bool                 `json:"dryRun"`
+	UsersScanned    int                  `json:"usersScanned"`
+	RoutinesScanned int                  `json:"routinesScanned"`
+	Violations      []integrityViolation `json:"violations"`
+	// Repaired counts the documents written back with their repairs
+	Repaired int `json:"repaired"`
+}
+
+var (
+	userDocumentType    = reflect.TypeOf(UserDocument{})
+	routineDocumentType = reflect.TypeOf(RoutineDocument{})
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// fieldDefaults are the values a missing or empty field is safely repaired to, by "Type.Field"
+var fieldDefaults = map[string]interface{}{
+	"UserDocumentSettings.UnitsPreference":  "Metric",
+	"UserDocumentSettings.SubscriptionTier": freeSubscriptionTier,
+}
+
+// fieldRules check the values of a field beyond their type, by "Type.Field", returning the problem if any
+var fieldRules = map[string]func(value interface{}) string{
+	"UserDocument.UID":                      requireNonEmpty,
+	"RoutineDocument.UID":                   requireNonEmpty,
+	"UserDocumentSettings.UnitsPreference":  requireOneOf("Metric", "Imperial"),
+	"UserDocumentSettings.SubscriptionTier": requireOneOf(freeSubscriptionTier, premiumSubscriptionTier),
+	"ExerciseDoc.MuscleGroup": func(value interface{}) string {
+		if muscleGroup, _ := value.(int64); muscleGroup < 0 || muscleGroup >= int64(len(muscleGroupNames)) {
+			return fmt.Sprintf("muscle group %d is not between 0 and %d", muscleGroup, len(muscleGroupNames)-1)
+		}
+		return ""
+	},
+}
+
+func requireNonEmpty(value interface{}) string {
+	if value == "" {
+		return "is empty"
+	}
+	return ""
+}
+
+func requireOneOf(allowed ...string) func(value interface{}) string {
+	return func(value interface{}) string {
+		for _, a := range allowed {
+			if value == a {
+				return ""
+			}
+		}
+		return fmt.Sprintf("%q is not one of %s", value, strings.Join(allowed, ", "))
+	}
+}
+
+// integrityChecker walks the data of a document against its Go type, repairing in place what is safe to repair
+type integrityChecker struct {
+	collection string
+	documentId string
+	violations []integrityViolation
+}
+
+func (c *integrityChecker) report(field, problem, repair string) {
+	c.violations = append(c.violations, integrityViolation{Collection: c.collection, DocumentId: c.documentId, Field: field, Problem: problem, Repair: repair})
+}
+
+// repaired reports whether any violation of the document was repaired
+func (c *integrityChecker) repaired() bool {
+	for _, violation := range c.violations {
+		if violation.Repair != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// migrate upgrades data to the current schema version first, as the Go types are only the schema of that version.
+// It returns false for documents written by a newer server, which cannot be checked
+func (c *integrityChecker) migrate(data map[string]interface{}) (bool, error) {
+	stored, err := migrateDocument(c.collection, data)
+	if err != nil {
+		return false, err
+	}
+	current := schemaVersions[c.collection]
+	switch {
+	case stored < current:
+		c.report("SchemaVersion", fmt.Sprintf("is version %d, not %d", stored, current), fmt.Sprintf("migrated to version %d", current))
+	case stored > current:
+		c.report("SchemaVersion", fmt.Sprintf("is version %d, newer than the %d this server knows", stored, current), "")
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkStruct checks the fields of data against the struct type t, reporting fields the schema does not know of
+func (c *integrityChecker) checkStruct(data map[string]interface{}, t reflect.Type, path string) {
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		known[field.Name] = true
+		key := t.Name() + "." + field.Name
+		fieldPath := joinFieldPath(path, field.Name)
+
+		value, ok := data[field.Name]
+		if !ok || value == "" {
+			if def, found := fieldDefaults[key]; found {
+				data[field.Name] = def
+				c.report(fieldPath, "is missing", fmt.Sprintf("set to %v", def))
+				continue
+			}
+		}
+		if !ok {
+			if field.Type.Kind() == reflect.Slice {
+				data[field.Name] = []interface{}{}
+				c.report(fieldPath, "is missing", "set to an empty list")
+				continue
+			}
+			c.report(fieldPath, "is missing", "")
+			continue
+		}
+
+		data[field.Name] = c.checkValue(value, field.Type, fieldPath)
+		if rule, found := fieldRules[key]; found {
+			if problem := rule(data[field.Name]); problem != "" {
+				c.report(fieldPath, problem, "")
+			}
+		}
+	}
+
+	unknown := make([]string, 0)
+	for name := range data {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		c.report(joinFieldPath(path, name), "is not a field of "+t.Name(), "")
+	}
+}
+
+// checkValue checks value against the type t, returning it, or its repaired replacement
+func (c *integrityChecker) checkValue(value interface{}, t reflect.Type, path string) interface{} {
+	switch {
+	case t == timeType:
+		if _, ok := value.(time.Time); !ok {
+			c.report(path, fmt.Sprintf("is a %T, not a timestamp", value), "")
+		}
+	case t.Kind() == reflect.Struct:
+		data, ok := value.(map[string]interface{})
+		if !ok {
+			c.report(path, fmt.Sprintf("is a %T, not a map", value), "")
+			return value
+		}
+		c.checkStruct(data, t, path)
+	case t.Kind() == reflect.Slice:
+		if value == nil {
+			c.report(path, "is null", "set to an empty list")
+			return []interface{}{}
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			c.report(path, fmt.Sprintf("is a %T, not a list", value), "")
+			return value
+		}
+		for i := range values {
+			values[i] = c.checkValue(values[i], t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case t.Kind() == reflect.String:
+		if _, ok := value.(string); !ok {
+			c.report(path, fmt.Sprintf("is a %T, not a string", value), "")
+		}
+	case t.Kind() == reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			c.report(path, fmt.Sprintf("is a %T, not a boolean", value), "")
+		}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		return c.checkNumber(value, true, path)
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return c.checkNumber(value, false, path)
+	}
+	return value
+}
+
+// checkNumber accepts any number where a float is expected, and repairs numbers stored as strings, or whole
+// floats where an integer is expected
+func (c *integrityChecker) checkNumber(value interface{}, integer bool, path string) interface{} {
+	switch number := value.(type) {
+	case int64:
+		return value
+	case float64:
+		if !integer {
+			return value
+		}
+		if number != math.Trunc(number) {
+			c.report(path, fmt.Sprintf("%v is not a whole number", number), "")
+			return value
+		}
+		c.report(path, "is a float, not an integer", "converted to an integer")
+		return int64(number)
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err != nil || (integer && parsed != math.Trunc(parsed)) {
+			c.report(path, fmt.Sprintf("%q is not a number", number), "")
+			return value
+		}
+		if integer {
+			c.report(path, "is a string, not a number", "converted to an integer")
+			return int64(parsed)
+		}
+		c.report(path, "is a string, not a number", "converted to a number")
+		return parsed
+	}
+	c.report(path, fmt.Sprintf("is a %T, not a number", value), "")
+	return value
+}
+
+// checkIntegrity checks every user and routine document against UserDocument and RoutineDocument, writing the
+// repaired documents back unless dryRun is set
+func checkIntegrity(ctx context.Context, store storage, dryRun bool) (*integrityReport, error) {
+	report := &integrityReport{DryRun: dryRun, Violations: []integrityViolation{}}
+
+	users, err := store.GetAllUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch every user: %w", err)
+	}
+	for _, user := range users {
+		refId, _ := user["RefId"].(string)
+		delete(user, "RefId")
+		checker := &integrityChecker{collection: "users", documentId: refId}
+		checkable, err := checker.migrate(user)
+		if err != nil {
+			return nil, err
+		}
+		if checkable {
+			checker.checkStruct(user, userDocumentType, "")
+		}
+		report.UsersScanned++
+		report.Violations = append(report.Violations, checker.violations...)
+
+		uid, _ := user["UID"].(string)
+		if dryRun || !checker.repaired() || uid == "" {
+			continue
+		}
+		// like migrate-documents, every top-level field is written back by its path, which leaves unknown fields alone
+		if err := store.UpdateUserDocument(ctx, uid, user); err != nil {
+			return nil, fmt.Errorf("error after repairing %d documents: %w", report.Repaired, err)
+		}
+		report.Repaired++
+	}
+
+	routines, err := store.GetAllRoutines(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch every routine: %w", err)
+	}
+	for _, routine := range routines {
+		refId, _ := routine["RefId"].(string)
+		delete(routine, "RefId")
+		checker := &integrityChecker{collection: "routines", documentId: refId}
+		checkable, err := checker.migrate(routine)
+		if err != nil {
+			return nil, err
+		}
+		if checkable {
+			checker.checkStruct(routine, routineDocumentType, "")
+		}
+		report.RoutinesScanned++
+		report.Violations = append(report.Violations, checker.violations...)
+
+		if dryRun || !checker.repaired() {
+			continue
+		}
+		// routines are replaced whole, which also drops the fields migrations renamed
+		if err := store.UpdateOneUserRoutine(ctx, refId, routine); err != nil {
+			return nil, fmt.Errorf("error after repairing %d documents: %w", report.Repaired, err)
+		}
+		report.Repaired++
+	}
+
+	return report, nil
+}
+
+// checkIntegrityCommand reports every violation of the schema without changing anything
+func (a *admin) checkIntegrityCommand(ctx context.Context, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("check-integrity", flag.ContinueOnError)
+	if err := parseAdminFlags(fs, args); err != nil {
+		return nil, err
+	}
+
+	return checkIntegrity(ctx, unmigrated(a.store), true)
+}
+
+// repairIntegrityCommand applies the safe repairs, leaving the other violations to be fixed by hand
+func (a *admin) repairIntegrityCommand(ctx context.Context, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("repair-integrity", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report the repairs without applying them")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return nil, err
+	}
+
+	return checkIntegrity(ctx, unmigrated(a.store), *dryRun)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// seedIntegrityViolations stores a user and routines the way older versions of the server, or hand edits, left them
+func seedIntegrityViolations(t *testing.T) (*memoryStorage, string, string) {
+	t.Helper()
+
+	store := newMemoryStorage()
+	store.collections["users"]["user-1"] = map[string]interface{}{
+		"UID":         "uid-1",
+		"CurrentGoal": "Bench 140",
+		"Metrics":     map[string]interface{}{"Height": "180", "JoinDate": time.Now(), "Weight": int64(80)},
+		"Settings":    map[string]interface{}{"UnitsPreference": "Metric", "SubscriptionExpiresAt": time.Time{}},
+	}
+	misspelled := seedRoutine(t, store, "uid-1", "Push Day", time.Now(), []map[string]interface{}{{
+		"WorkoutName": "Bench",
+		"Excersices": []map[string]interface{}{{
+			"MuscleGroup":  0,
+			"ExerciseName": "Bench Press",
+			"Sets":         []map[string]interface{}{{"Reps": 5, "Weight": 100, "IsDropSet": false, "IsWarmUp": false}},
+		}},
+	}})
+	broken := seedRoutine(t, store, "", "Leg Day", time.Now(), []map[string]interface{}{{
+		"WorkoutName": "Squat",
+		"Exercises":   []map[string]interface{}{{"MuscleGroup": 14, "ExerciseName": "Squat", "Sets": nil}},
+		"Notes":       "heavy",
+	}})
+	return store, misspelled, broken
+}
+
+func TestCheckIntegrity_DryRun(t *testing.T) {
+	store, misspelled, broken := seedIntegrityViolations(t)
+
+	report, err := checkIntegrity(context.Background(), store, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.UsersScanned != 1 || report.RoutinesScanned != 2 || report.Repaired != 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	expected := []integrityViolation{
+		{Collection: "users", DocumentId: "user-1", Field: "Metrics.Height", Problem: "is a string, not a number", Repair: "converted to a number"},
+		{Collection: "users", DocumentId: "user-1", Field: "SchemaVersion", Problem: fmt.Sprintf("is version 0, not %d", userSchemaVersion), Repair: fmt.Sprintf("migrated to version %d", userSchemaVersion)},
+		{Collection: "routines", DocumentId: misspelled, Field: "SchemaVersion", Problem: "is version 0, not 1", Repair: "migrated to version 1"},
+		{Collection: "routines", DocumentId: broken, Field: "SchemaVersion", Problem: "is version 0, not 1", Repair: "migrated to version 1"},
+		{Collection: "routines", DocumentId: broken, Field: "UID", Problem: "is empty"},
+		{Collection: "routines", DocumentId: broken, Field: "Workouts[0].Exercises[0].Sets", Problem: "is null", Repair: "set to an empty list"},
+		{Collection: "routines", DocumentId: broken, Field: "Workouts[0].Exercises[0].MuscleGroup", Problem: "muscle group 14 is not between 0 and 11"},
+		{Collection: "routines", DocumentId: broken, Field: "Workouts[0].Notes", Problem: "is not a field of WorkoutDoc"},
+	}
+	found := map[integrityViolation]bool{}
+	for _, violation := range report.Violations {
+		found[violation] = true
+	}
+	for _, violation := range expected {
+		if !found[violation] {
+			t.Errorf("expected violation %+v, got %+v", violation, report.Violations)
+		}
+	}
+	if len(report.Violations) != len(expected) {
+		t.Errorf("expected %d violations but got %d: %+v", len(expected), len(report.Violations), report.Violations)
+	}
+
+	routine, err := store.GetAllRoutines(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, r := range routine {
+		workout := r["Workouts"].([]interface{})[0].(map[string]interface{})
+		if r["RefId"] == misspelled && workout["Excersices"] == nil {
+			t.Errorf("expected a dry run to leave the misspelled field alone, got %v", workout)
+		}
+	}
+}
+
+func TestCheckIntegrity_Repair(t *testing.T) {
+	store, misspelled, _ := seedIntegrityViolations(t)
+
+	report, err := checkIntegrity(context.Background(), store, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Repaired != 3 {
+		t.Errorf("expected the user and both routines to be repaired, got %d", report.Repaired)
+	}
+
+	user, err := store.GetUserDocument(context.Background(), "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if height := user["Metrics"].(map[string]interface{})["Height"]; height != float64(180) {
+		t.Errorf("expected Height to be converted to 180, got %#v", height)
+	}
+	if tier := user["Settings"].(map[string]interface{})["SubscriptionTier"]; tier != freeSubscriptionTier {
+		t.Errorf("expected the migration to set the missing tier to Free, got %v", tier)
+	}
+
+	routines, err := userRoutines(context.Background(), store, "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(routines) != 1 || routines[0].RefId != misspelled || len(routines[0].Workouts) != 1 || len(routines[0].Workouts[0].Exercises) != 1 {
+		t.Fatalf("expected the misspelled exercises to be readable after the repair, got %+v", routines)
+	}
+
+	// what could not be repaired is still reported, and nothing is written again
+	report, err = checkIntegrity(context.Background(), store, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Repaired != 0 || len(report.Violations) != 3 {
+		t.Errorf("expected only the violations needing a person to be left, got %+v", report)
+	}
+}
+
+func TestCheckIntegrity_FractionalMetrics(t *testing.T) {
+	store := newMemoryStorage()
+	profile := newUserDocument("uid-1", []string{passwordProvider})
+	profile.Metrics.Height, profile.Metrics.Weight = 180.5, 72.5
+	if err := store.CreateUserDocument(context.Background(), profile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	report, err := checkIntegrity(context.Background(), store, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(report.Violations) != 0 {
+		t.Errorf("expected a weight of 72.5 to be valid, got %+v", report.Violations)
+	}
+}
+
+func TestAdmin_CheckIntegrity(t *testing.T) {
+	store, _, _ := seedIntegrityViolations(t)
+
+	code, stdout, stderr := runAdminCommand(t, store, "check-integrity")
+	if code != 0 {
+		t.Fatalf("expected exit code 0 but got %d: %s", code, stderr)
+	}
+	report := integrityReport{}
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.DryRun || len(report.Violations) == 0 {
+		t.Errorf("expected a dry run report of the violations, got %+v", report)
+	}
+	// the admin's store migrates what it reads, the check sees the documents as stored
+	outdated := false
+	for _, violation := range report.Violations {
+		outdated = outdated || violation.Field == "SchemaVersion"
+	}
+	if !outdated {
+		t.Errorf("expected the outdated schema versions to be reported, got %+v", report.Violations)
+	}
+
+	if code, _, _ := runAdminCommand(t, store, "check-integrity", "--dry-run"); code != 2 {
+		t.Errorf("expected check-integrity to take no flags, got exit code %d", code)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader carries the ID of a request. A valid ID sent by the client or a proxy is kept, otherwise one is
+// generated, and it is always echoed back on the response
+const requestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+type loggerContextKey struct{}
+
+type requestInfoContextKey struct{}
+
+// requestInfo collects what handlers learn about a request that belongs in its access log
+type requestInfo struct {
+	mu  sync.Mutex
+	uid string
+}
+
+// newLogger creates the logger of the service, writing format ("text" or "json") at or above level
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("error parsing log level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// loggerFrom returns the request-scoped logger stored in ctx by logRequests, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// setRequestUID records the user a request was authorized as, for its access log and later log lines
+func setRequestUID(ctx context.Context, uid string) {
+	if info, ok := ctx.Value(requestInfoContextKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		info.uid = uid
+		info.mu.Unlock()
+	}
+}
+
+// logRequests gives every request an ID and a logger carrying it, then writes an access log line once the request
+// has been served. Paths are never logged, as they contain idTokens; the route pattern the ServeMux matched is
+func logRequests(logger *slog.Logger, next http.Handler) http.Handler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		info := &requestInfo{}
+		requestLogger := logger.With("request_id", requestID)
+		ctx := withLogger(r.Context(), requestLogger)
+		ctx = context.WithValue(ctx, requestInfoContextKey{}, info)
+		r = r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		info.mu.Lock()
+		uid := info.uid
+		info.mu.Unlock()
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		requestLogger.LogAttrs(r.Context(), level, "request served",
+			slog.String("method", r.Method),
+			slog.String("route", routeLabel(r.Pattern)),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("uid", uid),
+		)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	return strings.IndexFunc(id, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r))
+	}) == -1
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("error generating request ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
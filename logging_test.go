@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// logLines decodes the JSON log lines written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("error decoding log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestLogRequests_AccessLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := newLogger(buf, "json", "info")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	store := newMemoryStorage()
+	if err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rtr := getMemoryTestRouter(store)
+	handler := routes(rtr.config, logger)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/user/uid-1/uid-1", nil))
+
+	requestID := w.Header().Get(requestIDHeader)
+	if len(requestID) != 32 {
+		t.Fatalf("expected a generated request ID, got %q", requestID)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected a single access log line, got %d: %s", len(lines), buf.String())
+	}
+
+	line := lines[0]
+	want := map[string]interface{}{
+		"msg":        "request served",
+		"request_id": requestID,
+		"method":     "GET",
+		"route":      "/api/v1/user/{uid}/{idToken}",
+		"status":     float64(http.StatusOK),
+		"uid":        "uid-1",
+		"bytes":      float64(w.Body.Len()),
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, line[key])
+		}
+	}
+	if _, ok := line["duration"]; !ok {
+		t.Errorf("expected a duration within %v", line)
+	}
+}
+
+func TestLogRequests_ErrorsCarryTheRequestID(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := newLogger(buf, "json", "info")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// without Firebase every authorized route fails with an internal error
+	rtr := getTestRouter()
+	handler := routes(rtr.config, logger)
+
+	req := httptest.NewRequest("GET", "/api/v1/user/uid-1/uid-1", nil)
+	req.Header.Set(requestIDHeader, "from-the-proxy-42")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get(requestIDHeader) != "from-the-proxy-42" {
+		t.Errorf("expected the incoming request ID to be kept, got %q", w.Header().Get(requestIDHeader))
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("expected an error and an access log line, got %s", buf.String())
+	}
+	for _, line := range lines {
+		if line["request_id"] != "from-the-proxy-42" || line["level"] != "ERROR" {
+			t.Errorf("expected an error carrying the request ID, got %v", line)
+		}
+	}
+	if strings.Contains(buf.String(), "/api/v1/user/uid-1") {
+		t.Errorf("expected the path, which holds the idToken, not to be logged")
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"", false},
+		{"4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"railway:edge-1.req_9", true},
+		{"has space", false},
+		{"line\nbreak", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Errorf("expected an unknown format to fail")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "text", "loud"); err == nil {
+		t.Errorf("expected an unknown level to fail")
+	}
+
+	buf := &bytes.Buffer{}
+	logger, err := newLogger(buf, "text", "warn")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("expected only warnings to be logged, got %q", buf.String())
+	}
+}
@@ -4,52 +4,160 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"google.golang.org/api/option"
 )
 
 func main() {
-	// create the logger
+	// operational tasks run as `repetiswole admin <command>` instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// log as text until the settings say otherwise
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	// get our keys from the environment
-	env, err := initEnvironmentVariables()
+	// resolve the settings from the config file, environment and flags
+	env, err := environment()
 	if err != nil {
-		logger.Error(fmt.Errorf("error in trying to get environment variables: %w", err).Error())
+		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
+	settings, printConfig, err := loadSettings(os.Args[1:], env)
+	if err != nil {
+		logger.Error(fmt.Errorf("error loading settings: %w", err).Error())
+		os.Exit(2)
+	}
+
+	if printConfig {
+		if err := settings.print(os.Stdout); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		if err := settings.validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := settings.validate(); err != nil {
+		logger.Error(err.Error())
+		os.Exit(2)
+	}
+
+	logger, err = newLogger(os.Stdout, settings.LogFormat, settings.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// storage and anything outside of a request log through the default logger
+	slog.SetDefault(logger)
+
+	// the root context is handed to every request and storage call, and is cancelled once the server has drained
+	rootCtx, cancelRoot := context.WithCancel(context.Background())
+	defer cancelRoot()
+
 	// initialize firebase app
-	opt := option.WithCredentialsFile(env["GOOGLE_APPLICATION_CREDENTIALS"])
-	firebaseApp, err := firebase.NewApp(context.Background(), nil, opt)
+	opt := option.WithCredentialsFile(settings.GoogleApplicationCredentials)
+	firebaseApp, err := firebase.NewApp(rootCtx, nil, opt)
 	if err != nil {
 		logger.Error(fmt.Errorf("error initializing firebase app: %w", err).Error())
 		os.Exit(1)
 	}
 
-	// Set port environment variable, given by Railway, to 8080
 	cfg := &config{
-		frontendBuildPath: "./frontend/dist/",
-		port:              8080,
-		ctx:               context.Background(),
-		env:               env,
-		firebaseApp:       firebaseApp,
+		frontendBuildPath:    settings.FrontendBuildPath,
+		port:                 settings.Port,
+		ctx:                  rootCtx,
+		firebaseApp:          firebaseApp,
+		readTimeout:          settings.ReadTimeout,
+		writeTimeout:         settings.WriteTimeout,
+		idleTimeout:          settings.IdleTimeout,
+		shutdownTimeout:      settings.ShutdownTimeout,
+		publicDomain:         settings.PublicDomain,
+		billingWebhookSecret: settings.StripeWebhookSecret,
+		firebaseAPIKey:       settings.GoogleFirebaseAPIKey,
+		metrics:              newMetrics(),
+		metricsToken:         settings.MetricsToken,
+		trustedProxies:       settings.TrustedProxies,
+		corsOrigins:          allowedOrigins(settings.PublicDomain, settings.CORSOrigins),
+		hsts:                 settings.Mode == "production",
+	}
+	if settings.RateLimitStore == "memory" {
+		cfg.rateLimiter = newMemoryRateLimitStore()
+	}
+
+	frontend, frontendFrom, err := frontendSource(settings.FrontendSource, settings.FrontendBuildPath)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
+	cfg.frontend = frontend
+
+	tracerProvider, err := newTracerProvider(rootCtx, settings.TraceExporter, settings.TraceEndpoint, os.Stdout)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	if tracerProvider != nil {
+		cfg.tracerProvider = tracerProvider
+	}
+	cfg.store = instrumentStorage(traceStorage(migrateStorage(newFirestoreStorage(cfg)), cfg.tracerProvider, "firestore"), cfg.metrics)
 
 	// create the server
 	srv := &http.Server{
-		Addr:     fmt.Sprintf("0.0.0.0:%d", cfg.port),
-		Handler:  routes(cfg, logger),
-		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		Addr:              fmt.Sprintf("0.0.0.0:%d", cfg.port),
+		Handler:           routes(cfg, logger),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ReadTimeout:       cfg.readTimeout,
+		ReadHeaderTimeout: cfg.readTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+		IdleTimeout:       cfg.idleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return rootCtx
+		},
 	}
 
-	logger.Info("starting the server", "port", cfg.port, "serving the frontend from the path", cfg.frontendBuildPath)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		logger.Error(fmt.Errorf("error listening on %s: %w", srv.Addr, err).Error())
+		os.Exit(1)
+	}
 
-	// Start the server
-	err = srv.ListenAndServe()
-	logger.Error(err.Error())
-	os.Exit(1)
+	logger.Info("starting the server", "port", cfg.port, "frontend source", frontendFrom, "frontend build path", cfg.frontendBuildPath)
+
+	// Railway sends SIGTERM on redeploys, and SIGINT is a local ctrl+c
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Start the server, blocking until it has shut down
+	serveErr := serve(signalCtx, srv, ln, cfg.shutdownTimeout, logger)
+
+	// abort any storage work that outlived the drain, then release the long-lived clients
+	cancelRoot()
+	if err := cfg.close(); err != nil {
+		logger.Error(fmt.Errorf("error closing firestore client: %w", err).Error())
+	}
+	if tracerProvider != nil {
+		// flush the spans of the last requests
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(flushCtx); err != nil {
+			logger.Error(fmt.Errorf("error flushing spans: %w", err).Error())
+		}
+		cancelFlush()
+	}
+
+	if serveErr != nil {
+		logger.Error(serveErr.Error())
+		os.Exit(1)
+	}
 }
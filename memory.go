@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStorage is an in-process storage for tests and local development. Documents are stored the way Firestore
+// returns them, structs become maps keyed by field name and integers become int64, and collections are scanned in
+// document ID order, checking the context before every document like the Firestore iterators do
+type memoryStorage struct {
+	mu          sync.Mutex
+	collections map[string]map[string]map[string]interface{}
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		collections: map[string]map[string]map[string]interface{}{
+			"users":           {},
+			"routines":        {},
+			"billingEvents":   {},
+			"routineCounters": {},
+			"workoutLogs":     {},
+		},
+	}
+}
+
+func (s *memoryStorage) CreateUserDocument(ctx context.Context, userDoc *UserDocument) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("error while trying to create new user document: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collections["users"][newDocumentID()] = toDocumentData(userDoc)
+	return nil
+}
+
+func (s *memoryStorage) CreateUserDocumentIfMissing(ctx context.Context, userDoc *UserDocument) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, fmt.Errorf("error while trying to create missing user document (uid: %s): %w", userDoc.UID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, data := range s.collections["users"] {
+		if data["UID"] == userDoc.UID {
+			return false, nil
+		}
+	}
+
+	s.collections["users"][newDocumentID()] = toDocumentData(userDoc)
+	return true, nil
+}
+
+func (s *memoryStorage) GetUserDocument(ctx context.Context, uid string) (map[string]interface{}, error) {
+	_, doc, err := s.find(ctx, "users", func(_ string, data map[string]interface{}) bool {
+		return data["UID"] == uid
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while iterating through the user documents to retrieve documents: %w", err)
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", uid, ErrNotFound)
+	}
+
+	return doc, nil
+}
+
+func (s *memoryStorage) UpdateUserDocument(ctx context.Context, uid string, requestedUpdates map[string]interface{}) error {
+	id, _, err := s.find(ctx, "users", func(_ string, data map[string]interface{}) bool {
+		return data["UID"] == uid
+	})
+	if err != nil {
+		return fmt.Errorf("error while iterating through the user documents to retrieve documents: %w", err)
+	}
+	if id == "" {
+		return fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", uid, ErrNotFound)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc := s.collections["users"][id]
+	for path, val := range requestedUpdates {
+		setPath(doc, strings.Split(path, "."), toDocumentValue(reflect.ValueOf(val)))
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) GetAllUsers(ctx context.Context) ([]map[string]interface{}, error) {
+	users := make([]map[string]interface{}, 0)
+	err := s.scan(ctx, "users", func(id string, data map[string]interface{}) bool {
+		data["RefId"] = id
+		users = append(users, data)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while iterating through the user documents: %w", err)
+	}
+
+	return users, nil
+}
+
+// CreateRoutineDocument holds the lock from reading the user document to writing the count, like the Firestore
+// transaction
+func (s *memoryStorage) CreateRoutineDocument(ctx context.Context, uid, routineName string, quota routineQuota) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("error while trying to create new routine document for user (uid: %s): %w", uid, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.routineCount(uid)
+	if quota != nil {
+		userDoc, err := s.userDocument(uid)
+		if err != nil {
+			return "", err
+		}
+		if err := routineQuotaError(quota, userDoc, uid, count); err != nil {
+			return "", fmt.Errorf("error while trying to create new routine document for user (uid: %s): %w", uid, err)
+		}
+	}
+
+	s.collections["routineCounters"][uid] = toDocumentData(RoutineCounterDocument{UID: uid, Count: count + 1})
+	id := newDocumentID()
+	s.collections["routines"][id] = toDocumentData(RoutineDocument{
+		SchemaVersion: routineSchemaVersion,
+		RoutineName:   routineName,
+		UID:           uid,
+		CreatedAt:     time.Now(),
+		Workouts:      []WorkoutDoc{},
+	})
+
+	return id, nil
+}
+
+// CreateRoutineDocuments holds the lock for every routine, like the Firestore transactions
+func (s *memoryStorage) CreateRoutineDocuments(ctx context.Context, uid string, writes []*routineWrite, quota routineQuota) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var userDoc map[string]interface{}
+	if quota != nil {
+		var err error
+		if userDoc, err = s.userDocument(uid); err != nil {
+			return err
+		}
+	}
+
+	count := s.routineCount(uid)
+	for _, write := range writes {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("error while trying to create routine documents for user (uid: %s): %w", uid, err)
+		}
+		if quota != nil {
+			err := routineQuotaError(quota, userDoc, uid, count)
+			if errors.Is(err, ErrQuotaExceeded) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		count++
+		s.collections["routineCounters"][uid] = toDocumentData(RoutineCounterDocument{UID: uid, Count: count})
+		write.RefId = newDocumentID()
+		s.collections["routines"][write.RefId] = toDocumentData(write.Document)
+		write.Written = true
+	}
+	return nil
+}
+
+// userDocument returns a copy of the user's document, which the caller must hold the lock for
+func (s *memoryStorage) userDocument(uid string) (map[string]interface{}, error) {
+	for _, data := range s.collections["users"] {
+		if data["UID"] == uid {
+			return toDocumentData(data), nil
+		}
+	}
+	return nil, fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", uid, ErrNotFound)
+}
+
+func (s *memoryStorage) GetUserRoutines(ctx context.Context, uid string) ([]map[string]interface{}, error) {
+	rd := make([]map[string]interface{}, 0)
+	err := s.scan(ctx, "routines", func(id string, data map[string]interface{}) bool {
+		if data["UID"] == uid {
+			data["RefId"] = id
+			rd = append(rd, data)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while iterating through the routine documents to retrieve documents: %w", err)
+	}
+
+	return rd, nil
+}
+
+func (s *memoryStorage) GetOneUserRoutine(ctx context.Context, routineRefId string) (map[string]interface{}, error) {
+	_, doc, err := s.find(ctx, "routines", func(id string, _ map[string]interface{}) bool {
+		return id == routineRefId
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while iterating through the routine documents to retrieve documents: %w", err)
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("error while trying to find routine associated with routine ref (%s): %w", routineRefId, ErrNotFound)
+	}
+
+	return doc, nil
+}
+
+func (s *memoryStorage) UpdateOneUserRoutine(ctx context.Context, routineRefId string, routineUpdates map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("error while trying to insert updates for user's routine with routine ID (%s): %w", routineRefId, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.collections["routines"][routineRefId]; !ok {
+		return fmt.Errorf("error, did not find associated user's routine document for routine of %s within routines collection: %w", routineRefId, ErrNotFound)
+	}
+
+	s.collections["routines"][routineRefId] = toDocumentData(routineUpdates)
+	return nil
+}
+
+func (s *memoryStorage) ReplaceRoutineDocuments(ctx context.Context, writes []*routineWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, write := range writes {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("error while trying to replace routine document (%s): %w", write.RefId, err)
+		}
+
+		s.collections["routines"][write.RefId] = toDocumentData(write.Document)
+		write.Written = true
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetAllRoutines(ctx context.Context) ([]map[string]interface{}, error) {
+	rd := make([]map[string]interface{}, 0)
+	err := s.scan(ctx, "routines", func(id string, data map[string]interface{}) bool {
+		data["RefId"] = id
+		rd = append(rd, data)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while iterating through the routine documents: %w", err)
+	}
+
+	return rd, nil
+}
+
+func (s *memoryStorage) DeleteRoutineDocument(ctx context.Context, routineRefId string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("error while trying to delete routine document (%s): %w", routineRefId, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routine, ok := s.collections["routines"][routineRefId]
+	if !ok {
+		return nil
+	}
+	delete(s.collections["routines"], routineRefId)
+
+	uid, _ := routine["UID"].(string)
+	if counter, ok := s.collections["routineCounters"][uid]; ok {
+		if count, _ := counter["Count"].(int64); count > 0 {
+			counter["Count"] = count - 1
+		}
+	}
+	return nil
+}
+
+// routineCount is the user's routine count, from their counter or else by counting their routines. The caller holds
+// the lock
+func (s *memoryStorage) routineCount(uid string) int {
+	if counter, ok := s.collections["routineCounters"][uid]; ok {
+		count, _ := counter["Count"].(int64)
+		return int(count)
+	}
+
+	count := 0
+	for _, data := range s.collections["routines"] {
+		if data["UID"] == uid {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *memoryStorage) CreateWorkoutLogDocuments(ctx context.Context, writes []*workoutLogWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, write := range writes {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("error while trying to create workout log document (%s): %w", write.ID, err)
+		}
+		if _, ok := s.collections["workoutLogs"][write.ID]; ok {
+			write.Duplicate = true
+			continue
+		}
+
+		s.collections["workoutLogs"][write.ID] = toDocumentData(write.Log)
+		write.Created = true
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetWorkoutLogs(ctx context.Context, uid string) ([]map[string]interface{}, error) {
+	logs := make([]map[string]interface{}, 0)
+	err := s.scan(ctx, "workoutLogs", func(id string, data map[string]interface{}) bool {
+		if data["UID"] == uid {
+			data["RefId"] = id
+			logs = append(logs, data)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while iterating through the workout log documents: %w", err)
+	}
+
+	return logs, nil
+}
+
+func (s *memoryStorage) CreateBillingEventDocument(ctx context.Context, eventID, eventType string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, fmt.Errorf("error while trying to create billing event document (%s): %w", eventID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.collections["billingEvents"][eventID]; ok {
+		return false, nil
+	}
+
+	s.collections["billingEvents"][eventID] = map[string]interface{}{
+		"Type":        eventType,
+		"ProcessedAt": time.Now(),
+	}
+	return true, nil
+}
+
+func (s *memoryStorage) DeleteBillingEventDocument(ctx context.Context, eventID string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("error while trying to delete billing event document (%s): %w", eventID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.collections["billingEvents"], eventID)
+	return nil
+}
+
+// UpdateUserSubscription holds the lock from reading the user document to updating it, like the Firestore transaction
+func (s *memoryStorage) UpdateUserSubscription(ctx context.Context, change *subscriptionChange) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, fmt.Errorf("error while trying to update subscription of user (uid: %s): %w", change.UID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, doc := range s.collections["users"] {
+		if doc["UID"] != change.UID {
+			continue
+		}
+
+		updates := subscriptionUpdates(doc, change)
+		for path, val := range updates {
+			setPath(doc, strings.Split(path, "."), toDocumentValue(reflect.ValueOf(val)))
+		}
+		return updates != nil, nil
+	}
+	return false, fmt.Errorf("error, did not find associated user document for UID of %s within users collection: %w", change.UID, ErrNotFound)
+}
+
+func (s *memoryStorage) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// scan calls visit with a copy of every document of the collection until visit returns false
+func (s *memoryStorage) scan(ctx context.Context, collection string, visit func(id string, data map[string]interface{}) bool) error {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.collections[collection]))
+	for id := range s.collections[collection] {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		doc, ok := s.collections[collection][id]
+		if ok {
+			doc = toDocumentData(doc)
+		}
+		s.mu.Unlock()
+
+		if ok && !visit(id, doc) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// find returns the ID and a copy of the first document matching match, or an empty ID if none does
+func (s *memoryStorage) find(ctx context.Context, collection string, match func(id string, data map[string]interface{}) bool) (string, map[string]interface{}, error) {
+	foundID, found := "", map[string]interface{}(nil)
+	err := s.scan(ctx, collection, func(id string, data map[string]interface{}) bool {
+		if match(id, data) {
+			foundID, found = id, data
+			return false
+		}
+		return true
+	})
+
+	return foundID, found, err
+}
+
+func newDocumentID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("error generating document ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func setPath(doc map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[path[len(path)-1]] = value
+}
+
+// toDocumentData converts a struct or map into a new document map, the shape Firestore's DocumentSnapshot.Data returns
+func toDocumentData(v interface{}) map[string]interface{} {
+	data, _ := toDocumentValue(reflect.ValueOf(v)).(map[string]interface{})
+	return data
+}
+
+func toDocumentValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return toDocumentValue(v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = toDocumentValue(v.Index(i))
+		}
+		return values
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		data := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			data[fmt.Sprint(key.Interface())] = toDocumentValue(v.MapIndex(key))
+		}
+		return data
+	case reflect.Struct:
+		data := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.IsExported() {
+				data[field.Name] = toDocumentValue(v.Field(i))
+			}
+		}
+		return data
+	}
+
+	return v.Interface()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemoryStorage_UserDocument(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+
+	if err := store.CreateUserDocument(ctx, &UserDocument{
+		UID:      "uid-1",
+		Metrics:  UserDocumentMetrics{Height: 180},
+		Settings: UserDocumentSettings{UnitsPreference: "Metric", SubscriptionTier: freeSubscriptionTier},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := store.UpdateUserDocument(ctx, "uid-1", map[string]interface{}{
+		"Metrics.Weight":           82.5,
+		"Settings.UnitsPreference": "Imperial",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	userDoc, err := store.GetUserDocument(ctx, "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// documents come back the way Firestore returns them
+	metrics := userDoc["Metrics"].(map[string]interface{})
+	if metrics["Height"] != float64(180) || metrics["Weight"] != 82.5 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+
+	profile, err := userProfileFromDocument(userDoc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if profile.Settings.UnitsPreference != "Imperial" || profile.Settings.SubscriptionTier != freeSubscriptionTier {
+		t.Errorf("unexpected settings: %+v", profile.Settings)
+	}
+
+	if err := store.UpdateUserDocument(ctx, "uid-2", map[string]interface{}{"CurrentGoal": "Run"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryStorage_ReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+
+	refId, err := store.CreateRoutineDocument(ctx, "uid-1", "PPL", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	routine, err := store.GetOneUserRoutine(ctx, refId)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routine["RoutineName"] = "changed"
+
+	routines, err := store.GetUserRoutines(ctx, "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(routines) != 1 || routines[0]["RoutineName"] != "PPL" || routines[0]["RefId"] != refId {
+		t.Errorf("unexpected routines: %+v", routines)
+	}
+}
+
+func TestMemoryStorage_ScanStopsWhenCancelled(t *testing.T) {
+	store := newMemoryStorage()
+	for i := 0; i < 10; i++ {
+		if _, err := store.CreateRoutineDocument(context.Background(), "uid-1", "PPL", nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	visited := 0
+	err := store.scan(ctx, "routines", func(_ string, _ map[string]interface{}) bool {
+		visited++
+		if visited == 3 {
+			cancel()
+		}
+		return true
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the scan to return context.Canceled, got %v", err)
+	}
+	if visited != 3 {
+		t.Errorf("expected the scan to stop after 3 documents, visited %d", visited)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of every latency histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}
+
+// metrics holds every metric of the service within its own registry, served in the Prometheus text format by the
+// /metrics route. A nil *metrics records nothing, so tests and tools can leave it unset
+type metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests        *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+	httpInFlight        prometheus.Gauge
+
+	storageOperations        *prometheus.CounterVec
+	storageOperationDuration *prometheus.HistogramVec
+
+	tokenVerifications        *prometheus.CounterVec
+	tokenVerificationDuration prometheus.Histogram
+
+	rateLimited *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "repetiswole_http_requests_total",
+			Help: "HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "repetiswole_http_request_duration_seconds",
+			Help:    "HTTP request latency by route pattern and method.",
+			Buckets: latencyBuckets,
+		}, []string{"route", "method"}),
+		httpInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "repetiswole_http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}),
+		storageOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "repetiswole_storage_operations_total",
+			Help: "Storage operations by operation and result, the result being ok or the error code of the failure.",
+		}, []string{"operation", "result"}),
+		storageOperationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "repetiswole_storage_operation_duration_seconds",
+			Help:    "Storage operation latency by operation.",
+			Buckets: latencyBuckets,
+		}, []string{"operation"}),
+		tokenVerifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "repetiswole_token_verifications_total",
+			Help: "idToken verifications by result.",
+		}, []string{"result"}),
+		tokenVerificationDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "repetiswole_token_verification_duration_seconds",
+			Help:    "idToken verification latency.",
+			Buckets: latencyBuckets,
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "repetiswole_rate_limited_requests_total",
+			Help: "Requests rejected by a rate limit, by policy and scope (ip or user).",
+		}, []string{"policy", "scope"}),
+	}
+
+	m.registry.MustRegister(
+		m.httpRequests, m.httpRequestDuration, m.httpInFlight,
+		m.storageOperations, m.storageOperationDuration,
+		m.tokenVerifications, m.tokenVerificationDuration,
+		m.rateLimited,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// middleware records every request served by next, labelled by the pattern the ServeMux matched rather than
+// the path, so that uids and idTokens never become label values
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.httpInFlight.Inc()
+		defer m.httpInFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route, method := routeLabel(r.Pattern), methodLabel(r.Method)
+		m.httpRequests.WithLabelValues(route, method, strconv.Itoa(rec.status)).Inc()
+		m.httpRequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeLabel turns "GET /api/v1/user/{uid}/{idToken}" into "/api/v1/user/{uid}/{idToken}"
+func routeLabel(pattern string) string {
+	if pattern == "" {
+		return "unmatched"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
+
+// methodLabel keeps the method label to the methods of the standard library, as a client may send any token as its
+// method and each would otherwise become a series of its own
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodHead, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+func (m *metrics) observeStorage(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	m.storageOperations.WithLabelValues(operation, resultLabel(err)).Inc()
+	m.storageOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) observeTokenVerification(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	m.tokenVerifications.WithLabelValues(resultLabel(err)).Inc()
+	m.tokenVerificationDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) observeRateLimited(policy, scope string) {
+	if m == nil {
+		return
+	}
+
+	m.rateLimited.WithLabelValues(policy, scope).Inc()
+}
+
+func resultLabel(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return string(toAPIError(err).Code)
+}
+
+// Metrics serves the metrics in the Prometheus text exposition format. When a metrics token is configured,
+// scrapers must send it as a bearer token
+func (rtr *router) Metrics(w http.ResponseWriter, r *http.Request) {
+	if token := rtr.config.metricsToken; token != "" && !bearerTokenMatches(r, token) {
+		w.Header().Set("Content-Type", "application/json")
+		rtr.StatusError(w, r, "metrics", fmt.Errorf("missing or wrong metrics token: %w", ErrForbidden))
+		return
+	}
+
+	if rtr.config.metrics == nil {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		return
+	}
+	promhttp.HandlerFor(rtr.config.metrics.registry, promhttp.HandlerOpts{ErrorLog: metricsErrorLog{r.Context()}}).ServeHTTP(w, r)
+}
+
+// bearerTokenMatches reports whether the request's Authorization header bears token, comparing in constant time
+func bearerTokenMatches(r *http.Request, token string) bool {
+	given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// metricsErrorLog hands the errors of gathering or writing the metrics to the request's logger
+type metricsErrorLog struct {
+	ctx context.Context
+}
+
+func (l metricsErrorLog) Println(v ...interface{}) {
+	loggerFrom(l.ctx).Error("error writing metrics", "error", fmt.Sprint(v...))
+}
+
+// statusRecorder remembers the status code and counts the bytes written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// instrumentedStorage records the latency and result of every call to the wrapped storage
+type instrumentedStorage struct {
+	next    storage
+	metrics *metrics
+}
+
+func instrumentStorage(next storage, m *metrics) storage {
+	if m == nil {
+		return next
+	}
+	return &instrumentedStorage{next: next, metrics: m}
+}
+
+func (s *instrumentedStorage) CreateUserDocument(ctx context.Context, userDoc *UserDocument) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("create_user", start, err) }(time.Now())
+	return s.next.CreateUserDocument(ctx, userDoc)
+}
+
+func (s *instrumentedStorage) CreateUserDocumentIfMissing(ctx context.Context, userDoc *UserDocument) (_ bool, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("create_user_if_missing", start, err) }(time.Now())
+	return s.next.CreateUserDocumentIfMissing(ctx, userDoc)
+}
+
+func (s *instrumentedStorage) GetUserDocument(ctx context.Context, uid string) (_ map[string]interface{}, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("get_user", start, err) }(time.Now())
+	return s.next.GetUserDocument(ctx, uid)
+}
+
+func (s *instrumentedStorage) UpdateUserDocument(ctx context.Context, uid string, requestedUpdates map[string]interface{}) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("update_user", start, err) }(time.Now())
+	return s.next.UpdateUserDocument(ctx, uid, requestedUpdates)
+}
+
+func (s *instrumentedStorage) CreateRoutineDocument(ctx context.Context, uid, routineName string, quota routineQuota) (_ string, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("create_routine", start, err) }(time.Now())
+	return s.next.CreateRoutineDocument(ctx, uid, routineName, quota)
+}
+
+func (s *instrumentedStorage) CreateRoutineDocuments(ctx context.Context, uid string, writes []*routineWrite, quota routineQuota) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("create_routines", start, err) }(time.Now())
+	return s.next.CreateRoutineDocuments(ctx, uid, writes, quota)
+}
+
+func (s *instrumentedStorage) GetUserRoutines(ctx context.Context, uid string) (_ []map[string]interface{}, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("list_routines", start, err) }(time.Now())
+	return s.next.GetUserRoutines(ctx, uid)
+}
+
+func (s *instrumentedStorage) GetOneUserRoutine(ctx context.Context, routineRefId string) (_ map[string]interface{}, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("get_routine", start, err) }(time.Now())
+	return s.next.GetOneUserRoutine(ctx, routineRefId)
+}
+
+func (s *instrumentedStorage) UpdateOneUserRoutine(ctx context.Context, routineRefId string, routineUpdates map[string]interface{}) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("update_routine", start, err) }(time.Now())
+	return s.next.UpdateOneUserRoutine(ctx, routineRefId, routineUpdates)
+}
+
+func (s *instrumentedStorage) ReplaceRoutineDocuments(ctx context.Context, writes []*routineWrite) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("replace_routines", start, err) }(time.Now())
+	return s.next.ReplaceRoutineDocuments(ctx, writes)
+}
+
+func (s *instrumentedStorage) GetAllUsers(ctx context.Context) (_ []map[string]interface{}, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("get_all_users", start, err) }(time.Now())
+	return s.next.GetAllUsers(ctx)
+}
+
+func (s *instrumentedStorage) GetAllRoutines(ctx context.Context) (_ []map[string]interface{}, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("get_all_routines", start, err) }(time.Now())
+	return s.next.GetAllRoutines(ctx)
+}
+
+func (s *instrumentedStorage) DeleteRoutineDocument(ctx context.Context, routineRefId string) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("delete_routine", start, err) }(time.Now())
+	return s.next.DeleteRoutineDocument(ctx, routineRefId)
+}
+
+func (s *instrumentedStorage) CreateWorkoutLogDocuments(ctx context.Context, writes []*workoutLogWrite) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("create_workout_logs", start, err) }(time.Now())
+	return s.next.CreateWorkoutLogDocuments(ctx, writes)
+}
+
+func (s *instrumentedStorage) GetWorkoutLogs(ctx context.Context, uid string) (_ []map[string]interface{}, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("get_workout_logs", start, err) }(time.Now())
+	return s.next.GetWorkoutLogs(ctx, uid)
+}
+
+func (s *instrumentedStorage) CreateBillingEventDocument(ctx context.Context, eventID, eventType string) (_ bool, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("create_billing_event", start, err) }(time.Now())
+	return s.next.CreateBillingEventDocument(ctx, eventID, eventType)
+}
+
+func (s *instrumentedStorage) DeleteBillingEventDocument(ctx context.Context, eventID string) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("delete_billing_event", start, err) }(time.Now())
+	return s.next.DeleteBillingEventDocument(ctx, eventID)
+}
+
+func (s *instrumentedStorage) UpdateUserSubscription(ctx context.Context, change *subscriptionChange) (_ bool, err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("update_user_subscription", start, err) }(time.Now())
+	return s.next.UpdateUserSubscription(ctx, change)
+}
+
+func (s *instrumentedStorage) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { s.metrics.observeStorage("ping", start, err) }(time.Now())
+	return s.next.Ping(ctx)
+}
+
+// instrumentedVerifier records the latency and result of every idToken verification
+type instrumentedVerifier struct {
+	next    tokenVerifier
+	metrics *metrics
+}
+
+func (v *instrumentedVerifier) VerifyIDToken(ctx context.Context, idToken string) (token *auth.Token, err error) {
+	defer func(start time.Time) {
+		result := err
+		switch {
+		case auth.IsIDTokenExpired(err):
+			result = ErrTokenExpired
+		case auth.IsIDTokenInvalid(err):
+			result = ErrInvalidToken
+		}
+		v.metrics.observeTokenVerification(start, result)
+	}(time.Now())
+	return v.next.VerifyIDToken(ctx, idToken)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsMiddleware_LabelsByRoutePattern(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.metrics = newMetrics()
+	rtr.config.store = instrumentStorage(rtr.config.store, rtr.config.metrics)
+	handler := routes(rtr.config, rtr.logger)
+
+	// a signed in user without a profile gets the default one, so the routines are what is not found
+	for _, path := range []string{"/status", "/api/v1/user/routine/single/routine-1/uid-1", "/api/v1/user/routine/single/routine-2/uid-2"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+	exposition := string(body)
+
+	for _, want := range []string{
+		`repetiswole_http_requests_total{method="GET",route="/status",status="200"} 1`,
+		// both users hit the same pattern, and the routine IDs and idTokens never become labels
+		`repetiswole_http_requests_total{method="GET",route="/api/v1/user/routine/single/{routineRefId}/{idToken}",status="404"} 2`,
+		`repetiswole_http_request_duration_seconds_count{method="GET",route="/api/v1/user/routine/single/{routineRefId}/{idToken}"} 2`,
+		`repetiswole_storage_operations_total{operation="get_routine",result="not_found"} 2`,
+		`repetiswole_storage_operation_duration_seconds_bucket{operation="get_routine",le="+Inf"} 2`,
+		`repetiswole_token_verifications_total{result="ok"} 2`,
+		"repetiswole_http_requests_in_flight 1",
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("expected %q within:\n%s", want, exposition)
+		}
+	}
+	if strings.Contains(exposition, "uid-1") || strings.Contains(exposition, "routine-1") {
+		t.Errorf("expected no uid or routine ID within the metrics")
+	}
+}
+
+func TestMetricsEndpoint_Token(t *testing.T) {
+	rtr := getTestRouter()
+	rtr.config.metrics = newMetrics()
+	rtr.config.metricsToken = "scrape-secret"
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"missing token", "", http.StatusForbidden},
+		{"wrong token", "Bearer nope", http.StatusForbidden},
+		{"right token", "Bearer scrape-secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			rtr.Metrics(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"GET", "GET"},
+		{"DELETE", "DELETE"},
+		{"OPTIONS", "OPTIONS"},
+		{"PROPFIND", "other"},
+		{"get", "other"},
+		{"X-RANDOM-1234", "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if got := methodLabel(tt.method); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *metrics
+
+	store := newMemoryStorage()
+	if instrumentStorage(store, m) != storage(store) {
+		t.Errorf("expected nil metrics to leave the storage unwrapped")
+	}
+
+	m.observeStorage("get_user", time.Now(), nil)
+	if _, err := instrumentStorage(store, newMetrics()).GetUserRoutines(context.Background(), "uid-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// the current SchemaVersion of the documents of each collection. A change to UserDocument, RoutineDocument, or the
+// structs within them bumps the version of its collection and registers a migration from the previous one
+const (
+	userSchemaVersion    = 3
+	routineSchemaVersion = 1
+)
+
+var schemaVersions = map[string]int{
+	"users":    userSchemaVersion,
+	"routines": routineSchemaVersion,
+}
+
+// migration upgrades the data of a document of collection from version from to from+1, in place
+type migration struct {
+	collection  string
+	from        int
+	description string
+	migrate     func(data map[string]interface{})
+}
+
+var migrations = []migration{
+	{"users", 0, "set the subscription settings of users registered before billing", migrateUserSubscription},
+	{"routines", 0, "rename Workouts[].Excersices to Exercises", migrateRoutineExercises},
+	{"users", 1, "set the sign-in providers of users registered before third-party sign-in", migrateUserProviders},
+	{"users", 2, "set the time of the last billing event of users from before events were ordered", migrateUserSubscriptionUpdatedAt},
+}
+
+func migrateUserSubscription(data map[string]interface{}) {
+	settings, ok := data["Settings"].(map[string]interface{})
+	if !ok {
+		settings = map[string]interface{}{}
+		data["Settings"] = settings
+	}
+	if tier, _ := settings["SubscriptionTier"].(string); tier == "" {
+		settings["SubscriptionTier"] = freeSubscriptionTier
+	}
+	if _, ok := settings["SubscriptionExpiresAt"]; !ok {
+		settings["SubscriptionExpiresAt"] = time.Time{}
+	}
+}
+
+// migrateUserProviders lists the email and password every user registered with before third-party providers could
+// be used
+func migrateUserProviders(data map[string]interface{}) {
+	if _, ok := data["Providers"].([]interface{}); !ok {
+		data["Providers"] = []interface{}{passwordProvider}
+	}
+}
+
+// migrateUserSubscriptionUpdatedAt leaves the subscription of users to be changed by the next billing event of any age
+func migrateUserSubscriptionUpdatedAt(data map[string]interface{}) {
+	settings, ok := data["Settings"].(map[string]interface{})
+	if !ok {
+		settings = map[string]interface{}{}
+		data["Settings"] = settings
+	}
+	if _, ok := settings["SubscriptionUpdatedAt"]; !ok {
+		settings["SubscriptionUpdatedAt"] = time.Time{}
+	}
+}
+
+func migrateRoutineExercises(data map[string]interface{}) {
+	workouts, _ := data["Workouts"].([]interface{})
+	for _, w := range workouts {
+		workout, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		exercises, misspelled := workout["Excersices"]
+		if !misspelled {
+			continue
+		}
+		// a workout written after the fix already has Exercises, which wins over the stale misspelled copy
+		if _, ok := workout["Exercises"]; !ok {
+			workout["Exercises"] = exercises
+		}
+		delete(workout, "Excersices")
+	}
+}
+
+// documentSchemaVersion is the SchemaVersion stored in data, where documents from before versions existed are version 0
+func documentSchemaVersion(data map[string]interface{}) int {
+	switch version := data["SchemaVersion"].(type) {
+	case int64:
+		return int(version)
+	case int:
+		return version
+	}
+	return 0
+}
+
+// migrateDocument upgrades data to the current schema version of its collection in place, returning the version it
+// was stored at. Documents written by a newer server are left alone
+func migrateDocument(collection string, data map[string]interface{}) (int, error) {
+	stored := documentSchemaVersion(data)
+	version := stored
+	for version < schemaVersions[collection] {
+		step, ok := findMigration(collection, version)
+		if !ok {
+			return stored, fmt.Errorf("error, no migration of %s documents from schema version %d", collection, version)
+		}
+		step.migrate(data)
+		version++
+	}
+	if version != stored {
+		data["SchemaVersion"] = int64(version)
+	}
+
+	return stored, nil
+}
+
+func findMigration(collection string, from int) (migration, bool) {
+	for _, m := range migrations {
+		if m.collection == collection && m.from == from {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// migratingStorage upgrades the user and routine documents it reads to their current schema version. Writes and
+// the other collections go straight to the wrapped storage
+type migratingStorage struct {
+	storage
+}
+
+func migrateStorage(next storage) storage {
+	return &migratingStorage{storage: next}
+}
+
+// unmigrated returns the storage under migratingStorage, for the operational tasks that look at documents as stored
+func unmigrated(store storage) storage {
+	if migrating, ok := store.(*migratingStorage); ok {
+		return migrating.storage
+	}
+	return store
+}
+
+func (s *migratingStorage) GetUserDocument(ctx context.Context, uid string) (map[string]interface{}, error) {
+	data, err := s.storage.GetUserDocument(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return data, migrateDocuments("users", data)
+}
+
+func (s *migratingStorage) GetAllUsers(ctx context.Context) ([]map[string]interface{}, error) {
+	users, err := s.storage.GetAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return users, migrateDocuments("users", users...)
+}
+
+// CreateRoutineDocument hands quota the user document at the current version, which is the one it is written against
+func (s *migratingStorage) CreateRoutineDocument(ctx context.Context, uid, routineName string, quota routineQuota) (string, error) {
+	return s.storage.CreateRoutineDocument(ctx, uid, routineName, migratedQuota(quota))
+}
+
+func (s *migratingStorage) CreateRoutineDocuments(ctx context.Context, uid string, writes []*routineWrite, quota routineQuota) error {
+	return s.storage.CreateRoutineDocuments(ctx, uid, writes, migratedQuota(quota))
+}
+
+// migratedQuota migrates the user document before handing it to quota
+func migratedQuota(quota routineQuota) routineQuota {
+	if quota == nil {
+		return nil
+	}
+	return func(userDoc map[string]interface{}) (int, error) {
+		if err := migrateDocuments("users", userDoc); err != nil {
+			return 0, err
+		}
+		return quota(userDoc)
+	}
+}
+
+func (s *migratingStorage) GetUserRoutines(ctx context.Context, uid string) ([]map[string]interface{}, error) {
+	routines, err := s.storage.GetUserRoutines(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return routines, migrateDocuments("routines", routines...)
+}
+
+func (s *migratingStorage) GetOneUserRoutine(ctx context.Context, routineRefId string) (map[string]interface{}, error) {
+	data, err := s.storage.GetOneUserRoutine(ctx, routineRefId)
+	if err != nil {
+		return nil, err
+	}
+	return data, migrateDocuments("routines", data)
+}
+
+func (s *migratingStorage) GetAllRoutines(ctx context.Context) ([]map[string]interface{}, error) {
+	routines, err := s.storage.GetAllRoutines(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return routines, migrateDocuments("routines", routines...)
+}
+
+func migrateDocuments(collection string, documents ...map[string]interface{}) error {
+	for _, data := range documents {
+		if _, err := migrateDocument(collection, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type migrationCounts struct {
+	Scanned  int `json:"scanned"`
+	Migrated int `json:"migrated"`
+	// Newer counts the documents written by a server with a newer schema, which are left alone
+	Newer int `json:"newer"`
+}
+
+type migrationReport struct {
+	DryRun   bool            `json:"dryRun"`
+	Users    migrationCounts `json:"users"`
+	Routines migrationCounts `json:"routines"`
+	// Skipped lists the documents that need migrating but cannot be written back, e.g. users without a UID
+	Skipped []string `json:"skipped"`
+}
+
+// migrateAllDocuments writes every user and routine document stored at an older schema version back at the current
+// one, so that the migrations can eventually be retired
+func migrateAllDocuments(ctx context.Context, store storage, dryRun bool) (*migrationReport, error) {
+	report := &migrationReport{DryRun: dryRun, Skipped: []string{}}
+
+	users, err := store.GetAllUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch every user: %w", err)
+	}
+	for _, user := range users {
+		refId, _ := user["RefId"].(string)
+		delete(user, "RefId")
+		report.Users.Scanned++
+
+		stored, err := migrateDocument("users", user)
+		if err != nil {
+			return nil, err
+		}
+		if stored > userSchemaVersion {
+			report.Users.Newer++
+		}
+		if stored >= userSchemaVersion {
+			continue
+		}
+		uid, _ := user["UID"].(string)
+		if uid == "" {
+			report.Skipped = append(report.Skipped, "users/"+refId)
+			continue
+		}
+		if !dryRun {
+			// migrations only add or change fields of the users collection, so writing every top-level field back
+			// by its path replaces the document
+			if err := store.UpdateUserDocument(ctx, uid, user); err != nil {
+				return nil, fmt.Errorf("error after migrating %d users: %w", report.Users.Migrated, err)
+			}
+		}
+		report.Users.Migrated++
+	}
+
+	routines, err := store.GetAllRoutines(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch every routine: %w", err)
+	}
+	for _, routine := range routines {
+		refId, _ := routine["RefId"].(string)
+		delete(routine, "RefId")
+		report.Routines.Scanned++
+
+		stored, err := migrateDocument("routines", routine)
+		if err != nil {
+			return nil, err
+		}
+		if stored > routineSchemaVersion {
+			report.Routines.Newer++
+		}
+		if stored >= routineSchemaVersion {
+			continue
+		}
+		if !dryRun {
+			if err := store.UpdateOneUserRoutine(ctx, refId, routine); err != nil {
+				return nil, fmt.Errorf("error after migrating %d routines: %w", report.Routines.Migrated, err)
+			}
+		}
+		report.Routines.Migrated++
+	}
+
+	return report, nil
+}
+
+func (a *admin) migrateDocumentsCommand(ctx context.Context, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("migrate-documents", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "count the documents to migrate without writing them")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return nil, err
+	}
+
+	return migrateAllDocuments(ctx, unmigrated(a.store), *dryRun)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// migrationStep identifies a migration, which is not comparable itself
+type migrationStep struct {
+	collection string
+	from       int
+}
+
+func TestMigrations_Registry(t *testing.T) {
+	for collection, current := range schemaVersions {
+		for version := 0; version < current; version++ {
+			if _, ok := findMigration(collection, version); !ok {
+				t.Errorf("expected a migration of %s documents from schema version %d", collection, version)
+			}
+		}
+	}
+
+	seen := map[migrationStep]bool{}
+	for _, m := range migrations {
+		step := migrationStep{m.collection, m.from}
+		if seen[step] {
+			t.Errorf("expected one migration of %s documents from schema version %d", m.collection, m.from)
+		}
+		seen[step] = true
+		if m.description == "" || m.from >= schemaVersions[m.collection] {
+			t.Errorf("unexpected migration %+v", m)
+		}
+	}
+}
+
+func TestMigrations_Steps(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		collection string
+		from       int
+		data       map[string]interface{}
+		expected   map[string]interface{}
+	}{
+		{
+			name:       "users 0 to 1 sets the subscription settings",
+			collection: "users",
+			from:       0,
+			data:       map[string]interface{}{"UID": "uid-1", "Settings": map[string]interface{}{"UnitsPreference": "Imperial"}},
+			expected: map[string]interface{}{"UID": "uid-1", "Settings": map[string]interface{}{
+				"UnitsPreference": "Imperial", "SubscriptionTier": freeSubscriptionTier, "SubscriptionExpiresAt": time.Time{},
+			}},
+		},
+		{
+			name:       "users 0 to 1 keeps a paid subscription",
+			collection: "users",
+			from:       0,
+			data:       map[string]interface{}{"Settings": map[string]interface{}{"SubscriptionTier": premiumSubscriptionTier, "SubscriptionExpiresAt": expiresAt}},
+			expected:   map[string]interface{}{"Settings": map[string]interface{}{"SubscriptionTier": premiumSubscriptionTier, "SubscriptionExpiresAt": expiresAt}},
+		},
+		{
+			name:       "users 0 to 1 without settings",
+			collection: "users",
+			from:       0,
+			data:       map[string]interface{}{"UID": "uid-1"},
+			expected: map[string]interface{}{"UID": "uid-1", "Settings": map[string]interface{}{
+				"SubscriptionTier": freeSubscriptionTier, "SubscriptionExpiresAt": time.Time{},
+			}},
+		},
+		{
+			name:       "users 1 to 2 lists the password provider",
+			collection: "users",
+			from:       1,
+			data:       map[string]interface{}{"UID": "uid-1", "Providers": nil},
+			expected:   map[string]interface{}{"UID": "uid-1", "Providers": []interface{}{passwordProvider}},
+		},
+		{
+			name:       "users 1 to 2 keeps linked providers",
+			collection: "users",
+			from:       1,
+			data:       map[string]interface{}{"Providers": []interface{}{passwordProvider, googleProvider}},
+			expected:   map[string]interface{}{"Providers": []interface{}{passwordProvider, googleProvider}},
+		},
+		{
+			name:       "users 2 to 3 sets the time of the last billing event",
+			collection: "users",
+			from:       2,
+			data:       map[string]interface{}{"Settings": map[string]interface{}{"SubscriptionTier": premiumSubscriptionTier}},
+			expected: map[string]interface{}{"Settings": map[string]interface{}{
+				"SubscriptionTier": premiumSubscriptionTier, "SubscriptionUpdatedAt": time.Time{},
+			}},
+		},
+		{
+			name:       "routines 0 to 1 renames Excersices",
+			collection: "routines",
+			from:       0,
+			data: map[string]interface{}{"Workouts": []interface{}{
+				map[string]interface{}{"WorkoutName": "Bench", "Excersices": []interface{}{"bench"}},
+				map[string]interface{}{"WorkoutName": "Rows", "Exercises": []interface{}{"rows"}},
+			}},
+			expected: map[string]interface{}{"Workouts": []interface{}{
+				map[string]interface{}{"WorkoutName": "Bench", "Exercises": []interface{}{"bench"}},
+				map[string]interface{}{"WorkoutName": "Rows", "Exercises": []interface{}{"rows"}},
+			}},
+		},
+		{
+			name:       "routines 0 to 1 prefers Exercises over a stale Excersices",
+			collection: "routines",
+			from:       0,
+			data: map[string]interface{}{"Workouts": []interface{}{
+				map[string]interface{}{"Exercises": []interface{}{"new"}, "Excersices": []interface{}{"old"}},
+			}},
+			expected: map[string]interface{}{"Workouts": []interface{}{
+				map[string]interface{}{"Exercises": []interface{}{"new"}},
+			}},
+		},
+		{
+			name:       "routines 0 to 1 without workouts",
+			collection: "routines",
+			from:       0,
+			data:       map[string]interface{}{"RoutineName": "Empty", "Workouts": nil},
+			expected:   map[string]interface{}{"RoutineName": "Empty", "Workouts": nil},
+		},
+	}
+
+	tested := map[migrationStep]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := findMigration(tt.collection, tt.from)
+			if !ok {
+				t.Fatalf("expected a migration of %s documents from schema version %d", tt.collection, tt.from)
+			}
+			step.migrate(tt.data)
+			if !reflect.DeepEqual(tt.data, tt.expected) {
+				t.Errorf("expected %v but got %v", tt.expected, tt.data)
+			}
+		})
+		tested[migrationStep{tt.collection, tt.from}] = true
+	}
+
+	for _, m := range migrations {
+		if !tested[migrationStep{m.collection, m.from}] {
+			t.Errorf("expected a test of the migration of %s documents from schema version %d", m.collection, m.from)
+		}
+	}
+}
+
+func TestMigrateDocument(t *testing.T) {
+	data := map[string]interface{}{"UID": "uid-1"}
+	stored, err := migrateDocument("users", data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored != 0 || data["SchemaVersion"] != int64(userSchemaVersion) {
+		t.Errorf("expected a document without a version to be migrated from 0, got %d %v", stored, data)
+	}
+
+	newer := map[string]interface{}{"SchemaVersion": int64(userSchemaVersion + 1), "Renamed": "kept"}
+	stored, err = migrateDocument("users", newer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored != userSchemaVersion+1 || len(newer) != 2 || newer["SchemaVersion"] != int64(userSchemaVersion+1) {
+		t.Errorf("expected a document from a newer server to be left alone, got %d %v", stored, newer)
+	}
+}
+
+func TestMigratingStorage(t *testing.T) {
+	raw := newMemoryStorage()
+	raw.collections["users"]["user-1"] = map[string]interface{}{"UID": "uid-1", "Settings": map[string]interface{}{"UnitsPreference": "Metric"}}
+	id := seedRoutine(t, raw, "uid-1", "Push Day", time.Now(), []map[string]interface{}{{"WorkoutName": "Bench", "Excersices": []map[string]interface{}{}}})
+	store := migrateStorage(raw)
+
+	user, err := store.GetUserDocument(context.Background(), "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if profile, err := userProfileFromDocument(user); err != nil || profile.Settings.SubscriptionTier != freeSubscriptionTier {
+		t.Errorf("expected the profile to be read at the current version, got %+v %v", profile, err)
+	}
+
+	routine, err := store.GetOneUserRoutine(context.Background(), id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	workout := routine["Workouts"].([]interface{})[0].(map[string]interface{})
+	if _, ok := workout["Exercises"]; !ok || routine["SchemaVersion"] != int64(routineSchemaVersion) {
+		t.Errorf("expected the routine to be read at the current version, got %v", routine)
+	}
+	for _, read := range []func() ([]map[string]interface{}, error){
+		func() ([]map[string]interface{}, error) { return store.GetUserRoutines(context.Background(), "uid-1") },
+		func() ([]map[string]interface{}, error) { return store.GetAllRoutines(context.Background()) },
+	} {
+		routines, err := read()
+		if err != nil || len(routines) != 1 || routines[0]["SchemaVersion"] != int64(routineSchemaVersion) {
+			t.Errorf("expected every routine to be read at the current version, got %v %v", routines, err)
+		}
+	}
+
+	// reads migrate what they return, the stored documents are only rewritten by migrate-documents
+	stored, _ := raw.GetOneUserRoutine(context.Background(), id)
+	if _, ok := stored["SchemaVersion"]; ok {
+		t.Errorf("expected reading to leave the stored routine alone, got %v", stored)
+	}
+}
+
+func TestMigrateAllDocuments(t *testing.T) {
+	store := newMemoryStorage()
+	store.collections["users"]["user-1"] = map[string]interface{}{"UID": "uid-1", "Settings": map[string]interface{}{"UnitsPreference": "Metric"}}
+	store.collections["users"]["user-2"] = map[string]interface{}{"Settings": map[string]interface{}{}}
+	store.collections["users"]["user-3"] = map[string]interface{}{"SchemaVersion": int64(userSchemaVersion + 1), "UID": "uid-3"}
+	if err := store.CreateUserDocument(context.Background(), &UserDocument{SchemaVersion: userSchemaVersion, UID: "uid-4"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	old := seedRoutine(t, store, "uid-1", "Push Day", time.Now(), []map[string]interface{}{{"WorkoutName": "Bench", "Excersices": []map[string]interface{}{}}})
+	if _, err := store.CreateRoutineDocument(context.Background(), "uid-1", "Leg Day", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	code, stdout, stderr := runAdminCommand(t, store, "migrate-documents", "--dry-run")
+	if code != 0 {
+		t.Fatalf("expected exit code 0 but got %d: %s", code, stderr)
+	}
+	report, err := migrateAllDocuments(context.Background(), store, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &migrationReport{
+		DryRun:   true,
+		Users:    migrationCounts{Scanned: 4, Migrated: 1, Newer: 1},
+		Routines: migrationCounts{Scanned: 2, Migrated: 1},
+		Skipped:  []string{"users/user-2"},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v but got %+v, printed as %s", expected, report, stdout)
+	}
+	if routine, _ := store.GetOneUserRoutine(context.Background(), old); documentSchemaVersion(routine) != 0 {
+		t.Errorf("expected a dry run to write nothing, got %v", routine)
+	}
+
+	if _, err := migrateAllDocuments(context.Background(), store, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routine, _ := store.GetOneUserRoutine(context.Background(), old)
+	workout := routine["Workouts"].([]interface{})[0].(map[string]interface{})
+	if documentSchemaVersion(routine) != routineSchemaVersion || workout["Excersices"] != nil || workout["Exercises"] == nil {
+		t.Errorf("expected the routine to be stored at the current version, got %v", routine)
+	}
+	user, _ := store.GetUserDocument(context.Background(), "uid-1")
+	if documentSchemaVersion(user) != userSchemaVersion || user["Settings"].(map[string]interface{})["SubscriptionTier"] != freeSubscriptionTier ||
+		!reflect.DeepEqual(user["Providers"], []interface{}{passwordProvider}) {
+		t.Errorf("expected the user to be stored at the current version, got %v", user)
+	}
+
+	report, err = migrateAllDocuments(context.Background(), store, false)
+	if err != nil || report.Users.Migrated != 0 || report.Routines.Migrated != 0 {
+		t.Errorf("expected nothing left to migrate, got %+v %v", report, err)
+	}
+}
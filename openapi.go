@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiOperation documents one route registered in registerRoutes. The OpenAPI document served at /api/openapi.json
+// is generated from these and from the Go request and response types they name
+type apiOperation struct {
+	Pattern     string
+	Summary     string
+	Description string
+	Tag         string
+	// Request is a zero value of the JSON body type, nil if the route takes no body
+	Request interface{}
+	// Response is a zero value of the type found under "data" in the success envelope, nil if the route returns none
+	Response interface{}
+	// Bare responses are written as-is instead of inside the {"message", "data"} envelope
+	Bare         bool
+	HeaderParams []string
+	// QueryParams are optional query parameters
+	QueryParams []string
+}
+
+var apiOperations = []apiOperation{
+	{
+		Pattern:  "GET /status",
+		Summary:  "Server status",
+		Tag:      "status",
+		Response: ServerStatusResponse{},
+		Bare:     true,
+	},
+	{
+		Pattern:     "GET /healthz",
+		Summary:     "Liveness probe",
+		Description: "Answers 200 while the process is serving requests, without checking any dependency.",
+		Tag:         "status",
+		Response:    HealthResponse{},
+		Bare:        true,
+	},
+	{
+		Pattern:     "GET /readyz",
+		Summary:     "Readiness probe",
+		Description: "Checks storage connectivity, the Firebase Auth client and the frontend build, answering 503 when any check fails. Results are cached for 10 seconds. The error of a failed check is only answered to requests bearing the metrics token.",
+		Tag:         "status",
+		Response:    HealthResponse{},
+		Bare:        true,
+	},
+	{
+		Pattern:  "GET /api/openapi.json",
+		Summary:  "This OpenAPI document",
+		Tag:      "status",
+		Response: map[string]interface{}{},
+		Bare:     true,
+	},
+	{
+		Pattern:     "GET /metrics",
+		Summary:     "Prometheus metrics",
+		Description: "Request, storage and idToken verification metrics in the Prometheus text format. Requires a bearer token when METRICS_TOKEN is set.",
+		Tag:         "status",
+		Bare:        true,
+	},
+	{
+		Pattern:     "POST /api/v1/register/email",
+		Summary:     "Register a user with an email and password",
+		Description: "Creates the Firebase Auth user and their document within the users collection.",
+		Tag:         "users",
+		Request:     NewUserEmailAuthRequest{},
+		Response:    RegisterResponse{},
+	},
+	{
+		Pattern:     "POST /api/v1/session/login",
+		Summary:     "Exchange an idToken for a session cookie",
+		Description: "The user must have signed in within the last 5 minutes. Sets the HttpOnly session cookie and the csrf_token cookie, after which any route accepts \"session\" in place of the idToken. POST and PUT requests made with the cookie must send the CSRF token in the X-CSRF-Token header.",
+		Tag:         "sessions",
+		Request:     SessionLoginRequest{},
+		Response:    SessionResponse{},
+	},
+	{
+		Pattern:     "GET /api/v1/session",
+		Summary:     "Describe the session of the session cookie",
+		Description: "Answers 401 when no session cookie was sent, or it expired or was revoked.",
+		Tag:         "sessions",
+		Response:    SessionResponse{},
+	},
+	{
+		Pattern:      "POST /api/v1/session/logout",
+		Summary:      "Clear the session cookie",
+		Description:  "Clears the session and csrf_token cookies of this browser. The session itself stays valid until it expires, see POST /api/v1/session/revoke.",
+		Tag:          "sessions",
+		HeaderParams: []string{csrfHeader},
+	},
+	{
+		Pattern:      "POST /api/v1/session/revoke",
+		Summary:      "Revoke every session of the user",
+		Description:  "Revokes every session cookie and refresh token of the user of the session cookie, signing them out on every device.",
+		Tag:          "sessions",
+		HeaderParams: []string{csrfHeader},
+	},
+	{
+		Pattern:     "POST /api/v1/user/providers/{uid}/{idToken}",
+		Summary:     "Link a third-party sign-in provider to a user's account",
+		Description: "Links the Google, Apple or GitHub credential the user signed in with to the account of the idToken, and returns the account's providers, which are also stored in the profile. GitHub requires an accessToken and Apple an idToken. Answers 409 when another account already uses the credential.",
+		Tag:         "users",
+		Request:     LinkProviderRequest{},
+		Response:    ProvidersResponse{},
+	},
+	{
+		Pattern:     "GET /api/v1/user/{uid}/{idToken}",
+		Summary:     "Get a user's profile",
+		Description: "The idToken must belong to the user with the given uid. The profile of a user who signed in with a third-party provider is created on their first request.",
+		Tag:         "users",
+		Response:    UserProfileResponse{},
+	},
+	{
+		Pattern:     "PUT /api/v1/user/{uid}/{idToken}",
+		Summary:     "Update a user's profile",
+		Description: "Only the listed Firestore field paths may be changed. Returns the fields that were updated.",
+		Tag:         "users",
+		Request:     ProfileUpdateRequest{},
+		Response:    ProfileUpdateRequest{},
+	},
+	{
+		Pattern:     "POST /api/v1/user/routine/create",
+		Summary:     "Create an empty routine",
+		Description: "Free tier users may own at most 3 routines.",
+		Tag:         "routines",
+		Request:     NewUserRoutineRequest{},
+		Response:    CreateRoutineResponse{},
+	},
+	{
+		Pattern:  "GET /api/v1/user/routine/{uid}/{idToken}",
+		Summary:  "List a user's routines",
+		Tag:      "routines",
+		Response: []RoutineResponse{},
+	},
+	{
+		Pattern:  "GET /api/v1/user/routine/single/{routineRefId}/{idToken}",
+		Summary:  "Get one routine",
+		Tag:      "routines",
+		Response: RoutineResponse{},
+	},
+	{
+		Pattern:     "PUT /api/v1/user/routine/single/{routineRefId}/{idToken}",
+		Summary:     "Replace one routine",
+		Description: "The routine's UID and CreatedAt are kept from the stored routine.",
+		Tag:         "routines",
+		Request:     RoutineUpdateRequest{},
+		Response:    RoutineResponse{},
+	},
+	{
+		Pattern:     "GET /api/v1/user/export/csv/{uid}/{idToken}",
+		Summary:     "Export every set of every routine and logged workout as CSV",
+		Description: "One text/csv row per set, with the routine, workout, exercise and muscle group names, and when logged workouts were performed. Weights are in the user's units preference, kg or lb.",
+		Tag:         "export",
+		Bare:        true,
+	},
+	{
+		Pattern:     "POST /api/v1/user/import/{uid}/{idToken}",
+		Summary:     "Import workout history from a Strong or Hevy CSV export",
+		Description: "The raw CSV export is the request body, at most 10MB. The format query parameter (strong or hevy) is detected from the header when omitted, and the units query parameter (kg or lb) sets the unit of Strong exports without a Weight Unit column, defaulting to the user's units preference. Workouts imported before are counted as duplicates rather than written again, so a report marked incomplete, after the deadline passed partway, is finished by uploading the export again.",
+		Tag:         "import",
+		Response:    ImportResponse{},
+		QueryParams: []string{"format", "units"},
+	},
+	{
+		Pattern:     "GET /api/v1/user/export/archive/{uid}/{idToken}",
+		Summary:     "Export a complete archive of the user's data",
+		Description: "A versioned JSON archive of the profile, settings, routines and workout logs, downloaded as an attachment. Restoring it is done with POST /api/v1/user/import/archive/{uid}/{idToken}.",
+		Tag:         "export",
+		Response:    AccountArchive{},
+		Bare:        true,
+	},
+	{
+		Pattern:     "POST /api/v1/user/import/archive/{uid}/{idToken}",
+		Summary:     "Restore an archive into the user's data",
+		Description: "The archive may come from another deployment or user. Routines matching an existing one by RefId or name, and the profile, are kept unless onConflict=replace. Workout logs already stored are never overwritten, and the subscription is never restored. Free tier quotas apply. A report marked incomplete, after the deadline passed partway, is finished by restoring the archive again.",
+		Tag:         "import",
+		Request:     AccountArchive{},
+		Response:    ArchiveRestoreResponse{},
+		QueryParams: []string{"onConflict"},
+	},
+	{
+		Pattern:      "POST /api/v1/billing/webhook",
+		Summary:      "Receive a billing provider event",
+		Description:  "Stripe-compatible signed events that update Settings.SubscriptionTier. Each event ID is only applied once.",
+		Tag:          "billing",
+		Request:      billingEvent{},
+		Response:     BillingWebhookResponse{},
+		HeaderParams: []string{"Stripe-Signature"},
+	},
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*jsonSchema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description,omitempty"`
+	OperationID string                      `json:"operationId"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string      `json:"name"`
+	In       string      `json:"in"`
+	Required bool        `json:"required"`
+	Schema   *jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// buildOpenAPIDocument generates the OpenAPI 3 document for every operation in apiOperations
+func buildOpenAPIDocument() *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:   "RepetiSwole API",
+			Version: "1.0.0",
+		},
+		Paths: map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: map[string]*jsonSchema{},
+		},
+	}
+	doc.Components.Schemas["Error"] = structSchema(reflect.TypeOf(apiError{}), doc.Components.Schemas)
+
+	for _, op := range apiOperations {
+		method, path, _ := strings.Cut(op.Pattern, " ")
+
+		operation := &openAPIOperation{
+			Summary:     op.Summary,
+			Description: op.Description,
+			OperationID: operationID(method, path),
+			Responses: map[string]*openAPIResponse{
+				"default": {
+					Description: "An error, see docs/API_ROUTES.MD for the list of codes",
+					Content:     jsonContent(&jsonSchema{Ref: "#/components/schemas/Error"}),
+				},
+			},
+		}
+		if op.Tag != "" {
+			operation.Tags = []string{op.Tag}
+		}
+
+		for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name: match[1], In: "path", Required: true, Schema: &jsonSchema{Type: "string"},
+			})
+		}
+		for _, header := range op.HeaderParams {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name: header, In: "header", Required: true, Schema: &jsonSchema{Type: "string"},
+			})
+		}
+		for _, query := range op.QueryParams {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name: query, In: "query", Schema: &jsonSchema{Type: "string"},
+			})
+		}
+
+		if op.Request != nil {
+			operation.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  jsonContent(schemaFor(reflect.TypeOf(op.Request), doc.Components.Schemas)),
+			}
+		}
+
+		success := &openAPIResponse{Description: "Success"}
+		if op.Response != nil {
+			data := schemaFor(reflect.TypeOf(op.Response), doc.Components.Schemas)
+			if op.Bare {
+				success.Content = jsonContent(data)
+			} else {
+				success.Content = jsonContent(&jsonSchema{
+					Type: "object",
+					Properties: map[string]*jsonSchema{
+						"message": {Type: "string"},
+						"data":    data,
+					},
+					Required: []string{"message", "data"},
+				})
+			}
+		}
+		operation.Responses[strconv.Itoa(http.StatusOK)] = success
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(method)] = operation
+	}
+
+	return doc
+}
+
+func jsonContent(schema *jsonSchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{"application/json": {Schema: schema}}
+}
+
+// operationID turns "GET /api/v1/user/{uid}/{idToken}" into "getApiV1UserUidIdToken"
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '{' || r == '}' || r == '.' }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// schemaFor reflects a JSON schema out of a Go type. Named structs are added to components and referenced,
+// and `validate` tags become the matching schema constraints
+func schemaFor(t reflect.Type, components map[string]*jsonSchema) *jsonSchema {
+	if t.Kind() == reflect.Pointer {
+		schema := schemaFor(t.Elem(), components)
+		if schema.Ref != "" {
+			return schema
+		}
+		schema.Nullable = true
+		return schema
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	}
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return &jsonSchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaFor(t.Elem(), components)}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), components)}
+	case reflect.Interface:
+		return &jsonSchema{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, components)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := components[name]; !ok {
+			// reserve the name first so that recursive types terminate
+			components[name] = &jsonSchema{}
+			*components[name] = *structSchema(t, components)
+		}
+		return &jsonSchema{Ref: "#/components/schemas/" + name}
+	}
+
+	return &jsonSchema{}
+}
+
+func structSchema(t reflect.Type, components map[string]*jsonSchema) *jsonSchema {
+	schema := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+
+		name := jsonFieldName(field)
+		property := schemaFor(field.Type, components)
+		if rules := field.Tag.Get("validate"); rules != "" {
+			if applyValidateRules(property, rules) {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		schema.Properties[name] = property
+	}
+
+	sort.Strings(schema.Required)
+	return schema
+}
+
+// applyValidateRules copies the rules understood by validate onto the schema, returning whether the field is required
+func applyValidateRules(schema *jsonSchema, rules string) bool {
+	required := false
+
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+		case "email":
+			schema.Format = "email"
+		case "oneof":
+			schema.Enum = strings.Fields(arg)
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+			length := int(bound)
+			switch {
+			case schema.Type == "string" && name == "min":
+				schema.MinLength = &length
+			case schema.Type == "string":
+				schema.MaxLength = &length
+			case schema.Type == "array" && name == "min":
+				schema.MinItems = &length
+			case schema.Type == "array":
+				schema.MaxItems = &length
+			case name == "min":
+				schema.Minimum = &bound
+			default:
+				schema.Maximum = &bound
+			}
+		}
+	}
+
+	return required
+}
+
+// openAPISpec is generated once, the operations and types it is built from cannot change at runtime
+var openAPISpec = sync.OnceValues(func() ([]byte, error) {
+	return json.Marshal(buildOpenAPIDocument())
+})
+
+func (rtr *router) OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	spec, err := openAPISpec()
+	if err != nil {
+		rtr.StatusError(w, r, "openapi spec", err)
+		return
+	}
+
+	if _, err := w.Write(spec); err != nil {
+		loggerFrom(r.Context()).Error("error writing response back during openapi endpoint", "error", err.Error())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordingRegistrar lists the patterns registerRoutes registers instead of serving them
+type recordingRegistrar struct {
+	patterns []string
+}
+
+func (r *recordingRegistrar) HandleFunc(pattern string, _ func(http.ResponseWriter, *http.Request)) {
+	r.patterns = append(r.patterns, pattern)
+}
+
+func TestOpenAPI_DocumentsEveryRegisteredRoute(t *testing.T) {
+	registrar := &recordingRegistrar{}
+	registerRoutes(registrar, getTestRouter())
+	doc := buildOpenAPIDocument()
+
+	registered := map[string]bool{}
+	for _, pattern := range registrar.patterns {
+		registered[pattern] = true
+		// the catch-all serves the React frontend, it is not part of the API
+		if pattern == "GET /" {
+			continue
+		}
+
+		method, path, _ := strings.Cut(pattern, " ")
+		if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("route %q is registered in routes() but missing from the OpenAPI document, add it to apiOperations", pattern)
+		}
+	}
+
+	for _, op := range apiOperations {
+		if !registered[op.Pattern] {
+			t.Errorf("apiOperations documents %q but no such route is registered in routes()", op.Pattern)
+		}
+	}
+}
+
+func TestOpenAPI_SchemasFollowValidateTags(t *testing.T) {
+	doc := buildOpenAPIDocument()
+
+	schema, ok := doc.Components.Schemas["NewUserEmailAuthRequest"]
+	if !ok {
+		t.Fatalf("expected NewUserEmailAuthRequest within the component schemas")
+	}
+
+	if strings.Join(schema.Required, ",") != "displayname,email,password" {
+		t.Errorf("unexpected required fields: %v", schema.Required)
+	}
+	if schema.Properties["email"].Format != "email" {
+		t.Errorf("expected email to have the email format")
+	}
+	if schema.Properties["password"].MinLength == nil || *schema.Properties["password"].MinLength != 6 {
+		t.Errorf("expected password to have a minLength of 6")
+	}
+	if units := doc.Components.Schemas["ProfileUpdateRequest"].Properties["Settings.UnitsPreference"]; len(units.Enum) != 2 {
+		t.Errorf("expected Settings.UnitsPreference to be an enum, got %+v", units)
+	}
+}
+
+func TestOpenAPIEndpoint(t *testing.T) {
+	r := getTestRouter()
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
+	w := httptest.NewRecorder()
+
+	r.OpenAPISpec(w, req)
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", resp.StatusCode)
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if raw["openapi"] != "3.0.3" {
+		t.Errorf("unexpected openapi version: %v", raw["openapi"])
+	}
+
+	// every $ref within the document must resolve to a component schema
+	schemas := raw["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := n["$ref"].(string); ok {
+				if _, found := schemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !found {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, child := range n {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range n {
+				walk(child)
+			}
+		}
+	}
+	walk(raw)
+}
@@ -0,0 +1,375 @@
+// Package client is a Go client for the RepetiSwole API. Every method takes a context, returns the typed data of the
+// response envelope, and returns an *Error carrying the API's error code when the request fails.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionIdToken takes the place of the idToken of any method once the client signed in with Login, so that the
+// request is authenticated by the session cookie instead
+const SessionIdToken = "session"
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	userAgent  string
+
+	// csrfToken of the session the client signed in to, sent along with every state-changing request
+	mu        sync.Mutex
+	csrfToken string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client, which times out after 30 seconds and keeps cookies. Login needs the
+// replacement to have a cookie Jar too
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// New creates a client for the API served at baseURL, e.g. "https://repetiswole-production.up.railway.app"
+func New(baseURL string, opts ...Option) *Client {
+	// a nil PublicSuffixList never makes cookiejar.New fail
+	jar, _ := cookiejar.New(nil)
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second, Jar: jar},
+		userAgent:  "repetiswole-go-client",
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+func (c *Client) Status(ctx context.Context) (*StatusResponse, error) {
+	status := &StatusResponse{}
+	if err := c.do(ctx, http.MethodGet, "/status", nil, nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Healthz reports whether the server is alive, it checks none of the server's dependencies
+func (c *Client) Healthz(ctx context.Context) (*HealthResponse, error) {
+	health := &HealthResponse{}
+	if err := c.do(ctx, http.MethodGet, "/healthz", nil, nil, health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// Readyz reports whether every dependency of the server is available. When one is not, the report of the checks is
+// returned along with an *Error of status 503 and code CodeUnavailable
+func (c *Client) Readyz(ctx context.Context) (*HealthResponse, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/readyz", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, decodeError(resp)
+	}
+
+	health := &HealthResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		return nil, fmt.Errorf("error decoding response of GET /readyz: %w", err)
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return health, &Error{
+			StatusCode: resp.StatusCode,
+			Code:       CodeUnavailable,
+			Message:    "a dependency of the server is unavailable",
+			RequestID:  resp.Header.Get("X-Request-ID"),
+		}
+	}
+	return health, nil
+}
+
+func (c *Client) OpenAPI(ctx context.Context) (OpenAPIDocument, error) {
+	doc := OpenAPIDocument{}
+	if err := c.do(ctx, http.MethodGet, "/api/openapi.json", nil, nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (c *Client) RegisterEmail(ctx context.Context, req RegisterEmailRequest) (*RegisterResponse, error) {
+	return doEnvelope[RegisterResponse](ctx, c, http.MethodPost, "/api/v1/register/email", req)
+}
+
+// Login exchanges the idToken of a user who signed in within the last 5 minutes for a session cookie, which the
+// client's cookie jar keeps. Methods then accept SessionIdToken in place of an idToken, and the client sends the
+// session's CSRF token along with every state-changing request
+func (c *Client) Login(ctx context.Context, idToken string) (*Session, error) {
+	session, err := doEnvelope[Session](ctx, c, http.MethodPost, "/api/v1/session/login", SessionLoginRequest{IdToken: idToken})
+	if err != nil {
+		return nil, err
+	}
+	c.setCSRFToken(session.CSRFToken)
+	return session, nil
+}
+
+// Session describes the session of the client's session cookie, failing with CodeInvalidToken when there is none
+func (c *Client) Session(ctx context.Context) (*Session, error) {
+	session, err := doEnvelope[Session](ctx, c, http.MethodGet, "/api/v1/session", nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setCSRFToken(session.CSRFToken)
+	return session, nil
+}
+
+// Logout clears the client's session cookie, which stays valid elsewhere until it expires. RevokeSessions ends every
+// session of the user instead
+func (c *Client) Logout(ctx context.Context) error {
+	if _, err := doEnvelope[json.RawMessage](ctx, c, http.MethodPost, "/api/v1/session/logout", nil); err != nil {
+		return err
+	}
+	c.setCSRFToken("")
+	return nil
+}
+
+// RevokeSessions signs the user of the client's session out on every device
+func (c *Client) RevokeSessions(ctx context.Context) error {
+	if _, err := doEnvelope[json.RawMessage](ctx, c, http.MethodPost, "/api/v1/session/revoke", nil); err != nil {
+		return err
+	}
+	c.setCSRFToken("")
+	return nil
+}
+
+func (c *Client) setCSRFToken(csrfToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.csrfToken = csrfToken
+}
+
+func (c *Client) GetProfile(ctx context.Context, uid, idToken string) (*UserProfile, error) {
+	return doEnvelope[UserProfile](ctx, c, http.MethodGet, joinPath("/api/v1/user", uid, idToken), nil)
+}
+
+// LinkProvider links a Google, Apple or GitHub credential to the user's account, returning the account's providers
+func (c *Client) LinkProvider(ctx context.Context, uid, idToken string, req LinkProviderRequest) (*ProvidersResponse, error) {
+	return doEnvelope[ProvidersResponse](ctx, c, http.MethodPost, joinPath("/api/v1/user/providers", uid, idToken), req)
+}
+
+// UpdateProfile returns the fields that were updated
+func (c *Client) UpdateProfile(ctx context.Context, uid, idToken string, update ProfileUpdate) (*ProfileUpdate, error) {
+	return doEnvelope[ProfileUpdate](ctx, c, http.MethodPut, joinPath("/api/v1/user", uid, idToken), update)
+}
+
+func (c *Client) CreateRoutine(ctx context.Context, uid, idToken, routineName string) (*CreateRoutineResponse, error) {
+	return doEnvelope[CreateRoutineResponse](ctx, c, http.MethodPost, "/api/v1/user/routine/create", CreateRoutineRequest{
+		RoutineName: routineName,
+		UID:         uid,
+		IdToken:     idToken,
+	})
+}
+
+func (c *Client) ListRoutines(ctx context.Context, uid, idToken string) ([]Routine, error) {
+	routines, err := doEnvelope[[]Routine](ctx, c, http.MethodGet, joinPath("/api/v1/user/routine", uid, idToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	return *routines, nil
+}
+
+func (c *Client) GetRoutine(ctx context.Context, routineRefId, idToken string) (*Routine, error) {
+	return doEnvelope[Routine](ctx, c, http.MethodGet, joinPath("/api/v1/user/routine/single", routineRefId, idToken), nil)
+}
+
+// UpdateRoutine replaces the routine's name and workouts, returning the routine as it was stored
+func (c *Client) UpdateRoutine(ctx context.Context, routineRefId, idToken string, routine Routine) (*Routine, error) {
+	return doEnvelope[Routine](ctx, c, http.MethodPut, joinPath("/api/v1/user/routine/single", routineRefId, idToken), routine)
+}
+
+// ExportCSV writes the CSV export of every set of the user's routines to w as it is downloaded
+func (c *Client) ExportCSV(ctx context.Context, uid, idToken string, w io.Writer) error {
+	return c.do(ctx, http.MethodGet, joinPath("/api/v1/user/export/csv", uid, idToken), nil, nil, w)
+}
+
+// ImportHistory uploads a Strong or Hevy CSV export. format ("strong" or "hevy") and units ("kg" or "lb") may be left
+// empty for the server to detect the format and use the user's units preference
+func (c *Client) ImportHistory(ctx context.Context, uid, idToken, format, units string, export io.Reader) (*ImportResponse, error) {
+	query := url.Values{}
+	if format != "" {
+		query.Set("format", format)
+	}
+	if units != "" {
+		query.Set("units", units)
+	}
+	path := joinPath("/api/v1/user/import", uid, idToken)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	envelope := &Envelope[ImportResponse]{}
+	header := http.Header{"Content-Type": []string{"text/csv"}}
+	if err := c.do(ctx, http.MethodPost, path, export, header, envelope); err != nil {
+		return nil, err
+	}
+	return &envelope.Data, nil
+}
+
+// ExportArchive writes the JSON account archive of the user to w as it is downloaded
+func (c *Client) ExportArchive(ctx context.Context, uid, idToken string, w io.Writer) error {
+	return c.do(ctx, http.MethodGet, joinPath("/api/v1/user/export/archive", uid, idToken), nil, nil, w)
+}
+
+// RestoreArchive uploads an archive written by ExportArchive. onConflict is "keep", the default when empty, or "replace"
+func (c *Client) RestoreArchive(ctx context.Context, uid, idToken, onConflict string, archive io.Reader) (*ArchiveRestoreResponse, error) {
+	path := joinPath("/api/v1/user/import/archive", uid, idToken)
+	if onConflict != "" {
+		path += "?" + url.Values{"onConflict": []string{onConflict}}.Encode()
+	}
+
+	envelope := &Envelope[ArchiveRestoreResponse]{}
+	if err := c.do(ctx, http.MethodPost, path, archive, nil, envelope); err != nil {
+		return nil, err
+	}
+	return &envelope.Data, nil
+}
+
+// SendBillingEvent posts a raw, already signed billing event, which is mostly useful for replaying provider events
+func (c *Client) SendBillingEvent(ctx context.Context, payload []byte, signature string) (*BillingWebhookResponse, error) {
+	envelope := &Envelope[BillingWebhookResponse]{}
+	header := http.Header{"Stripe-Signature": []string{signature}}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/billing/webhook", bytes.NewReader(payload), header, envelope); err != nil {
+		return nil, err
+	}
+	return &envelope.Data, nil
+}
+
+// doEnvelope sends body as JSON and decodes the data of the response envelope
+func doEnvelope[T any](ctx context.Context, c *Client, method, path string, body interface{}) (*T, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request body for %s %s: %w", method, path, err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	envelope := &Envelope[T]{}
+	if err := c.do(ctx, method, path, reader, nil, envelope); err != nil {
+		return nil, err
+	}
+
+	return &envelope.Data, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, header http.Header, dst interface{}) error {
+	resp, err := c.send(ctx, method, path, body, header)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+
+	// downloads are copied as-is rather than decoded
+	if out, ok := dst.(io.Writer); ok {
+		if _, err := io.Copy(out, resp.Body); err != nil {
+			return fmt.Errorf("error reading response of %s %s: %w", method, path, err)
+		}
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return fmt.Errorf("error decoding response of %s %s: %w", method, path, err)
+	}
+
+	return nil
+}
+
+// send sends the request and returns the response whatever its status, which the caller must close the body of
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for %s %s: %w", method, path, err)
+	}
+
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		c.mu.Lock()
+		if c.csrfToken != "" && req.Header.Get("X-CSRF-Token") == "" {
+			req.Header.Set("X-CSRF-Token", c.csrfToken)
+		}
+		c.mu.Unlock()
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request %s %s: %w", method, path, err)
+	}
+
+	return resp, nil
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil || json.Unmarshal(raw, apiErr) != nil || apiErr.Message == "" {
+		// not one of our error bodies, e.g. a proxy's error page
+		apiErr.Message = strings.TrimSpace(string(raw))
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+
+	return apiErr
+}
+
+func joinPath(prefix string, params ...string) string {
+	path := prefix
+	for _, param := range params {
+		path += "/" + url.PathEscape(param)
+	}
+	return path
+}
@@ -0,0 +1,345 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubServer answers a single expected request with a canned status and body
+func stubServer(t *testing.T, wantMethod, wantPath string, status int, body string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != wantMethod || r.URL.EscapedPath() != wantPath {
+			t.Errorf("expected %s %s, got %s %s", wantMethod, wantPath, r.Method, r.URL.EscapedPath())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestGetProfile(t *testing.T) {
+	srv := stubServer(t, "GET", "/api/v1/user/uid-1/token%2F1", http.StatusOK, `{
+		"message": "successfully retrieved user data",
+		"data": {
+			"UID": "uid-1",
+			"CurrentGoal": "Bench 225",
+			"Metrics": {"Height": 180.5, "Weight": 82, "JoinDate": "2025-01-02T03:04:05Z"},
+			"Settings": {"UnitsPreference": "Metric", "SubscriptionTier": "Free"}
+		}
+	}`)
+
+	profile, err := New(srv.URL).GetProfile(context.Background(), "uid-1", "token/1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if profile.UID != "uid-1" || profile.Metrics.Height != 180.5 || profile.Settings.SubscriptionTier != "Free" {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+	if !profile.Metrics.JoinDate.Equal(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("unexpected join date: %v", profile.Metrics.JoinDate)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	srv := stubServer(t, "GET", "/healthz", http.StatusOK, `{"status": "ok"}`)
+
+	health, err := New(srv.URL).Healthz(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if health.Status != "ok" {
+		t.Errorf("unexpected health: %+v", health)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus string
+		wantErr    bool
+	}{
+		{"ready", http.StatusOK, `{"status": "ok", "checks": {"storage": {"status": "ok", "durationMs": 1.5, "checkedAt": "2025-01-02T03:04:05Z"}}}`, "ok", false},
+		{"not ready", http.StatusServiceUnavailable, `{"status": "unavailable", "checks": {"storage": {"status": "unavailable", "durationMs": 3000, "checkedAt": "2025-01-02T03:04:05Z"}}}`, "unavailable", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := stubServer(t, "GET", "/readyz", tt.status, tt.body)
+
+			health, err := New(srv.URL).Readyz(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected an error: %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr && !IsCode(err, CodeUnavailable) {
+				t.Errorf("expected an unavailable *Error, got %v", err)
+			}
+			// the checks are reported whether or not the server is ready
+			if health == nil || health.Status != tt.wantStatus || health.Checks["storage"].Status != tt.wantStatus {
+				t.Errorf("unexpected health: %+v", health)
+			}
+		})
+	}
+}
+
+func TestSession_SendsCookieAndCSRFToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie("session")
+		switch r.URL.Path {
+		case "/api/v1/session/login":
+			if r.Header.Get("X-CSRF-Token") != "" {
+				t.Errorf("expected no CSRF token before signing in")
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "cookie-1", Path: "/"})
+			_, _ = io.WriteString(w, `{"message": "successfully signed in", "data": {"UID": "uid-1", "expiresAt": "2025-01-07T03:04:05Z", "csrfToken": "csrf-1"}}`)
+		case "/api/v1/user/routine/create":
+			if cookie == nil || cookie.Value != "cookie-1" || r.Header.Get("X-CSRF-Token") != "csrf-1" {
+				t.Errorf("expected the session cookie and its CSRF token, got cookie %v and token %q", cookie, r.Header.Get("X-CSRF-Token"))
+			}
+			_, _ = io.WriteString(w, `{"message": "successfully created new routine for user", "data": {"RefId": "routine-1"}}`)
+		case "/api/v1/session":
+			if r.Header.Get("X-CSRF-Token") != "" {
+				t.Errorf("expected no CSRF token on a GET request")
+			}
+			_, _ = io.WriteString(w, `{"message": "successfully retrieved session", "data": {"UID": "uid-1", "expiresAt": "2025-01-07T03:04:05Z", "csrfToken": "csrf-1"}}`)
+		case "/api/v1/session/logout":
+			if r.Header.Get("X-CSRF-Token") != "csrf-1" {
+				t.Errorf("expected the CSRF token when signing out, got %q", r.Header.Get("X-CSRF-Token"))
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "", Path: "/", MaxAge: -1})
+			_, _ = io.WriteString(w, `{"message": "successfully signed out", "data": null}`)
+		case "/api/v1/session/revoke":
+			if cookie != nil || r.Header.Get("X-CSRF-Token") != "" {
+				t.Errorf("expected neither the cookie nor the CSRF token once signed out, got cookie %v and token %q", cookie, r.Header.Get("X-CSRF-Token"))
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"error": "the idToken is not valid", "code": "invalid_token"}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c := New(srv.URL)
+	session, err := c.Login(context.Background(), "fresh-id-token")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.UID != "uid-1" || session.CSRFToken != "csrf-1" {
+		t.Errorf("unexpected session: %+v", session)
+	}
+
+	if _, err := c.CreateRoutine(context.Background(), "uid-1", SessionIdToken, "Push Day"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := c.Session(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.Logout(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.RevokeSessions(context.Background()); !IsCode(err, CodeInvalidToken) {
+		t.Errorf("expected revoking without a session to fail with invalid_token, got %v", err)
+	}
+}
+
+func TestCreateRoutine_SendsBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := CreateRoutineRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding request body: %v", err)
+		}
+		if body.RoutineName != "Push Day" || body.UID != "uid-1" || body.IdToken != "token" {
+			t.Errorf("unexpected request body: %+v", body)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected a JSON content type, got %q", r.Header.Get("Content-Type"))
+		}
+		_, _ = io.WriteString(w, `{"message": "successfully created new routine for user", "data": {"RefId": "routine-1"}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	created, err := New(srv.URL).CreateRoutine(context.Background(), "uid-1", "token", "Push Day")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if created.RefId != "routine-1" {
+		t.Errorf("unexpected ref id: %s", created.RefId)
+	}
+}
+
+func TestListRoutines(t *testing.T) {
+	srv := stubServer(t, "GET", "/api/v1/user/routine/uid-1/token", http.StatusOK, `{
+		"message": "successfully fetched users routines",
+		"data": [{
+			"RefId": "routine-1",
+			"RoutineName": "PPL",
+			"UID": "uid-1",
+			"CreatedAt": "2025-01-02T03:04:05Z",
+			"Workouts": [{"WorkoutName": "Push", "Exercises": [{"MuscleGroup": 0, "ExerciseName": "Bench", "Sets": [{"Reps": 5, "Weight": 100, "IsDropSet": false, "IsWarmUp": true}]}]}]
+		}]
+	}`)
+
+	routines, err := New(srv.URL).ListRoutines(context.Background(), "uid-1", "token")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(routines) != 1 || routines[0].Workouts[0].Exercises[0].Sets[0].Reps != 5 || !routines[0].Workouts[0].Exercises[0].Sets[0].IsWarmUp {
+		t.Errorf("unexpected routines: %+v", routines)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	csv := "routine_name,routine_created_at\nPush Day,2024-03-01T12:00:00Z\n"
+	srv := stubServer(t, "GET", "/api/v1/user/export/csv/uid-1/token", http.StatusOK, csv)
+
+	out := &strings.Builder{}
+	if err := New(srv.URL).ExportCSV(context.Background(), "uid-1", "token", out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != csv {
+		t.Errorf("expected the export to be copied as-is, got %q", out.String())
+	}
+}
+
+func TestImportHistory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1/user/import/uid-1/token" || r.URL.RawQuery != "format=strong" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if got := r.Header.Get("Content-Type"); got != "text/csv" {
+			t.Errorf("expected a text/csv body, got %q", got)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != "Date,Exercise Name\n" {
+			t.Errorf("expected the export as the body, got %q", body)
+		}
+		_, _ = io.WriteString(w, `{"message": "successfully imported workout history", "data": {"format": "strong", "workouts": 2, "sets": 9, "errors": [{"line": 4, "error": "bad reps"}]}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	report, err := New(srv.URL).ImportHistory(context.Background(), "uid-1", "token", "strong", "", strings.NewReader("Date,Exercise Name\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Workouts != 2 || report.Sets != 9 || len(report.Errors) != 1 || report.Errors[0].Line != 4 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestRestoreArchive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1/user/import/archive/uid-1/token" || r.URL.RawQuery != "onConflict=replace" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		_, _ = io.WriteString(w, `{"message": "successfully restored account archive", "data": {"profile": "replaced", "routines": {"created": 1, "replaced": 2}, "conflicts": [{"kind": "routine", "name": "Push Day", "resolution": "replaced"}]}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	report, err := New(srv.URL).RestoreArchive(context.Background(), "uid-1", "token", "replace", strings.NewReader(`{"format": "repetiswole.account"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Profile != "replaced" || report.Routines.Replaced != 2 || len(report.Conflicts) != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantCode    string
+		wantDetails int
+	}{
+		{"api error", http.StatusUnauthorized, `{"error": "id token has expired", "code": "token_expired"}`, CodeTokenExpired, 0},
+		{"validation details", http.StatusUnprocessableEntity, `{"error": "request failed validation", "code": "validation_failed", "details": [{"field": "email", "message": "is required"}]}`, CodeValidationFailed, 1},
+		{"not our error body", http.StatusBadGateway, `<html>bad gateway</html>`, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := stubServer(t, "GET", "/api/v1/user/routine/single/routine-1/token", tt.status, tt.body)
+
+			_, err := New(srv.URL).GetRoutine(context.Background(), "routine-1", "token")
+
+			apiErr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("expected an *Error, got %T: %v", err, err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Code != tt.wantCode || len(apiErr.Details) != tt.wantDetails {
+				t.Errorf("unexpected error: %+v", apiErr)
+			}
+			if apiErr.Message == "" {
+				t.Errorf("expected a message")
+			}
+			if tt.wantCode != "" && !IsCode(err, tt.wantCode) {
+				t.Errorf("expected IsCode to match %s", tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestErrorRequestID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-1")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"error": "routine not found", "code": "not_found"}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, err := New(srv.URL).GetRoutine(context.Background(), "routine-1", "token")
+
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.RequestID != "req-1" {
+		t.Fatalf("expected an *Error with the request ID, got %v", err)
+	}
+	if !strings.Contains(apiErr.Error(), "req-1") {
+		t.Errorf("expected the request ID within the message, got %q", apiErr.Error())
+	}
+}
+
+func TestErrorRetryAfter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "42")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = io.WriteString(w, `{"error": "rate limit exceeded, retry in 42s", "code": "rate_limited"}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, err := New(srv.URL).GetRoutine(context.Background(), "routine-1", "token")
+
+	apiErr, ok := err.(*Error)
+	if !ok || !IsCode(err, CodeRateLimited) {
+		t.Fatalf("expected a rate_limited *Error, got %v", err)
+	}
+	if apiErr.RetryAfter != 42*time.Second {
+		t.Errorf("expected to retry after 42s, got %s", apiErr.RetryAfter)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := New(srv.URL).Status(ctx); err == nil {
+		t.Fatalf("expected an error once the context expires")
+	}
+}
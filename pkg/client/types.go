@@ -0,0 +1,226 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Error codes returned by the API, see docs/API_ROUTES.MD
+const (
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidSignature = "invalid_signature"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeInvalidToken     = "invalid_token"
+	CodeTokenExpired     = "token_expired"
+	CodeForbidden        = "forbidden"
+	CodeCSRFFailed       = "csrf_failed"
+	CodeNotFound         = "not_found"
+	CodeAlreadyExists    = "already_exists"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeValidationFailed = "validation_failed"
+	CodeRateLimited      = "rate_limited"
+	CodeUnavailable      = "unavailable"
+	CodeTimeout          = "timeout"
+	CodeInternal         = "internal"
+)
+
+// Error is returned by every Client method when the API responds with a non 2xx status
+type Error struct {
+	StatusCode int          `json:"-"`
+	Code       string       `json:"code"`
+	Message    string       `json:"error"`
+	Details    []FieldError `json:"details,omitempty"`
+	// RequestID is the X-Request-ID of the failed request, which the server's logs are keyed by
+	RequestID string `json:"-"`
+	// RetryAfter is how long a rate limited client should wait before retrying, from the Retry-After header
+	RetryAfter time.Duration `json:"-"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("repetiswole api error (status %d, code %s, request %s): %s", e.StatusCode, e.Code, e.RequestID, e.Message)
+	}
+	return fmt.Sprintf("repetiswole api error (status %d, code %s): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsCode reports whether err is an API Error with the given code, such as CodeTokenExpired
+func IsCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// Envelope is the body of every successful API response
+type Envelope[T any] struct {
+	Message string `json:"message"`
+	Data    T      `json:"data"`
+}
+
+type StatusResponse struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// HealthResponse is the body of /healthz and /readyz. Checks is only set by /readyz, keyed by the name of each check
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	// Error is only answered to requests bearing the server's metrics token
+	Error      string    `json:"error,omitempty"`
+	DurationMs float64   `json:"durationMs"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+type SessionLoginRequest struct {
+	IdToken string `json:"idToken"`
+}
+
+// Session describes a session cookie. The client sends CSRFToken in the X-CSRF-Token header by itself
+type Session struct {
+	UID       string    `json:"UID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CSRFToken string    `json:"csrfToken"`
+}
+
+type RegisterEmailRequest struct {
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	DisplayName string `json:"displayname"`
+}
+
+type RegisterResponse struct {
+	UID string `json:"UID"`
+}
+
+type UserProfile struct {
+	UID         string       `json:"UID"`
+	Providers   []string     `json:"Providers"`
+	CurrentGoal string       `json:"CurrentGoal"`
+	Metrics     UserMetrics  `json:"Metrics"`
+	Settings    UserSettings `json:"Settings"`
+}
+
+// LinkProviderRequest is a credential issued by ProviderID, one of "google.com", "apple.com" or "github.com"
+type LinkProviderRequest struct {
+	ProviderID  string `json:"providerId"`
+	IdToken     string `json:"idToken,omitempty"`
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+type ProvidersResponse struct {
+	UID       string   `json:"UID"`
+	Providers []string `json:"Providers"`
+}
+
+type UserMetrics struct {
+	Height   float64   `json:"Height"`
+	Weight   float64   `json:"Weight"`
+	JoinDate time.Time `json:"JoinDate"`
+}
+
+type UserSettings struct {
+	UnitsPreference       string     `json:"UnitsPreference"`
+	SubscriptionTier      string     `json:"SubscriptionTier"`
+	SubscriptionExpiresAt *time.Time `json:"SubscriptionExpiresAt,omitempty"`
+}
+
+// ProfileUpdate changes only the fields that are set
+type ProfileUpdate struct {
+	CurrentGoal     *string  `json:"CurrentGoal,omitempty"`
+	Height          *float64 `json:"Metrics.Height,omitempty"`
+	Weight          *float64 `json:"Metrics.Weight,omitempty"`
+	UnitsPreference *string  `json:"Settings.UnitsPreference,omitempty"`
+}
+
+type CreateRoutineRequest struct {
+	RoutineName string `json:"routineName"`
+	UID         string `json:"uid"`
+	IdToken     string `json:"idToken"`
+}
+
+type CreateRoutineResponse struct {
+	RefId string `json:"RefId"`
+}
+
+type Routine struct {
+	RefId       string    `json:"RefId"`
+	RoutineName string    `json:"RoutineName"`
+	UID         string    `json:"UID"`
+	CreatedAt   time.Time `json:"CreatedAt"`
+	Workouts    []Workout `json:"Workouts"`
+}
+
+type Workout struct {
+	WorkoutName string     `json:"WorkoutName"`
+	Exercises   []Exercise `json:"Exercises"`
+}
+
+type Exercise struct {
+	MuscleGroup  int    `json:"MuscleGroup"`
+	ExerciseName string `json:"ExerciseName"`
+	Sets         []Set  `json:"Sets"`
+}
+
+type Set struct {
+	Reps      int     `json:"Reps"`
+	Weight    float64 `json:"Weight"`
+	IsDropSet bool    `json:"IsDropSet"`
+	IsWarmUp  bool    `json:"IsWarmUp"`
+}
+
+// ImportResponse reports what an import wrote and which rows of the export it could not use
+type ImportResponse struct {
+	Format            string           `json:"format"`
+	Workouts          int              `json:"workouts"`
+	Duplicates        int              `json:"duplicates"`
+	Sets              int              `json:"sets"`
+	SkippedRows       int              `json:"skippedRows"`
+	UnmappedExercises []string         `json:"unmappedExercises"`
+	Errors            []ImportRowError `json:"errors"`
+	// Incomplete is set when the server ran out of time partway, uploading the export again imports the rest
+	Incomplete bool `json:"incomplete"`
+}
+
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ArchiveRestoreResponse reports what restoring an account archive did with the profile, routines and workout logs
+type ArchiveRestoreResponse struct {
+	Profile     string               `json:"profile"`
+	Routines    ArchiveRestoreCounts `json:"routines"`
+	WorkoutLogs ArchiveRestoreCounts `json:"workoutLogs"`
+	Conflicts   []ArchiveConflict    `json:"conflicts"`
+	// Incomplete is set when the server ran out of time partway, restoring the archive again finishes it
+	Incomplete bool `json:"incomplete"`
+}
+
+type ArchiveRestoreCounts struct {
+	Created  int `json:"created"`
+	Replaced int `json:"replaced"`
+	Kept     int `json:"kept"`
+}
+
+type ArchiveConflict struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Resolution string `json:"resolution"`
+}
+
+type BillingWebhookResponse struct {
+	EventID string `json:"eventId"`
+}
+
+// OpenAPIDocument is left undecoded, it is meant to be handed to OpenAPI tooling
+type OpenAPIDocument = json.RawMessage
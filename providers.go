@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// the Firebase provider IDs of the sign-in methods a user may have. Signing in with a third-party provider happens in
+// the frontend with the Firebase JS SDK, the server only links further providers to an existing account
+const (
+	passwordProvider = "password"
+	googleProvider   = "google.com"
+	appleProvider    = "apple.com"
+	githubProvider   = "github.com"
+)
+
+const (
+	identityToolkitEndpoint = "https://identitytoolkit.googleapis.com/v1/accounts:signInWithIdp"
+	identityToolkitTimeout  = 10 * time.Second
+	// the most we will read from an Identity Toolkit response, which carries a handful of tokens
+	maxIdentityToolkitBodyBytes = 64 * 1024
+)
+
+// LinkProviderRequest is the credential a third-party provider issued to the user. GitHub only issues access tokens,
+// Apple only identity tokens, and Google either
+type LinkProviderRequest struct {
+	ProviderID  string `json:"providerId" validate:"required,oneof=google.com apple.com github.com"`
+	IdToken     string `json:"idToken,omitempty" validate:"max=8192"`
+	AccessToken string `json:"accessToken,omitempty" validate:"max=8192"`
+}
+
+// validateCredential checks that the request carries the kind of token its provider issues
+func (req *LinkProviderRequest) validateCredential() error {
+	switch {
+	case req.ProviderID == githubProvider && req.AccessToken == "":
+		return validationError(fieldError{Field: "accessToken", Message: "is required for github.com"})
+	case req.ProviderID == appleProvider && req.IdToken == "":
+		return validationError(fieldError{Field: "idToken", Message: "is required for apple.com"})
+	case req.IdToken == "" && req.AccessToken == "":
+		return validationError(fieldError{Field: "idToken", Message: "idToken or accessToken is required"})
+	}
+	return nil
+}
+
+type ProvidersResponse struct {
+	UID       string   `json:"UID"`
+	Providers []string `json:"Providers"`
+}
+
+// providerLinker links a third-party credential to the Firebase account the idToken belongs to
+type providerLinker interface {
+	LinkProvider(ctx context.Context, idToken string, credential *LinkProviderRequest) error
+}
+
+// identityToolkit links providers with the signInWithIdp endpoint of the Identity Toolkit REST API, which the Admin
+// SDK has no equivalent of
+type identityToolkit struct {
+	endpoint   string
+	apiKey     string
+	requestURI string
+	httpClient *http.Client
+}
+
+func newIdentityToolkit(apiKey, publicDomain string) *identityToolkit {
+	requestURI := "http://localhost"
+	if publicDomain != "" {
+		requestURI = "https://" + publicDomain
+	}
+	return &identityToolkit{
+		endpoint:   identityToolkitEndpoint,
+		apiKey:     apiKey,
+		requestURI: requestURI,
+		httpClient: &http.Client{Timeout: identityToolkitTimeout},
+	}
+}
+
+type signInWithIdpRequest struct {
+	PostBody          string `json:"postBody"`
+	RequestURI        string `json:"requestUri"`
+	IdToken           string `json:"idToken"`
+	ReturnSecureToken bool   `json:"returnSecureToken"`
+}
+
+type identityToolkitError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (it *identityToolkit) LinkProvider(ctx context.Context, idToken string, credential *LinkProviderRequest) error {
+	postBody := url.Values{"providerId": {credential.ProviderID}}
+	if credential.IdToken != "" {
+		postBody.Set("id_token", credential.IdToken)
+	}
+	if credential.AccessToken != "" {
+		postBody.Set("access_token", credential.AccessToken)
+	}
+	payload, err := json.Marshal(signInWithIdpRequest{
+		PostBody:          postBody.Encode(),
+		RequestURI:        it.requestURI,
+		IdToken:           idToken,
+		ReturnSecureToken: true,
+	})
+	if err != nil {
+		return fmt.Errorf("error while trying to encode signInWithIdp request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, it.endpoint+"?key="+url.QueryEscape(it.apiKey), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error while trying to create signInWithIdp request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := it.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while trying to link %s: %w", credential.ProviderID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIdentityToolkitBodyBytes))
+	if err != nil {
+		return fmt.Errorf("error while trying to read signInWithIdp response: %w", err)
+	}
+	failure := identityToolkitError{}
+	if err := json.Unmarshal(body, &failure); err != nil || failure.Error.Message == "" {
+		return fmt.Errorf("error, signInWithIdp answered %d: %w", resp.StatusCode, ErrUnavailable)
+	}
+	return linkProviderError(credential.ProviderID, failure.Error.Message)
+}
+
+// linkProviderError maps the message of a failed signInWithIdp call, e.g. "INVALID_IDP_RESPONSE : details", onto
+// the error the client sees. Messages it does not know of are failures of the Identity Toolkit, whose message is only
+// logged
+func linkProviderError(providerID, message string) error {
+	reason, _, _ := strings.Cut(message, " ")
+	switch reason {
+	case "FEDERATED_USER_ID_ALREADY_LINKED", "EMAIL_EXISTS":
+		return fmt.Errorf("error linking %s, another account already uses it: %w", providerID, ErrAlreadyExists)
+	case "INVALID_IDP_RESPONSE", "INVALID_CREDENTIAL_OR_PROVIDER_ID", "OPERATION_NOT_ALLOWED":
+		apiErr := validationError(fieldError{Field: "providerId", Message: fmt.Sprintf("%s rejected the credential", providerID)})
+		apiErr.cause = fmt.Errorf("signInWithIdp: %s", message)
+		return apiErr
+	case "TOKEN_EXPIRED", "CREDENTIAL_TOO_OLD_LOGIN_AGAIN":
+		return fmt.Errorf("error linking %s: %w", providerID, ErrTokenExpired)
+	case "INVALID_ID_TOKEN", "USER_NOT_FOUND", "USER_DISABLED":
+		return fmt.Errorf("error linking %s (%s): %w", providerID, reason, ErrInvalidToken)
+	}
+	return fmt.Errorf("error while trying to link %s (signInWithIdp: %s): %w", providerID, message, ErrUnavailable)
+}
+
+// signInProviders lists the sign-in providers of the user's Firebase account, e.g. "password" or "google.com"
+func (rtr *router) signInProviders(ctx context.Context, uid string) ([]string, error) {
+	accounts, err := rtr.config.userAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := accounts.GetUser(ctx, uid)
+	if auth.IsUserNotFound(err) {
+		return nil, fmt.Errorf("error, no account for user (uid: %s): %w", uid, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to get account of user (uid: %s): %w", uid, err)
+	}
+
+	providers := []string{}
+	for _, info := range record.ProviderUserInfo {
+		providers = append(providers, info.ProviderID)
+	}
+	sort.Strings(providers)
+	return providers, nil
+}
+
+func (rtr *router) LinkProvider(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	uid := r.PathValue("uid")
+	idToken := r.PathValue("idToken")
+
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "link provider", err)
+		return
+	}
+
+	credential := &LinkProviderRequest{}
+	if err := decodeJSONBody(w, r, credential, maxSmallJSONBodyBytes); err != nil {
+		rtr.StatusError(w, r, "link provider", err)
+		return
+	}
+	if err := credential.validateCredential(); err != nil {
+		rtr.StatusError(w, r, "link provider", err)
+		return
+	}
+
+	linker, err := rtr.config.providerLinker()
+	if err != nil {
+		rtr.StatusError(w, r, "link provider", err)
+		return
+	}
+	if err := linker.LinkProvider(r.Context(), idToken, credential); err != nil {
+		rtr.StatusError(w, r, "link provider", err)
+		return
+	}
+
+	// the account is the source of truth, the profile keeps a copy so that it is returned with the rest of the profile
+	providers, err := rtr.signInProviders(r.Context(), uid)
+	if err != nil {
+		rtr.StatusError(w, r, "link provider", err)
+		return
+	}
+	err = rtr.withProfile(r.Context(), uid, func() error {
+		return rtr.config.store.UpdateUserDocument(r.Context(), uid, map[string]interface{}{"Providers": providers})
+	})
+	if err != nil {
+		rtr.StatusError(w, r, "link provider",
+			fmt.Errorf("error while trying to store providers of user (uid: %s): %w", uid, err))
+		return
+	}
+
+	rtr.StatusOK(w, r, http.StatusOK, "successfully linked provider", ProvidersResponse{UID: uid, Providers: providers})
+}
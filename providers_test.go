@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeLinker links every credential to the fake account of the idToken, which fakeVerifier takes to be its uid
+type fakeLinker struct {
+	accounts *fakeAccounts
+	err      error
+}
+
+func (l *fakeLinker) LinkProvider(_ context.Context, idToken string, credential *LinkProviderRequest) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.accounts.link(idToken, credential.ProviderID)
+	return nil
+}
+
+func TestLinkProvider(t *testing.T) {
+	store := newMemoryStorage()
+	accounts := &fakeAccounts{}
+	rtr := getMemoryTestRouter(store)
+	rtr.config.accounts = accounts
+	rtr.config.linker = &fakeLinker{accounts: accounts}
+	handler := routes(rtr.config, rtr.logger)
+	if err := store.CreateUserDocument(context.Background(), newUserDocument("uid-1", []string{passwordProvider})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := strings.NewReader(`{"providerId": "google.com", "idToken": "google-token"}`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/user/providers/uid-1/uid-1", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	envelope := struct {
+		Data ProvidersResponse `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{googleProvider, passwordProvider}
+	if envelope.Data.UID != "uid-1" || !reflect.DeepEqual(envelope.Data.Providers, expected) {
+		t.Errorf("expected providers %v but got %+v", expected, envelope.Data)
+	}
+
+	user, err := store.GetUserDocument(context.Background(), "uid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	profile, err := userProfileFromDocument(user)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(profile.Providers, expected) {
+		t.Errorf("expected the profile to list providers %v but got %v", expected, profile.Providers)
+	}
+}
+
+func TestLinkProvider_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		linkErr   error
+		expected  int
+		errorCode errorCode
+	}{
+		{"unsupported provider", "/api/v1/user/providers/uid-1/uid-1", `{"providerId": "facebook.com", "idToken": "token"}`, nil, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"github without an access token", "/api/v1/user/providers/uid-1/uid-1", `{"providerId": "github.com", "idToken": "token"}`, nil, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"apple without an id token", "/api/v1/user/providers/uid-1/uid-1", `{"providerId": "apple.com", "accessToken": "token"}`, nil, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"someone else's account", "/api/v1/user/providers/uid-2/uid-1", `{"providerId": "google.com", "idToken": "token"}`, nil, http.StatusForbidden, codeForbidden},
+		{"malformed body for someone else's account", "/api/v1/user/providers/uid-2/uid-1", `{"providerId": "facebook.com"`, nil, http.StatusForbidden, codeForbidden},
+		{"credential of another account", "/api/v1/user/providers/uid-1/uid-1", `{"providerId": "google.com", "idToken": "token"}`, linkProviderError(googleProvider, "FEDERATED_USER_ID_ALREADY_LINKED"), http.StatusConflict, codeAlreadyExists},
+		{"rejected credential", "/api/v1/user/providers/uid-1/uid-1", `{"providerId": "github.com", "accessToken": "token"}`, linkProviderError(githubProvider, "INVALID_IDP_RESPONSE : bad token"), http.StatusUnprocessableEntity, codeValidationFailed},
+		{"identity toolkit failure", "/api/v1/user/providers/uid-1/uid-1", `{"providerId": "google.com", "idToken": "token"}`, linkProviderError(googleProvider, "INTERNAL_ERROR : backend"), http.StatusServiceUnavailable, codeUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStorage()
+			accounts := &fakeAccounts{}
+			rtr := getMemoryTestRouter(store)
+			rtr.config.accounts = accounts
+			rtr.config.linker = &fakeLinker{accounts: accounts, err: tt.linkErr}
+
+			w := httptest.NewRecorder()
+			routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.expected {
+				t.Fatalf("expected status %d but got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+			apiErr := apiError{}
+			if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil || apiErr.Code != tt.errorCode {
+				t.Errorf("expected code %s but got %+v %v", tt.errorCode, apiErr, err)
+			}
+			if strings.Contains(apiErr.Message, "backend") {
+				t.Errorf("expected the Identity Toolkit's message to stay out of the response, got %q", apiErr.Message)
+			}
+			if users, _ := store.GetAllUsers(context.Background()); len(users) != 0 {
+				t.Errorf("expected no profile to be created, got %v", users)
+			}
+		})
+	}
+}
+
+func TestLinkProvider_NotConfigured(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"providerId": "google.com", "idToken": "token"}`)
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/user/providers/uid-1/uid-1", body))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 without a Firebase API key but got %d", w.Code)
+	}
+}
+
+func TestGetUserProfileData_ProvisionsThirdPartyUser(t *testing.T) {
+	store := newMemoryStorage()
+	rtr := getMemoryTestRouter(store)
+	rtr.config.accounts = &fakeAccounts{providers: map[string][]string{"uid-1": {githubProvider}}}
+
+	w := httptest.NewRecorder()
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/user/uid-1/uid-1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	envelope := struct {
+		Data UserProfileResponse `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(envelope.Data.Providers, []string{githubProvider}) || envelope.Data.Settings.SubscriptionTier != freeSubscriptionTier {
+		t.Errorf("expected a default profile signed in with GitHub, got %+v", envelope.Data)
+	}
+}
+
+func TestIdentityToolkit_LinkProvider(t *testing.T) {
+	var received signInWithIdpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "api-key" {
+			t.Errorf("expected the API key to be sent, got %s", r.URL)
+		}
+		raw, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(raw, &received); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if strings.Contains(received.PostBody, "github.com") {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error": {"code": 400, "message": "FEDERATED_USER_ID_ALREADY_LINKED"}}`)
+			return
+		}
+		io.WriteString(w, `{"localId": "uid-1", "providerId": "google.com"}`)
+	}))
+	defer srv.Close()
+
+	linker := newIdentityToolkit("api-key", "example.com")
+	linker.endpoint = srv.URL
+
+	err := linker.LinkProvider(context.Background(), "firebase-token", &LinkProviderRequest{ProviderID: googleProvider, IdToken: "google-token"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	postBody, err := url.ParseQuery(received.PostBody)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received.IdToken != "firebase-token" || received.RequestURI != "https://example.com" ||
+		postBody.Get("providerId") != googleProvider || postBody.Get("id_token") != "google-token" {
+		t.Errorf("unexpected signInWithIdp request %+v", received)
+	}
+
+	err = linker.LinkProvider(context.Background(), "firebase-token", &LinkProviderRequest{ProviderID: githubProvider, AccessToken: "github-token"})
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists but got %v", err)
+	}
+}
+
+func TestLinkProviderError(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected int
+	}{
+		{"FEDERATED_USER_ID_ALREADY_LINKED", http.StatusConflict},
+		{"INVALID_IDP_RESPONSE : Invalid Idp Response: id_token audience mismatch", http.StatusUnprocessableEntity},
+		{"INVALID_ID_TOKEN", http.StatusUnauthorized},
+		{"TOKEN_EXPIRED", http.StatusUnauthorized},
+		{"INTERNAL_ERROR", http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		if status := toAPIError(linkProviderError(googleProvider, tt.message)).Status; status != tt.expected {
+			t.Errorf("expected %q to map to %d but got %d", tt.message, tt.expected, status)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit allows Requests per Period, with bursts of up to Requests. A zero rateLimit is not enforced
+type rateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// rateLimitPolicy limits a group of routes per client IP before the handler runs, and per user once the request's
+// idToken has been verified. Every policy has its own buckets, so hammering one group does not lock a client out of another
+type rateLimitPolicy struct {
+	name    string
+	perIP   rateLimit
+	perUser rateLimit
+}
+
+var (
+	// registrationRateLimit is deliberately tight, as every registration creates a Firebase account
+	registrationRateLimit = rateLimitPolicy{name: "registration", perIP: rateLimit{Requests: 5, Period: time.Hour}}
+	readRateLimit         = rateLimitPolicy{name: "read", perIP: rateLimit{Requests: 300, Period: time.Minute}, perUser: rateLimit{Requests: 120, Period: time.Minute}}
+	writeRateLimit        = rateLimitPolicy{name: "write", perIP: rateLimit{Requests: 120, Period: time.Minute}, perUser: rateLimit{Requests: 60, Period: time.Minute}}
+)
+
+// rateLimitStore keeps the token buckets. memoryRateLimitStore keeps them within the process; a store shared between
+// replicas, e.g. on Redis, implements the same interface so that every replica enforces one limit
+type rateLimitStore interface {
+	// Take removes a token from the bucket of key. When the bucket is empty it returns false and how long until a
+	// token is available again
+	Take(ctx context.Context, key string, limit rateLimit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// rateLimitSweepInterval is how often memoryRateLimitStore forgets the buckets that have refilled
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled, after which it is no different from a bucket that was never used
+	full time.Time
+}
+
+// memoryRateLimitStore keeps token buckets in memory, so each replica enforces its own limits
+type memoryRateLimitStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{now: time.Now, buckets: map[string]*tokenBucket{}}
+}
+
+func (s *memoryRateLimitStore) Take(_ context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	capacity := float64(limit.Requests)
+	perSecond := capacity / limit.Period.Seconds()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond)
+	bucket.updated = now
+
+	allowed, retryAfter := true, time.Duration(0)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+	} else {
+		allowed = false
+		retryAfter = time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.full = now.Add(time.Duration((capacity - bucket.tokens) / perSecond * float64(time.Second)))
+
+	return allowed, retryAfter, nil
+}
+
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for key, bucket := range s.buckets {
+		if !now.Before(bucket.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.nextSweep = now.Add(rateLimitSweepInterval)
+}
+
+// rateLimitError is returned once a client has used up its bucket, and tells it when to retry
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry in %s", e.retryAfter.Round(time.Second))
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// retryAfterSeconds is the value of the Retry-After header, rounded up so that clients never retry too early
+func (e *rateLimitError) retryAfterSeconds() int {
+	return int(math.Ceil(e.retryAfter.Seconds()))
+}
+
+type rateLimitPolicyContextKey struct{}
+
+// withRateLimit enforces the per-IP limit of policy before next runs, and records the policy so that authorizeUser
+// and authorizeRoutine can enforce its per-user limit. Without a rate limit store nothing is enforced
+func (rtr *router) withRateLimit(policy rateLimitPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rtr.config.rateLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		ip := clientIP(r, rtr.config.trustedProxies)
+		if err := rtr.takeRateLimit(r.Context(), policy, "ip", ip, policy.perIP); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			rtr.StatusError(w, r, "rate limit "+policy.name, err)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), rateLimitPolicyContextKey{}, policy)))
+	}
+}
+
+// limitUser enforces the per-user limit of the request's policy, once its idToken has been verified as uid's
+func (rtr *router) limitUser(ctx context.Context, uid string) error {
+	policy, ok := ctx.Value(rateLimitPolicyContextKey{}).(rateLimitPolicy)
+	if !ok || rtr.config.rateLimiter == nil {
+		return nil
+	}
+
+	return rtr.takeRateLimit(ctx, policy, "user", uid, policy.perUser)
+}
+
+func (rtr *router) takeRateLimit(ctx context.Context, policy rateLimitPolicy, scope, subject string, limit rateLimit) error {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return nil
+	}
+
+	allowed, retryAfter, err := rtr.config.rateLimiter.Take(ctx, policy.name+":"+scope+":"+subject, limit)
+	if err != nil {
+		// an unreachable shared store should not take the API down with it
+		loggerFrom(ctx).Warn("error checking rate limit, letting the request through", "policy", policy.name, "scope", scope, "error", err.Error())
+		return nil
+	}
+	if !allowed {
+		rtr.config.metrics.observeRateLimited(policy.name, scope)
+		return &rateLimitError{retryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// clientIP returns the address of the client. Behind trustedProxies reverse proxies, each appending the address it
+// received the request from to X-Forwarded-For, the client is the entry the outermost trusted proxy appended;
+// anything before it could have been sent by the client itself
+func clientIP(r *http.Request, trustedProxies int) string {
+	if trustedProxies > 0 {
+		hops := []string{}
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		if len(hops) >= trustedProxies && hops[len(hops)-trustedProxies] != "" {
+			return hops[len(hops)-trustedProxies]
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMemoryRateLimitStore_TokenBucket(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	limit := rateLimit{Requests: 3, Period: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := store.Take(context.Background(), "ip:1", limit); !allowed {
+			t.Fatalf("expected request %d of the burst to be allowed", i+1)
+		}
+	}
+
+	allowed, retryAfter, err := store.Take(context.Background(), "ip:1", limit)
+	if err != nil || allowed {
+		t.Fatalf("expected the 4th request to be limited, got %v, %v", allowed, err)
+	}
+	if retryAfter != 20*time.Second {
+		t.Errorf("expected a token to be available in 20s, got %s", retryAfter)
+	}
+	if allowed, _, _ := store.Take(context.Background(), "ip:2", limit); !allowed {
+		t.Errorf("expected another key to have its own bucket")
+	}
+
+	now = now.Add(20 * time.Second)
+	if allowed, _, _ := store.Take(context.Background(), "ip:1", limit); !allowed {
+		t.Errorf("expected a token to have refilled after 20s")
+	}
+	if allowed, _, _ := store.Take(context.Background(), "ip:1", limit); allowed {
+		t.Errorf("expected only one token to have refilled")
+	}
+}
+
+func TestMemoryRateLimitStore_Sweep(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	_, _, _ = store.Take(context.Background(), "short", rateLimit{Requests: 10, Period: time.Minute})
+	_, _, _ = store.Take(context.Background(), "long", rateLimit{Requests: 5, Period: time.Hour})
+
+	now = now.Add(2 * rateLimitSweepInterval)
+	_, _, _ = store.Take(context.Background(), "new", rateLimit{Requests: 10, Period: time.Minute})
+
+	if _, ok := store.buckets["short"]; ok {
+		t.Errorf("expected the refilled bucket to be forgotten")
+	}
+	if _, ok := store.buckets["long"]; !ok {
+		t.Errorf("expected the bucket still refilling to be kept")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		forwardedFor   []string
+		trustedProxies int
+		want           string
+	}{
+		{"no proxies", []string{"203.0.113.9"}, 0, "192.0.2.1"},
+		{"one proxy", []string{"203.0.113.9"}, 1, "203.0.113.9"},
+		{"spoofed entry", []string{"198.51.100.7, 203.0.113.9"}, 1, "203.0.113.9"},
+		{"two proxies", []string{"203.0.113.9, 10.0.0.2", "10.0.0.3"}, 2, "10.0.0.2"},
+		{"missing header", nil, 1, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.0.2.1:4321"
+			for _, header := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := clientIP(req, tt.trustedProxies); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRateLimit_Registration(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.rateLimiter = newMemoryRateLimitStore()
+	rtr.config.metrics = newMetrics()
+	handler := routes(rtr.config, rtr.logger)
+
+	register := func(remoteAddr string) *http.Response {
+		req := httptest.NewRequest("POST", "/api/v1/register/email", strings.NewReader(`{}`))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	for i := 0; i < registrationRateLimit.perIP.Requests; i++ {
+		if resp := register("192.0.2.1:1000"); resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("expected request %d to be let through", i+1)
+		}
+	}
+
+	resp := register("192.0.2.1:1001")
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 but got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "720" {
+		t.Errorf("expected to retry after 720 seconds, got %q", resp.Header.Get("Retry-After"))
+	}
+	apiErr := &apiError{}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if apiErr.Code != codeRateLimited {
+		t.Errorf("expected code %s, got %s", codeRateLimited, apiErr.Code)
+	}
+
+	if resp := register("192.0.2.2:1000"); resp.StatusCode == http.StatusTooManyRequests {
+		t.Errorf("expected another IP to be let through")
+	}
+
+	if rejected := testutil.ToFloat64(rtr.config.metrics.rateLimited.WithLabelValues("registration", "ip")); rejected != 1 {
+		t.Errorf("expected the rejection to be counted once, got %v", rejected)
+	}
+}
+
+func TestRateLimit_BehindRailwayProxy(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.rateLimiter = newMemoryRateLimitStore()
+	rtr.config.trustedProxies = 1
+	handler := routes(rtr.config, rtr.logger)
+
+	// every request arrives from Railway's proxy, which appends the client's IP to whatever the client sent
+	register := func(forwardedFor string) int {
+		req := httptest.NewRequest("POST", "/api/v1/register/email", strings.NewReader(`{}`))
+		req.RemoteAddr = "100.64.0.2:48120"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < registrationRateLimit.perIP.Requests; i++ {
+		if code := register("203.0.113.9"); code == http.StatusTooManyRequests {
+			t.Fatalf("expected request %d to be let through", i+1)
+		}
+	}
+	if code := register("198.51.100.7, 203.0.113.9"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the first client to be limited, even when spoofing X-Forwarded-For, got %d", code)
+	}
+	if code := register("198.51.100.7"); code == http.StatusTooManyRequests {
+		t.Errorf("expected a second client behind the same proxy to have its own bucket")
+	}
+}
+
+func TestRateLimit_PerUser(t *testing.T) {
+	store := newMemoryStorage()
+	rtr := getMemoryTestRouter(store)
+	rtr.config.rateLimiter = newMemoryRateLimitStore()
+	policy := rateLimitPolicy{name: "test", perIP: rateLimit{Requests: 100, Period: time.Minute}, perUser: rateLimit{Requests: 2, Period: time.Minute}}
+	handler := rtr.withRateLimit(policy, rtr.GetAllUserRoutines)
+
+	get := func(remoteAddr, uid string) int {
+		req := httptest.NewRequest("GET", "/api/v1/user/routine/"+uid+"/"+uid, nil)
+		req.SetPathValue("uid", uid)
+		req.SetPathValue("idToken", uid)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	// the user's bucket is shared by every address they send requests from
+	if code := get("192.0.2.1:1000", "uid-1"); code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", code)
+	}
+	if code := get("192.0.2.2:1000", "uid-1"); code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", code)
+	}
+	if code := get("192.0.2.3:1000", "uid-1"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the user's 3rd request to be limited, got %d", code)
+	}
+	if code := get("192.0.2.1:1000", "uid-2"); code != http.StatusOK {
+		t.Errorf("expected another user to be let through, got %d", code)
+	}
+}
+
+func TestRateLimit_Disabled(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	policy := rateLimitPolicy{name: "test", perIP: rateLimit{Requests: 1, Period: time.Hour}}
+	handler := rtr.withRateLimit(policy, rtr.ServerStatus)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/status", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected no limit without a rate limit store, got %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// apiResponse is the envelope of every successful API response
+type apiResponse struct {
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+type RegisterResponse struct {
+	UID string `json:"UID"`
+}
+
+// UserProfileResponse is a document of the users collection as returned to clients
+type UserProfileResponse struct {
+	UID         string               `json:"UID"`
+	Providers   []string             `json:"Providers"`
+	CurrentGoal string               `json:"CurrentGoal"`
+	Metrics     UserMetricsResponse  `json:"Metrics"`
+	Settings    UserSettingsResponse `json:"Settings"`
+}
+
+type UserMetricsResponse struct {
+	Height   float64   `json:"Height"`
+	Weight   float64   `json:"Weight"`
+	JoinDate time.Time `json:"JoinDate"`
+}
+
+type UserSettingsResponse struct {
+	UnitsPreference       string     `json:"UnitsPreference"`
+	SubscriptionTier      string     `json:"SubscriptionTier"`
+	SubscriptionExpiresAt *time.Time `json:"SubscriptionExpiresAt,omitempty"`
+}
+
+type CreateRoutineResponse struct {
+	RefId string `json:"RefId"`
+}
+
+// RoutineResponse is a document of the routines collection as returned to clients, RefId being its document ID
+type RoutineResponse struct {
+	RefId       string            `json:"RefId"`
+	RoutineName string            `json:"RoutineName"`
+	UID         string            `json:"UID"`
+	CreatedAt   time.Time         `json:"CreatedAt"`
+	Workouts    []WorkoutResponse `json:"Workouts"`
+}
+
+type WorkoutResponse struct {
+	WorkoutName string             `json:"WorkoutName"`
+	Exercises   []ExerciseResponse `json:"Exercises"`
+}
+
+type ExerciseResponse struct {
+	MuscleGroup  int           `json:"MuscleGroup"`
+	ExerciseName string        `json:"ExerciseName"`
+	Sets         []SetResponse `json:"Sets"`
+}
+
+type SetResponse struct {
+	Reps      int     `json:"Reps"`
+	Weight    float64 `json:"Weight"`
+	IsDropSet bool    `json:"IsDropSet"`
+	IsWarmUp  bool    `json:"IsWarmUp"`
+}
+
+type BillingWebhookResponse struct {
+	EventID string `json:"eventId"`
+}
+
+// decodeDocument converts raw Firestore document data into one of the typed responses, going through JSON so that
+// numbers stored as either integers or doubles both decode
+func decodeDocument(data map[string]interface{}, dst interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error while trying to encode document data: %w", err)
+	}
+
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return fmt.Errorf("error while trying to decode document data into %T: %w", dst, err)
+	}
+
+	return nil
+}
+
+func userProfileFromDocument(data map[string]interface{}) (*UserProfileResponse, error) {
+	profile := &UserProfileResponse{}
+	if err := decodeDocument(data, profile); err != nil {
+		return nil, err
+	}
+
+	// documents created before billing existed store no expiry, and registration stores the zero time
+	if expiresAt := profile.Settings.SubscriptionExpiresAt; expiresAt != nil && expiresAt.IsZero() {
+		profile.Settings.SubscriptionExpiresAt = nil
+	}
+
+	return profile, nil
+}
+
+func routineFromDocument(refId string, data map[string]interface{}) (*RoutineResponse, error) {
+	routine := &RoutineResponse{}
+	if err := decodeDocument(data, routine); err != nil {
+		return nil, err
+	}
+
+	routine.RefId = refId
+	if routine.Workouts == nil {
+		routine.Workouts = []WorkoutResponse{}
+	}
+
+	return routine, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserProfileFromDocument(t *testing.T) {
+	joined := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	profile, err := userProfileFromDocument(map[string]interface{}{
+		"UID":         "test-user-123",
+		"CurrentGoal": "Unchosen!",
+		"Metrics": map[string]interface{}{
+			"Height":   int64(180),
+			"Weight":   81.5,
+			"JoinDate": joined,
+		},
+		"Settings": map[string]interface{}{
+			"UnitsPreference":       "Metric",
+			"SubscriptionTier":      freeSubscriptionTier,
+			"SubscriptionExpiresAt": time.Time{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if profile.Metrics.Height != 180 || profile.Metrics.Weight != 81.5 || !profile.Metrics.JoinDate.Equal(joined) {
+		t.Errorf("unexpected metrics: %+v", profile.Metrics)
+	}
+	if profile.Settings.SubscriptionExpiresAt != nil {
+		t.Errorf("expected the zero expiry stored at registration to be omitted, got %v", profile.Settings.SubscriptionExpiresAt)
+	}
+}
+
+func TestRoutineFromDocument(t *testing.T) {
+	routine, err := routineFromDocument("routine-123", map[string]interface{}{
+		"RoutineName": "Push Day",
+		"UID":         "test-user-123",
+		"CreatedAt":   time.Now(),
+		// numbers written by the frontend before validation existed were stored as doubles
+		"Workouts": []interface{}{
+			map[string]interface{}{
+				"WorkoutName": "Push",
+				"Exercises": []interface{}{
+					map[string]interface{}{
+						"MuscleGroup":  float64(0),
+						"ExerciseName": "Bench Press",
+						"Sets":         []interface{}{map[string]interface{}{"Reps": float64(5), "Weight": 100.5, "IsDropSet": false, "IsWarmUp": true}},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if routine.RefId != "routine-123" {
+		t.Errorf("expected RefId to be the document ID, got %q", routine.RefId)
+	}
+	if set := routine.Workouts[0].Exercises[0].Sets[0]; set.Reps != 5 || set.Weight != 100.5 || !set.IsWarmUp {
+		t.Errorf("unexpected set: %+v", set)
+	}
+
+	empty, err := routineFromDocument("routine-456", map[string]interface{}{"RoutineName": "New", "UID": "test-user-123"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if empty.Workouts == nil {
+		t.Errorf("expected an empty routine to have an empty, not null, list of workouts")
+	}
+}
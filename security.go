@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// contentSecurityPolicy lets the frontend load its own bundle and talk to the API and Firebase, whose sign-in flows
+// run in frames and popups served from the project's auth domain. Inline styles stay allowed for React's style props
+var contentSecurityPolicy = strings.Join([]string{
+	"default-src 'self'",
+	"script-src 'self' https://apis.google.com",
+	"style-src 'self' 'unsafe-inline'",
+	"img-src 'self' data: https:",
+	"font-src 'self' data:",
+	"connect-src 'self' https://*.googleapis.com https://*.firebaseio.com https://*.google-analytics.com",
+	"frame-src https://*.firebaseapp.com https://*.web.app",
+	"object-src 'none'",
+	"base-uri 'self'",
+	"form-action 'self'",
+	"frame-ancestors 'none'",
+}, "; ")
+
+// hstsHeader asks browsers to only use HTTPS for a year. It is only sent in production, where Railway terminates TLS
+const hstsHeader = "max-age=31536000; includeSubDomains"
+
+const corsMaxAge = "600"
+
+// securityHeaders sets the headers every response should carry, before next writes any of its own
+func securityHeaders(hsts bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", contentSecurityPolicy)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if hsts {
+			h.Set("Strict-Transport-Security", hstsHeader)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedOrigins returns the origins allowed to call the API from a browser: the deployment's public domain and any
+// extra origins from the settings, separated by commas or spaces, e.g. the Vite dev server's http://localhost:5173
+func allowedOrigins(publicDomain, extra string) []string {
+	origins := []string{}
+	if publicDomain != "" {
+		origins = append(origins, "https://"+publicDomain)
+	}
+	for _, origin := range strings.FieldsFunc(extra, func(r rune) bool { return r == ',' || r == ' ' }) {
+		origins = append(origins, strings.TrimSuffix(origin, "/"))
+	}
+	return origins
+}
+
+// cors applies the CORS policy of the config to the API routes. Requests from an allowed origin get the headers that
+// let the browser read the response, preflight requests are answered here, and those from any other origin are refused
+func (rtr *router) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := slices.Contains(rtr.config.corsOrigins, origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", requestIDHeader+", Retry-After")
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		if !allowed {
+			w.Header().Set("Content-Type", "application/json")
+			rtr.StatusError(w, r, "cors preflight", fmt.Errorf("origin %q is not allowed to call the API: %w", origin, ErrForbidden))
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+requestIDHeader+", "+csrfHeader)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, hsts := range []bool{false, true} {
+		rtr := getMemoryTestRouter(newMemoryStorage())
+		rtr.config.hsts = hsts
+		w := httptest.NewRecorder()
+		routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+
+		for header, want := range map[string]string{
+			"Content-Security-Policy": contentSecurityPolicy,
+			"X-Content-Type-Options":  "nosniff",
+			"X-Frame-Options":         "DENY",
+			"Referrer-Policy":         "strict-origin-when-cross-origin",
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("expected %s to be %q, got %q", header, want, got)
+			}
+		}
+		if got := w.Header().Get("Strict-Transport-Security"); (got != "") != hsts {
+			t.Errorf("expected Strict-Transport-Security to be set only with hsts (%v), got %q", hsts, got)
+		}
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	got := allowedOrigins("repetiswole.up.railway.app", "http://localhost:5173/, http://127.0.0.1:5173")
+	want := []string{"https://repetiswole.up.railway.app", "http://localhost:5173", "http://127.0.0.1:5173"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if got := allowedOrigins("", ""); len(got) != 0 {
+		t.Errorf("expected no origins, got %v", got)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.corsOrigins = []string{"https://repetiswole.up.railway.app"}
+	handler := routes(rtr.config, rtr.logger)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantAllowed bool
+	}{
+		{"allowed origin", "GET", "/api/v1/user/routine/uid-1/uid-1", "https://repetiswole.up.railway.app", false, http.StatusOK, true},
+		{"other origin", "GET", "/api/v1/user/routine/uid-1/uid-1", "https://evil.example", false, http.StatusOK, false},
+		{"allowed preflight", "OPTIONS", "/api/v1/user/routine/create", "https://repetiswole.up.railway.app", true, http.StatusNoContent, true},
+		{"refused preflight", "OPTIONS", "/api/v1/user/routine/create", "https://evil.example", true, http.StatusForbidden, false},
+		{"frontend", "GET", "/status", "https://repetiswole.up.railway.app", false, http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d but got %d", tt.wantStatus, w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); (got == tt.origin) != tt.wantAllowed {
+				t.Errorf("expected the origin to be allowed (%v), got Access-Control-Allow-Origin %q", tt.wantAllowed, got)
+			}
+			if tt.preflight && tt.wantAllowed && w.Header().Get("Access-Control-Allow-Methods") == "" {
+				t.Errorf("expected the preflight to list the allowed methods")
+			}
+		})
+	}
+}
+
+// failingFS fails to stat any file but index.html with an error other than fs.ErrNotExist
+type failingFS struct {
+	fstest.MapFS
+}
+
+func (f failingFS) Stat(name string) (fs.FileInfo, error) {
+	if name != "index.html" {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: errors.New("input/output error")}
+	}
+	return f.MapFS.Stat(name)
+}
+
+func TestServeFrontend(t *testing.T) {
+	files := fstest.MapFS{
+		"index.html":          {Data: []byte("<html>index</html>")},
+		"assets/app.js":       {Data: []byte("console.log('app')")},
+		"assets/nested/a.txt": {Data: []byte("nested")},
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"root", "/", http.StatusOK, "<html>index</html>"},
+		{"asset", "/assets/app.js", http.StatusOK, "console.log('app')"},
+		{"react router path", "/home/routines/abc", http.StatusOK, "<html>index</html>"},
+		{"directory", "/assets/", http.StatusOK, "<html>index</html>"},
+		// the ServeMux redirects to the cleaned path, and paths it leaves alone are cleaned before they are looked up
+		{"traversal", "/assets/../../../etc/passwd", http.StatusTemporaryRedirect, ""},
+		{"encoded traversal", "/..%2f..%2fetc/passwd", http.StatusOK, "<html>index</html>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rtr := getMemoryTestRouter(newMemoryStorage())
+			rtr.config.frontend = files
+			w := httptest.NewRecorder()
+			routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			body, _ := io.ReadAll(w.Body)
+			if w.Code != tt.wantStatus || tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("expected %d %q, got %d %q", tt.wantStatus, tt.wantBody, w.Code, body)
+			}
+		})
+	}
+}
+
+func TestServeFrontend_StatError(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.frontend = failingFS{fstest.MapFS{"index.html": {Data: []byte("<html>index</html>")}}}
+
+	w := httptest.NewRecorder()
+	routes(rtr.config, rtr.logger).ServeHTTP(w, httptest.NewRequest("GET", "/assets/app.js", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 but got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"code":"internal"`) {
+		t.Errorf("expected an internal error body, got %s", w.Body.String())
+	}
+}
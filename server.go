@@ -3,89 +3,142 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
-	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
-	"github.com/joho/godotenv"
+	"firebase.google.com/go/v4/errorutils"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func routes(cfg *config, logger *slog.Logger) *http.ServeMux {
+func routes(cfg *config, logger *slog.Logger) http.Handler {
 	m := http.NewServeMux()
 	r := &router{
 		config: cfg,
 		logger: logger,
 	}
 
-	m.HandleFunc("GET /status", r.ServerStatus)
+	registerRoutes(m, r)
+
+	return logRequests(logger, traceRequests(cfg.tracer(), cfg.metrics.middleware(securityHeaders(cfg.hsts, r.cors(r.sessions(m))))))
+}
+
+// routeRegistrar is satisfied by *http.ServeMux, and lets tests list every pattern registerRoutes registers
+type routeRegistrar interface {
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
 
-	m.HandleFunc("POST /api/v1/register/email", r.EmailRegister)
-	m.HandleFunc("GET /api/v1/user/{uid}/{idToken}", r.GetUserProfileData)
-	m.HandleFunc("PUT /api/v1/user/{uid}/{idToken}", r.UpdateUserProfileData)
-	m.HandleFunc("POST /api/v1/user/routine/create", r.CreateUserRoutine)
-	m.HandleFunc("GET /api/v1/user/routine/{uid}/{idToken}", r.GetAllUserRoutines)
-	m.HandleFunc("GET /api/v1/user/routine/single/{routineRefId}/{idToken}", r.GetOneUserRoutine)
-	m.HandleFunc("PUT /api/v1/user/routine/single/{routineRefId}/{idToken}", r.UpdateOneUserRoutine)
+// registerRoutes registers every route of the service. API routes must also be documented within apiOperations in openapi.go
+func registerRoutes(m routeRegistrar, r *router) {
+	m.HandleFunc("GET /status", r.ServerStatus)
+	m.HandleFunc("GET /healthz", r.Healthz)
+	m.HandleFunc("GET /readyz", r.Readyz)
+	m.HandleFunc("GET /api/openapi.json", r.OpenAPISpec)
+	m.HandleFunc("GET /metrics", r.Metrics)
+
+	m.HandleFunc("POST /api/v1/register/email", r.withRateLimit(registrationRateLimit, withDeadline(writeRouteTimeout, r.EmailRegister)))
+	m.HandleFunc("POST /api/v1/session/login", r.withRateLimit(writeRateLimit, withDeadline(writeRouteTimeout, r.SessionLogin)))
+	m.HandleFunc("GET /api/v1/session", r.withRateLimit(readRateLimit, withDeadline(readRouteTimeout, r.GetSession)))
+	m.HandleFunc("POST /api/v1/session/logout", r.withRateLimit(writeRateLimit, r.SessionLogout))
+	m.HandleFunc("POST /api/v1/session/revoke", r.withRateLimit(writeRateLimit, withDeadline(writeRouteTimeout, r.SessionRevoke)))
+	m.HandleFunc("POST /api/v1/user/providers/{uid}/{idToken}", r.withRateLimit(writeRateLimit, withDeadline(writeRouteTimeout, r.LinkProvider)))
+	m.HandleFunc("GET /api/v1/user/{uid}/{idToken}", r.withRateLimit(readRateLimit, withDeadline(readRouteTimeout, r.GetUserProfileData)))
+	m.HandleFunc("PUT /api/v1/user/{uid}/{idToken}", r.withRateLimit(writeRateLimit, withDeadline(writeRouteTimeout, r.UpdateUserProfileData)))
+	m.HandleFunc("POST /api/v1/user/routine/create", r.withRateLimit(writeRateLimit, withDeadline(writeRouteTimeout, r.CreateUserRoutine)))
+	m.HandleFunc("GET /api/v1/user/routine/{uid}/{idToken}", r.withRateLimit(readRateLimit, withDeadline(readRouteTimeout, r.GetAllUserRoutines)))
+	m.HandleFunc("GET /api/v1/user/routine/single/{routineRefId}/{idToken}", r.withRateLimit(readRateLimit, withDeadline(readRouteTimeout, r.GetOneUserRoutine)))
+	m.HandleFunc("PUT /api/v1/user/routine/single/{routineRefId}/{idToken}", r.withRateLimit(writeRateLimit, withDeadline(writeRouteTimeout, r.UpdateOneUserRoutine)))
+	m.HandleFunc("GET /api/v1/user/export/csv/{uid}/{idToken}", r.withRateLimit(readRateLimit, withDeadline(readRouteTimeout, r.ExportCSV)))
+	m.HandleFunc("POST /api/v1/user/import/{uid}/{idToken}", r.withRateLimit(writeRateLimit, withDeadline(importRouteTimeout, r.ImportHistory)))
+	m.HandleFunc("GET /api/v1/user/export/archive/{uid}/{idToken}", r.withRateLimit(readRateLimit, withDeadline(readRouteTimeout, r.ExportArchive)))
+	m.HandleFunc("POST /api/v1/user/import/archive/{uid}/{idToken}", r.withRateLimit(writeRateLimit, withDeadline(importRouteTimeout, r.RestoreArchive)))
+	// the webhook is authenticated by its signature, and Stripe backs off on its own when deliveries fail
+	m.HandleFunc("POST /api/v1/billing/webhook", withDeadline(billingRouteTimeout, r.BillingWebhook))
 
 	// catch-all routing solution for serving static React frontend with Go, handling React Router routing cases
 	// see: https://stackoverflow.com/a/64687181
 	m.HandleFunc("GET /", r.ServeFrontend)
-
-	return m
 }
 
 // implements the Routes interface
 type router struct {
 	config *config
 	logger *slog.Logger
+
+	readinessOnce    sync.Once
+	readinessChecker *readinessChecker
+
+	frontendOnce   sync.Once
+	frontendServer *frontendServer
 }
 
-func (r *router) StatusOK(w http.ResponseWriter, httpStatus int, message string, data interface{}) {
+func (r *router) StatusOK(w http.ResponseWriter, req *http.Request, httpStatus int, message string, data interface{}) {
 	w.WriteHeader(httpStatus)
-	err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": message,
-		"data":    data,
+	err := json.NewEncoder(w).Encode(apiResponse{
+		Message: message,
+		Data:    data,
 	})
 
 	if err != nil {
-		errMsg := fmt.Sprintf("error returning json marshalling for the following success message: %s", message)
-		r.logger.Error(errMsg)
+		loggerFrom(req.Context()).Error("error returning json marshalling for success message", "message", message, "error", err.Error())
 	}
 }
 
-func (r *router) StatusError(w http.ResponseWriter, httpStatus int, endpointPathDescriptor string, rootErr error) {
-	w.WriteHeader(httpStatus)
-	err := json.NewEncoder(w).Encode(map[string]string{
-		"error": fmt.Sprintf("error marshalling clients request during API path %s: %v", endpointPathDescriptor, rootErr.Error()),
-	})
+// StatusError writes rootErr as an apiError, choosing the HTTP status and error code from the sentinel errors it wraps.
+// Server errors are logged with the request's logger, and answered with its request ID in place of their cause.
+// Rate limited clients are told when to retry with a Retry-After header
+func (r *router) StatusError(w http.ResponseWriter, req *http.Request, endpointPathDescriptor string, rootErr error) {
+	apiErr := toAPIError(rootErr)
+	if apiErr.Status >= http.StatusInternalServerError {
+		loggerFrom(req.Context()).Error("request failed", "endpoint", endpointPathDescriptor, "code", apiErr.Code, "error", rootErr.Error())
+		withID := *apiErr
+		withID.RequestID = w.Header().Get(requestIDHeader)
+		apiErr = &withID
+	} else if apiErr.cause != nil {
+		// the client only sees the fixed message of the code, the chain explaining it is for us
+		loggerFrom(req.Context()).Info("request rejected", "endpoint", endpointPathDescriptor, "code", apiErr.Code, "error", rootErr.Error())
+	}
+
+	var limited *rateLimitError
+	if errors.As(rootErr, &limited) {
+		w.Header().Set("Retry-After", strconv.Itoa(limited.retryAfterSeconds()))
+	}
+
+	w.WriteHeader(apiErr.Status)
+	err := json.NewEncoder(w).Encode(apiErr)
 
 	if err != nil {
-		errMsg := fmt.Sprintf("error while json encoding in endpoint path: %s", endpointPathDescriptor)
-		r.logger.Error(errMsg)
+		loggerFrom(req.Context()).Error("error while json encoding", "endpoint", endpointPathDescriptor, "error", err.Error())
 	}
 }
 
-func (r *router) ServerStatus(w http.ResponseWriter, _ *http.Request) {
+type ServerStatusResponse struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (r *router) ServerStatus(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	response, err := json.Marshal(struct {
-		Message string `json:"message"`
-		Code    int    `json:"code"`
-	}{"Server status:", http.StatusOK})
+	response, err := json.Marshal(ServerStatusResponse{"Server status:", http.StatusOK})
 
 	if err != nil {
-		slog.Error("error marshalling status: %w", err.Error(), "")
+		loggerFrom(req.Context()).Error("error marshalling status", "error", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	if _, err = w.Write(response); err != nil {
-		slog.Error("error writing response back during status endpoint: %w", err.Error(), "")
-		w.WriteHeader(http.StatusInternalServerError)
+		loggerFrom(req.Context()).Error("error writing response back during status endpoint", "error", err.Error())
 	}
 }
 
@@ -93,14 +146,160 @@ type config struct {
 	frontendBuildPath string
 	port              int
 	ctx               context.Context
-	env               map[string]string
 	firebaseApp       *firebase.App
+
+	// publicDomain is the domain the deployment is served from, empty when running locally
+	publicDomain string
+	// billingWebhookSecret verifies billing webhook signatures, the webhook is disabled without one
+	billingWebhookSecret string
+	// firebaseAPIKey is the web API key the Identity Toolkit REST API is called with, linking providers is disabled
+	// without one
+	firebaseAPIKey string
+
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+
+	// long-lived clients, created on first use and closed by close when the server shuts down
+	clientsMu sync.Mutex
+	firestore *firestore.Client
+	auth      *auth.Client
+
+	// store is where handlers read and write documents, a firestoreStorage outside of tests
+	store storage
+	// verifier overrides the Firebase auth client when verifying idTokens, accounts when managing users, sessions when
+	// managing session cookies, and linker the Identity Toolkit when linking sign-in providers
+	verifier tokenVerifier
+	accounts userAccounts
+	sessions sessionManager
+	linker   providerLinker
+
+	// metrics is nil when nothing should be recorded, and metricsToken guards /metrics and the errors of /readyz when it is set
+	metrics      *metrics
+	metricsToken string
+
+	// tracerProvider is nil when tracing is disabled
+	tracerProvider trace.TracerProvider
+
+	// rateLimiter is nil when requests are not rate limited. trustedProxies is how many reverse proxies in front of
+	// the server append to X-Forwarded-For
+	rateLimiter    rateLimitStore
+	trustedProxies int
+
+	// corsOrigins may call the API from a browser, and hsts is set when the deployment is only reachable over HTTPS
+	corsOrigins []string
+	hsts        bool
+	// frontend overrides the files of frontendBuildPath when serving the frontend
+	frontend fs.FS
+}
+
+// frontendFiles returns the files of the frontend build
+func (cfg *config) frontendFiles() fs.FS {
+	if cfg.frontend != nil {
+		return cfg.frontend
+	}
+	return os.DirFS(cfg.frontendBuildPath)
+}
+
+func (cfg *config) firestoreClient() (*firestore.Client, error) {
+	cfg.clientsMu.Lock()
+	defer cfg.clientsMu.Unlock()
+
+	if cfg.firestore != nil {
+		return cfg.firestore, nil
+	}
+	if cfg.firebaseApp == nil {
+		return nil, fmt.Errorf("firebaseApp is not initialized")
+	}
+
+	client, err := cfg.firebaseApp.Firestore(cfg.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.firestore = client
+	return client, nil
+}
+
+func (cfg *config) authClient() (*auth.Client, error) {
+	cfg.clientsMu.Lock()
+	defer cfg.clientsMu.Unlock()
+
+	if cfg.auth != nil {
+		return cfg.auth, nil
+	}
+	if cfg.firebaseApp == nil {
+		return nil, fmt.Errorf("firebaseApp is not initialized")
+	}
+
+	client, err := cfg.firebaseApp.Auth(cfg.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.auth = client
+	return client, nil
+}
+
+func (cfg *config) userAccounts() (userAccounts, error) {
+	if cfg.accounts != nil {
+		return cfg.accounts, nil
+	}
+	return cfg.authClient()
+}
+
+func (cfg *config) sessionManager() (sessionManager, error) {
+	if cfg.sessions != nil {
+		return cfg.sessions, nil
+	}
+	return cfg.authClient()
+}
+
+func (cfg *config) providerLinker() (providerLinker, error) {
+	if cfg.linker != nil {
+		return cfg.linker, nil
+	}
+	if cfg.firebaseAPIKey == "" {
+		return nil, newAPIError(http.StatusServiceUnavailable, codeUnavailable, "linking sign-in providers is not configured")
+	}
+	return newIdentityToolkit(cfg.firebaseAPIKey, cfg.publicDomain), nil
+}
+
+func (cfg *config) idTokenVerifier() (tokenVerifier, error) {
+	var verifier tokenVerifier = cfg.verifier
+	if verifier == nil {
+		client, err := cfg.authClient()
+		if err != nil {
+			return nil, err
+		}
+		verifier = client
+	}
+
+	if cfg.metrics == nil {
+		return verifier, nil
+	}
+	return &instrumentedVerifier{next: verifier, metrics: cfg.metrics}, nil
+}
+
+// close releases the long-lived clients, the auth client holds no connections of its own
+func (cfg *config) close() error {
+	cfg.clientsMu.Lock()
+	defer cfg.clientsMu.Unlock()
+
+	if cfg.firestore == nil {
+		return nil
+	}
+
+	err := cfg.firestore.Close()
+	cfg.firestore = nil
+	return err
 }
 
 type NewUserEmailAuthRequest struct {
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	DisplayName string `json:"displayname"`
+	Email       string `json:"email" validate:"required,email,max=254"`
+	Password    string `json:"password" validate:"required,min=6,max=128"`
+	DisplayName string `json:"displayname" validate:"required,max=64"`
 }
 
 type FirebaseAuthResponseOk struct {
@@ -111,56 +310,84 @@ type FirebaseAuthResponseOk struct {
 	IdToken      string `json:"idToken"`
 }
 
-func (rtr *router) ServeFrontend(w http.ResponseWriter, r *http.Request) {
-	fs := http.FileServer(http.Dir(rtr.config.frontendBuildPath))
-	// If the requested file exists then return if; otherwise return index.html (fileserver default page)
-	if r.URL.Path != "/" {
-		fullPath := rtr.config.frontendBuildPath + strings.TrimPrefix(path.Clean(r.URL.Path), "/")
-		_, err := os.Stat(fullPath)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				panic(err)
-			}
-			// Requested file does not exist so we return the default (resolves to index.html)
-			r.URL.Path = "/"
-		}
-	}
-
-	fs.ServeHTTP(w, r)
-}
-
 func (rtr *router) EmailRegister(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	user := &NewUserEmailAuthRequest{}
 
-	if err := json.NewDecoder(r.Body).Decode(user); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError, "register email", err)
+	if err := decodeJSONBody(w, r, user, maxSmallJSONBodyBytes); err != nil {
+		rtr.StatusError(w, r, "register email", err)
 		return
 	}
 
-	if rtr.config.firebaseApp == nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"register email, firebaseApp is not initialized",
-			fmt.Errorf("firebaseApp is not initialized"))
-		return
-	}
-
-	client, err := rtr.config.firebaseApp.Auth(rtr.config.ctx)
+	accounts, err := rtr.config.userAccounts()
 	if err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError, "register new user from email", err)
+		rtr.StatusError(w, r, "register new user from email", err)
 		return
 	}
 
 	tryUser := (&auth.UserToCreate{}).Email(user.Email).Password(user.Password).DisplayName(user.DisplayName)
-	createdUser, err := client.CreateUser(rtr.config.ctx, tryUser)
+	createdUser, err := accounts.CreateUser(r.Context(), tryUser)
 	if err != nil {
-		rtr.StatusError(w, http.StatusBadRequest, "register email, bad request", err)
+		rtr.StatusError(w, r, "register email", registrationError(err))
 		return
 	}
 
-	newUserDocument := &UserDocument{
-		UID:         createdUser.UID,
-		CurrentGoal: "Unchosen!",
+	if err := rtr.config.store.CreateUserDocument(r.Context(), newUserDocument(createdUser.UID, []string{passwordProvider})); err != nil {
+		// the account is deleted again so that registering with the same email can be retried. Should that fail too,
+		// the profile is created by the user's first authenticated request instead
+		written, rollbackErr := rollbackRegistration(r.Context(), rtr.config.store, accounts, createdUser.UID)
+		if rollbackErr != nil {
+			loggerFrom(r.Context()).Error("error rolling back registration", "uid", createdUser.UID, "error", rollbackErr)
+		}
+		if !written {
+			rtr.StatusError(w, r, "register email firestore creating new user doc", err)
+			return
+		}
+		loggerFrom(r.Context()).Warn("profile was written despite failing", "uid", createdUser.UID, "error", err.Error())
+	}
+
+	rtr.StatusOK(w, r, http.StatusOK, "successfully created new user", RegisterResponse{UID: createdUser.UID})
+}
+
+// userAccounts is satisfied by *auth.Client, and lets tests register users without Firebase
+type userAccounts interface {
+	CreateUser(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error)
+	GetUser(ctx context.Context, uid string) (*auth.UserRecord, error)
+	DeleteUser(ctx context.Context, uid string) error
+}
+
+// registrationRollbackTimeout bounds rolling back a failed registration, which outlives the request
+const registrationRollbackTimeout = 10 * time.Second
+
+// rollbackRegistration deletes the account of a registration whose profile was not written, returning whether the
+// profile was written after all. A write that failed on its deadline or the connection may still have committed, and
+// deleting the account of a written profile would leave the profile orphaned, so the account is only deleted once the
+// profile is known to be missing
+func rollbackRegistration(ctx context.Context, store storage, accounts userAccounts, uid string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), registrationRollbackTimeout)
+	defer cancel()
+
+	_, err := store.GetUserDocument(ctx, uid)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return false, fmt.Errorf("error while trying to check whether the profile of user (uid: %s) was written, keeping their account: %w", uid, err)
+	}
+
+	if err := accounts.DeleteUser(ctx, uid); err != nil {
+		return false, fmt.Errorf("error while trying to delete user (uid: %s) after their profile was not created: %w", uid, err)
+	}
+	return false, nil
+}
+
+// newUserDocument is the profile of a newly registered user, who can sign in with providers
+func newUserDocument(uid string, providers []string) *UserDocument {
+	return &UserDocument{
+		SchemaVersion: userSchemaVersion,
+		UID:           uid,
+		Providers:     providers,
+		CurrentGoal:   "Unchosen!",
 		Metrics: UserDocumentMetrics{
 			Height:   0,
 			Weight:   0,
@@ -168,17 +395,75 @@ func (rtr *router) EmailRegister(w http.ResponseWriter, r *http.Request) {
 		},
 		Settings: UserDocumentSettings{
 			UnitsPreference:  "Metric",
-			SubscriptionTier: "Free",
+			SubscriptionTier: freeSubscriptionTier,
 		},
 	}
+}
 
-	if err := CreateUserDocument(rtr, newUserDocument); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError, "register email firestore creating new user doc", err)
-		return
+// registrationError maps a failed Firebase CreateUser call onto the error the client sees. Only the input Firebase
+// rejects is the client's fault, anything else, e.g. an unreachable or over quota Firebase, is a server error
+func registrationError(err error) error {
+	switch {
+	case auth.IsEmailAlreadyExists(err):
+		return fmt.Errorf("error registering email, an account already uses it: %w", ErrAlreadyExists)
+	case auth.IsInvalidEmail(err):
+		return validationError(fieldError{Field: "email", Message: "email address is not valid"})
+	case !errorutils.IsInvalidArgument(err):
+		return fmt.Errorf("error while trying to create firebase user: %w", err)
+	}
+
+	// Firebase names the rejected input within its error, e.g. "WEAK_PASSWORD : Password should be at least 6 characters"
+	var apiErr *apiError
+	switch message := err.Error(); {
+	case strings.Contains(message, "PASSWORD"):
+		apiErr = validationError(fieldError{Field: "password", Message: "password is too weak"})
+	case strings.Contains(message, "DISPLAY_NAME"):
+		apiErr = validationError(fieldError{Field: "displayname", Message: "display name is not valid"})
+	default:
+		apiErr = validationError()
+		apiErr.Message = "firebase rejected the email, password or display name"
+	}
+	apiErr.cause = err
+	return apiErr
+}
+
+// authorizeUser mints the idToken and checks that it belongs to the user with the given uid
+func (rtr *router) authorizeUser(ctx context.Context, idToken, uid string) error {
+	token, err := MintIdToken(ctx, rtr, idToken)
+	if err != nil {
+		return fmt.Errorf("error while trying to mint idToken: %w", err)
+	}
+
+	if token.UID != uid {
+		return fmt.Errorf("idToken does not belong to user (uid: %s): %w", uid, ErrForbidden)
+	}
+
+	return rtr.limitUser(ctx, token.UID)
+}
+
+// withProfile runs fn for an authorized user, and runs it again once their default user document has been created
+// should fn not find it. That is the first request of a user who signed in with a third-party provider, or one
+// after a registration whose profile write and rollback both failed. fn must only return ErrNotFound for a missing
+// user document
+func (rtr *router) withProfile(ctx context.Context, uid string, fn func() error) error {
+	err := fn()
+	if !errors.Is(err, ErrNotFound) {
+		return err
 	}
 
-	arbitratryReturnData := make(map[string]interface{})
-	rtr.StatusOK(w, http.StatusOK, "successfully created new user", arbitratryReturnData)
+	providers, err := rtr.signInProviders(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("error while trying to provision profile of user (uid: %s): %w", uid, err)
+	}
+	created, err := rtr.config.store.CreateUserDocumentIfMissing(ctx, newUserDocument(uid, providers))
+	if err != nil {
+		return fmt.Errorf("error while trying to create missing profile of user (uid: %s): %w", uid, err)
+	}
+	if created {
+		loggerFrom(ctx).Info("provisioned user profile", "uid", uid, "providers", providers)
+	}
+
+	return fn()
 }
 
 func (rtr *router) GetUserProfileData(w http.ResponseWriter, r *http.Request) {
@@ -186,23 +471,30 @@ func (rtr *router) GetUserProfileData(w http.ResponseWriter, r *http.Request) {
 	uid := r.PathValue("uid")
 	idToken := r.PathValue("idToken")
 
-	if err := MintIdToken(rtr, idToken); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"get user profile data",
-			fmt.Errorf("error while trying to mint idToken: %v", err))
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "get user profile data", err)
 		return
 	}
 
 	// if the ID token was valid, we return the user based off their UID
-	userDoc, err := GetUserDocument(rtr, uid)
+	var userDoc map[string]interface{}
+	err := rtr.withProfile(r.Context(), uid, func() (err error) {
+		userDoc, err = rtr.config.store.GetUserDocument(r.Context(), uid)
+		return err
+	})
 	if err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"getting user documents",
-			fmt.Errorf("error while trying to get user document: %v", err.Error()))
+		rtr.StatusError(w, r, "getting user documents",
+			fmt.Errorf("error while trying to get user document: %w", err))
 		return
 	}
 
-	rtr.StatusOK(w, http.StatusOK, "successfully retrieved user data", userDoc)
+	profile, err := userProfileFromDocument(userDoc)
+	if err != nil {
+		rtr.StatusError(w, r, "getting user documents", err)
+		return
+	}
+
+	rtr.StatusOK(w, r, http.StatusOK, "successfully retrieved user data", profile)
 }
 
 func (rtr *router) UpdateUserProfileData(w http.ResponseWriter, r *http.Request) {
@@ -210,61 +502,68 @@ func (rtr *router) UpdateUserProfileData(w http.ResponseWriter, r *http.Request)
 	uid := r.PathValue("uid")
 	idToken := r.PathValue("idToken")
 
-	if err := MintIdToken(rtr, idToken); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"update user profile data",
-			fmt.Errorf("error while trying to mint idToken: %v", err))
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "update user profile data", err)
 		return
 	}
 
 	// if the ID token was valid, we update the user with the associated uid with what was requested within the PUT body request
-	requestedUpdates := make(map[string]interface{})
-	if err := json.NewDecoder(r.Body).Decode(&requestedUpdates); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError, "update user document", err)
+	profileUpdate := &ProfileUpdateRequest{}
+	if err := decodeJSONBody(w, r, profileUpdate, maxSmallJSONBodyBytes); err != nil {
+		rtr.StatusError(w, r, "update user document", err)
 		return
 	}
 
-	if err := UpdateUserDocument(rtr, uid, requestedUpdates); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"updating user documents",
-			fmt.Errorf("error while trying to update user document: %v", err.Error()))
+	requestedUpdates := profileUpdate.Updates()
+	if len(requestedUpdates) == 0 {
+		rtr.StatusError(w, r, "update user document", validationError(fieldError{Field: "", Message: "at least one field must be updated"}))
+		return
+	}
+
+	err := rtr.withProfile(r.Context(), uid, func() error {
+		return rtr.config.store.UpdateUserDocument(r.Context(), uid, requestedUpdates)
+	})
+	if err != nil {
+		rtr.StatusError(w, r, "updating user documents",
+			fmt.Errorf("error while trying to update user document: %w", err))
 		return
 	}
 
-	rtr.StatusOK(w, http.StatusOK, "successfully updated user data", requestedUpdates)
+	rtr.StatusOK(w, r, http.StatusOK, "successfully updated user data", profileUpdate)
 }
 
 type NewUserRoutineRequest struct {
-	RoutineName string `json:"routineName"`
-	UID         string `json:"uid"`
-	IdToken     string `json:"idToken"`
+	RoutineName string `json:"routineName" validate:"required,max=100"`
+	UID         string `json:"uid" validate:"required"`
+	IdToken     string `json:"idToken" validate:"required"`
 }
 
 func (rtr *router) CreateUserRoutine(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	reqRoutine := &NewUserRoutineRequest{}
 
-	if err := json.NewDecoder(r.Body).Decode(reqRoutine); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError, "create user routine", err)
+	if err := decodeJSONBody(w, r, reqRoutine, maxSmallJSONBodyBytes); err != nil {
+		rtr.StatusError(w, r, "create user routine", err)
 		return
 	}
 
-	if err := MintIdToken(rtr, reqRoutine.IdToken); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"create user routine",
-			fmt.Errorf("error while trying to mint idToken: %v", err))
+	if err := rtr.authorizeUser(r.Context(), reqRoutine.IdToken, reqRoutine.UID); err != nil {
+		rtr.StatusError(w, r, "create user routine", err)
 		return
 	}
 
-	if err := CreateRoutineDocument(rtr, reqRoutine.UID, reqRoutine.RoutineName); err != nil {
-		rtr.StatusError(w, http.StatusBadRequest,
-			"create user routine",
-			fmt.Errorf("error while create user routine: %v", err))
+	var refId string
+	err := rtr.withProfile(r.Context(), reqRoutine.UID, func() (err error) {
+		refId, err = createRoutineWithinQuota(r.Context(), rtr.config.store, reqRoutine.UID, reqRoutine.RoutineName)
+		return err
+	})
+	if err != nil {
+		rtr.StatusError(w, r, "create user routine",
+			fmt.Errorf("error while create user routine: %w", err))
 		return
 	}
 
-	arbitratryReturnData := make(map[string]interface{})
-	rtr.StatusOK(w, http.StatusOK, "successfully created new routine for user", arbitratryReturnData)
+	rtr.StatusOK(w, r, http.StatusOK, "successfully created new routine for user", CreateRoutineResponse{RefId: refId})
 }
 
 func (rtr *router) GetAllUserRoutines(w http.ResponseWriter, r *http.Request) {
@@ -272,22 +571,52 @@ func (rtr *router) GetAllUserRoutines(w http.ResponseWriter, r *http.Request) {
 	uid := r.PathValue("uid")
 	idToken := r.PathValue("idToken")
 
-	if err := MintIdToken(rtr, idToken); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"getting user routines",
-			fmt.Errorf("error while trying to mint idToken while fetching user routines: %v", err))
+	if err := rtr.authorizeUser(r.Context(), idToken, uid); err != nil {
+		rtr.StatusError(w, r, "getting user routines", err)
 		return
 	}
 
-	routineDocuments, err := GetUserRoutines(rtr, uid)
+	routineDocuments, err := rtr.config.store.GetUserRoutines(r.Context(), uid)
 	if err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"update user profile data",
-			fmt.Errorf("error while trying to fetch user routines: %v", err))
+		rtr.StatusError(w, r, "getting user routines",
+			fmt.Errorf("error while trying to fetch user routines: %w", err))
 		return
 	}
 
-	rtr.StatusOK(w, http.StatusOK, "successfully fetched users routines", routineDocuments)
+	routines := make([]*RoutineResponse, 0, len(routineDocuments))
+	for _, routineDocument := range routineDocuments {
+		refId, _ := routineDocument["RefId"].(string)
+		routine, err := routineFromDocument(refId, routineDocument)
+		if err != nil {
+			rtr.StatusError(w, r, "getting user routines", err)
+			return
+		}
+		routines = append(routines, routine)
+	}
+
+	rtr.StatusOK(w, r, http.StatusOK, "successfully fetched users routines", routines)
+}
+
+// authorizeRoutine mints the idToken and fetches the routine, checking that the routine belongs to the token's user
+func (rtr *router) authorizeRoutine(ctx context.Context, idToken, routineRefId string) (map[string]interface{}, error) {
+	token, err := MintIdToken(ctx, rtr, idToken)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to mint idToken while fetching user routines: %w", err)
+	}
+	if err := rtr.limitUser(ctx, token.UID); err != nil {
+		return nil, err
+	}
+
+	routineDocumentData, err := rtr.config.store.GetOneUserRoutine(ctx, routineRefId)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to fetch one user routine with associated routine id (%s): %w", routineRefId, err)
+	}
+
+	if routineDocumentData["UID"] != token.UID {
+		return nil, fmt.Errorf("routine (%s) does not belong to the idToken's user: %w", routineRefId, ErrForbidden)
+	}
+
+	return routineDocumentData, nil
 }
 
 func (rtr *router) GetOneUserRoutine(w http.ResponseWriter, r *http.Request) {
@@ -295,22 +624,19 @@ func (rtr *router) GetOneUserRoutine(w http.ResponseWriter, r *http.Request) {
 	routineRefId := r.PathValue("routineRefId")
 	idToken := r.PathValue("idToken")
 
-	if err := MintIdToken(rtr, idToken); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"getting user routines",
-			fmt.Errorf("error while trying to mint idToken while fetching user routines: %v", err))
+	routineDocumentData, err := rtr.authorizeRoutine(r.Context(), idToken, routineRefId)
+	if err != nil {
+		rtr.StatusError(w, r, "getting one user routine", err)
 		return
 	}
 
-	routineDocumentData, err := GetOneUserRoutine(rtr, routineRefId)
+	routine, err := routineFromDocument(routineRefId, routineDocumentData)
 	if err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"getting one user routine",
-			fmt.Errorf("error while trying to fetch one user routine with associated routine id (%s): %v", routineRefId, err))
+		rtr.StatusError(w, r, "getting one user routine", err)
 		return
 	}
 
-	rtr.StatusOK(w, http.StatusOK, "successfully fetched users routines", routineDocumentData)
+	rtr.StatusOK(w, r, http.StatusOK, "successfully fetched users routines", routine)
 }
 
 func (rtr *router) UpdateOneUserRoutine(w http.ResponseWriter, r *http.Request) {
@@ -318,50 +644,37 @@ func (rtr *router) UpdateOneUserRoutine(w http.ResponseWriter, r *http.Request)
 	routineRefId := r.PathValue("routineRefId")
 	idToken := r.PathValue("idToken")
 
-	if err := MintIdToken(rtr, idToken); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"getting user routines",
-			fmt.Errorf("error while trying to mint idToken while fetching user routines: %v", err))
+	existingRoutine, err := rtr.authorizeRoutine(r.Context(), idToken, routineRefId)
+	if err != nil {
+		rtr.StatusError(w, r, "updating user's routine documents", err)
 		return
 	}
 
 	// if the ID token was valid, we update the user's routine with the new routine data
-	requestedUpdates := make(map[string]interface{})
-	if err := json.NewDecoder(r.Body).Decode(&requestedUpdates); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError, "update user document", err)
+	routineUpdate := &RoutineUpdateRequest{}
+	if err := decodeJSONBody(w, r, routineUpdate, maxJSONBodyBytes); err != nil {
+		rtr.StatusError(w, r, "update user's routine document", err)
 		return
 	}
 
-	if err := UpdateOneUserRoutine(rtr, routineRefId, requestedUpdates); err != nil {
-		rtr.StatusError(w, http.StatusInternalServerError,
-			"updating user's routine documents",
-			fmt.Errorf("error while trying to update user's routine document: %v", err.Error()))
+	if routineUpdate.UID != "" && routineUpdate.UID != existingRoutine["UID"] {
+		rtr.StatusError(w, r, "update user's routine document", validationError(fieldError{Field: "UID", Message: "cannot be changed"}))
 		return
 	}
 
-	rtr.StatusOK(w, http.StatusOK, "successfully updated user's routine data", requestedUpdates)
-}
+	requestedUpdates := routineUpdate.toDocument(existingRoutine["UID"], existingRoutine["CreatedAt"])
 
-func initEnvironmentVariables() (map[string]string, error) {
-	// if we are in local development mode, then use a package to load the environment variables
-	mode := os.Getenv("MODE")
-	if mode == "development" || mode == "" {
-		err := godotenv.Load()
-		if err != nil {
-			return nil, fmt.Errorf("error loading .env file with godotenv: %w", err)
-		}
+	if err := rtr.config.store.UpdateOneUserRoutine(r.Context(), routineRefId, requestedUpdates); err != nil {
+		rtr.StatusError(w, r, "updating user's routine documents",
+			fmt.Errorf("error while trying to update user's routine document: %w", err))
+		return
 	}
 
-	env := make(map[string]string)
-	keys := []string{"MODE", "GOOGLE_APPLICATION_CREDENTIALS", "GOOGLE_FIREBASE_API_KEY", "RAILWAY_PUBLIC_DOMAIN"}
-
-	for _, key := range keys {
-		env[key] = os.Getenv(key)
-		// ignore all keys that start with RAILWAY, as that denotes that it will be injected into the environment by Railway
-		if !strings.HasPrefix(key, "RAILWAY") && env[key] == "" {
-			return nil, fmt.Errorf("error in retrieving environment variable key: %s", key)
-		}
+	routine, err := routineFromDocument(routineRefId, requestedUpdates)
+	if err != nil {
+		rtr.StatusError(w, r, "updating user's routine documents", err)
+		return
 	}
 
-	return env, nil
+	rtr.StatusOK(w, r, http.StatusOK, "successfully updated user's routine data", routine)
 }
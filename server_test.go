@@ -4,26 +4,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"log/slog"
+
+	"firebase.google.com/go/v4/auth"
 )
 
 // mock config with minimal usable values
 func getTestRouter() *router {
+	cfg := &config{
+		frontendBuildPath: "./testdata/build",
+		port:              8080,
+		ctx:               context.Background(),
+		firebaseApp:       nil, // Will be nil for now unless mocking FirebaseApp
+	}
+	cfg.store = newFirestoreStorage(cfg)
+
 	return &router{
-		config: &config{
-			frontendBuildPath: "./testdata/build",
-			port:              8080,
-			ctx:               context.Background(),
-			env: map[string]string{
-				"GOOGLE_FIREBASE_API_KEY": "fake_api_key",
-			},
-			firebaseApp: nil, // Will be nil for now unless mocking FirebaseApp
-		},
+		config: cfg,
 		logger: slog.Default(),
 	}
 }
@@ -86,6 +91,224 @@ func TestEmailRegister_BadFirebaseClient(t *testing.T) {
 	}
 }
 
+// fakeAccounts creates users with sequential uids and records the ones deleted
+type fakeAccounts struct {
+	mu      sync.Mutex
+	created int
+	deleted []string
+	// providers are the sign-in providers of each uid, "password" for those without any
+	providers map[string][]string
+}
+
+func (a *fakeAccounts) CreateUser(_ context.Context, _ *auth.UserToCreate) (*auth.UserRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.created++
+	return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: fmt.Sprintf("uid-%d", a.created)}}, nil
+}
+
+func (a *fakeAccounts) GetUser(_ context.Context, uid string) (*auth.UserRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	providers, ok := a.providers[uid]
+	if !ok {
+		providers = []string{passwordProvider}
+	}
+	record := &auth.UserRecord{UserInfo: &auth.UserInfo{UID: uid, ProviderID: "firebase"}}
+	for _, provider := range providers {
+		record.ProviderUserInfo = append(record.ProviderUserInfo, &auth.UserInfo{UID: uid, ProviderID: provider})
+	}
+	return record, nil
+}
+
+// link adds provider to the sign-in providers of uid
+func (a *fakeAccounts) link(uid, provider string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.providers == nil {
+		a.providers = map[string][]string{}
+	}
+	if _, ok := a.providers[uid]; !ok {
+		a.providers[uid] = []string{passwordProvider}
+	}
+	a.providers[uid] = append(a.providers[uid], provider)
+}
+
+func (a *fakeAccounts) DeleteUser(_ context.Context, uid string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.deleted = append(a.deleted, uid)
+	return nil
+}
+
+// failingProfileStorage fails every user document write
+type failingProfileStorage struct {
+	*memoryStorage
+}
+
+func (s *failingProfileStorage) CreateUserDocument(_ context.Context, _ *UserDocument) error {
+	return fmt.Errorf("error while trying to create new user document: %w", context.DeadlineExceeded)
+}
+
+// committedProfileStorage writes the profile, yet fails the way a write whose answer arrived after the deadline does
+type committedProfileStorage struct {
+	*memoryStorage
+}
+
+func (s *committedProfileStorage) CreateUserDocument(ctx context.Context, userDoc *UserDocument) error {
+	if err := s.memoryStorage.CreateUserDocument(ctx, userDoc); err != nil {
+		return err
+	}
+	return fmt.Errorf("error while trying to create new user document: %w", context.DeadlineExceeded)
+}
+
+func registerEmail(t *testing.T, store storage, accounts *fakeAccounts) *http.Response {
+	t.Helper()
+
+	rtr := getMemoryTestRouter(store)
+	rtr.config.accounts = accounts
+	body := strings.NewReader(`{"email": "lifter@example.com", "password": "password123", "displayname": "Lifter"}`)
+	w := httptest.NewRecorder()
+	rtr.EmailRegister(w, httptest.NewRequest("POST", "/api/v1/register/email", body))
+	return w.Result()
+}
+
+func TestEmailRegister_CreatesProfile(t *testing.T) {
+	store := newMemoryStorage()
+	accounts := &fakeAccounts{}
+
+	resp := registerEmail(t, store, accounts)
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+	if _, err := store.GetUserDocument(context.Background(), "uid-1"); err != nil {
+		t.Errorf("expected the profile to be created, got %v", err)
+	}
+	if len(accounts.deleted) != 0 {
+		t.Errorf("expected no account to be rolled back, got %v", accounts.deleted)
+	}
+}
+
+func TestEmailRegister_RollsBackWithoutProfile(t *testing.T) {
+	accounts := &fakeAccounts{}
+
+	resp := registerEmail(t, &failingProfileStorage{memoryStorage: newMemoryStorage()}, accounts)
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected the storage error to be returned, got %d", resp.StatusCode)
+	}
+	if len(accounts.deleted) != 1 || accounts.deleted[0] != "uid-1" {
+		t.Errorf("expected the account without a profile to be deleted, got %v", accounts.deleted)
+	}
+}
+
+func TestEmailRegister_KeepsAccountOfWrittenProfile(t *testing.T) {
+	store := newMemoryStorage()
+	accounts := &fakeAccounts{}
+
+	resp := registerEmail(t, &committedProfileStorage{memoryStorage: store}, accounts)
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the registration to succeed once its profile is found, got %d", resp.StatusCode)
+	}
+	if len(accounts.deleted) != 0 {
+		t.Errorf("expected the account of the written profile to be kept, got %v", accounts.deleted)
+	}
+	if _, err := store.GetUserDocument(context.Background(), "uid-1"); err != nil {
+		t.Errorf("expected the profile to be kept, got %v", err)
+	}
+}
+
+func TestRegistrationError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"transport failure", fmt.Errorf("Post \"https://identitytoolkit.googleapis.com\": dial tcp: connection refused"), http.StatusInternalServerError},
+		{"deadline", fmt.Errorf("error creating user: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := toAPIError(registrationError(tt.err))
+			if apiErr.Status != tt.expected || apiErr.Code == codeValidationFailed {
+				t.Errorf("expected status %d but got %+v", tt.expected, apiErr)
+			}
+			if strings.Contains(apiErr.Message, "identitytoolkit") {
+				t.Errorf("expected the cause to stay out of the message, got %q", apiErr.Message)
+			}
+		})
+	}
+}
+
+func TestGetUserProfileData_CreatesMissingProfile(t *testing.T) {
+	store := newMemoryStorage()
+	rtr := getMemoryTestRouter(store)
+	handler := routes(rtr.config, rtr.logger)
+
+	// the first requests of a user who registered without a profile race to create it
+	var wg sync.WaitGroup
+	codes := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/user/uid-1/uid-1", nil))
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected status 200 but got %d", code)
+		}
+	}
+
+	users, err := store.GetAllUsers(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(users) != 1 || users[0]["UID"] != "uid-1" || users[0]["CurrentGoal"] != "Unchosen!" {
+		t.Errorf("expected one default profile to be created, got %v", users)
+	}
+
+	// someone else's idToken still does not create a profile
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/user/uid-2/uid-1", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 but got %d", w.Code)
+	}
+	if users, _ := store.GetAllUsers(context.Background()); len(users) != 1 {
+		t.Errorf("expected no profile for an unauthorized request, got %v", users)
+	}
+}
+
 func TestUpdateUserProfileData_FirebaseAppNil(t *testing.T) {
 	r := getTestRouter()
 
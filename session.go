@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+const (
+	// sessionIdToken takes the place of the idToken of any route, in the path or body, to authenticate the request
+	// with the session cookie instead
+	sessionIdToken = "session"
+
+	sessionCookieName = "session"
+	csrfCookieName    = "csrf_token"
+	csrfHeader        = "X-CSRF-Token"
+
+	// Firebase session cookies last between 5 minutes and 2 weeks
+	sessionCookieDuration = 5 * 24 * time.Hour
+	// how long ago the user must have signed in for their idToken to be exchanged for a session cookie, so that a
+	// stolen idToken cannot be turned into a longer-lived session
+	sessionRecentSignIn = 5 * time.Minute
+
+	sessionLoginPath = "/api/v1/session/login"
+)
+
+// sessionManager is satisfied by *auth.Client, and lets tests manage sessions without Firebase
+type sessionManager interface {
+	SessionCookie(ctx context.Context, idToken string, expiresIn time.Duration) (string, error)
+	VerifySessionCookieAndCheckRevoked(ctx context.Context, sessionCookie string) (*auth.Token, error)
+	RevokeRefreshTokens(ctx context.Context, uid string) error
+}
+
+type SessionLoginRequest struct {
+	IdToken string `json:"idToken" validate:"required"`
+}
+
+// SessionResponse describes the session of the session cookie. CSRFToken must be sent in the X-CSRF-Token header of
+// every POST and PUT request made with the cookie, and is also readable from the csrf_token cookie
+type SessionResponse struct {
+	UID       string    `json:"UID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CSRFToken string    `json:"csrfToken"`
+}
+
+type sessionCookieContextKey struct{}
+
+// csrfToken is derived from the HttpOnly session cookie, so that a token set by anyone unable to read the cookie,
+// e.g. by injecting a csrf_token cookie, never matches
+func csrfToken(sessionCookie string) string {
+	sum := sha256.Sum256([]byte("csrf:" + sessionCookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessions hands the session cookie of API requests to MintIdToken, and refuses state-changing requests that carry
+// the cookie without the matching CSRF token. Logging in is exempt, as it replaces whatever session the browser holds
+func (rtr *router) sessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			expected := csrfToken(cookie.Value)
+			if r.URL.Path != sessionLoginPath && subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(expected)) != 1 {
+				w.Header().Set("Content-Type", "application/json")
+				rtr.StatusError(w, r, "csrf check", newAPIError(http.StatusForbidden, codeCSRFFailed,
+					"requests authenticated by the session cookie must send its CSRF token in the X-CSRF-Token header"))
+				return
+			}
+		}
+
+		withCookie := r.WithContext(context.WithValue(r.Context(), sessionCookieContextKey{}, cookie.Value))
+		next.ServeHTTP(w, withCookie)
+
+		// the ServeMux sets the pattern on the request it was given, hand it back to the middlewares wrapping this one
+		r.Pattern = withCookie.Pattern
+	})
+}
+
+// verifySessionCookie verifies the session cookie of the request in place of an idToken, including that the user's
+// sessions have not been revoked
+func verifySessionCookie(ctx context.Context, rtr *router) (_ *auth.Token, err error) {
+	ctx, span := startSpan(ctx, rtr.config.tracer(), "auth.VerifySessionCookie")
+	defer func() { finishSpan(span, err) }()
+	defer func(start time.Time) { rtr.config.metrics.observeTokenVerification(start, err) }(time.Now())
+
+	cookie, _ := ctx.Value(sessionCookieContextKey{}).(string)
+	if cookie == "" {
+		return nil, fmt.Errorf("error, no session cookie was sent: %w", ErrInvalidToken)
+	}
+
+	sessions, err := rtr.config.sessionManager()
+	if err != nil {
+		return nil, fmt.Errorf("error initializing firebase auth client: %v", err)
+	}
+
+	token, err := sessions.VerifySessionCookieAndCheckRevoked(ctx, cookie)
+	if auth.IsSessionCookieExpired(err) {
+		return nil, fmt.Errorf("error verifying session cookie: %w", ErrTokenExpired)
+	}
+	if auth.IsSessionCookieInvalid(err) || auth.IsSessionCookieRevoked(err) || auth.IsUserDisabled(err) {
+		return nil, fmt.Errorf("error verifying session cookie (%v): %w", err, ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error verifying session cookie: %w", err)
+	}
+
+	setRequestUID(ctx, token.UID)
+	return token, nil
+}
+
+// setSessionCookies sets or, with an empty sessionCookie, clears the session and CSRF cookies
+func (rtr *router) setSessionCookies(w http.ResponseWriter, sessionCookie string, expiresAt time.Time) {
+	maxAge, csrf := -1, ""
+	if sessionCookie != "" {
+		maxAge, csrf = int(time.Until(expiresAt).Seconds()), csrfToken(sessionCookie)
+	}
+	// browsers treat http://localhost as secure, but not every one sends Secure cookies to it
+	secure := rtr.config.hsts || rtr.config.publicDomain != ""
+
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookieName, Value: sessionCookie, Path: "/", MaxAge: maxAge,
+		HttpOnly: true, Secure: secure, SameSite: http.SameSiteStrictMode,
+	})
+	// the frontend reads the CSRF token to send it back in the X-CSRF-Token header
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookieName, Value: csrf, Path: "/", MaxAge: maxAge,
+		Secure: secure, SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// SessionLogin exchanges the idToken of a user who just signed in for a session cookie
+func (rtr *router) SessionLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	login := &SessionLoginRequest{}
+	if err := decodeJSONBody(w, r, login, maxSmallJSONBodyBytes); err != nil {
+		rtr.StatusError(w, r, "session login", err)
+		return
+	}
+	if login.IdToken == sessionIdToken {
+		rtr.StatusError(w, r, "session login", validationError(fieldError{Field: "idToken", Message: "must be an idToken"}))
+		return
+	}
+
+	token, err := MintIdToken(r.Context(), rtr, login.IdToken)
+	if err != nil {
+		rtr.StatusError(w, r, "session login", fmt.Errorf("error while trying to mint idToken: %w", err))
+		return
+	}
+	if time.Since(time.Unix(token.AuthTime, 0)) > sessionRecentSignIn {
+		rtr.StatusError(w, r, "session login",
+			fmt.Errorf("error, user (uid: %s) must have signed in within %v: %w", token.UID, sessionRecentSignIn, ErrTokenExpired))
+		return
+	}
+	if err := rtr.limitUser(r.Context(), token.UID); err != nil {
+		rtr.StatusError(w, r, "session login", err)
+		return
+	}
+
+	sessions, err := rtr.config.sessionManager()
+	if err != nil {
+		rtr.StatusError(w, r, "session login", err)
+		return
+	}
+	expiresAt := time.Now().Add(sessionCookieDuration)
+	cookie, err := sessions.SessionCookie(r.Context(), login.IdToken, sessionCookieDuration)
+	if err != nil {
+		rtr.StatusError(w, r, "session login", fmt.Errorf("error while trying to create session cookie: %w", err))
+		return
+	}
+
+	rtr.setSessionCookies(w, cookie, expiresAt)
+	rtr.StatusOK(w, r, http.StatusOK, "successfully signed in", SessionResponse{
+		UID:       token.UID,
+		ExpiresAt: expiresAt,
+		CSRFToken: csrfToken(cookie),
+	})
+}
+
+// GetSession describes the session of the session cookie, e.g. for the frontend to tell whether it is signed in
+func (rtr *router) GetSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token, err := MintIdToken(r.Context(), rtr, sessionIdToken)
+	if err != nil {
+		rtr.StatusError(w, r, "get session", err)
+		return
+	}
+
+	cookie, _ := r.Context().Value(sessionCookieContextKey{}).(string)
+	rtr.StatusOK(w, r, http.StatusOK, "successfully retrieved session", SessionResponse{
+		UID:       token.UID,
+		ExpiresAt: time.Unix(token.Expires, 0).UTC(),
+		CSRFToken: csrfToken(cookie),
+	})
+}
+
+// SessionLogout clears the session cookie of this browser, which stays valid until it expires should it have been
+// copied elsewhere. SessionRevoke ends every session instead
+func (rtr *router) SessionLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rtr.setSessionCookies(w, "", time.Time{})
+	rtr.StatusOK(w, r, http.StatusOK, "successfully signed out", nil)
+}
+
+// SessionRevoke revokes every session cookie and refresh token of the user, signing them out everywhere. idTokens
+// already issued stay valid until they expire within the hour
+func (rtr *router) SessionRevoke(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token, err := MintIdToken(r.Context(), rtr, sessionIdToken)
+	if err != nil {
+		rtr.StatusError(w, r, "revoke sessions", err)
+		return
+	}
+	if err := rtr.limitUser(r.Context(), token.UID); err != nil {
+		rtr.StatusError(w, r, "revoke sessions", err)
+		return
+	}
+
+	sessions, err := rtr.config.sessionManager()
+	if err != nil {
+		rtr.StatusError(w, r, "revoke sessions", err)
+		return
+	}
+	if err := sessions.RevokeRefreshTokens(r.Context(), token.UID); err != nil {
+		rtr.StatusError(w, r, "revoke sessions",
+			fmt.Errorf("error while trying to revoke sessions of user (uid: %s): %w", token.UID, err))
+		return
+	}
+
+	rtr.setSessionCookies(w, "", time.Time{})
+	rtr.StatusOK(w, r, http.StatusOK, "successfully revoked every session", nil)
+}
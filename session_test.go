@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// fakeSessions issues "cookie-<uid>" session cookies for the idTokens of fakeVerifier, which are their uid
+type fakeSessions struct {
+	mu      sync.Mutex
+	revoked map[string]bool
+}
+
+func (s *fakeSessions) SessionCookie(_ context.Context, idToken string, _ time.Duration) (string, error) {
+	return "cookie-" + idToken, nil
+}
+
+func (s *fakeSessions) VerifySessionCookieAndCheckRevoked(_ context.Context, cookie string) (*auth.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uid, ok := strings.CutPrefix(cookie, "cookie-")
+	if !ok || s.revoked[uid] {
+		return nil, fmt.Errorf("session cookie is invalid or revoked: %w", ErrInvalidToken)
+	}
+	return &auth.Token{UID: uid, Expires: time.Now().Add(time.Hour).Unix()}, nil
+}
+
+func (s *fakeSessions) RevokeRefreshTokens(_ context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.revoked == nil {
+		s.revoked = map[string]bool{}
+	}
+	s.revoked[uid] = true
+	return nil
+}
+
+// staleVerifier verifies idTokens of users who signed in an hour ago
+type staleVerifier struct{}
+
+func (staleVerifier) VerifyIDToken(_ context.Context, idToken string) (*auth.Token, error) {
+	return &auth.Token{UID: idToken, AuthTime: time.Now().Add(-time.Hour).Unix()}, nil
+}
+
+func getSessionTestHandler(store storage, sessions *fakeSessions) (*router, http.Handler) {
+	rtr := getMemoryTestRouter(store)
+	rtr.config.sessions = sessions
+	return rtr, routes(rtr.config, rtr.logger)
+}
+
+// serveWithCookies serves the request with the cookies, and the CSRF token should csrf be set
+func serveWithCookies(handler http.Handler, req *http.Request, cookies []*http.Cookie, csrf string) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	if csrf != "" {
+		req.Header.Set(csrfHeader, csrf)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func sessionLogin(t *testing.T, handler http.Handler, idToken string) ([]*http.Cookie, SessionResponse) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/session/login", strings.NewReader(`{"idToken": "`+idToken+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	envelope := struct {
+		Data SessionResponse `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return w.Result().Cookies(), envelope.Data
+}
+
+func TestSessionLogin(t *testing.T) {
+	_, handler := getSessionTestHandler(newMemoryStorage(), &fakeSessions{})
+
+	cookies, session := sessionLogin(t, handler, "uid-1")
+	if session.UID != "uid-1" || session.CSRFToken != csrfToken("cookie-uid-1") || time.Until(session.ExpiresAt) < 4*24*time.Hour {
+		t.Errorf("unexpected session %+v", session)
+	}
+
+	byName := map[string]*http.Cookie{}
+	for _, cookie := range cookies {
+		byName[cookie.Name] = cookie
+	}
+	sessionCookie, csrf := byName[sessionCookieName], byName[csrfCookieName]
+	if sessionCookie == nil || sessionCookie.Value != "cookie-uid-1" || !sessionCookie.HttpOnly || sessionCookie.SameSite != http.SameSiteStrictMode || sessionCookie.MaxAge <= 0 {
+		t.Errorf("expected an HttpOnly, SameSite=Strict session cookie, got %+v", sessionCookie)
+	}
+	if csrf == nil || csrf.Value != session.CSRFToken || csrf.HttpOnly {
+		t.Errorf("expected a readable CSRF cookie holding the CSRF token, got %+v", csrf)
+	}
+}
+
+func TestSessionLogin_Rejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier tokenVerifier
+		body     string
+		expected int
+	}{
+		{"missing idToken", fakeVerifier{}, `{}`, http.StatusUnprocessableEntity},
+		{"session in place of the idToken", fakeVerifier{}, `{"idToken": "session"}`, http.StatusUnprocessableEntity},
+		{"signed in too long ago", staleVerifier{}, `{"idToken": "uid-1"}`, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rtr, handler := getSessionTestHandler(newMemoryStorage(), &fakeSessions{})
+			rtr.config.verifier = tt.verifier
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/session/login", strings.NewReader(tt.body)))
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d but got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+			if cookies := w.Result().Cookies(); len(cookies) != 0 {
+				t.Errorf("expected no cookies, got %v", cookies)
+			}
+		})
+	}
+}
+
+func TestSession_AuthenticatesRoutes(t *testing.T) {
+	_, handler := getSessionTestHandler(newMemoryStorage(), &fakeSessions{})
+	cookies, session := sessionLogin(t, handler, "uid-1")
+
+	w := serveWithCookies(handler, httptest.NewRequest("GET", "/api/v1/user/uid-1/session", nil), cookies, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the session cookie to authenticate reads, got %d: %s", w.Code, w.Body.String())
+	}
+	w = serveWithCookies(handler, httptest.NewRequest("GET", "/api/v1/user/uid-2/session", nil), cookies, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the session of another user to be forbidden, got %d", w.Code)
+	}
+	w = serveWithCookies(handler, httptest.NewRequest("GET", "/api/v1/session", nil), nil, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a session cookie but got %d", w.Code)
+	}
+
+	update := `{"CurrentGoal": "Squat 200"}`
+	w = serveWithCookies(handler, httptest.NewRequest("PUT", "/api/v1/user/uid-1/session", strings.NewReader(update)), cookies, session.CSRFToken)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the session cookie and CSRF token to authenticate writes, got %d: %s", w.Code, w.Body.String())
+	}
+	body := `{"routineName": "Push Day", "uid": "uid-1", "idToken": "session"}`
+	w = serveWithCookies(handler, httptest.NewRequest("POST", "/api/v1/user/routine/create", strings.NewReader(body)), cookies, session.CSRFToken)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected session in place of the idToken of a body, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSession_LabelsByRoutePattern(t *testing.T) {
+	rtr := getMemoryTestRouter(newMemoryStorage())
+	rtr.config.sessions = &fakeSessions{}
+	rtr.config.metrics = newMetrics()
+	handler := routes(rtr.config, rtr.logger)
+	cookies, _ := sessionLogin(t, handler, "uid-1")
+
+	serveWithCookies(handler, httptest.NewRequest("GET", "/api/v1/session", nil), cookies, "")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `repetiswole_http_requests_total{method="GET",route="/api/v1/session",status="200"} 1`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected requests with the session cookie to be labelled by their route, %q within:\n%s", want, w.Body.String())
+	}
+}
+
+func TestSession_RequiresCSRFToken(t *testing.T) {
+	_, handler := getSessionTestHandler(newMemoryStorage(), &fakeSessions{})
+	cookies, _ := sessionLogin(t, handler, "uid-1")
+
+	// a token set by someone who cannot read the session cookie, matching a csrf_token cookie they injected
+	injected := append([]*http.Cookie{}, cookies...)
+	injected = append(injected, &http.Cookie{Name: csrfCookieName, Value: "attacker"})
+
+	tests := []struct {
+		name    string
+		cookies []*http.Cookie
+		csrf    string
+	}{
+		{"missing token", cookies, ""},
+		{"wrong token", cookies, csrfToken("cookie-uid-2")},
+		{"injected token", injected, "attacker"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/api/v1/user/uid-1/session", strings.NewReader(`{"CurrentGoal": "Squat 200"}`))
+			w := serveWithCookies(handler, req, tt.cookies, tt.csrf)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("expected status 403 but got %d", w.Code)
+			}
+			apiErr := apiError{}
+			if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil || apiErr.Code != codeCSRFFailed {
+				t.Errorf("expected code %s but got %+v %v", codeCSRFFailed, apiErr, err)
+			}
+		})
+	}
+
+	// requests authenticated by an idToken alone are not subject to CSRF
+	w := serveWithCookies(handler, httptest.NewRequest("PUT", "/api/v1/user/uid-1/uid-1", strings.NewReader(`{"CurrentGoal": "Squat 200"}`)), nil, "")
+	if w.Code == http.StatusForbidden {
+		t.Errorf("expected a request without the session cookie to skip the CSRF check, got %d", w.Code)
+	}
+}
+
+func TestSessionLogout(t *testing.T) {
+	_, handler := getSessionTestHandler(newMemoryStorage(), &fakeSessions{})
+	cookies, session := sessionLogin(t, handler, "uid-1")
+
+	w := serveWithCookies(handler, httptest.NewRequest("POST", "/api/v1/session/logout", nil), cookies, session.CSRFToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge >= 0 || cookie.Value != "" {
+			t.Errorf("expected %s to be cleared, got %+v", cookie.Name, cookie)
+		}
+	}
+	if len(w.Result().Cookies()) != 2 {
+		t.Errorf("expected both cookies to be cleared, got %v", w.Result().Cookies())
+	}
+}
+
+func TestSessionRevoke(t *testing.T) {
+	sessions := &fakeSessions{}
+	_, handler := getSessionTestHandler(newMemoryStorage(), sessions)
+	cookies, session := sessionLogin(t, handler, "uid-1")
+	other, _ := sessionLogin(t, handler, "uid-2")
+
+	w := serveWithCookies(handler, httptest.NewRequest("POST", "/api/v1/session/revoke", nil), cookies, session.CSRFToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies()) != 2 {
+		t.Errorf("expected both cookies to be cleared, got %v", w.Result().Cookies())
+	}
+
+	// the revoked cookie, e.g. copied to another device, no longer authenticates anything
+	w = serveWithCookies(handler, httptest.NewRequest("GET", "/api/v1/session", nil), cookies, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a revoked session but got %d", w.Code)
+	}
+	w = serveWithCookies(handler, httptest.NewRequest("GET", "/api/v1/session", nil), other, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the sessions of other users to be kept, got %d", w.Code)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// settings is the typed configuration of the server. Every field can be set, from lowest to highest precedence, by
+// its default, the YAML config file, its environment variable and its command-line flag. The flag of a field is its
+// YAML key with dashes, e.g. --read-timeout
+type settings struct {
+	Mode              string `yaml:"mode" env:"MODE" default:"development" validate:"oneof=development production" usage:"development reads a .env file when one exists"`
+	Port              int    `yaml:"port" env:"PORT" default:"8080" validate:"min=1,max=65535" usage:"port to listen on"`
+	LogFormat         string `yaml:"log_format" env:"LOG_FORMAT" default:"text" validate:"oneof=text json" usage:"text, or json for log aggregators"`
+	LogLevel          string `yaml:"log_level" env:"LOG_LEVEL" default:"info" validate:"oneof=debug info warn error" usage:"lowest level that is logged"`
+	TraceExporter     string `yaml:"trace_exporter" env:"TRACE_EXPORTER" default:"none" validate:"oneof=none stdout otlp" usage:"where spans are exported: none, stdout or otlp"`
+	TraceEndpoint     string `yaml:"trace_endpoint" env:"TRACE_ENDPOINT" usage:"OTLP/HTTP endpoint URL, defaults to the OTEL_EXPORTER_OTLP_* environment variables"`
+	FrontendSource    string `yaml:"frontend_source" env:"FRONTEND_SOURCE" default:"auto" validate:"oneof=auto embed disk" usage:"embed serves the build embedded with -tags embedfrontend, disk the frontend build path, auto the embedded build when there is one"`
+	FrontendBuildPath string `yaml:"frontend_build_path" env:"FRONTEND_BUILD_PATH" default:"./frontend/dist/" validate:"required" usage:"directory of the built React frontend"`
+	RateLimitStore    string `yaml:"rate_limit_store" env:"RATE_LIMIT_STORE" default:"memory" validate:"oneof=memory none" usage:"where rate limit buckets are kept: memory, or none to disable rate limiting"`
+	TrustedProxies    int    `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" default:"0" validate:"min=0,max=10" usage:"reverse proxies in front of the server appending to X-Forwarded-For, 1 on Railway"`
+
+	GoogleApplicationCredentials string `yaml:"google_application_credentials" env:"GOOGLE_APPLICATION_CREDENTIALS" validate:"required" usage:"path to the Firebase service account JSON"`
+	GoogleFirebaseAPIKey         string `yaml:"google_firebase_api_key" env:"GOOGLE_FIREBASE_API_KEY" validate:"required" secret:"true" usage:"Firebase web API key"`
+	PublicDomain                 string `yaml:"public_domain" env:"RAILWAY_PUBLIC_DOMAIN" usage:"public domain of the deployment, injected by Railway"`
+	CORSOrigins                  string `yaml:"cors_origins" env:"CORS_ORIGINS" usage:"origins besides the public domain allowed to call the API from a browser, comma separated"`
+	StripeWebhookSecret          string `yaml:"stripe_webhook_secret" env:"STRIPE_WEBHOOK_SECRET" secret:"true" usage:"signing secret of the billing webhook, which is disabled without one"`
+	MetricsToken                 string `yaml:"metrics_token" env:"METRICS_TOKEN" secret:"true" usage:"bearer token scrapers must send to /metrics, which is public without one"`
+
+	ReadTimeout     time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT" default:"15s" usage:"time allowed to read a request, e.g. 15s or 15"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT" default:"30s" usage:"time allowed to write a response"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT" default:"120s" usage:"time a keep-alive connection may sit idle"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT" default:"20s" usage:"time in-flight requests get to finish on shutdown"`
+}
+
+// configFileEnv names the config file when --config is not given
+const configFileEnv = "REPETISWOLE_CONFIG"
+
+const redacted = "[redacted]"
+
+// environment returns the process environment. Outside of production, a .env file in the working directory fills in
+// any variable the process environment does not set
+func environment() (map[string]string, error) {
+	env := map[string]string{}
+	if os.Getenv("MODE") != "production" {
+		dotenv, err := godotenv.Read()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading .env file: %w", err)
+		}
+		for key, value := range dotenv {
+			env[key] = value
+		}
+	}
+
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		env[key] = value
+	}
+
+	return env, nil
+}
+
+// loadSettings resolves the settings from their defaults, the config file, env and the command-line args. It reports
+// whether --print-config was passed, and does not validate the settings so that invalid ones can still be printed
+func loadSettings(args []string, env map[string]string) (*settings, bool, error) {
+	s := &settings{}
+	fields := settingFields()
+
+	fs := flag.NewFlagSet("repetiswole", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", env[configFileEnv], "path to a YAML config file")
+	printConfig := fs.Bool("print-config", false, "print the resolved configuration with secrets redacted, then exit")
+	flagValues := map[string]*string{}
+	for _, field := range fields {
+		flagValues[field.flag] = fs.String(field.flag, "", field.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, fmt.Errorf("error parsing command-line flags: %w", err)
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("error parsing command-line flags: unexpected argument %q", fs.Arg(0))
+	}
+
+	for _, field := range fields {
+		if field.fallback == "" {
+			continue
+		}
+		if err := field.set(s, field.fallback); err != nil {
+			panic(fmt.Sprintf("invalid default of setting %s: %v", field.key, err))
+		}
+	}
+
+	if *configFile != "" {
+		if err := s.applyFile(*configFile, fields); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, field := range fields {
+		value, ok := env[field.env]
+		if !ok || value == "" {
+			continue
+		}
+		if err := field.set(s, value); err != nil {
+			return nil, false, fmt.Errorf("error in environment variable %s: %w", field.env, err)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, field := range fields {
+			if field.flag == f.Name {
+				if err := field.set(s, *flagValues[f.Name]); err != nil {
+					flagErr = errors.Join(flagErr, fmt.Errorf("error in flag --%s: %w", f.Name, err))
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, false, flagErr
+	}
+
+	return s, *printConfig, nil
+}
+
+func (s *settings) applyFile(path string, fields []settingField) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	var errs error
+	for key, value := range values {
+		field, ok := findSettingField(fields, key)
+		if !ok {
+			errs = errors.Join(errs, fmt.Errorf("unknown setting %q", key))
+			continue
+		}
+		text, err := settingScalar(value)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("setting %s: %w", key, err))
+			continue
+		}
+		if err := field.set(s, text); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("setting %s: %w", key, err))
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("error in config file %s: %w", path, errs)
+	}
+
+	return nil
+}
+
+// settingScalar turns the YAML value of a setting into the text a flag or environment variable would hold. Every
+// setting is a scalar, a map or list is a mistake rather than something to flatten into Go syntax
+func settingScalar(value interface{}) (string, error) {
+	switch value.(type) {
+	case nil:
+		return "", nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("must be a single value, not a YAML map")
+	case []interface{}:
+		return "", fmt.Errorf("must be a single value, not a YAML list")
+	}
+	return fmt.Sprint(value), nil
+}
+
+// validate reports every invalid setting at once, along with the ways of setting it
+func (s *settings) validate() error {
+	fields := settingFields()
+	problems := []string{}
+
+	for _, detail := range validate(s) {
+		field, _ := findSettingFieldByName(fields, detail.Field)
+		problems = append(problems, field.problem(detail.Message))
+	}
+	for _, field := range fields {
+		if duration, ok := field.value(s).(time.Duration); ok && duration <= 0 {
+			problems = append(problems, field.problem("must be a positive duration"))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	return nil
+}
+
+// print writes the settings as a YAML config file, replacing the value of every secret that is set
+func (s *settings) print(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, field := range settingFields() {
+		value := field.value(s)
+		text := fmt.Sprint(value)
+		if duration, ok := value.(time.Duration); ok {
+			text = duration.String()
+		}
+		if field.secret && text != "" {
+			text = redacted
+		}
+
+		valueNode := &yaml.Node{Kind: yaml.ScalarNode, Value: text}
+		if _, isString := value.(string); isString {
+			valueNode.Style = yaml.DoubleQuotedStyle
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: field.key}, valueNode)
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding settings: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("error encoding settings: %w", err)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// settingField describes one field of settings, read from its struct tags
+type settingField struct {
+	name     string
+	key      string
+	env      string
+	flag     string
+	fallback string
+	usage    string
+	secret   bool
+	index    int
+}
+
+func settingFields() []settingField {
+	t := reflect.TypeOf(settings{})
+	fields := make([]settingField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("yaml")
+		fields = append(fields, settingField{
+			name:     field.Name,
+			key:      key,
+			env:      field.Tag.Get("env"),
+			flag:     strings.ReplaceAll(key, "_", "-"),
+			fallback: field.Tag.Get("default"),
+			usage:    field.Tag.Get("usage"),
+			secret:   field.Tag.Get("secret") == "true",
+			index:    i,
+		})
+	}
+	return fields
+}
+
+func findSettingField(fields []settingField, key string) (settingField, bool) {
+	for _, field := range fields {
+		if field.key == key {
+			return field, true
+		}
+	}
+	return settingField{}, false
+}
+
+func findSettingFieldByName(fields []settingField, name string) (settingField, bool) {
+	for _, field := range fields {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return settingField{}, false
+}
+
+func (f settingField) value(s *settings) interface{} {
+	return reflect.ValueOf(s).Elem().Field(f.index).Interface()
+}
+
+func (f settingField) set(s *settings, raw string) error {
+	dst := reflect.ValueOf(s).Elem().Field(f.index)
+
+	switch dst.Interface().(type) {
+	case string:
+		dst.SetString(raw)
+	case int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		dst.SetInt(int64(n))
+	case time.Duration:
+		duration, err := parseDuration(raw)
+		if err != nil {
+			return err
+		}
+		dst.SetInt(int64(duration))
+	default:
+		panic(fmt.Sprintf("unsupported type of setting %s", f.key))
+	}
+
+	return nil
+}
+
+func (f settingField) problem(message string) string {
+	return fmt.Sprintf("%s %s (set %s, --%s or %s in the config file)", f.key, message, f.env, f.flag, f.key)
+}
+
+// parseDuration parses a duration such as "30s", or a whole number of seconds
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration such as 30s", value)
+	}
+
+	return duration, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requiredEnv holds the settings that have no default
+var requiredEnv = map[string]string{
+	"GOOGLE_APPLICATION_CREDENTIALS": "./firebase-config.json",
+	"GOOGLE_FIREBASE_API_KEY":        "fake_api_key",
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "repetiswole.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadSettings_Defaults(t *testing.T) {
+	s, printConfig, err := loadSettings(nil, requiredEnv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if printConfig {
+		t.Errorf("expected printConfig to be false")
+	}
+	if err := s.validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+
+	if s.Port != 8080 || s.FrontendBuildPath != "./frontend/dist/" || s.Mode != "development" {
+		t.Errorf("unexpected defaults: %+v", s)
+	}
+	if s.ReadTimeout != 15*time.Second || s.WriteTimeout != 30*time.Second || s.IdleTimeout != 120*time.Second || s.ShutdownTimeout != 20*time.Second {
+		t.Errorf("unexpected default timeouts: %+v", s)
+	}
+}
+
+func TestLoadSettings_Precedence(t *testing.T) {
+	path := writeConfigFile(t, "port: 9000\nread_timeout: 5s\nwrite_timeout: 45\nmode: production\n")
+
+	env := map[string]string{
+		configFileEnv:         path,
+		"PORT":                "9100",
+		"SERVER_READ_TIMEOUT": "7s",
+	}
+	for key, value := range requiredEnv {
+		env[key] = value
+	}
+
+	s, _, err := loadSettings([]string{"--port", "9200"}, env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// flags beat env, env beats the file, and the file beats the defaults
+	if s.Port != 9200 {
+		t.Errorf("expected the flag to win, got port %d", s.Port)
+	}
+	if s.ReadTimeout != 7*time.Second {
+		t.Errorf("expected env to beat the file, got %v", s.ReadTimeout)
+	}
+	if s.WriteTimeout != 45*time.Second || s.Mode != "production" {
+		t.Errorf("expected the file to beat the defaults, got %v and %s", s.WriteTimeout, s.Mode)
+	}
+	if s.IdleTimeout != 120*time.Second {
+		t.Errorf("expected the default idle timeout, got %v", s.IdleTimeout)
+	}
+}
+
+func TestLoadSettings_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{"unknown flag", []string{"--prot", "1"}, nil, "flag provided but not defined"},
+		{"bad duration", nil, map[string]string{"SERVER_IDLE_TIMEOUT": "soon"}, "SERVER_IDLE_TIMEOUT"},
+		{"bad port flag", []string{"--port=http"}, nil, "--port"},
+		{"missing config file", []string{"--config", "does-not-exist.yaml"}, nil, "error reading config file"},
+		{"unknown file setting", []string{"--config", writeConfigFile(t, "prot: 1\n")}, nil, `unknown setting "prot"`},
+		{"list file setting", []string{"--config", writeConfigFile(t, "cors_origins:\n  - https://a.example\n  - https://b.example\n")}, nil, "setting cors_origins: must be a single value, not a YAML list"},
+		{"map file setting", []string{"--config", writeConfigFile(t, "port:\n  http: 8080\n")}, nil, "setting port: must be a single value, not a YAML map"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := loadSettings(tt.args, tt.env)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	s, _, err := loadSettings([]string{"--port", "0", "--mode", "staging", "--shutdown-timeout", "0s"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = s.validate()
+	if err == nil {
+		t.Fatalf("expected the settings to be invalid")
+	}
+
+	// every problem is reported at once, with how to fix it
+	for _, want := range []string{
+		"mode must be one of: development, production",
+		"port must be at least 1",
+		"google_application_credentials is required (set GOOGLE_APPLICATION_CREDENTIALS, --google-application-credentials",
+		"google_firebase_api_key is required",
+		"shutdown_timeout must be a positive duration",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q within:\n%v", want, err)
+		}
+	}
+}
+
+func TestSettingsPrint_RedactsSecrets(t *testing.T) {
+	env := map[string]string{"STRIPE_WEBHOOK_SECRET": "whsec_live_secret"}
+	for key, value := range requiredEnv {
+		env[key] = value
+	}
+
+	s, printConfig, err := loadSettings([]string{"--print-config"}, env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !printConfig {
+		t.Errorf("expected printConfig to be true")
+	}
+
+	out := &bytes.Buffer{}
+	if err := s.print(out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	printed := out.String()
+	if strings.Contains(printed, "whsec_live_secret") || strings.Contains(printed, "fake_api_key") {
+		t.Errorf("expected secrets to be redacted:\n%s", printed)
+	}
+	for _, want := range []string{`stripe_webhook_secret: "[redacted]"`, `public_domain: ""`, "port: 8080", "read_timeout: 15s"} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("expected %q within:\n%s", want, printed)
+		}
+	}
+
+	// the printed settings are a valid config file
+	reloaded, _, err := loadSettings([]string{"--config", writeConfigFile(t, printed)}, nil)
+	if err != nil {
+		t.Fatalf("expected the printed settings to load, got %v", err)
+	}
+	if reloaded.Port != s.Port || reloaded.ReadTimeout != s.ReadTimeout {
+		t.Errorf("unexpected reloaded settings: %+v", reloaded)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"45s", 45 * time.Second, false},
+		{"2m", 2 * time.Minute, false},
+		{"10", 10 * time.Second, false},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseDuration(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDuration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
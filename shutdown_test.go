@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startServe runs serve on a random port with a handler that blocks until release is closed
+func startServe(t *testing.T, shutdownTimeout time.Duration) (string, chan struct{}, chan struct{}, context.CancelFunc, chan error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			_, _ = io.WriteString(w, "done")
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, srv, ln, shutdownTimeout, slog.Default())
+	}()
+
+	return "http://" + ln.Addr().String(), started, release, cancel, done
+}
+
+func TestServe_DrainsInFlightRequests(t *testing.T) {
+	url, started, release, cancel, done := startServe(t, 5*time.Second)
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	// shutting down while the request is still being handled must not drop it
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	res := <-responses
+	if res.err != nil || res.body != "done" {
+		t.Fatalf("expected the in-flight request to complete, got body=%q err=%v", res.body, res.err)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("expected new connections to be refused after shutdown")
+	}
+}
+
+func TestServe_ShutdownDeadline(t *testing.T) {
+	url, started, release, cancel, done := startServe(t, 50*time.Millisecond)
+	defer close(release)
+
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error when requests outlive the shutdown timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve did not return after the shutdown timeout")
+	}
+}
+
+func TestConfigClose_WithoutClients(t *testing.T) {
+	cfg := getTestRouter().config
+
+	if _, err := cfg.firestoreClient(); err == nil {
+		t.Errorf("expected an error creating a firestore client without a firebase app")
+	}
+	if err := cfg.close(); err != nil {
+		t.Errorf("expected closing unused clients to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// storage is everything the handlers read from and write to. Every method takes the context of the request
+// it serves, so a disconnected client or an expired route deadline stops the work
+type storage interface {
+	CreateUserDocument(ctx context.Context, userDoc *UserDocument) error
+	// CreateUserDocumentIfMissing creates the document unless the user already has one, returning whether it did
+	CreateUserDocumentIfMissing(ctx context.Context, userDoc *UserDocument) (bool, error)
+	GetUserDocument(ctx context.Context, uid string) (map[string]interface{}, error)
+	UpdateUserDocument(ctx context.Context, uid string, requestedUpdates map[string]interface{}) error
+	// GetAllUsers returns the document of every user, for operational tasks rather than requests
+	GetAllUsers(ctx context.Context) ([]map[string]interface{}, error)
+
+	// CreateRoutineDocument creates an empty routine unless quota, when set, does not allow the user another one. The
+	// check and the creation are one transaction, counted by the user's routineCounters document
+	CreateRoutineDocument(ctx context.Context, uid, routineName string, quota routineQuota) (string, error)
+	// CreateRoutineDocuments creates the routines of writes in order, within quota like CreateRoutineDocument, in as
+	// few transactions as Firestore allows. Once quota allows no more, the remaining writes are left unwritten
+	CreateRoutineDocuments(ctx context.Context, uid string, writes []*routineWrite, quota routineQuota) error
+	GetUserRoutines(ctx context.Context, uid string) ([]map[string]interface{}, error)
+	GetOneUserRoutine(ctx context.Context, routineRefId string) (map[string]interface{}, error)
+	UpdateOneUserRoutine(ctx context.Context, routineRefId string, routineUpdates map[string]interface{}) error
+	// GetAllRoutines returns the routines of every user, for operational tasks rather than requests
+	GetAllRoutines(ctx context.Context) ([]map[string]interface{}, error)
+	// ReplaceRoutineDocuments overwrites the routine of every write's RefId in bulk
+	ReplaceRoutineDocuments(ctx context.Context, writes []*routineWrite) error
+	// DeleteRoutineDocument deletes the routine and takes it off its user's routine count
+	DeleteRoutineDocument(ctx context.Context, routineRefId string) error
+
+	// CreateWorkoutLogDocuments stores every log in bulk, unless a log with its ID already exists, and marks each write
+	// Created or Duplicate. Should it fail, e.g. once the deadline passes, the writes it got to stay marked
+	CreateWorkoutLogDocuments(ctx context.Context, writes []*workoutLogWrite) error
+	GetWorkoutLogs(ctx context.Context, uid string) ([]map[string]interface{}, error)
+
+	CreateBillingEventDocument(ctx context.Context, eventID, eventType string) (bool, error)
+	DeleteBillingEventDocument(ctx context.Context, eventID string) error
+	// UpdateUserSubscription applies change to the user's subscription settings unless a newer event changed them last,
+	// returning whether it did. The check and the update are one transaction
+	UpdateUserSubscription(ctx context.Context, change *subscriptionChange) (bool, error)
+
+	// Ping returns nil when the storage is reachable
+	Ping(ctx context.Context) error
+}
+
+// routineWrite is a routine document to store under RefId, which creating the routine sets. A write not marked Written
+// was not stored, either because quota did not allow it or because the storage failed before reaching it
+type routineWrite struct {
+	RefId    string
+	Document map[string]interface{}
+	Written  bool
+}
+
+// workoutLogWrite is a workout log to store under ID. A write marked neither Created nor Duplicate was not stored
+type workoutLogWrite struct {
+	ID        string
+	Log       *WorkoutLogDocument
+	Created   bool
+	Duplicate bool
+}
+
+// tokenVerifier is satisfied by *auth.Client, and lets tests verify idTokens without Firebase
+type tokenVerifier interface {
+	VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error)
+}
+
+// per-route deadlines, applied on top of the server's write timeout so that storage calls are cancelled
+// before the connection is
+const (
+	readRouteTimeout    = 10 * time.Second
+	writeRouteTimeout   = 15 * time.Second
+	billingRouteTimeout = 20 * time.Second
+	// imports write one document per workout in bulk, years of history take longer than any other write
+	importRouteTimeout = 25 * time.Second
+)
+
+// withDeadline cancels the request context of next once timeout has passed
+func withDeadline(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// routineQuota returns how many routines the owner of userDoc may have, or noRoutineLimit. Storage calls it within
+// the transaction that creates the routine, where Firestore may retry it, so it must only look at userDoc
+type routineQuota func(userDoc map[string]interface{}) (int, error)
+
+const (
+	noRoutineLimit = -1
+	// freeRoutineLimit is how many routines a user on the Free tier may have
+	freeRoutineLimit = 3
+)
+
+// createRoutineWithinQuota creates a routine unless the user's subscription tier does not allow another one
+func createRoutineWithinQuota(ctx context.Context, store storage, uid, routineName string) (string, error) {
+	return store.CreateRoutineDocument(ctx, uid, routineName, subscriptionRoutineQuota(time.Now()))
+}
+
+// createRoutinesWithinQuota creates the routines of writes until the user's subscription tier allows no more
+func createRoutinesWithinQuota(ctx context.Context, store storage, uid string, writes []*routineWrite) error {
+	return store.CreateRoutineDocuments(ctx, uid, writes, subscriptionRoutineQuota(time.Now()))
+}
+
+// subscriptionRoutineQuota limits users on the Free tier at now to freeRoutineLimit routines
+func subscriptionRoutineQuota(now time.Time) routineQuota {
+	return func(userDoc map[string]interface{}) (int, error) {
+		settings, ok := userDoc["Settings"].(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("error trying to get users subscription settings while trying to create user workout routine")
+		}
+
+		if effectiveSubscriptionTier(settings, now) == freeSubscriptionTier {
+			return freeRoutineLimit, nil
+		}
+		return noRoutineLimit, nil
+	}
+}
+
+// routineQuotaError is the error of a creation that quota did not allow, or nil
+func routineQuotaError(quota routineQuota, userDoc map[string]interface{}, uid string, count int) error {
+	limit, err := quota(userDoc)
+	if err != nil {
+		return err
+	}
+	if limit != noRoutineLimit && count >= limit {
+		return fmt.Errorf("error trying to make routine, user (uid: %s) cannot have more than %d routines: %w", uid, limit, ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// storageBillingStore adapts storage to the billingStore the webhook needs
+type storageBillingStore struct {
+	store storage
+}
+
+func (s *storageBillingStore) RecordEvent(ctx context.Context, eventID, eventType string) (bool, error) {
+	return s.store.CreateBillingEventDocument(ctx, eventID, eventType)
+}
+
+func (s *storageBillingStore) ForgetEvent(ctx context.Context, eventID string) error {
+	return s.store.DeleteBillingEventDocument(ctx, eventID)
+}
+
+func (s *storageBillingStore) UpdateSubscription(ctx context.Context, change *subscriptionChange) (bool, error) {
+	return s.store.UpdateUserSubscription(ctx, change)
+}
+
+// subscriptionUpdates are the updates change makes to the user document, or nil if a newer event changed the
+// subscription last. Events of the same second are applied in the order they arrive
+func subscriptionUpdates(userDoc map[string]interface{}, change *subscriptionChange) map[string]interface{} {
+	settings, _ := userDoc["Settings"].(map[string]interface{})
+	if last, ok := settings["SubscriptionUpdatedAt"].(time.Time); ok && last.After(change.EventCreated) {
+		return nil
+	}
+
+	updates := map[string]interface{}{
+		"Settings.SubscriptionTier":      change.Tier,
+		"Settings.SubscriptionUpdatedAt": change.EventCreated,
+	}
+	if !change.ExpiresAt.IsZero() {
+		updates["Settings.SubscriptionExpiresAt"] = change.ExpiresAt
+		return updates
+	}
+	// the event did not carry an expiry, so we keep the stored one unless it passed before the event, in which case it
+	// ended an earlier subscription and would otherwise treat a re-subscribed user as Free
+	if expiresAt, ok := settings["SubscriptionExpiresAt"].(time.Time); ok && !expiresAt.IsZero() && expiresAt.Before(change.EventCreated) {
+		updates["Settings.SubscriptionExpiresAt"] = time.Time{}
+	}
+	return updates
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// fakeVerifier accepts every idToken, treating the token itself as the user's UID
+type fakeVerifier struct{}
+
+func (fakeVerifier) VerifyIDToken(_ context.Context, idToken string) (*auth.Token, error) {
+	return &auth.Token{UID: idToken, AuthTime: time.Now().Unix()}, nil
+}
+
+// blockingStorage blocks routine listing until the request context is done, recording why it stopped
+type blockingStorage struct {
+	*memoryStorage
+	stopped chan error
+}
+
+func (s *blockingStorage) GetUserRoutines(ctx context.Context, _ string) ([]map[string]interface{}, error) {
+	<-ctx.Done()
+	s.stopped <- ctx.Err()
+	return nil, fmt.Errorf("error while iterating through the routine documents: %w", ctx.Err())
+}
+
+func getMemoryTestRouter(store storage) *router {
+	rtr := getTestRouter()
+	rtr.config.store = store
+	rtr.config.verifier = fakeVerifier{}
+	rtr.config.accounts = &fakeAccounts{}
+	return rtr
+}
+
+func TestWithDeadline_CancelsStorage(t *testing.T) {
+	store := &blockingStorage{memoryStorage: newMemoryStorage(), stopped: make(chan error, 1)}
+	rtr := getMemoryTestRouter(store)
+
+	req := httptest.NewRequest("GET", "/api/v1/user/routine/uid-1/uid-1", nil)
+	req.SetPathValue("uid", "uid-1")
+	req.SetPathValue("idToken", "uid-1")
+	w := httptest.NewRecorder()
+
+	withDeadline(20*time.Millisecond, rtr.GetAllUserRoutines)(w, req)
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if err := <-store.stopped; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected storage to stop at the deadline, got %v", err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504 but got %d", resp.StatusCode)
+	}
+
+	apiErr := &apiError{}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if apiErr.Code != codeTimeout {
+		t.Errorf("expected code %s, got %s", codeTimeout, apiErr.Code)
+	}
+}
+
+func TestClientDisconnect_CancelsStorage(t *testing.T) {
+	store := &blockingStorage{memoryStorage: newMemoryStorage(), stopped: make(chan error, 1)}
+	rtr := getMemoryTestRouter(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/api/v1/user/routine/uid-1/uid-1", nil).WithContext(ctx)
+	req.SetPathValue("uid", "uid-1")
+	req.SetPathValue("idToken", "uid-1")
+
+	done := make(chan struct{})
+	go func() {
+		rtr.GetAllUserRoutines(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-store.stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected storage to stop once the client went away, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("storage was not cancelled with the request")
+	}
+	<-done
+}
+
+func TestCreateRoutineWithinQuota(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+
+	for _, uid := range []string{"free-user", "premium-user"} {
+		tier := freeSubscriptionTier
+		if uid == "premium-user" {
+			tier = premiumSubscriptionTier
+		}
+		if err := store.CreateUserDocument(ctx, &UserDocument{UID: uid, Settings: UserDocumentSettings{SubscriptionTier: tier}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := createRoutineWithinQuota(ctx, store, uid, "Push Day"); err != nil {
+				t.Fatalf("unexpected error creating routine %d for %s: %v", i, uid, err)
+			}
+		}
+	}
+
+	if _, err := createRoutineWithinQuota(ctx, store, "free-user", "Leg Day"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected the 4th routine of a free user to exceed the quota, got %v", err)
+	}
+	if _, err := createRoutineWithinQuota(ctx, store, "premium-user", "Leg Day"); err != nil {
+		t.Errorf("expected a premium user to create a 4th routine, got %v", err)
+	}
+	if _, err := createRoutineWithinQuota(ctx, store, "missing-user", "Leg Day"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing user to be not found, got %v", err)
+	}
+}
+
+func TestCreateRoutineWithinQuota_RoutineCounter(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	if err := store.CreateUserDocument(ctx, &UserDocument{UID: "free-user", Settings: UserDocumentSettings{SubscriptionTier: freeSubscriptionTier}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// routines created before the counters existed are counted when the first creation finds no counter
+	for _, id := range []string{"legacy-1", "legacy-2"} {
+		store.collections["routines"][id] = map[string]interface{}{"UID": "free-user", "RoutineName": id}
+	}
+	if _, err := createRoutineWithinQuota(ctx, store, "free-user", "Push Day"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count := store.collections["routineCounters"]["free-user"]["Count"]; count != int64(3) {
+		t.Errorf("expected the counter to include the legacy routines, got %v", count)
+	}
+	if _, err := createRoutineWithinQuota(ctx, store, "free-user", "Leg Day"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected the 4th routine to exceed the quota, got %v", err)
+	}
+
+	// deleting a routine frees its place within the quota
+	if err := store.DeleteRoutineDocument(ctx, "legacy-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := createRoutineWithinQuota(ctx, store, "free-user", "Leg Day"); err != nil {
+		t.Errorf("expected a deleted routine to free a place, got %v", err)
+	}
+}
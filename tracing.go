@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/emoral435/repetiswole"
+
+// tracePropagator reads and writes the W3C traceparent header, so spans join the trace of an upstream proxy or client
+var tracePropagator = propagation.TraceContext{}
+
+// newTracerProvider creates the tracer provider for the exporter named in the settings: "none", "stdout" (writing
+// to w) or "otlp" (over HTTP to endpoint, or to the OTEL_EXPORTER_OTLP_* environment variables when it is empty)
+func newTracerProvider(ctx context.Context, exporter, endpoint string, w io.Writer) (*sdktrace.TracerProvider, error) {
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, fmt.Errorf("error creating stdout trace exporter: %w", err)
+		}
+		spanExporter = stdout
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		otlp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating otlp trace exporter: %w", err)
+		}
+		spanExporter = otlp
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("repetiswole")))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// tracer returns the tracer of the configured provider, or a tracer that records nothing
+func (cfg *config) tracer() trace.Tracer {
+	if cfg.tracerProvider == nil {
+		return noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return cfg.tracerProvider.Tracer(tracerName)
+}
+
+// traceRequests starts a server span for every request, named after the route pattern the ServeMux matched once
+// the request has been served. The trace ID is added to the request's logger
+func traceRequests(tracer trace.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			attribute.String("http.request_id", w.Header().Get(requestIDHeader)),
+		))
+		defer span.End()
+
+		if span.SpanContext().IsValid() {
+			ctx = withLogger(ctx, loggerFrom(ctx).With("trace_id", span.SpanContext().TraceID().String()))
+		}
+		traced := r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, traced)
+
+		// the ServeMux sets the pattern on the request it was given, hand it back to the middlewares wrapping this one
+		r.Pattern = traced.Pattern
+		route := routeLabel(r.Pattern)
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(
+			semconv.HTTPRoute(route),
+			semconv.HTTPResponseStatusCode(rec.status),
+		)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(rec.status))
+		}
+	})
+}
+
+// startSpan starts an internal span, finishSpan records how it ended
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func finishSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, resultLabel(err))
+	}
+	span.End()
+}
+
+// tracedStorage wraps every call to the wrapped storage in a span
+type tracedStorage struct {
+	next   storage
+	tracer trace.Tracer
+	system string
+}
+
+// traceStorage wraps next in spans named "storage.<method>". Without a tracer provider next is returned as-is
+func traceStorage(next storage, tp trace.TracerProvider, system string) storage {
+	if tp == nil {
+		return next
+	}
+	return &tracedStorage{next: next, tracer: tp.Tracer(tracerName), system: system}
+}
+
+func (s *tracedStorage) start(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, semconv.DBSystemKey.String(s.system), semconv.DBOperationName(operation))
+	return s.tracer.Start(ctx, "storage."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (s *tracedStorage) CreateUserDocument(ctx context.Context, userDoc *UserDocument) (err error) {
+	ctx, span := s.start(ctx, "CreateUserDocument", semconv.DBCollectionName("users"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.CreateUserDocument(ctx, userDoc)
+}
+
+func (s *tracedStorage) CreateUserDocumentIfMissing(ctx context.Context, userDoc *UserDocument) (_ bool, err error) {
+	ctx, span := s.start(ctx, "CreateUserDocumentIfMissing", semconv.DBCollectionName("users"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.CreateUserDocumentIfMissing(ctx, userDoc)
+}
+
+func (s *tracedStorage) GetUserDocument(ctx context.Context, uid string) (_ map[string]interface{}, err error) {
+	ctx, span := s.start(ctx, "GetUserDocument", semconv.DBCollectionName("users"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.GetUserDocument(ctx, uid)
+}
+
+func (s *tracedStorage) UpdateUserDocument(ctx context.Context, uid string, requestedUpdates map[string]interface{}) (err error) {
+	ctx, span := s.start(ctx, "UpdateUserDocument", semconv.DBCollectionName("users"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.UpdateUserDocument(ctx, uid, requestedUpdates)
+}
+
+func (s *tracedStorage) CreateRoutineDocument(ctx context.Context, uid, routineName string, quota routineQuota) (_ string, err error) {
+	ctx, span := s.start(ctx, "CreateRoutineDocument", semconv.DBCollectionName("routines"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.CreateRoutineDocument(ctx, uid, routineName, quota)
+}
+
+func (s *tracedStorage) CreateRoutineDocuments(ctx context.Context, uid string, writes []*routineWrite, quota routineQuota) (err error) {
+	ctx, span := s.start(ctx, "CreateRoutineDocuments", semconv.DBCollectionName("routines"), attribute.Int("db.operation.batch.size", len(writes)))
+	defer func() { finishSpan(span, err) }()
+	return s.next.CreateRoutineDocuments(ctx, uid, writes, quota)
+}
+
+func (s *tracedStorage) GetUserRoutines(ctx context.Context, uid string) (_ []map[string]interface{}, err error) {
+	ctx, span := s.start(ctx, "GetUserRoutines", semconv.DBCollectionName("routines"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.GetUserRoutines(ctx, uid)
+}
+
+func (s *tracedStorage) GetOneUserRoutine(ctx context.Context, routineRefId string) (_ map[string]interface{}, err error) {
+	ctx, span := s.start(ctx, "GetOneUserRoutine", semconv.DBCollectionName("routines"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.GetOneUserRoutine(ctx, routineRefId)
+}
+
+func (s *tracedStorage) UpdateOneUserRoutine(ctx context.Context, routineRefId string, routineUpdates map[string]interface{}) (err error) {
+	ctx, span := s.start(ctx, "UpdateOneUserRoutine", semconv.DBCollectionName("routines"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.UpdateOneUserRoutine(ctx, routineRefId, routineUpdates)
+}
+
+func (s *tracedStorage) ReplaceRoutineDocuments(ctx context.Context, writes []*routineWrite) (err error) {
+	ctx, span := s.start(ctx, "ReplaceRoutineDocuments", semconv.DBCollectionName("routines"), attribute.Int("db.operation.batch.size", len(writes)))
+	defer func() { finishSpan(span, err) }()
+	return s.next.ReplaceRoutineDocuments(ctx, writes)
+}
+
+func (s *tracedStorage) GetAllUsers(ctx context.Context) (_ []map[string]interface{}, err error) {
+	ctx, span := s.start(ctx, "GetAllUsers", semconv.DBCollectionName("users"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.GetAllUsers(ctx)
+}
+
+func (s *tracedStorage) GetAllRoutines(ctx context.Context) (_ []map[string]interface{}, err error) {
+	ctx, span := s.start(ctx, "GetAllRoutines", semconv.DBCollectionName("routines"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.GetAllRoutines(ctx)
+}
+
+func (s *tracedStorage) DeleteRoutineDocument(ctx context.Context, routineRefId string) (err error) {
+	ctx, span := s.start(ctx, "DeleteRoutineDocument", semconv.DBCollectionName("routines"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.DeleteRoutineDocument(ctx, routineRefId)
+}
+
+func (s *tracedStorage) CreateWorkoutLogDocuments(ctx context.Context, writes []*workoutLogWrite) (err error) {
+	ctx, span := s.start(ctx, "CreateWorkoutLogDocuments", semconv.DBCollectionName("workoutLogs"), attribute.Int("db.operation.batch.size", len(writes)))
+	defer func() { finishSpan(span, err) }()
+	return s.next.CreateWorkoutLogDocuments(ctx, writes)
+}
+
+func (s *tracedStorage) GetWorkoutLogs(ctx context.Context, uid string) (_ []map[string]interface{}, err error) {
+	ctx, span := s.start(ctx, "GetWorkoutLogs", semconv.DBCollectionName("workoutLogs"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.GetWorkoutLogs(ctx, uid)
+}
+
+func (s *tracedStorage) CreateBillingEventDocument(ctx context.Context, eventID, eventType string) (_ bool, err error) {
+	ctx, span := s.start(ctx, "CreateBillingEventDocument", semconv.DBCollectionName("billingEvents"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.CreateBillingEventDocument(ctx, eventID, eventType)
+}
+
+func (s *tracedStorage) DeleteBillingEventDocument(ctx context.Context, eventID string) (err error) {
+	ctx, span := s.start(ctx, "DeleteBillingEventDocument", semconv.DBCollectionName("billingEvents"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.DeleteBillingEventDocument(ctx, eventID)
+}
+
+func (s *tracedStorage) UpdateUserSubscription(ctx context.Context, change *subscriptionChange) (_ bool, err error) {
+	ctx, span := s.start(ctx, "UpdateUserSubscription", semconv.DBCollectionName("users"))
+	defer func() { finishSpan(span, err) }()
+	return s.next.UpdateUserSubscription(ctx, change)
+}
+
+func (s *tracedStorage) Ping(ctx context.Context) (err error) {
+	ctx, span := s.start(ctx, "Ping")
+	defer func() { finishSpan(span, err) }()
+	return s.next.Ping(ctx)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// getTracedTestRouter serves a memory storage with every span recorded in memory
+func getTracedTestRouter(t *testing.T, store storage) (*router, *tracetest.SpanRecorder) {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() {
+		_ = tp.Shutdown(context.Background())
+	})
+
+	rtr := getMemoryTestRouter(traceStorage(store, tp, "memory"))
+	rtr.config.tracerProvider = tp
+	return rtr, recorder
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+	return byName
+}
+
+func TestTracing_SpanStructure(t *testing.T) {
+	store := newMemoryStorage()
+	if err := store.CreateUserDocument(context.Background(), &UserDocument{UID: "uid-1", Settings: UserDocumentSettings{SubscriptionTier: freeSubscriptionTier}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rtr, recorder := getTracedTestRouter(t, store)
+	handler := routes(rtr.config, rtr.logger)
+
+	body := strings.NewReader(`{"routineName": "Push Day", "uid": "uid-1", "idToken": "uid-1"}`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/user/routine/create", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+
+	spans := spansByName(recorder.Ended())
+	root, ok := spans["POST /api/v1/user/routine/create"]
+	if !ok {
+		t.Fatalf("expected a server span named after the route pattern, got %v", spans)
+	}
+	if root.SpanKind() != trace.SpanKindServer || root.Parent().IsValid() {
+		t.Errorf("expected a root server span, got kind %v and parent %v", root.SpanKind(), root.Parent())
+	}
+
+	// the auth check and the storage transaction that checks the quota and writes are children of the request
+	for _, name := range []string{"auth.VerifyIDToken", "storage.CreateRoutineDocument"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() || span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("expected %s to be a child of the request span", name)
+		}
+	}
+
+	attributes := map[string]string{}
+	for _, attr := range root.Attributes() {
+		attributes[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attributes["http.route"] != "/api/v1/user/routine/create" || attributes["http.response.status_code"] != "200" {
+		t.Errorf("unexpected request span attributes: %v", attributes)
+	}
+	if attributes["http.request_id"] != w.Header().Get(requestIDHeader) {
+		t.Errorf("expected the request ID on the request span, got %v", attributes)
+	}
+}
+
+func TestTracing_StorageErrors(t *testing.T) {
+	rtr, recorder := getTracedTestRouter(t, newMemoryStorage())
+	handler := routes(rtr.config, rtr.logger)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/user/routine/single/missing/uid-1", nil))
+
+	span, ok := spansByName(recorder.Ended())["storage.GetOneUserRoutine"]
+	if !ok {
+		t.Fatalf("expected a storage.GetOneUserRoutine span")
+	}
+	if span.Status().Code != codes.Error || span.Status().Description != string(codeNotFound) {
+		t.Errorf("expected the span to record the not_found error, got %+v", span.Status())
+	}
+	if len(span.Events()) != 1 || span.Events()[0].Name != "exception" {
+		t.Errorf("expected the error to be recorded as an event, got %+v", span.Events())
+	}
+}
+
+func TestTracing_JoinsIncomingTrace(t *testing.T) {
+	rtr, recorder := getTracedTestRouter(t, newMemoryStorage())
+	handler := routes(rtr.config, rtr.logger)
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected a single span, got %d", len(spans))
+	}
+	if spans[0].SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[0].Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the span to continue the incoming trace, got %v with parent %v", spans[0].SpanContext(), spans[0].Parent())
+	}
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	tp, err := newTracerProvider(context.Background(), "none", "", nil)
+	if err != nil || tp != nil {
+		t.Errorf("expected no provider for the none exporter, got %v, %v", tp, err)
+	}
+
+	if _, err := newTracerProvider(context.Background(), "zipkin", "", nil); err == nil {
+		t.Errorf("expected an unknown exporter to fail")
+	}
+
+	out := &bytes.Buffer{}
+	tp, err = newTracerProvider(context.Background(), "stdout", "", out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, span := tp.Tracer(tracerName).Start(context.Background(), "exported")
+	span.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), `"Name":"exported"`) {
+		t.Errorf("expected the span to be written to stdout, got %s", out.String())
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// request bodies are small JSON documents, a routine with every workout filled in is still well under this
+	maxJSONBodyBytes = 1 << 20
+	// registration and routine creation bodies only carry a few short strings
+	maxSmallJSONBodyBytes = 4 * 1024
+)
+
+// RoutineUpdateRequest is the body of PUT /api/v1/user/routine/single/{routineRefId}/{idToken}. The frontend sends
+// back the whole RoutineDoc it fetched, so CreatedAt and RefId are accepted but never stored
+type RoutineUpdateRequest struct {
+	RoutineName string                 `json:"RoutineName" validate:"required,max=100"`
+	UID         string                 `json:"UID"`
+	CreatedAt   json.RawMessage        `json:"CreatedAt"`
+	RefId       string                 `json:"RefId"`
+	Workouts    []WorkoutUpdateRequest `json:"Workouts" validate:"max=50"`
+}
+
+type WorkoutUpdateRequest struct {
+	WorkoutName string                  `json:"WorkoutName" validate:"required,max=100"`
+	Exercises   []ExerciseUpdateRequest `json:"Exercises" validate:"max=50"`
+}
+
+type ExerciseUpdateRequest struct {
+	MuscleGroup  int                `json:"MuscleGroup" validate:"min=0,max=11"`
+	ExerciseName string             `json:"ExerciseName" validate:"required,max=100"`
+	Sets         []SetUpdateRequest `json:"Sets" validate:"max=100"`
+}
+
+type SetUpdateRequest struct {
+	Reps      int     `json:"Reps" validate:"min=0,max=1000"`
+	Weight    float64 `json:"Weight" validate:"min=0,max=5000"`
+	IsDropSet bool    `json:"IsDropSet"`
+	IsWarmUp  bool    `json:"IsWarmUp"`
+}
+
+// ProfileUpdateRequest is the body of PUT /api/v1/user/{uid}/{idToken}. Keys are Firestore field paths, and only the
+// fields listed here may be changed by a client, so that e.g. Settings.SubscriptionTier stays under the billing webhook's control
+type ProfileUpdateRequest struct {
+	CurrentGoal     *string  `json:"CurrentGoal,omitempty" validate:"max=200"`
+	Height          *float64 `json:"Metrics.Height,omitempty" validate:"min=0,max=300"`
+	Weight          *float64 `json:"Metrics.Weight,omitempty" validate:"min=0,max=1000"`
+	UnitsPreference *string  `json:"Settings.UnitsPreference,omitempty" validate:"oneof=Metric Imperial"`
+}
+
+// Updates returns the set fields of the request keyed by their Firestore field path
+func (p *ProfileUpdateRequest) Updates() map[string]interface{} {
+	updates := make(map[string]interface{})
+	value := reflect.ValueOf(p).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.IsNil() {
+			continue
+		}
+		updates[jsonFieldName(value.Type().Field(i))] = field.Elem().Interface()
+	}
+
+	return updates
+}
+
+// decodeJSONBody strictly decodes a request body of at most maxBytes into dst and then validates it,
+// aggregating every rejected field into a single validation_failed error
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}, maxBytes int64) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+
+	// a body must hold exactly one JSON value
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return invalidJSONError(fmt.Errorf("request body must only contain a single JSON object"))
+	}
+
+	if details := validate(dst); len(details) > 0 {
+		return validationError(details...)
+	}
+
+	return nil
+}
+
+func decodeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+			fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit))
+	case errors.As(err, &typeErr):
+		return validationError(fieldError{Field: typeErr.Field, Message: fmt.Sprintf("must be a %s", typeErr.Type)})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for unknown fields, the name is quoted at the end of the message
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return validationError(fieldError{Field: field, Message: "unknown field"})
+	}
+
+	return invalidJSONError(err)
+}
+
+// validate checks v against the rules in its `validate` struct tags, walking nested structs and slices of structs.
+// The supported rules are required, email, min=N, max=N and oneof=a b c. min and max bound the length of strings
+// and slices, and the value of numbers. Nil pointers are skipped so that optional fields only get checked when set
+func validate(v interface{}) []fieldError {
+	details := []fieldError{}
+	validateValue(reflect.ValueOf(v), "", &details)
+	return details
+}
+
+func validateValue(value reflect.Value, path string, details *[]fieldError) {
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Struct:
+		if value.Type() == reflect.TypeOf(time.Time{}) {
+			return
+		}
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fieldPath := joinFieldPath(path, jsonFieldName(field))
+			fieldValue := value.Field(i)
+
+			if rules := field.Tag.Get("validate"); rules != "" {
+				if message := checkRules(fieldValue, rules); message != "" {
+					*details = append(*details, fieldError{Field: fieldPath, Message: message})
+					continue
+				}
+			}
+			validateValue(fieldValue, fieldPath, details)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			validateValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i), details)
+		}
+	}
+}
+
+// checkRules returns why value breaks the first failing rule, or an empty string if it passes them all
+func checkRules(value reflect.Value, rules string) string {
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if value.IsZero() || (value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "") {
+				return "is required"
+			}
+		case "email":
+			address, err := mail.ParseAddress(value.String())
+			if err != nil || address.Address != value.String() {
+				return "must be a valid email address"
+			}
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				panic(fmt.Sprintf("invalid %s rule %q", name, rule))
+			}
+			if message := checkBound(value, name, bound); message != "" {
+				return message
+			}
+		case "oneof":
+			options := strings.Fields(arg)
+			found := false
+			for _, option := range options {
+				if value.String() == option {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Sprintf("must be one of: %s", strings.Join(options, ", "))
+			}
+		default:
+			panic(fmt.Sprintf("unknown validation rule %q", rule))
+		}
+	}
+
+	return ""
+}
+
+func checkBound(value reflect.Value, name string, bound float64) string {
+	var size float64
+	unit := ""
+
+	switch value.Kind() {
+	case reflect.String:
+		size, unit = float64(utf8.RuneCountInString(value.String())), " characters"
+	case reflect.Slice, reflect.Map:
+		size, unit = float64(value.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(value.Int())
+	case reflect.Float32, reflect.Float64:
+		size = value.Float()
+	default:
+		return ""
+	}
+
+	if name == "min" && size < bound {
+		return fmt.Sprintf("must be at least %s%s", strconv.FormatFloat(bound, 'f', -1, 64), unit)
+	}
+	if name == "max" && size > bound {
+		return fmt.Sprintf("must be at most %s%s", strconv.FormatFloat(bound, 'f', -1, 64), unit)
+	}
+
+	return ""
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func joinFieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// toDocument converts the validated request into the routine document stored in Firestore. The owner and creation
+// time always come from the stored routine, a client cannot change them
+func (req *RoutineUpdateRequest) toDocument(uid, createdAt interface{}) map[string]interface{} {
+	workouts := make([]map[string]interface{}, 0, len(req.Workouts))
+	for _, workout := range req.Workouts {
+		exercises := make([]map[string]interface{}, 0, len(workout.Exercises))
+		for _, exercise := range workout.Exercises {
+			sets := make([]map[string]interface{}, 0, len(exercise.Sets))
+			for _, set := range exercise.Sets {
+				sets = append(sets, map[string]interface{}{
+					"Reps":      set.Reps,
+					"Weight":    set.Weight,
+					"IsDropSet": set.IsDropSet,
+					"IsWarmUp":  set.IsWarmUp,
+				})
+			}
+			exercises = append(exercises, map[string]interface{}{
+				"MuscleGroup":  exercise.MuscleGroup,
+				"ExerciseName": exercise.ExerciseName,
+				"Sets":         sets,
+			})
+		}
+		workouts = append(workouts, map[string]interface{}{
+			"WorkoutName": workout.WorkoutName,
+			"Exercises":   exercises,
+		})
+	}
+
+	return map[string]interface{}{
+		"SchemaVersion": routineSchemaVersion,
+		"RoutineName":   req.RoutineName,
+		"UID":           uid,
+		"CreatedAt":     createdAt,
+		"Workouts":      workouts,
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidate_AggregatesFieldErrors(t *testing.T) {
+	req := &NewUserEmailAuthRequest{
+		Email:       "not-an-email",
+		Password:    "123",
+		DisplayName: strings.Repeat("a", 65),
+	}
+
+	details := validate(req)
+
+	want := map[string]bool{"email": true, "password": true, "displayname": true}
+	if len(details) != len(want) {
+		t.Fatalf("expected %d field errors, got %+v", len(want), details)
+	}
+	for _, detail := range details {
+		if !want[detail.Field] {
+			t.Errorf("unexpected field error: %+v", detail)
+		}
+	}
+}
+
+func TestValidate_NestedRoutine(t *testing.T) {
+	routine := &RoutineUpdateRequest{
+		RoutineName: "Push Pull Legs",
+		Workouts: []WorkoutUpdateRequest{
+			{
+				WorkoutName: "Push",
+				Exercises: []ExerciseUpdateRequest{
+					{MuscleGroup: 0, ExerciseName: "Bench Press", Sets: []SetUpdateRequest{{Reps: 5, Weight: 100}}},
+					{MuscleGroup: 12, ExerciseName: " ", Sets: []SetUpdateRequest{{Reps: -1, Weight: 20}}},
+				},
+			},
+		},
+	}
+
+	details := validate(routine)
+
+	want := map[string]bool{
+		"Workouts[0].Exercises[1].MuscleGroup":  true,
+		"Workouts[0].Exercises[1].ExerciseName": true,
+		"Workouts[0].Exercises[1].Sets[0].Reps": true,
+	}
+	if len(details) != len(want) {
+		t.Fatalf("expected %d field errors, got %+v", len(want), details)
+	}
+	for _, detail := range details {
+		if !want[detail.Field] {
+			t.Errorf("unexpected field error: %+v", detail)
+		}
+	}
+}
+
+func TestValidate_OptionalProfileFields(t *testing.T) {
+	units := "Furlongs"
+	weight := 80.5
+	req := &ProfileUpdateRequest{UnitsPreference: &units, Weight: &weight}
+
+	details := validate(req)
+	if len(details) != 1 || details[0].Field != "Settings.UnitsPreference" {
+		t.Fatalf("expected only Settings.UnitsPreference to fail, got %+v", details)
+	}
+
+	updates := req.Updates()
+	if len(updates) != 2 || updates["Metrics.Weight"] != weight || updates["Settings.UnitsPreference"] != units {
+		t.Errorf("unexpected updates: %+v", updates)
+	}
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		maxBytes   int64
+		wantStatus int
+		wantCode   errorCode
+	}{
+		{"valid body", `{"routineName":"Push Day","uid":"abc","idToken":"token"}`, maxSmallJSONBodyBytes, 0, ""},
+		{"frontend casing", `{"RoutineName":"Push Day","UID":"abc","IdToken":"token"}`, maxSmallJSONBodyBytes, 0, ""},
+		{"malformed json", `{"routineName":`, maxSmallJSONBodyBytes, http.StatusBadRequest, codeInvalidJSON},
+		{"trailing data", `{"routineName":"a","uid":"b","idToken":"c"} {}`, maxSmallJSONBodyBytes, http.StatusBadRequest, codeInvalidJSON},
+		{"unknown field", `{"routineName":"a","uid":"b","idToken":"c","admin":true}`, maxSmallJSONBodyBytes, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"wrong type", `{"routineName":5,"uid":"b","idToken":"c"}`, maxSmallJSONBodyBytes, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"empty routine name", `{"routineName":"","uid":"b","idToken":"c"}`, maxSmallJSONBodyBytes, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"too large", `{"routineName":"` + strings.Repeat("a", 64) + `"}`, 32, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/v1/user/routine/create", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			err := decodeJSONBody(w, req, &NewUserRoutineRequest{}, tt.maxBytes)
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected an apiError, got %v", err)
+			}
+			if apiErr.Status != tt.wantStatus || apiErr.Code != tt.wantCode {
+				t.Errorf("expected %d %s, got %d %s", tt.wantStatus, tt.wantCode, apiErr.Status, apiErr.Code)
+			}
+		})
+	}
+}
+
+func TestEmailRegister_ValidationFailed(t *testing.T) {
+	r := getTestRouter()
+
+	bodyBytes, _ := json.Marshal(map[string]string{
+		"email":       "",
+		"password":    "",
+		"displayname": "Tester",
+	})
+
+	req := httptest.NewRequest("POST", "/api/v1/register/email", bytes.NewReader(bodyBytes))
+	w := httptest.NewRecorder()
+
+	r.EmailRegister(w, req)
+
+	resp := w.Result()
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 for empty email and password, got %d", resp.StatusCode)
+	}
+
+	var result apiError
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(result.Details) != 2 {
+		t.Errorf("expected both email and password to be reported, got %+v", result.Details)
+	}
+}